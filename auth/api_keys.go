@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Scopes an API key can be granted. Logins through a session have all of them.
+const (
+	ScopeChatWrite   = "chat:write"
+	ScopePatternsRun = "patterns:run"
+	ScopeHistoryRead = "history:read"
+)
+
+var Scopes = []string{ScopeChatWrite, ScopePatternsRun, ScopeHistoryRead}
+
+// APIKeyPrefix starts every API key so AuthMiddleware can tell keys from JWTs
+const APIKeyPrefix = "gsk_"
+
+// apiKeyDisplayLength is how much of a key is stored in the clear to identify it
+const apiKeyDisplayLength = 12
+
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// GenerateAPIKey returns a new key and the prefix shown to identify it. Only
+// HashToken of the key is stored.
+func GenerateAPIKey() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate api key: %v", err)
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, key[:apiKeyDisplayLength], nil
+}
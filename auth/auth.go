@@ -1,91 +1,162 @@
 package auth
 
 import (
-	"log"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
+	"github.com/google/uuid"
+)
+
+// RefreshTokenTTL is how long a refresh token, and the cookie holding it, lasts
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// MFATokenTTL is how long a user has to enter their second factor after their password
+const MFATokenTTL = 5 * time.Minute
+
+// AccessTokenTTL is how long an access token lasts
+const AccessTokenTTL = 15 * time.Minute
+
+// Purposes of tokens other than access tokens. Services verifying tokens
+// through the JWKS must reject any token with a pur claim.
+const (
+	mfaPurpose     = "mfa"
+	refreshPurpose = "refresh"
 )
 
 type Claims struct {
 	UserID string `json:"ui"`
+	// SessionID identifies the login; refresh tokens rotated from it share the ID as their family
+	SessionID string `json:"sid,omitempty"`
+	// Purpose marks refresh tokens and tokens that only work for one step,
+	// such as an MFA challenge; they are never accepted as access tokens
+	Purpose string `json:"pur,omitempty"`
+	// Role is the user's role when the access token was issued
+	Role string `json:"rol,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func getTokenSecretVar(key string) []byte {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file")
-	}
-	return []byte(os.Getenv(key))
+// keyRing signs and verifies every token; main sets it with SetKeyRing
+var keyRing *KeyRing
+
+func SetKeyRing(ring *KeyRing) {
+	keyRing = ring
 }
 
-func GenerateAccessToken(userID string) (string, error) {
-	claims := &Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-		},
+// Issuer is the iss claim of every token, JWT_ISSUER or gippity-serv
+func Issuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
 	}
-
-	accessTokenSecret := getTokenSecretVar("ACCESS_TOKEN_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(accessTokenSecret)
+	return "gippity-serv"
 }
 
-func GenerateRefreshToken(userID string) (string, error) {
-	claims := &Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)),
-		},
+func signToken(claims *Claims, ttl time.Duration) (string, error) {
+	if keyRing == nil {
+		return "", fmt.Errorf("signing keys are not loaded")
 	}
+	now := time.Now()
+	claims.Issuer = Issuer()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	return keyRing.sign(claims)
+}
+
+func GenerateAccessToken(userID string, sessionID string, role string) (string, error) {
+	return signToken(&Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		Role:      role,
+	}, AccessTokenTTL)
+}
 
-	refreshTokenSecret := getTokenSecretVar("REFRESH_TOKEN_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(refreshTokenSecret)
+func GenerateRefreshToken(userID string, sessionID string) (string, error) {
+	return signToken(&Claims{
+		UserID:           userID,
+		SessionID:        sessionID,
+		Purpose:          refreshPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{ID: uuid.NewString()},
+	}, RefreshTokenTTL)
 }
 
+// ValidateToken checks an access token, or a refresh token if isRefresh
 func ValidateToken(tokenString string, isRefresh bool) (*Claims, error) {
-	accessTokenSecret := getTokenSecretVar("ACCESS_TOKEN_SECRET")
-	refreshTokenSecret := getTokenSecretVar("REFRESH_TOKEN_SECRET")
-	secret := accessTokenSecret
+	purpose := ""
 	if isRefresh {
-		secret = refreshTokenSecret
+		purpose = refreshPurpose
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
-
+	claims, err := parseToken(tokenString)
 	if err != nil {
 		return nil, err
 	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("token cannot be used here")
+	}
+	return claims, nil
+}
+
+// GenerateMFAToken is handed out instead of tokens when the password was right
+// but a second factor is still needed
+func GenerateMFAToken(userID string) (string, error) {
+	return signToken(&Claims{
+		UserID:           userID,
+		Purpose:          mfaPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{ID: uuid.NewString()},
+	}, MFATokenTTL)
+}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
-	} else {
+func ValidateMFAToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
 		return nil, err
 	}
+	if claims.Purpose != mfaPurpose {
+		return nil, fmt.Errorf("not an mfa token")
+	}
+	return claims, nil
 }
 
-func RefreshTokens(refreshTokenString string) (string, string, error) {
-	claims, err := ValidateToken(refreshTokenString, true)
-	if err != nil {
-		return "", "", err
+// parseToken verifies a token against the key its kid names
+func parseToken(tokenString string) (*Claims, error) {
+	if keyRing == nil {
+		return nil, fmt.Errorf("signing keys are not loaded")
 	}
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return keyRing.verificationKey(token)
+	}, jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}))
 
-	newAccessToken, err := GenerateAccessToken(claims.UserID)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	newRefreshToken, err := GenerateRefreshToken(claims.UserID)
-	if err != nil {
-		return "", "", err
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
 	}
+	if claims.Issuer != Issuer() {
+		return nil, fmt.Errorf("invalid token issuer")
+	}
+	return claims, nil
+}
 
-	return newAccessToken, newRefreshToken, nil
+// HashToken is how refresh tokens are stored, so a database leak does not leak usable tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateOpaqueToken returns a random URL-safe token for links sent by email.
+// Only its HashToken is stored.
+func GenerateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
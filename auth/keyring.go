@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Algorithms the key ring can sign with
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+const rsaKeyBits = 3072
+
+// KeyStore persists signing keys so every instance signs and verifies with the same ring
+type KeyStore interface {
+	GetSigningKeys(ctx context.Context) ([]*models.SigningKey, error)
+	CreateSigningKey(ctx context.Context, key *models.SigningKey) error
+}
+
+type KeyRingConfig struct {
+	// Algorithm new keys are created for
+	Algorithm string
+	// RotationInterval is how long a key signs before a new one replaces it
+	RotationInterval time.Duration
+	// PropagationDelay is how long a new key is published before it signs,
+	// so other instances and JWKS caches know it by the time tokens use it
+	PropagationDelay time.Duration
+}
+
+// KeyRingConfigFromEnv reads JWT_SIGNING_ALG (EdDSA or RS256, default EdDSA),
+// JWT_KEY_ROTATION (default 720h) and JWT_KEY_PROPAGATION (default 10m)
+func KeyRingConfigFromEnv() (KeyRingConfig, error) {
+	config := KeyRingConfig{
+		Algorithm:        AlgorithmEdDSA,
+		RotationInterval: 30 * 24 * time.Hour,
+		PropagationDelay: 10 * time.Minute,
+	}
+	if alg := os.Getenv("JWT_SIGNING_ALG"); alg != "" {
+		if alg != AlgorithmEdDSA && alg != AlgorithmRS256 {
+			return config, fmt.Errorf("JWT_SIGNING_ALG must be %s or %s", AlgorithmEdDSA, AlgorithmRS256)
+		}
+		config.Algorithm = alg
+	}
+	for env, target := range map[string]*time.Duration{
+		"JWT_KEY_ROTATION":    &config.RotationInterval,
+		"JWT_KEY_PROPAGATION": &config.PropagationDelay,
+	} {
+		if raw := os.Getenv(env); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				return config, fmt.Errorf("%s must be a positive duration", env)
+			}
+			*target = d
+		}
+	}
+	return config, nil
+}
+
+type ringKey struct {
+	id          string
+	method      jwt.SigningMethod
+	private     crypto.Signer
+	activatesAt time.Time
+	createdAt   time.Time
+}
+
+// KeyRing holds the keys that sign and verify tokens. The newest active key
+// signs; every unexpired key verifies, so rotating does not log anyone out.
+type KeyRing struct {
+	store  KeyStore
+	config KeyRingConfig
+
+	mu   sync.RWMutex
+	keys map[string]*ringKey
+	// signing is newest first
+	signing []*ringKey
+}
+
+func NewKeyRing(store KeyStore, config KeyRingConfig) *KeyRing {
+	return &KeyRing{store: store, config: config, keys: make(map[string]*ringKey)}
+}
+
+// Refresh loads the keys from the store, creating a new key first when the
+// newest one is due for rotation
+func (r *KeyRing) Refresh(ctx context.Context) error {
+	stored, err := r.store.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var newest *models.SigningKey
+	for _, key := range stored {
+		if newest == nil || key.CreatedAt.After(newest.CreatedAt) {
+			newest = key
+		}
+	}
+	if newest == nil || now.Sub(newest.CreatedAt) >= r.config.RotationInterval {
+		// The first key of an empty ring has nobody to propagate to
+		activatesAt := now.Add(r.config.PropagationDelay)
+		if newest == nil {
+			activatesAt = now
+		}
+		key, err := generateSigningKey(r.config.Algorithm, now, activatesAt, r.config.RotationInterval)
+		if err != nil {
+			return err
+		}
+		if err := r.store.CreateSigningKey(ctx, key); err != nil {
+			return err
+		}
+		log.Printf("Created JWT signing key %s (%s), signing from %s", key.ID, key.Algorithm, key.ActivatesAt.Format(time.RFC3339))
+		stored = append(stored, key)
+	}
+
+	keys := make(map[string]*ringKey, len(stored))
+	signing := make([]*ringKey, 0, len(stored))
+	for _, key := range stored {
+		parsed, err := parseSigningKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key %s: %v", key.ID, err)
+		}
+		keys[parsed.id] = parsed
+		signing = append(signing, parsed)
+	}
+	sort.Slice(signing, func(i, j int) bool {
+		return signing[i].createdAt.After(signing[j].createdAt)
+	})
+
+	r.mu.Lock()
+	r.keys = keys
+	r.signing = signing
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch refreshes the ring every interval, which also rotates it when due
+func (r *KeyRing) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Refresh(ctx); err != nil {
+				log.Println("Failed to refresh signing keys [kr-001]", err)
+			}
+		}
+	}
+}
+
+// sign signs claims with the newest active key and sets its kid header
+func (r *KeyRing) sign(claims jwt.Claims) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var key *ringKey
+	now := time.Now()
+	for _, candidate := range r.signing {
+		if !candidate.activatesAt.After(now) {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// verificationKey finds the public key a token names in its kid header
+func (r *KeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	r.mu.RLock()
+	key, ok := r.keys[kid]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("token algorithm %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.private.Public(), nil
+}
+
+// JWK is a public key in JSON Web Key form
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns every key that can verify tokens, including ones not yet signing
+func (r *KeyRing) JWKS() JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range r.signing {
+		jwk := JWK{KeyID: key.id, Use: "sig", Algorithm: key.method.Alg()}
+		switch public := key.private.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// generateSigningKey creates a key that signs for one rotation interval from
+// activatesAt and verifies for as long as the tokens it signed can live
+func generateSigningKey(algorithm string, now time.Time, activatesAt time.Time, rotation time.Duration) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %s", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signing key: %v", err)
+	}
+	return &models.SigningKey{
+		ID:          uuid.NewString(),
+		Algorithm:   algorithm,
+		PrivateKey:  der,
+		CreatedAt:   now,
+		ActivatesAt: activatesAt,
+		ExpiresAt:   activatesAt.Add(rotation).Add(RefreshTokenTTL),
+	}, nil
+}
+
+func parseSigningKey(key *models.SigningKey) (*ringKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key is not a signer")
+	}
+
+	var method jwt.SigningMethod
+	switch key.Algorithm {
+	case AlgorithmEdDSA:
+		if _, ok := private.(ed25519.PrivateKey); !ok {
+			return nil, fmt.Errorf("EdDSA key is %T", private)
+		}
+		method = jwt.SigningMethodEdDSA
+	case AlgorithmRS256:
+		if _, ok := private.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("RS256 key is %T", private)
+		}
+		method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s", key.Algorithm)
+	}
+	return &ringKey{id: key.ID, method: method, private: private, activatesAt: key.ActivatesAt, createdAt: key.CreatedAt}, nil
+}
@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyStore keeps signing keys in memory
+type keyStore struct {
+	mu   sync.Mutex
+	keys []*models.SigningKey
+}
+
+func (s *keyStore) GetSigningKeys(ctx context.Context) ([]*models.SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.SigningKey(nil), s.keys...), nil
+}
+
+func (s *keyStore) CreateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+var testConfig = KeyRingConfig{
+	Algorithm:        AlgorithmEdDSA,
+	RotationInterval: time.Hour,
+	PropagationDelay: 10 * time.Minute,
+}
+
+// useKeyRing loads a ring from store and makes it the one tokens are signed with
+func useKeyRing(t *testing.T, store *keyStore, config KeyRingConfig) *KeyRing {
+	t.Helper()
+	ring := NewKeyRing(store, config)
+	if err := ring.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	SetKeyRing(ring)
+	t.Cleanup(func() { SetKeyRing(nil) })
+	return ring
+}
+
+// tokenKeyID returns the kid header of a token without verifying it
+func tokenKeyID(t *testing.T, tokenString string) string {
+	t.Helper()
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRingSignsWithTheActiveKey(t *testing.T) {
+	store := &keyStore{}
+	useKeyRing(t, store, testConfig)
+	if len(store.keys) != 1 {
+		t.Fatalf("an empty ring created %d keys, want 1", len(store.keys))
+	}
+
+	token, err := GenerateAccessToken("user-1", "session-1", "user")
+	if err != nil {
+		t.Fatalf("the first key of a ring does not sign: %v", err)
+	}
+	if kid := tokenKeyID(t, token); kid != store.keys[0].ID {
+		t.Fatalf("token kid = %q, want %q", kid, store.keys[0].ID)
+	}
+	claims, err := ValidateToken(token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != "user-1" || claims.SessionID != "session-1" || claims.Role != "user" || claims.Issuer != Issuer() {
+		t.Fatalf("claims = %+v", claims)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	now := time.Now()
+	old, err := generateSigningKey(AlgorithmEdDSA, now.Add(-2*time.Hour), now.Add(-2*time.Hour), testConfig.RotationInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &keyStore{keys: []*models.SigningKey{old}}
+	ring := useKeyRing(t, store, testConfig)
+	if len(store.keys) != 2 {
+		t.Fatalf("a key past its rotation interval was not replaced: %d keys", len(store.keys))
+	}
+	next := store.keys[1]
+
+	// The new key is published right away but only signs after propagating
+	if len(ring.JWKS().Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want the old and the new one", len(ring.JWKS().Keys))
+	}
+	oldToken, err := GenerateAccessToken("user-1", "session-1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKeyID(t, oldToken); kid != old.ID {
+		t.Fatalf("token was signed by %q before the new key propagated, want %q", kid, old.ID)
+	}
+
+	next.ActivatesAt = now.Add(-time.Minute)
+	if err := ring.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := GenerateAccessToken("user-1", "session-1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKeyID(t, newToken); kid != next.ID {
+		t.Fatalf("token was signed by %q after rotation, want %q", kid, next.ID)
+	}
+	// Tokens of the retired key stay valid until they expire
+	if _, err := ValidateToken(oldToken, false); err != nil {
+		t.Fatalf("a token of the retired key was refused: %v", err)
+	}
+}
+
+func TestValidateTokenRejectsUnknownKeys(t *testing.T) {
+	useKeyRing(t, &keyStore{}, testConfig)
+	token, err := GenerateAccessToken("user-1", "session-1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token from another ring names a kid this one does not have
+	useKeyRing(t, &keyStore{}, testConfig)
+	if _, err := ValidateToken(token, false); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("a token of an unknown key returned %v", err)
+	}
+
+	// Tokens without a kid, like the HS256 ones from before the ring, are refused
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: "user-1"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(legacy, false); err == nil {
+		t.Fatal("an HS256 token without a kid was accepted")
+	}
+}
+
+func TestValidateTokenChecksPurposeAndIssuer(t *testing.T) {
+	useKeyRing(t, &keyStore{}, testConfig)
+	access, err := GenerateAccessToken("user-1", "session-1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := GenerateRefreshToken("user-1", "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa, err := GenerateMFAToken("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		token     string
+		isRefresh bool
+		ok        bool
+	}{
+		{"access as access", access, false, true},
+		{"refresh as refresh", refresh, true, true},
+		{"refresh as access", refresh, false, false},
+		{"access as refresh", access, true, false},
+		{"mfa as access", mfa, false, false},
+		{"mfa as refresh", mfa, true, false},
+	} {
+		if _, err := ValidateToken(tt.token, tt.isRefresh); (err == nil) != tt.ok {
+			t.Errorf("%s: ValidateToken returned %v", tt.name, err)
+		}
+	}
+	if _, err := ValidateMFAToken(mfa); err != nil {
+		t.Errorf("ValidateMFAToken refused an MFA token: %v", err)
+	}
+	if _, err := ValidateMFAToken(access); err == nil {
+		t.Error("ValidateMFAToken accepted an access token")
+	}
+
+	t.Setenv("JWT_ISSUER", "someone-else")
+	if _, err := ValidateToken(access, false); err == nil {
+		t.Fatal("a token of another issuer was accepted")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	for _, tt := range []struct {
+		algorithm string
+		keyType   string
+	}{
+		{AlgorithmEdDSA, "OKP"},
+		{AlgorithmRS256, "RSA"},
+	} {
+		config := testConfig
+		config.Algorithm = tt.algorithm
+		store := &keyStore{}
+		ring := useKeyRing(t, store, config)
+
+		keys := ring.JWKS().Keys
+		if len(keys) != 1 {
+			t.Fatalf("%s: JWKS has %d keys, want 1", tt.algorithm, len(keys))
+		}
+		jwk := keys[0]
+		if jwk.KeyID != store.keys[0].ID || jwk.KeyType != tt.keyType || jwk.Algorithm != tt.algorithm || jwk.Use != "sig" {
+			t.Fatalf("%s: JWK = %+v", tt.algorithm, jwk)
+		}
+		switch tt.algorithm {
+		case AlgorithmEdDSA:
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Curve != "Ed25519" || err != nil || len(x) != 32 {
+				t.Fatalf("Ed25519 JWK has curve %q and x %q", jwk.Curve, jwk.X)
+			}
+		case AlgorithmRS256:
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if jwk.E != "AQAB" || err != nil || len(n)*8 != rsaKeyBits {
+				t.Fatalf("RSA JWK has e %q and a %d bit n", jwk.E, len(n)*8)
+			}
+		}
+
+		token, err := GenerateAccessToken("user-1", "session-1", "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ValidateToken(token, false); err != nil {
+			t.Fatalf("%s: %v", tt.algorithm, err)
+		}
+	}
+}
+
+func TestKeyRingConfigFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want KeyRingConfig
+		ok   bool
+	}{
+		{"defaults", nil, KeyRingConfig{AlgorithmEdDSA, 720 * time.Hour, 10 * time.Minute}, true},
+		{"overrides", map[string]string{"JWT_SIGNING_ALG": "RS256", "JWT_KEY_ROTATION": "24h", "JWT_KEY_PROPAGATION": "1m"},
+			KeyRingConfig{AlgorithmRS256, 24 * time.Hour, time.Minute}, true},
+		{"unknown algorithm", map[string]string{"JWT_SIGNING_ALG": "HS256"}, KeyRingConfig{}, false},
+		{"zero rotation", map[string]string{"JWT_KEY_ROTATION": "0s"}, KeyRingConfig{}, false},
+		{"bad propagation", map[string]string{"JWT_KEY_PROPAGATION": "soon"}, KeyRingConfig{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"JWT_SIGNING_ALG", "JWT_KEY_ROTATION", "JWT_KEY_PROPAGATION"} {
+				t.Setenv(env, tt.env[env])
+			}
+			config, err := KeyRingConfigFromEnv()
+			if (err == nil) != tt.ok {
+				t.Fatalf("KeyRingConfigFromEnv returned %v", err)
+			}
+			if tt.ok && config != tt.want {
+				t.Fatalf("config = %+v, want %+v", config, tt.want)
+			}
+		})
+	}
+}
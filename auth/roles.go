@@ -0,0 +1,49 @@
+package auth
+
+// Roles a user can have, from least to most privileged
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var Roles = []string{RoleUser, RoleAdmin}
+
+// Permissions checked by RequirePermission on admin routes
+const (
+	PermissionManageModels   = "models:manage"
+	PermissionManageUsers    = "users:manage"
+	PermissionManagePatterns = "patterns:manage"
+)
+
+var rolePermissions = map[string][]string{
+	RoleUser:  {},
+	RoleAdmin: {PermissionManageModels, PermissionManageUsers, PermissionManagePatterns},
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether role grants permission. Unknown roles grant nothing.
+func HasPermission(role string, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HighestRole picks the most privileged known role out of roles, or RoleUser
+func HighestRole(roles []string) string {
+	highest := 0
+	for _, role := range roles {
+		for i, known := range Roles {
+			if role == known && i > highest {
+				highest = i
+			}
+		}
+	}
+	return Roles[highest]
+}
@@ -0,0 +1,33 @@
+package auth
+
+import "testing"
+
+func TestHasPermission(t *testing.T) {
+	for _, permission := range []string{PermissionManageModels, PermissionManageUsers, PermissionManagePatterns} {
+		if !HasPermission(RoleAdmin, permission) {
+			t.Errorf("admins lack %s", permission)
+		}
+		for _, role := range []string{RoleUser, "", "owner"} {
+			if HasPermission(role, permission) {
+				t.Errorf("role %q has %s", role, permission)
+			}
+		}
+	}
+}
+
+func TestHighestRole(t *testing.T) {
+	for _, tt := range []struct {
+		roles []string
+		want  string
+	}{
+		{nil, RoleUser},
+		{[]string{"owner"}, RoleUser},
+		{[]string{RoleUser}, RoleUser},
+		{[]string{RoleAdmin, RoleUser}, RoleAdmin},
+		{[]string{RoleUser, "owner", RoleAdmin}, RoleAdmin},
+	} {
+		if got := HighestRole(tt.roles); got != tt.want {
+			t.Errorf("HighestRole(%q) = %s, want %s", tt.roles, got, tt.want)
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/FiveEightyEight/gippity-serv/auth"
 	"github.com/FiveEightyEight/gippity-serv/db"
 	"github.com/FiveEightyEight/gippity-serv/handlers"
+	"github.com/FiveEightyEight/gippity-serv/jobs"
+	"github.com/FiveEightyEight/gippity-serv/mailer"
+	"github.com/FiveEightyEight/gippity-serv/oidc"
+	"github.com/FiveEightyEight/gippity-serv/password"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/FiveEightyEight/gippity-serv/repository/sqlite"
+	"github.com/FiveEightyEight/gippity-serv/webauthn"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -16,12 +30,134 @@ func homePath(c echo.Context) error {
 	return c.String(http.StatusOK, "Welcome home")
 }
 
+// runMigrate handles `migrate up`, `migrate down [steps]`, `migrate status` and `migrate to <version>`
+func runMigrate(args []string) error {
+	if inMemory() {
+		return fmt.Errorf("the in-memory repository has no migrations")
+	}
+	repo, migrator, err := connect()
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [steps] | status | to <version>")
+	}
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("steps must be a positive number: %s", args[1])
+			}
+		}
+		return migrator.Down(ctx, steps)
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: migrate to <version>")
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("version must be a number: %s", args[1])
+		}
+		return migrator.To(ctx, version)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q, expected up, down, status or to", args[0])
+}
+
+// inMemory reports whether DATABASE_URL selects the in-memory repository, for tests and demos
+func inMemory() bool {
+	return strings.HasPrefix(os.Getenv("DATABASE_URL"), "memory:")
+}
+
+// schemaMigrator is what runMigrate needs from db.Migrator and sqlite.Migrator
+type schemaMigrator interface {
+	Up(ctx context.Context) error
+	Down(ctx context.Context, steps int) error
+	To(ctx context.Context, version int64) error
+	Status(ctx context.Context) ([]db.MigrationStatus, error)
+}
+
+// connect opens the database selected by DATABASE_URL, a SQLite file for
+// sqlite:// urls and Postgres otherwise, along with its migrations
+func connect() (repository.Repository, schemaMigrator, error) {
+	if strings.HasPrefix(os.Getenv("DATABASE_URL"), sqlite.Scheme) {
+		repo, err := sqlite.NewDatabaseConnection()
+		if err != nil {
+			return nil, nil, err
+		}
+		migrator, err := repo.Migrator()
+		if err != nil {
+			repo.Close()
+			return nil, nil, fmt.Errorf("failed to load migrations: %v", err)
+		}
+		return repo, migrator, nil
+	}
+
+	repo, err := db.NewDatabaseConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := repo.Migrator()
+	if err != nil {
+		repo.Close()
+		return nil, nil, fmt.Errorf("failed to load migrations: %v", err)
+	}
+	return repo, migrator, nil
+}
+
+// openRepository connects to the database selected by DATABASE_URL,
+// migrating it first unless MIGRATE_ON_START is false
+func openRepository(ctx context.Context) (repository.Repository, error) {
+	if inMemory() {
+		log.Println("Using the in-memory repository, nothing is persisted")
+		return memory.New(), nil
+	}
+	repo, migrator, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Instances starting together take turns, so each migration runs once
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		if err := migrator.Up(ctx); err != nil {
+			repo.Close()
+			return nil, fmt.Errorf("failed to migrate: %v", err)
+		}
+	}
+	return repo, nil
+}
+
 func main() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatalf("Error loading .env file")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("Error migrating: %v", err)
+		}
+		return
+	}
+
 	patternsStorage := &db.Storage{
 		Label:         "Patterns",
 		Dir:           "./patterns", // Adjust this path as needed
@@ -31,13 +167,93 @@ func main() {
 	if err := patternsStorage.Configure(); err != nil {
 		log.Fatalf("Error configuring patterns storage: %v", err)
 	}
+	patternCatalog, err := db.NewPatternCatalog(patternsStorage)
+	if err != nil {
+		log.Fatalf("Error loading patterns: %v", err)
+	}
+	reloadInterval := 5 * time.Second
+	if raw := os.Getenv("PATTERNS_RELOAD_INTERVAL"); raw != "" {
+		if reloadInterval, err = time.ParseDuration(raw); err != nil || reloadInterval <= 0 {
+			log.Fatalf("Error parsing PATTERNS_RELOAD_INTERVAL: %s", raw)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go patternCatalog.Watch(ctx, reloadInterval)
+
 	// Initialize database connection
-	db, err := db.NewDatabaseConnection()
+	db, err := openRepository(ctx)
 	if err != nil {
 		log.Fatalf("Error connecting to database: %v", err)
 	}
 	defer db.Close()
 
+	keyRingConfig, err := auth.KeyRingConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring JWT signing keys: %v", err)
+	}
+	keyRing := auth.NewKeyRing(db, keyRingConfig)
+	if err := keyRing.Refresh(ctx); err != nil {
+		log.Fatalf("Error loading JWT signing keys: %v", err)
+	}
+	auth.SetKeyRing(keyRing)
+	go keyRing.Watch(ctx, time.Minute)
+
+	worker := jobs.NewWorker(db, patternCatalog, handlers.CompletePattern)
+	if raw := os.Getenv("JOB_WORKER_CONCURRENCY"); raw != "" {
+		if worker.Concurrency, err = strconv.Atoi(raw); err != nil || worker.Concurrency < 1 {
+			log.Fatalf("Error parsing JOB_WORKER_CONCURRENCY: %s", raw)
+		}
+	}
+	go worker.Start(ctx)
+
+	go jobs.NewExportWorker(db).Start(ctx)
+
+	scheduler := jobs.NewScheduler(db, patternCatalog, handlers.CompletePattern, handlers.ChatCompletion)
+	go scheduler.Start(ctx)
+
+	go jobs.Sweep(ctx, "expired refresh tokens", time.Hour, db.DeleteExpiredRefreshTokens)
+	go jobs.Sweep(ctx, "used email tokens", time.Hour, db.DeleteExpiredEmailTokens)
+	go jobs.Sweep(ctx, "expired oidc logins", time.Hour, db.DeleteExpiredOIDCLoginStates)
+	go jobs.Sweep(ctx, "expired webauthn challenges", time.Hour, db.DeleteExpiredWebAuthnChallenges)
+	go jobs.Sweep(ctx, "expired mfa challenges", time.Hour, db.DeleteExpiredMFAChallenges)
+	go jobs.Sweep(ctx, "expired signing keys", time.Hour, db.DeleteExpiredSigningKeys)
+	go jobs.Sweep(ctx, "expired data exports", time.Hour, db.DeleteExpiredDataExports)
+	go jobs.Sweep(ctx, "deleted accounts", time.Hour, db.PurgeDeletedUsers)
+	go jobs.Sweep(ctx, "stale auth throttles", time.Hour, func(ctx context.Context) (int64, error) {
+		return db.DeleteStaleAuthThrottles(ctx, handlers.AuthThrottleWindow)
+	})
+	go jobs.Sweep(ctx, "stale sessions", time.Hour, func(ctx context.Context) (int64, error) {
+		return db.DeleteStaleSessions(ctx, auth.RefreshTokenTTL)
+	})
+	go jobs.Sweep(ctx, "abandoned replies", 10*time.Minute, func(ctx context.Context) (int64, error) {
+		return db.FailStaleMessages(ctx, handlers.ReplyTimeout)
+	})
+	trashRetention := 30 * 24 * time.Hour
+	if raw := os.Getenv("TRASH_RETENTION"); raw != "" {
+		if trashRetention, err = time.ParseDuration(raw); err != nil || trashRetention < 0 {
+			log.Fatalf("Error parsing TRASH_RETENTION: %s", raw)
+		}
+	}
+	go jobs.Sweep(ctx, "trashed chats and messages", time.Hour, func(ctx context.Context) (int64, error) {
+		return db.PurgeTrash(ctx, trashRetention)
+	})
+
+	mail, err := mailer.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring mailer: %v", err)
+	}
+
+	providers, err := oidc.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring OIDC providers: %v", err)
+	}
+
+	wa, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring WebAuthn: %v", err)
+	}
+
 	e := echo.New()
 	e.HideBanner = true
 	e.Use(middleware.Logger())
@@ -46,25 +262,135 @@ func main() {
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"http://localhost:4321"},
 		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, "If-None-Match"},
+		ExposeHeaders:    []string{"ETag"},
 		AllowCredentials: true,
 	}))
 
 	e.GET("/", homePath)
-	e.POST("/create_account", handlers.CreateUser(db))
-	e.POST("/login", handlers.Login(db))
-	e.POST("/register", handlers.CreateUser(db))
-	e.POST("/refresh", handlers.RefreshToken)
+	e.GET("/.well-known/jwks.json", handlers.JWKS(keyRing))
+	hasher := password.NewHasher()
+	sessions := handlers.NewSessionCache(db)
+	e.POST("/create_account", handlers.CreateUser(db, hasher, mail))
+	e.POST("/login", handlers.Login(db, hasher))
+	e.POST("/login/mfa", handlers.LoginMFA(db, wa))
+	e.POST("/login/mfa/webauthn", handlers.BeginPasskeyMFA(db, wa))
+	e.POST("/webauthn/login/begin", handlers.BeginPasskeyLogin(db, wa))
+	e.POST("/webauthn/login/finish", handlers.FinishPasskeyLogin(db, wa))
+	e.POST("/register", handlers.CreateUser(db, hasher, mail))
+	e.POST("/refresh", handlers.RefreshToken(db, sessions))
+	e.POST("/logout", handlers.Logout(db, sessions))
+	e.POST("/logout-all", handlers.LogoutAll(db, sessions))
+	e.POST("/verify-email", handlers.VerifyEmail(db))
+	e.POST("/password-reset/request", handlers.RequestPasswordReset(db, mail))
+	e.POST("/password-reset", handlers.ResetPassword(db, hasher, sessions))
+	e.POST("/magic-link/request", handlers.RequestMagicLink(db, mail))
+	e.POST("/magic-link/login", handlers.MagicLinkLogin(db))
+	e.GET("/auth/oidc/:provider/login", handlers.OIDCLogin(db, providers))
+	e.GET("/auth/oidc/:provider/callback", handlers.OIDCCallback(db, providers, hasher, sessions))
 
 	// Protected routes
 	authGroup := e.Group("/api/v1")
-	authGroup.Use(handlers.AuthMiddleware)
-	authGroup.GET("/models", handlers.GetAllAIModels(db))
-	authGroup.GET("/patterns", handlers.GetPatterns(patternsStorage))
-	authGroup.GET("/chat", handlers.GetConversation(db))
-	authGroup.POST("/conversation", handlers.Conversation(db))
-	authGroup.GET("/chat-history", handlers.GetChatHistory(db))
-	authGroup.DELETE("/chat/:id", handlers.DeleteChat(db))
+	authGroup.Use(handlers.AuthMiddleware(db, sessions))
+	authGroup.GET("/models", handlers.GetAllAIModels(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.GET("/patterns", handlers.GetPatterns(patternCatalog), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.GET("/patterns/:name", handlers.GetPattern(patternCatalog), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.GET("/chat", handlers.GetConversation(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.GET("/chat-history", handlers.GetChatHistory(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.DELETE("/chat/:id", handlers.DeleteChat(db), handlers.RequireScope(auth.ScopeChatWrite))
+	authGroup.GET("/chat-trash", handlers.GetChatTrash(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.POST("/chat/:id/restore", handlers.RestoreChat(db), handlers.RequireScope(auth.ScopeChatWrite))
+	authGroup.DELETE("/chat/:id/messages/:message_id", handlers.DeleteMessage(db), handlers.RequireScope(auth.ScopeChatWrite))
+	authGroup.GET("/chat/:id/trash", handlers.GetMessageTrash(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.POST("/chat/:id/messages/:message_id/restore", handlers.RestoreMessage(db), handlers.RequireScope(auth.ScopeChatWrite))
+	authGroup.PUT("/chat/:id/workspace", handlers.MoveChat(db), handlers.RequireScope(auth.ScopeChatWrite))
+	authGroup.GET("/chat/:id/instructions", handlers.GetChatInstructions(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	authGroup.PUT("/chat/:id/instructions", handlers.UpdateChatInstructions(db), handlers.RequireScope(auth.ScopeChatWrite))
+
+	// Account management is only available to logins, not API keys
+	account := authGroup.Group("", handlers.RequireSession)
+	account.GET("/sessions", handlers.GetSessions(db))
+	account.DELETE("/sessions/:id", handlers.DeleteSession(db, sessions))
+	account.GET("/me", handlers.GetMe(db))
+	account.PUT("/me", handlers.UpdateMe(db, mail))
+	account.GET("/me/preferences", handlers.GetPreferences(db))
+	account.PUT("/me/preferences", handlers.UpdatePreferences(db))
+	account.GET("/me/metadata", handlers.GetMetadata(db))
+	account.PUT("/me/metadata", handlers.UpdateMetadata(db))
+	account.GET("/me/instructions", handlers.GetCustomInstructions(db))
+	account.PUT("/me/instructions", handlers.UpdateCustomInstructions(db))
+	account.POST("/me/verify-email", handlers.SendVerificationEmail(db, mail))
+	account.GET("/me/mfa", handlers.GetMFAStatus(db))
+	account.POST("/me/mfa/totp", handlers.EnrollTOTP(db))
+	account.POST("/me/mfa/totp/confirm", handlers.ConfirmTOTP(db))
+	account.POST("/me/mfa/totp/disable", handlers.DisableTOTP(db))
+	account.POST("/me/mfa/recovery-codes", handlers.RegenerateRecoveryCodes(db))
+	account.GET("/me/identities", handlers.GetIdentities(db))
+	account.GET("/me/passkeys", handlers.GetPasskeys(db))
+	account.POST("/me/passkeys/register/begin", handlers.BeginPasskeyRegistration(db, wa))
+	account.POST("/me/passkeys/register/finish", handlers.FinishPasskeyRegistration(db, wa))
+	account.DELETE("/me/passkeys/:id", handlers.DeletePasskey(db))
+	account.POST("/api-keys", handlers.CreateAPIKey(db))
+	account.GET("/api-keys", handlers.GetAPIKeys(db))
+	account.DELETE("/api-keys/:id", handlers.DeleteAPIKey(db))
+	account.POST("/me/exports", handlers.RequestDataExport(db))
+	account.GET("/me/exports", handlers.GetDataExports(db))
+	account.GET("/me/exports/:id/download", handlers.DownloadDataExport(db))
+	account.POST("/me/deletion", handlers.RequestAccountDeletion(db, mail))
+	account.DELETE("/me/deletion", handlers.CancelAccountDeletion(db))
+
+	// Organizations and their team workspaces; roles are per organization
+	account.POST("/orgs", handlers.CreateOrganization(db))
+	account.GET("/orgs", handlers.GetOrganizations(db))
+	account.PUT("/orgs/:id", handlers.UpdateOrganization(db))
+	account.DELETE("/orgs/:id", handlers.DeleteOrganization(db))
+	account.GET("/orgs/:id/members", handlers.GetOrganizationMembers(db))
+	account.POST("/orgs/:id/members", handlers.AddOrganizationMember(db))
+	account.PUT("/orgs/:id/members/:user_id", handlers.UpdateOrganizationMember(db))
+	account.DELETE("/orgs/:id/members/:user_id", handlers.RemoveOrganizationMember(db))
+	account.GET("/orgs/:id/workspaces", handlers.GetWorkspaces(db))
+	account.POST("/orgs/:id/workspaces", handlers.CreateWorkspace(db))
+	account.PUT("/workspaces/:id", handlers.UpdateWorkspace(db))
+	account.DELETE("/workspaces/:id", handlers.DeleteWorkspace(db))
+	account.GET("/workspaces/:id/models", handlers.GetWorkspaceModels(db))
+	account.PUT("/workspaces/:id/models", handlers.SetWorkspaceModels(db))
+	account.GET("/workspaces/:id/patterns", handlers.GetWorkspacePatterns(db))
+	account.PUT("/workspaces/:id/patterns/:name", handlers.SaveWorkspacePattern(db))
+	account.DELETE("/workspaces/:id/patterns/:name", handlers.DeleteWorkspacePattern(db))
+
+	// Admin routes check the role in the access token, so API keys never reach them
+	admin := account.Group("/admin")
+	admin.GET("/models", handlers.GetAllAIModels(db), handlers.RequirePermission(auth.PermissionManageModels))
+	admin.POST("/models", handlers.CreateAIModel(db), handlers.RequirePermission(auth.PermissionManageModels))
+	admin.PUT("/models/:id", handlers.UpdateAIModel(db), handlers.RequirePermission(auth.PermissionManageModels))
+	admin.DELETE("/models/:id", handlers.DeleteAIModel(db), handlers.RequirePermission(auth.PermissionManageModels))
+	admin.GET("/users", handlers.GetUsers(db), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.GET("/users/:id", handlers.GetUserByID(db), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.PUT("/users/:id/active", handlers.UpdateUserActive(db, sessions), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.PUT("/users/:id/role", handlers.UpdateUserRole(db, sessions), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.DELETE("/users/:id", handlers.DeleteUser(db, sessions), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.POST("/users/:id/unlock", handlers.UnlockUser(db), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.GET("/security-events", handlers.GetSecurityEvents(db), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.GET("/roles", handlers.GetRoleSettings(db), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.PUT("/roles/:role", handlers.UpdateRoleSetting(db), handlers.RequirePermission(auth.PermissionManageUsers))
+	admin.PUT("/patterns/:name", handlers.SavePattern(patternCatalog), handlers.RequirePermission(auth.PermissionManagePatterns))
+	admin.DELETE("/patterns/:name", handlers.DeletePattern(patternCatalog), handlers.RequirePermission(auth.PermissionManagePatterns))
+
+	// Routes that spend model tokens need a verified email
+	verified := authGroup.Group("", handlers.RequireVerifiedEmail(db))
+	verified.POST("/patterns/:name/run", handlers.RunPattern(db, patternCatalog), handlers.RequireScope(auth.ScopePatternsRun))
+	verified.POST("/conversation", handlers.Conversation(db), handlers.RequireScope(auth.ScopeChatWrite))
+	verified.POST("/jobs", handlers.CreateJob(db, patternCatalog), handlers.RequireScope(auth.ScopePatternsRun))
+	verified.GET("/jobs", handlers.GetJobs(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	verified.GET("/jobs/:id", handlers.GetJob(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	verified.GET("/jobs/:id/items", handlers.GetJobItems(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	verified.GET("/jobs/:id/results.jsonl", handlers.GetJobResults(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	verified.POST("/schedules", handlers.CreateSchedule(db, patternCatalog), handlers.RequireScope(auth.ScopePatternsRun))
+	verified.GET("/schedules", handlers.GetSchedules(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	verified.GET("/schedules/:id", handlers.GetSchedule(db), handlers.RequireScope(auth.ScopeHistoryRead))
+	verified.PUT("/schedules/:id", handlers.UpdateSchedule(db, patternCatalog), handlers.RequireScope(auth.ScopePatternsRun))
+	verified.DELETE("/schedules/:id", handlers.DeleteSchedule(db), handlers.RequireScope(auth.ScopePatternsRun))
+	verified.GET("/schedules/:id/runs", handlers.GetScheduleRuns(db), handlers.RequireScope(auth.ScopeHistoryRead))
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = ":8080"
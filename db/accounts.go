@@ -0,0 +1,318 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrDeletionScheduled    = errors.New("account deletion is already scheduled")
+	ErrDeletionNotScheduled = errors.New("account deletion is not scheduled")
+	ErrExportInProgress     = errors.New("a data export is already in progress")
+	ErrExportNotFound       = errors.New("data export not found")
+)
+
+const (
+	ExportStatusQueued  = "queued"
+	ExportStatusRunning = "running"
+	ExportStatusDone    = "done"
+	ExportStatusFailed  = "failed"
+)
+
+// ScheduleUserDeletion marks the account to be purged at the given time
+func (r *PostgresRepository) ScheduleUserDeletion(ctx context.Context, id uuid.UUID, at time.Time) error {
+	query := `UPDATE users SET deletion_scheduled_at = $2 WHERE id = $1 AND deletion_scheduled_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, id, at)
+	if err != nil {
+		return fmt.Errorf("failed to schedule user deletion: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeletionScheduled
+	}
+	return nil
+}
+
+func (r *PostgresRepository) CancelUserDeletion(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE users SET deletion_scheduled_at = NULL WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`
+	tag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to cancel user deletion: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeletionNotScheduled
+	}
+	return nil
+}
+
+// PurgeDeletedUsers deletes the accounts whose deletion grace period has passed
+func (r *PostgresRepository) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	rows, err := r.db.Query(ctx, `SELECT id FROM users WHERE deletion_scheduled_at <= NOW() LIMIT 100`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get users due for deletion: %v", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan users due for deletion: %v", err)
+	}
+
+	var purged int64
+	for _, id := range ids {
+		if err := r.DeleteUser(ctx, id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// DeleteUser removes the user and everything they own. Personal chats are
+// deleted; chats and messages they shared with a workspace stay there without
+// an author. Organizations they were the only owner of pass to the next
+// admin, or member, by seniority, and organizations left empty are deleted.
+func (r *PostgresRepository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin user deletion: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM chats WHERE user_id = $1 AND workspace_id IS NULL`, id); err != nil {
+		return fmt.Errorf("failed to delete personal chats: %v", err)
+	}
+
+	query := `UPDATE organization_members m SET role = 'owner'
+              FROM (SELECT DISTINCT ON (organization_id) organization_id, user_id
+                    FROM organization_members
+                    WHERE user_id <> $1
+                      AND organization_id IN (SELECT organization_id FROM organization_members WHERE user_id = $1 AND role = 'owner')
+                      AND organization_id NOT IN (SELECT organization_id FROM organization_members WHERE user_id <> $1 AND role = 'owner')
+                    ORDER BY organization_id, role = 'admin' DESC, created_at) heirs
+              WHERE m.organization_id = heirs.organization_id AND m.user_id = heirs.user_id`
+	if _, err := tx.Exec(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to hand over organizations: %v", err)
+	}
+
+	// Lockout details name the username the attempts were made against
+	if _, err := tx.Exec(ctx, `UPDATE security_events SET detail = detail - 'key' WHERE user_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to anonymize security events: %v", err)
+	}
+	query = `DELETE FROM auth_throttles WHERE key = (SELECT 'login:' || LOWER(username) FROM users WHERE id = $1)`
+	if _, err := tx.Exec(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to delete auth throttles: %v", err)
+	}
+
+	tag, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	query = `DELETE FROM organizations o
+             WHERE NOT EXISTS (SELECT 1 FROM organization_members m WHERE m.organization_id = o.id)`
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to delete empty organizations: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit user deletion: %v", err)
+	}
+	return nil
+}
+
+// exportQueries select everything stored about the user given as $1, one JSON
+// file each. Secrets such as password hashes, key hashes and passkey public
+// keys are left out.
+var exportQueries = []struct {
+	name  string
+	query string
+}{
+	{"profile.json", `SELECT id, username, email, created_at, last_login, is_active, email_verified_at, role, deletion_scheduled_at
+                      FROM users WHERE id = $1`},
+	{"metadata.json", `SELECT preferred_language, timezone, interests, profession, education_level, birth_year, country, last_updated
+                       FROM user_metadata WHERE user_id = $1`},
+	{"preferences.json", `SELECT default_ai_model, theme, message_display_count, notifications_enabled
+                          FROM user_preferences WHERE user_id = $1`},
+	{"custom_instructions.json", `SELECT instructions, metadata_fields, updated_at
+                                  FROM custom_instructions WHERE user_id = $1`},
+	// Chats and messages in the trash are still stored, so they are exported with their deleted_at
+	{"chats.json", `SELECT id, title, created_at, last_updated, is_archived, ai_model_version, workspace_id, deleted_at
+                    FROM chats WHERE user_id = $1 ORDER BY created_at`},
+	// Attachments are stored as part of the message, or job item, they were sent with
+	{"messages.json", `SELECT m.id, m.chat_id, m.role, m.content, m.created_at, m.is_edited, m.status, m.deleted_at
+                       FROM messages m JOIN chats c ON c.id = m.chat_id
+                       WHERE m.user_id = $1 OR (c.user_id = $1 AND c.workspace_id IS NULL)
+                       ORDER BY m.chat_id, m.created_at`},
+	{"usage.json", `SELECT COALESCE(c.ai_model_version, '') AS ai_model_version, m.role,
+                           COUNT(*) AS messages, SUM(LENGTH(m.content)) AS characters,
+                           MIN(m.created_at) AS first_used_at, MAX(m.created_at) AS last_used_at
+                    FROM messages m JOIN chats c ON c.id = m.chat_id
+                    WHERE m.user_id = $1
+                    GROUP BY 1, 2 ORDER BY 1, 2`},
+	{"jobs.json", `SELECT id, pattern, variables, ai_model_version, status, created_at, finished_at
+                   FROM jobs WHERE user_id = $1 ORDER BY created_at`},
+	{"job_items.json", `SELECT i.job_id, i.position, i.input, i.output, i.error, i.status
+                        FROM job_items i JOIN jobs j ON j.id = i.job_id
+                        WHERE j.user_id = $1 ORDER BY i.job_id, i.position`},
+	{"schedules.json", `SELECT id, name, cron_expression, pattern, prompt, variables, ai_model_version, chat_id,
+                               append_to_chat, is_active, next_run_at, last_run_at, created_at
+                        FROM schedules WHERE user_id = $1 ORDER BY created_at`},
+	{"schedule_runs.json", `SELECT r.schedule_id, r.chat_id, r.status, r.error, r.started_at, r.finished_at
+                            FROM schedule_runs r JOIN schedules s ON s.id = r.schedule_id
+                            WHERE s.user_id = $1 ORDER BY r.started_at`},
+	{"organizations.json", `SELECT o.id, o.name, m.role, m.created_at AS joined_at
+                            FROM organization_members m JOIN organizations o ON o.id = m.organization_id
+                            WHERE m.user_id = $1 ORDER BY o.name`},
+	{"workspace_patterns.json", `SELECT workspace_id, name, system_prompt, user_prompt, created_at, updated_at
+                                 FROM workspace_patterns WHERE created_by = $1 ORDER BY workspace_id, name`},
+	{"sessions.json", `SELECT id, user_agent, ip_address, created_at, last_used_at, revoked_at
+                       FROM sessions WHERE user_id = $1 ORDER BY created_at`},
+	{"api_keys.json", `SELECT id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at
+                       FROM api_keys WHERE user_id = $1 ORDER BY created_at`},
+	{"identities.json", `SELECT provider, subject, email, groups, created_at, last_login_at
+                         FROM user_identities WHERE user_id = $1 ORDER BY created_at`},
+	{"passkeys.json", `SELECT id, name, attestation_format, transports, backup_eligible, created_at, last_used_at
+                       FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at`},
+	{"security_events.json", `SELECT id, event_type, ip_address, detail, created_at
+                              FROM security_events WHERE user_id = $1 ORDER BY created_at`},
+}
+
+// GetUserExportFiles reads everything stored about the user from one snapshot
+func (r *PostgresRepository) GetUserExportFiles(ctx context.Context, userID uuid.UUID) ([]models.ExportFile, error) {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin export transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	files := make([]models.ExportFile, 0, len(exportQueries))
+	for _, q := range exportQueries {
+		var data []byte
+		query := `SELECT COALESCE(json_agg(t), '[]'::json) FROM (` + q.query + `) t`
+		if err := tx.QueryRow(ctx, query, userID).Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to export %s: %v", q.name, err)
+		}
+		files = append(files, models.ExportFile{Name: q.name, Data: data})
+	}
+	return files, nil
+}
+
+// CreateDataExport queues an export unless the user already has one queued or running
+func (r *PostgresRepository) CreateDataExport(ctx context.Context, userID uuid.UUID) (*models.DataExport, error) {
+	query := `INSERT INTO data_exports (user_id)
+              SELECT $1 WHERE NOT EXISTS (
+                  SELECT 1 FROM data_exports WHERE user_id = $1 AND status IN ('queued', 'running'))
+              RETURNING id, user_id, status, size, created_at`
+	export := &models.DataExport{}
+	err := r.db.QueryRow(ctx, query, userID).Scan(&export.ID, &export.UserID, &export.Status, &export.Size, &export.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrExportInProgress
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data export: %v", err)
+	}
+	return export, nil
+}
+
+const dataExportColumns = `id, user_id, status, COALESCE(error, ''), size, created_at, finished_at, expires_at`
+
+func scanDataExport(row pgx.Row) (*models.DataExport, error) {
+	export := &models.DataExport{}
+	err := row.Scan(&export.ID, &export.UserID, &export.Status, &export.Error, &export.Size, &export.CreatedAt, &export.FinishedAt, &export.ExpiresAt)
+	return export, err
+}
+
+func (r *PostgresRepository) GetDataExportsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.DataExport, error) {
+	query := `SELECT ` + dataExportColumns + ` FROM data_exports WHERE user_id = $1 ORDER BY created_at DESC`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data exports: %v", err)
+	}
+	defer rows.Close()
+
+	exports := []*models.DataExport{}
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan data export: %v", err)
+		}
+		exports = append(exports, export)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over data exports: %v", err)
+	}
+	return exports, nil
+}
+
+// GetDataExportArchive returns the zip of a finished export belonging to userID
+func (r *PostgresRepository) GetDataExportArchive(ctx context.Context, id uuid.UUID, userID uuid.UUID) ([]byte, error) {
+	query := `SELECT archive FROM data_exports
+              WHERE id = $1 AND user_id = $2 AND status = 'done' AND expires_at > NOW()`
+	var archive []byte
+	err := r.db.QueryRow(ctx, query, id, userID).Scan(&archive)
+	if err == pgx.ErrNoRows {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data export archive: %v", err)
+	}
+	return archive, nil
+}
+
+// ClaimDataExport marks the oldest queued export running and returns it, or
+// nil if there is none. Exports left running longer than staleAfter, by an
+// instance that went away, are claimed again.
+func (r *PostgresRepository) ClaimDataExport(ctx context.Context, staleAfter time.Duration) (*models.DataExport, error) {
+	query := `UPDATE data_exports SET status = 'running', started_at = NOW()
+              WHERE id = (
+                  SELECT id FROM data_exports
+                  WHERE status = 'queued' OR (status = 'running' AND started_at < $1)
+                  ORDER BY created_at
+                  LIMIT 1
+                  FOR UPDATE SKIP LOCKED)
+              RETURNING ` + dataExportColumns
+	export, err := scanDataExport(r.db.QueryRow(ctx, query, time.Now().Add(-staleAfter)))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim data export: %v", err)
+	}
+	return export, nil
+}
+
+func (r *PostgresRepository) CompleteDataExport(ctx context.Context, id uuid.UUID, archive []byte, expiresAt time.Time) error {
+	query := `UPDATE data_exports
+              SET status = 'done', archive = $2, size = $3, finished_at = NOW(), expires_at = $4
+              WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id, archive, len(archive), expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to complete data export: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) FailDataExport(ctx context.Context, id uuid.UUID, cause string, expiresAt time.Time) error {
+	query := `UPDATE data_exports SET status = 'failed', error = $2, finished_at = NOW(), expires_at = $3 WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id, cause, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to record data export failure: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) DeleteExpiredDataExports(ctx context.Context) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM data_exports WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired data exports: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrAPIKeyInvalid = errors.New("api key is unknown, expired or revoked")
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row pgx.Row) (*models.APIKey, error) {
+	key := &models.APIKey{}
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&key.Scopes,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt)
+	return key, err
+}
+
+func (r *PostgresRepository) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	query := `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+              VALUES ($1, $2, $3, $4, $5, $6)
+              RETURNING id, created_at`
+	err := r.db.QueryRow(ctx, query,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.KeyHash,
+		key.Scopes,
+		key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create api key: %v", err)
+	}
+	return nil
+}
+
+// GetActiveAPIKeyByHash finds a key that is neither revoked nor expired and whose owner is active
+func (r *PostgresRepository) GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+              FROM api_keys
+              WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+                AND user_id IN (SELECT id FROM users WHERE is_active IS NOT FALSE)`
+	key, err := scanAPIKey(r.db.QueryRow(ctx, query, keyHash))
+	if err == pgx.ErrNoRows {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %v", err)
+	}
+	return key, nil
+}
+
+// GetAPIKeysByUserID lists a user's keys that have not been revoked, newest first
+func (r *PostgresRepository) GetAPIKeysByUserID(ctx context.Context, userID uuid.UUID) ([]*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+              FROM api_keys
+              WHERE user_id = $1 AND revoked_at IS NULL
+              ORDER BY created_at DESC`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []*models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over api keys: %v", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys, returning false if they have no such key
+func (r *PostgresRepository) RevokeAPIKey(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error) {
+	query := `UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke api key: %v", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// TouchAPIKey records that a key was used. It writes at most once a minute per key.
+func (r *PostgresRepository) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE api_keys SET last_used_at = NOW()
+              WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	_, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to touch api key: %v", err)
+	}
+	return nil
+}
@@ -2,19 +2,50 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/FiveEightyEight/gippity-serv/models"
 	"github.com/FiveEightyEight/gippity-serv/repository"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 )
 
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrAIModelNotFound = errors.New("ai model not found")
+	ErrAIModelInUse    = errors.New("ai model is referenced by chats or preferences")
+	ErrAIModelExists   = errors.New("an ai model with this name already exists")
+	ErrChatNotFound    = errors.New("chat not found")
+	ErrChatTrashed     = errors.New("chat is in the trash")
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// Message statuses. An assistant reply is pending while it streams.
+const (
+	MessagePending  = "pending"
+	MessageComplete = "complete"
+	MessageFailed   = "failed"
+)
+
+// dbtx is what queries run on: the pool, or the transaction of a unit of work
+type dbtx interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
 type PostgresRepository struct {
-	db *pgxpool.Pool
+	db   dbtx
+	pool *pgxpool.Pool
 }
 
 func NewDatabaseConnection() (*PostgresRepository, error) {
@@ -22,15 +53,55 @@ func NewDatabaseConnection() (*PostgresRepository, error) {
 	if err != nil {
 		log.Fatalf("Error loading .env file")
 	}
-	db, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+	return Open(context.Background(), os.Getenv("DATABASE_URL"))
+}
+
+// Open connects to the Postgres database at url
+func Open(ctx context.Context, url string) (*PostgresRepository, error) {
+	db, err := pgxpool.New(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %v", err)
 	}
-	return &PostgresRepository{db: db}, nil
+	return &PostgresRepository{db: db, pool: db}, nil
 }
 
 func (r *PostgresRepository) Close() {
-	r.db.Close()
+	r.pool.Close()
+}
+
+// InTx runs fn on a copy of the repository whose queries all go through one transaction
+func (r *PostgresRepository) InTx(ctx context.Context, fn func(tx repository.ConversationTx) error) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(&PostgresRepository{db: tx, pool: r.pool}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+const userColumns = `id, username, email, password_hash, created_at, last_login, COALESCE(is_active, TRUE), email_verified_at, role, deletion_scheduled_at`
+
+func scanUser(row pgx.Row) (*models.User, error) {
+	user := &models.User{}
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash,
+		&user.CreatedAt,
+		&user.LastLogin,
+		&user.IsActive,
+		&user.EmailVerifiedAt,
+		&user.Role,
+		&user.DeletionScheduledAt)
+	return user, err
 }
 
 func (r *PostgresRepository) CreateUser(ctx context.Context, user *models.User) error {
@@ -53,15 +124,35 @@ func (r *PostgresRepository) GetUserByID(ctx context.Context, id int) (*models.U
 }
 
 func (r *PostgresRepository) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
-	query := `SELECT id, username, email, password_hash FROM users WHERE username = $1`
-	user := &models.User{}
-	err := r.db.QueryRow(ctx, query, username).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash)
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
+	user, err := scanUser(r.db.QueryRow(ctx, query, username))
+	if err == pgx.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user by username: %v", err)
 	}
 	return user, nil
 }
 
+func (r *PostgresRepository) GetUserByUUID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	user, err := scanUser(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by ID: %v", err)
+	}
+	return user, nil
+}
+
+func (r *PostgresRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE LOWER(email) = LOWER($1)`
+	user, err := scanUser(r.db.QueryRow(ctx, query, email))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by email: %v", err)
+	}
+	return user, nil
+}
+
 func (r *PostgresRepository) UpdateUser(ctx context.Context, user *models.User) error {
 	query := `UPDATE users SET username = $1, email = $2, password_hash = $3 WHERE id = $4`
 	_, err := r.db.Exec(ctx, query, user.Username, user.Email, user.PasswordHash, user.ID)
@@ -71,28 +162,102 @@ func (r *PostgresRepository) UpdateUser(ctx context.Context, user *models.User)
 	return nil
 }
 
-func (r *PostgresRepository) DeleteUser(ctx context.Context, id int) error {
-	query := `DELETE FROM users WHERE id = $1`
-	_, err := r.db.Exec(ctx, query, id)
+// UpdateUserPasswordHash replaces only the password hash, e.g. when upgrading it after login
+func (r *PostgresRepository) UpdateUserPasswordHash(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1 WHERE id = $2`
+	_, err := r.db.Exec(ctx, query, passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %v", err)
+	}
+	return nil
+}
+
+// ListUsers pages through users, newest first. A non-empty search matches
+// the start of the username or email.
+func (r *PostgresRepository) ListUsers(ctx context.Context, search string, limit int, offset int) ([]*models.User, error) {
+	query := `SELECT ` + userColumns + `
+              FROM users
+              WHERE $1 = '' OR username ILIKE $1 || '%' OR email ILIKE $1 || '%'
+              ORDER BY created_at DESC, pk DESC
+              LIMIT $2 OFFSET $3`
+	rows, err := r.db.Query(ctx, query, escapeLike(search), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over users: %v", err)
+	}
+	return users, nil
+}
+
+func (r *PostgresRepository) SetUserActive(ctx context.Context, id uuid.UUID, active bool) error {
+	tag, err := r.db.Exec(ctx, `UPDATE users SET is_active = $2 WHERE id = $1`, id, active)
+	if err != nil {
+		return fmt.Errorf("failed to set user active: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepository) SetUserRole(ctx context.Context, id uuid.UUID, role string) error {
+	tag, err := r.db.Exec(ctx, `UPDATE users SET role = $2 WHERE id = $1`, id, role)
 	if err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
+		return fmt.Errorf("failed to set user role: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
 	}
 	return nil
 }
 
+// Postgres error codes the repository maps to its own errors
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+func isPgError(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
+// escapeLike makes s match literally in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
 func (r *PostgresRepository) CreateAIModel(ctx context.Context, model *models.AIModel) error {
 	query := `INSERT INTO ai_models (name, version, description, is_active) VALUES ($1, $2, $3, $4) RETURNING id`
 	err := r.db.QueryRow(ctx, query, model.Name, model.Version, model.Description, model.IsActive).Scan(&model.ID)
+	if isPgError(err, uniqueViolation) {
+		return ErrAIModelExists
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create AI model: %v", err)
 	}
 	return nil
 }
 
-func (r *PostgresRepository) GetAIModelByID(ctx context.Context, id int) (*models.AIModel, error) {
+func (r *PostgresRepository) GetAIModelByID(ctx context.Context, id uuid.UUID) (*models.AIModel, error) {
 	query := `SELECT id, name, version, description, is_active FROM ai_models WHERE id = $1`
 	model := &models.AIModel{}
 	err := r.db.QueryRow(ctx, query, id).Scan(&model.ID, &model.Name, &model.Version, &model.Description, &model.IsActive)
+	if err == pgx.ErrNoRows {
+		return nil, ErrAIModelNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get AI model by ID: %v", err)
 	}
@@ -125,25 +290,37 @@ func (r *PostgresRepository) GetAllAIModels(ctx context.Context) ([]*models.AIMo
 
 func (r *PostgresRepository) UpdateAIModel(ctx context.Context, model *models.AIModel) error {
 	query := `UPDATE ai_models SET name = $1, version = $2, description = $3, is_active = $4 WHERE id = $5`
-	_, err := r.db.Exec(ctx, query, model.Name, model.Version, model.Description, model.IsActive, model.ID)
+	tag, err := r.db.Exec(ctx, query, model.Name, model.Version, model.Description, model.IsActive, model.ID)
+	if isPgError(err, uniqueViolation) {
+		return ErrAIModelExists
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update AI model: %v", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrAIModelNotFound
+	}
 	return nil
 }
 
-func (r *PostgresRepository) DeleteAIModel(ctx context.Context, id int) error {
+func (r *PostgresRepository) DeleteAIModel(ctx context.Context, id uuid.UUID) error {
 	query := `DELETE FROM ai_models WHERE id = $1`
-	_, err := r.db.Exec(ctx, query, id)
+	tag, err := r.db.Exec(ctx, query, id)
+	if isPgError(err, foreignKeyViolation) {
+		return ErrAIModelInUse
+	}
 	if err != nil {
 		return fmt.Errorf("failed to delete AI model: %v", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrAIModelNotFound
+	}
 	return nil
 }
 
 func (r *PostgresRepository) CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
-	query := `INSERT INTO chats (user_id, title, created_at, last_updated, is_archived, ai_model_version) 
-              VALUES ($1, $2, $3, $4, $5, $6) 
+	query := `INSERT INTO chats (user_id, title, created_at, last_updated, is_archived, ai_model_version, workspace_id) 
+              VALUES ($1, $2, $3, $4, $5, $6, $7) 
               RETURNING id`
 	err := r.db.QueryRow(ctx, query,
 		chat.UserID,
@@ -151,26 +328,40 @@ func (r *PostgresRepository) CreateChat(ctx context.Context, chat *models.Chat)
 		chat.CreatedAt,
 		chat.LastUpdated,
 		chat.IsArchived,
-		chat.AIModelVersion).Scan(&chat.ID)
+		chat.AIModelVersion,
+		chat.WorkspaceID).Scan(&chat.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create chat: %v", err)
 	}
 	return chat, nil
 }
 
-func (r *PostgresRepository) GetChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
-	query := `SELECT id, user_id, title, created_at, last_updated, is_archived, ai_model_version 
-              FROM chats 
-              WHERE id = $1`
+const chatColumns = `id, user_id, title, created_at, last_updated, is_archived, ai_model_version, workspace_id, deleted_at`
+
+func scanChat(row pgx.Row) (*models.Chat, error) {
 	chat := &models.Chat{}
-	err := r.db.QueryRow(ctx, query, id).Scan(
+	err := row.Scan(
 		&chat.ID,
 		&chat.UserID,
 		&chat.Title,
 		&chat.CreatedAt,
 		&chat.LastUpdated,
 		&chat.IsArchived,
-		&chat.AIModelVersion)
+		&chat.AIModelVersion,
+		&chat.WorkspaceID,
+		&chat.DeletedAt)
+	return chat, err
+}
+
+// GetChatByID returns the chat unless it is in the trash
+func (r *PostgresRepository) GetChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE id = $1 AND deleted_at IS NULL`
+	chat, err := scanChat(r.db.QueryRow(ctx, query, id))
+	if err == pgx.ErrNoRows {
+		return nil, ErrChatNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get chat by ID: %v", err)
 	}
@@ -179,14 +370,15 @@ func (r *PostgresRepository) GetChatByID(ctx context.Context, id uuid.UUID) (*mo
 
 func (r *PostgresRepository) UpdateChat(ctx context.Context, chat *models.Chat) error {
 	query := `UPDATE chats 
-              SET user_id = $1, title = $2, last_updated = $3, is_archived = $4, ai_model_version = $5
-              WHERE id = $6`
+              SET user_id = $1, title = $2, last_updated = $3, is_archived = $4, ai_model_version = $5, workspace_id = $6
+              WHERE id = $7`
 	_, err := r.db.Exec(ctx, query,
 		chat.UserID,
 		chat.Title,
 		chat.LastUpdated,
 		chat.IsArchived,
 		chat.AIModelVersion,
+		chat.WorkspaceID,
 		chat.ID)
 	if err != nil {
 		return fmt.Errorf("failed to update chat: %v", err)
@@ -194,19 +386,159 @@ func (r *PostgresRepository) UpdateChat(ctx context.Context, chat *models.Chat)
 	return nil
 }
 
+// TouchChat moves the chat's last_updated forward to at. It never moves it
+// back, so replies finishing out of order leave the latest time.
+// TouchChat moves last_updated forward to at. Trashed chats are refused with ErrChatTrashed.
+func (r *PostgresRepository) TouchChat(ctx context.Context, id uuid.UUID, at time.Time) error {
+	query := `UPDATE chats SET last_updated = GREATEST(last_updated, $2) WHERE id = $1 AND deleted_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, id, at)
+	if err != nil {
+		return fmt.Errorf("failed to touch chat: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return r.unwritableChat(ctx, id)
+	}
+	return nil
+}
+
+// unwritableChat explains why a write to a chat matched no row
+func (r *PostgresRepository) unwritableChat(ctx context.Context, id uuid.UUID) error {
+	var trashed bool
+	err := r.db.QueryRow(ctx, `SELECT deleted_at IS NOT NULL FROM chats WHERE id = $1`, id).Scan(&trashed)
+	if err == pgx.ErrNoRows {
+		return ErrChatNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get chat: %v", err)
+	}
+	if trashed {
+		return ErrChatTrashed
+	}
+	return ErrChatNotFound
+}
+
+// DeleteChat moves the chat and its messages to the trash, stamping them
+// with the same deleted_at so RestoreChat brings back exactly those messages
 func (r *PostgresRepository) DeleteChat(ctx context.Context, id uuid.UUID) error {
-	query := `DELETE FROM chats WHERE id = $1`
-	_, err := r.db.Exec(ctx, query, id)
+	tx, err := r.db.Begin(ctx)
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE chats SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`, id); err != nil {
 		return fmt.Errorf("failed to delete chat: %v", err)
 	}
+	query := `UPDATE messages SET deleted_at = (SELECT deleted_at FROM chats WHERE id = $1)
+              WHERE chat_id = $1 AND deleted_at IS NULL`
+	if _, err := tx.Exec(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to delete chat messages: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
 	return nil
 }
 
+// GetTrashedChatByID returns the chat only if it is in the trash
+func (r *PostgresRepository) GetTrashedChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE id = $1 AND deleted_at IS NOT NULL`
+	chat, err := scanChat(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrChatNotFound
+		}
+		return nil, fmt.Errorf("failed to get trashed chat by ID: %v", err)
+	}
+	return chat, nil
+}
+
+// GetTrashedChatsByUserID returns the user's trashed personal chats, most recently deleted first
+func (r *PostgresRepository) GetTrashedChatsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE user_id = $1 AND workspace_id IS NULL AND deleted_at IS NOT NULL
+              ORDER BY deleted_at DESC`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed chats by user ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
+
+// GetTrashedChatsByWorkspaceID returns the workspace's trashed chats, most recently deleted first
+func (r *PostgresRepository) GetTrashedChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE workspace_id = $1 AND deleted_at IS NOT NULL
+              ORDER BY deleted_at DESC`
+	rows, err := r.db.Query(ctx, query, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed chats by workspace ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
+
+// RestoreChat takes the chat out of the trash with the messages that were
+// trashed along with it. Messages deleted on their own before stay trashed.
+func (r *PostgresRepository) RestoreChat(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE messages SET deleted_at = NULL
+              WHERE chat_id = $1 AND deleted_at = (SELECT deleted_at FROM chats WHERE id = $1)`
+	if _, err := tx.Exec(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to restore chat messages: %v", err)
+	}
+	tag, err := tx.Exec(ctx, `UPDATE chats SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore chat: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrChatNotFound
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes chats and messages that have been in the
+// trash longer than olderThan, and returns how many it deleted
+func (r *PostgresRepository) PurgeTrash(ctx context.Context, olderThan time.Duration) (int64, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	cutoff := time.Now().Add(-olderThan)
+	chats, err := tx.Exec(ctx, `DELETE FROM chats WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trashed chats: %v", err)
+	}
+	messages, err := tx.Exec(ctx, `DELETE FROM messages WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trashed messages: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return chats.RowsAffected() + messages.RowsAffected(), nil
+}
+
+// GetChatsByUserID returns the user's personal chats; chats moved to a workspace are listed with it
 func (r *PostgresRepository) GetChatsByUserID(ctx context.Context, userID uuid.UUID, sortByLastUpdated bool) ([]*models.Chat, error) {
-	query := `SELECT id, user_id, title, created_at, last_updated, is_archived, ai_model_version 
+	query := `SELECT ` + chatColumns + `
               FROM chats 
-              WHERE user_id = $1`
+              WHERE user_id = $1 AND workspace_id IS NULL AND deleted_at IS NULL`
 
 	if sortByLastUpdated {
 		query += ` ORDER BY last_updated DESC`
@@ -217,18 +549,28 @@ func (r *PostgresRepository) GetChatsByUserID(ctx context.Context, userID uuid.U
 		return nil, fmt.Errorf("failed to get chats by user ID: %v", err)
 	}
 	defer rows.Close()
+	return scanChats(rows)
+}
+
+// GetChatsByWorkspaceID returns every chat shared with the workspace, most recently updated first
+func (r *PostgresRepository) GetChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE workspace_id = $1 AND deleted_at IS NULL
+              ORDER BY last_updated DESC`
+	rows, err := r.db.Query(ctx, query, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats by workspace ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
 
+func scanChats(rows pgx.Rows) ([]*models.Chat, error) {
 	var chats []*models.Chat
 	for rows.Next() {
-		chat := &models.Chat{}
-		if err := rows.Scan(
-			&chat.ID,
-			&chat.UserID,
-			&chat.Title,
-			&chat.CreatedAt,
-			&chat.LastUpdated,
-			&chat.IsArchived,
-			&chat.AIModelVersion); err != nil {
+		chat, err := scanChat(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan chat: %v", err)
 		}
 		chats = append(chats, chat)
@@ -241,10 +583,17 @@ func (r *PostgresRepository) GetChatsByUserID(ctx context.Context, userID uuid.U
 	return chats, nil
 }
 
-// CreateMessage inserts a new message into the database
+// CreateMessage inserts a new message into the database. Messages without a status are complete.
 func (r *PostgresRepository) CreateMessage(ctx context.Context, message *models.Message) error {
-	query := `INSERT INTO messages (chat_id, user_id, role, content, created_at, is_edited)
-              VALUES ($1, $2, $3, $4, $5, $6)
+	if message.Status == "" {
+		message.Status = MessageComplete
+	}
+	// The chat row is share locked so DeleteChat cannot trash it without also
+	// trashing this message
+	query := `INSERT INTO messages (chat_id, user_id, role, content, created_at, is_edited, status)
+              SELECT id, $2::uuid, $3, $4, $5::timestamptz, $6::boolean, $7
+              FROM chats WHERE id = $1 AND deleted_at IS NULL
+              FOR SHARE
               RETURNING id`
 	err := r.db.QueryRow(ctx, query,
 		message.ChatID,
@@ -252,7 +601,11 @@ func (r *PostgresRepository) CreateMessage(ctx context.Context, message *models.
 		message.Role,
 		message.Content,
 		message.CreatedAt,
-		message.IsEdited).Scan(&message.ID)
+		message.IsEdited,
+		message.Status).Scan(&message.ID)
+	if err == pgx.ErrNoRows {
+		return r.unwritableChat(ctx, message.ChatID)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create message: %v", err)
 	}
@@ -261,9 +614,9 @@ func (r *PostgresRepository) CreateMessage(ctx context.Context, message *models.
 
 // GetMessageByID retrieves a message by its ID
 func (r *PostgresRepository) GetMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error) {
-	query := `SELECT id, chat_id, user_id, role, content, created_at, is_edited
+	query := `SELECT id, chat_id, user_id, role, content, created_at, is_edited, status
               FROM messages
-              WHERE id = $1`
+              WHERE id = $1 AND deleted_at IS NULL`
 	message := &models.Message{}
 	err := r.db.QueryRow(ctx, query, id).Scan(
 		&message.ID,
@@ -272,7 +625,11 @@ func (r *PostgresRepository) GetMessageByID(ctx context.Context, id uuid.UUID) (
 		&message.Role,
 		&message.Content,
 		&message.CreatedAt,
-		&message.IsEdited)
+		&message.IsEdited,
+		&message.Status)
+	if err == pgx.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get message by ID: %v", err)
 	}
@@ -294,9 +651,33 @@ func (r *PostgresRepository) UpdateMessage(ctx context.Context, message *models.
 	return nil
 }
 
-// DeleteMessage deletes a message from the database
+// FinishMessage saves the final content and status of a pending message.
+// Messages that are no longer pending are left as they are.
+func (r *PostgresRepository) FinishMessage(ctx context.Context, message *models.Message) error {
+	query := `UPDATE messages
+              SET content = $1, status = $2
+              WHERE id = $3 AND status = 'pending'`
+	_, err := r.db.Exec(ctx, query, message.Content, message.Status, message.ID)
+	if err != nil {
+		return fmt.Errorf("failed to finish message: %v", err)
+	}
+	return nil
+}
+
+// FailStaleMessages marks messages still pending after olderThan as failed,
+// such as replies whose server stopped while they streamed
+func (r *PostgresRepository) FailStaleMessages(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `UPDATE messages SET status = 'failed' WHERE status = 'pending' AND created_at < $1`
+	tag, err := r.db.Exec(ctx, query, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fail stale messages: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteMessage moves a message to the trash
 func (r *PostgresRepository) DeleteMessage(ctx context.Context, id uuid.UUID) error {
-	query := `DELETE FROM messages WHERE id = $1`
+	query := `UPDATE messages SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
 	_, err := r.db.Exec(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete message: %v", err)
@@ -304,11 +685,90 @@ func (r *PostgresRepository) DeleteMessage(ctx context.Context, id uuid.UUID) er
 	return nil
 }
 
+// GetTrashedMessageByID returns a message that was moved to the trash on its
+// own; messages trashed with their chat come back with RestoreChat
+func (r *PostgresRepository) GetTrashedMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error) {
+	query := `SELECT m.id, m.chat_id, m.user_id, m.role, m.content, m.created_at, m.is_edited, m.status, m.deleted_at
+              FROM messages m JOIN chats c ON c.id = m.chat_id
+              WHERE m.id = $1 AND m.deleted_at IS NOT NULL AND c.deleted_at IS NULL`
+	message := &models.Message{}
+	err := r.db.QueryRow(ctx, query, id).Scan(
+		&message.ID,
+		&message.ChatID,
+		&message.UserID,
+		&message.Role,
+		&message.Content,
+		&message.CreatedAt,
+		&message.IsEdited,
+		&message.Status,
+		&message.DeletedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed message by ID: %v", err)
+	}
+	return message, nil
+}
+
+// GetTrashedMessagesByChatID returns the messages moved to the trash from a
+// chat that is not itself in the trash, most recently deleted first
+func (r *PostgresRepository) GetTrashedMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error) {
+	query := `SELECT m.id, m.chat_id, m.user_id, m.role, m.content, m.created_at, m.is_edited, m.status, m.deleted_at
+              FROM messages m JOIN chats c ON c.id = m.chat_id
+              WHERE m.chat_id = $1 AND m.deleted_at IS NOT NULL AND c.deleted_at IS NULL
+              ORDER BY m.deleted_at DESC`
+	rows, err := r.db.Query(ctx, query, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed messages by chat ID: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.Message{}
+	for rows.Next() {
+		message := &models.Message{}
+		if err := rows.Scan(
+			&message.ID,
+			&message.ChatID,
+			&message.UserID,
+			&message.Role,
+			&message.Content,
+			&message.CreatedAt,
+			&message.IsEdited,
+			&message.Status,
+			&message.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over messages: %v", err)
+	}
+	return messages, nil
+}
+
+// RestoreMessage takes a message out of the trash. It returns
+// ErrMessageNotFound unless the message was trashed on its own.
+func (r *PostgresRepository) RestoreMessage(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE messages SET deleted_at = NULL
+              WHERE id = $1 AND deleted_at IS NOT NULL
+              AND chat_id IN (SELECT id FROM chats WHERE deleted_at IS NULL)`
+	tag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore message: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
 // GetMessagesByChatID retrieves all messages for a given chat_id
 func (r *PostgresRepository) GetMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error) {
-	query := `SELECT id, chat_id, user_id, role, content, created_at, is_edited
+	query := `SELECT id, chat_id, user_id, role, content, created_at, is_edited, status
               FROM messages
-              WHERE chat_id = $1
+              WHERE chat_id = $1 AND deleted_at IS NULL
               ORDER BY created_at ASC`
 	rows, err := r.db.Query(ctx, query, chatID)
 	if err != nil {
@@ -326,7 +786,8 @@ func (r *PostgresRepository) GetMessagesByChatID(ctx context.Context, chatID uui
 			&message.Role,
 			&message.Content,
 			&message.CreatedAt,
-			&message.IsEdited); err != nil {
+			&message.IsEdited,
+			&message.Status); err != nil {
 			return nil, fmt.Errorf("failed to scan message: %v", err)
 		}
 		messages = append(messages, message)
@@ -339,10 +800,11 @@ func (r *PostgresRepository) GetMessagesByChatID(ctx context.Context, chatID uui
 	return messages, nil
 }
 
+// GetMessageContentsByChatID returns the chat's complete messages for sending to the model
 func (r *PostgresRepository) GetMessageContentsByChatID(ctx context.Context, chatID uuid.UUID) ([]models.MessageContent, error) {
 	query := `SELECT role, content
               FROM messages
-              WHERE chat_id = $1
+              WHERE chat_id = $1 AND status = 'complete' AND deleted_at IS NULL
               ORDER BY created_at ASC`
 	rows, err := r.db.Query(ctx, query, chatID)
 	if err != nil {
@@ -366,8 +828,4 @@ func (r *PostgresRepository) GetMessageContentsByChatID(ctx context.Context, cha
 	return messages, nil
 }
 
-var _ repository.UserRepository = (*PostgresRepository)(nil)
-
-// Implement other repository methods (UserMetadata, Chat, Message, ChatAIModel, UserPreferences) similarly...
-
-// Ensure other interfaces are implemented...
+var _ repository.Repository = (*PostgresRepository)(nil)
@@ -0,0 +1,38 @@
+package db_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/repository/repositorytest"
+)
+
+// TestRepository migrates the database at TEST_DATABASE_URL to the latest
+// version and runs the repository contract against it. The database keeps
+// the rows the tests create, so point it at one that is only used for tests.
+func TestRepository(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	repo, err := db.Open(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	m, err := repo.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		return repo
+	})
+}
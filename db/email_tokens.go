@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	EmailTokenVerify    = "verify_email"
+	EmailTokenReset     = "password_reset"
+	EmailTokenMagicLink = "magic_link"
+)
+
+var ErrEmailTokenInvalid = errors.New("email token is unknown, expired or already used")
+
+// CreateEmailToken stores a new token, invalidating older unused tokens for the same purpose
+func (r *PostgresRepository) CreateEmailToken(ctx context.Context, token *models.EmailToken) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin email token transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE email_tokens SET used_at = NOW() WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`, token.UserID, token.Purpose)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate old email tokens: %v", err)
+	}
+
+	query := `INSERT INTO email_tokens (user_id, purpose, token_hash, expires_at)
+              VALUES ($1, $2, $3, $4)
+              RETURNING id, created_at`
+	err = tx.QueryRow(ctx, query, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create email token: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit email token: %v", err)
+	}
+	return nil
+}
+
+// ConsumeEmailToken marks an unexpired, unused token as used and returns its user.
+// Doing both in one statement means a token can only ever be consumed once.
+func (r *PostgresRepository) ConsumeEmailToken(ctx context.Context, tokenHash string, purpose string) (uuid.UUID, error) {
+	query := `UPDATE email_tokens
+              SET used_at = NOW()
+              WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+              RETURNING user_id`
+	var userID uuid.UUID
+	err := r.db.QueryRow(ctx, query, tokenHash, purpose).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return uuid.Nil, ErrEmailTokenInvalid
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to consume email token: %v", err)
+	}
+	return userID, nil
+}
+
+// DeleteExpiredEmailTokens removes tokens that can no longer be used
+func (r *PostgresRepository) DeleteExpiredEmailTokens(ctx context.Context) (int64, error) {
+	query := `DELETE FROM email_tokens WHERE expires_at < NOW() OR used_at IS NOT NULL`
+	tag, err := r.db.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired email tokens: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (r *PostgresRepository) MarkEmailVerified(ctx context.Context, userID uuid.UUID) error {
+	query := `UPDATE users SET email_verified_at = NOW() WHERE id = $1 AND email_verified_at IS NULL`
+	_, err := r.db.Exec(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark email verified: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) IsEmailVerified(ctx context.Context, userID uuid.UUID) (bool, error) {
+	query := `SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1`
+	var verified bool
+	err := r.db.QueryRow(ctx, query, userID).Scan(&verified)
+	if err != nil {
+		return false, fmt.Errorf("failed to check email verification: %v", err)
+	}
+	return verified, nil
+}
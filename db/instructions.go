@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// PersonalizationFields are the user_metadata fields a user can share with the assistant
+var PersonalizationFields = []string{"profession", "interests", "preferred_language", "education_level"}
+
+func ValidPersonalizationField(field string) bool {
+	for _, f := range PersonalizationFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCustomInstructions returns the user's custom instructions, empty if they never saved any
+func (r *PostgresRepository) GetCustomInstructions(ctx context.Context, userID uuid.UUID) (*models.CustomInstructions, error) {
+	query := `SELECT instructions, metadata_fields, updated_at FROM custom_instructions WHERE user_id = $1`
+	instructions := &models.CustomInstructions{UserID: userID}
+	err := r.db.QueryRow(ctx, query, userID).Scan(
+		&instructions.Instructions,
+		&instructions.MetadataFields,
+		&instructions.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		instructions.MetadataFields = []string{}
+		return instructions, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get custom instructions: %v", err)
+	}
+	return instructions, nil
+}
+
+func (r *PostgresRepository) SaveCustomInstructions(ctx context.Context, instructions *models.CustomInstructions) error {
+	query := `INSERT INTO custom_instructions (user_id, instructions, metadata_fields, updated_at)
+              VALUES ($1, $2, $3, NOW())
+              ON CONFLICT (user_id) DO UPDATE SET
+                  instructions = EXCLUDED.instructions,
+                  metadata_fields = EXCLUDED.metadata_fields,
+                  updated_at = NOW()
+              RETURNING updated_at`
+	err := r.db.QueryRow(ctx, query, instructions.UserID, instructions.Instructions, instructions.MetadataFields).
+		Scan(&instructions.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save custom instructions: %v", err)
+	}
+	return nil
+}
+
+// GetChatInstructions returns the chat's settings, the defaults if none were saved
+func (r *PostgresRepository) GetChatInstructions(ctx context.Context, chatID uuid.UUID) (*models.ChatInstructions, error) {
+	query := `SELECT instructions, personalization_disabled, updated_at FROM chat_instructions WHERE chat_id = $1`
+	instructions := &models.ChatInstructions{ChatID: chatID}
+	err := r.db.QueryRow(ctx, query, chatID).Scan(
+		&instructions.Instructions,
+		&instructions.PersonalizationDisabled,
+		&instructions.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return instructions, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat instructions: %v", err)
+	}
+	return instructions, nil
+}
+
+func (r *PostgresRepository) SaveChatInstructions(ctx context.Context, instructions *models.ChatInstructions) error {
+	query := `INSERT INTO chat_instructions (chat_id, instructions, personalization_disabled, updated_at)
+              VALUES ($1, $2, $3, NOW())
+              ON CONFLICT (chat_id) DO UPDATE SET
+                  instructions = EXCLUDED.instructions,
+                  personalization_disabled = EXCLUDED.personalization_disabled,
+                  updated_at = NOW()
+              RETURNING updated_at`
+	err := r.db.QueryRow(ctx, query, instructions.ChatID, instructions.Instructions, instructions.PersonalizationDisabled).
+		Scan(&instructions.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save chat instructions: %v", err)
+	}
+	return nil
+}
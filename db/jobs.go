@@ -0,0 +1,302 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+)
+
+// StaleJobItemError is the error left on items a worker stopped running without finishing
+const StaleJobItemError = "worker stopped before the item finished"
+
+const jobColumns = `j.id, j.user_id, j.pattern, j.variables, j.ai_model_version, j.status, j.created_at, j.finished_at,
+              (SELECT COUNT(*) FROM job_items i WHERE i.job_id = j.id),
+              (SELECT COUNT(*) FROM job_items i WHERE i.job_id = j.id AND i.status = 'completed'),
+              (SELECT COUNT(*) FROM job_items i WHERE i.job_id = j.id AND i.status = 'failed')`
+
+func scanJob(row pgx.Row) (*models.Job, error) {
+	job := &models.Job{}
+	var aiModelVersion *string
+	err := row.Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Pattern,
+		&job.Variables,
+		&aiModelVersion,
+		&job.Status,
+		&job.CreatedAt,
+		&job.FinishedAt,
+		&job.TotalItems,
+		&job.CompletedItems,
+		&job.FailedItems)
+	if aiModelVersion != nil {
+		job.AIModelVersion = *aiModelVersion
+	}
+	return job, err
+}
+
+// CreateJob inserts a job and one queued item per input in a single transaction
+func (r *PostgresRepository) CreateJob(ctx context.Context, job *models.Job, inputs []string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin job transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO jobs (user_id, pattern, variables, ai_model_version, status)
+              VALUES ($1, $2, $3, $4, $5)
+              RETURNING id, created_at`
+	job.Status = JobStatusQueued
+	err = tx.QueryRow(ctx, query,
+		job.UserID,
+		job.Pattern,
+		job.Variables,
+		job.AIModelVersion,
+		job.Status).Scan(&job.ID, &job.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+
+	rows := make([][]interface{}, len(inputs))
+	for i, input := range inputs {
+		rows[i] = []interface{}{job.ID, i, input}
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"job_items"}, []string{"job_id", "position", "input"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to create job items: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit job: %v", err)
+	}
+	job.TotalItems = len(inputs)
+	return nil
+}
+
+// GetJobByID retrieves a job along with its item counts
+func (r *PostgresRepository) GetJobByID(ctx context.Context, id uuid.UUID) (*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+              FROM jobs j
+              WHERE j.id = $1`
+	job, err := scanJob(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job by ID: %v", err)
+	}
+	return job, nil
+}
+
+// GetJobsByUserID retrieves a user's jobs, newest first
+func (r *PostgresRepository) GetJobsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+              FROM jobs j
+              WHERE j.user_id = $1
+              ORDER BY j.created_at DESC`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jobs by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over jobs: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// GetJobItems retrieves a page of a job's items in input order
+func (r *PostgresRepository) GetJobItems(ctx context.Context, jobID uuid.UUID, offset, limit int) ([]*models.JobItem, error) {
+	query := `SELECT id, job_id, position, input, COALESCE(output, ''), COALESCE(error, ''), status, attempts, updated_at
+              FROM job_items
+              WHERE job_id = $1
+              ORDER BY position ASC
+              OFFSET $2 LIMIT $3`
+	rows, err := r.db.Query(ctx, query, jobID, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []*models.JobItem
+	for rows.Next() {
+		item := &models.JobItem{}
+		if err := rows.Scan(
+			&item.ID,
+			&item.JobID,
+			&item.Position,
+			&item.Input,
+			&item.Output,
+			&item.Error,
+			&item.Status,
+			&item.Attempts,
+			&item.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan job item: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over job items: %v", err)
+	}
+
+	return items, nil
+}
+
+// ClaimJobItems marks up to limit runnable items as running and returns them.
+// SKIP LOCKED lets several workers, in one process or many, poll the same table
+// without handing out an item twice.
+func (r *PostgresRepository) ClaimJobItems(ctx context.Context, limit int) ([]*models.JobItem, error) {
+	query := `WITH claimed AS (
+                  SELECT id FROM job_items
+                  WHERE status = 'queued' AND run_after <= NOW()
+                  ORDER BY pk
+                  LIMIT $1
+                  FOR UPDATE SKIP LOCKED
+              )
+              UPDATE job_items i
+              SET status = 'running', attempts = i.attempts + 1, updated_at = NOW()
+              FROM claimed
+              WHERE i.id = claimed.id
+              RETURNING i.id, i.job_id, i.position, i.input, i.status, i.attempts, i.updated_at`
+	rows, err := r.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim job items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []*models.JobItem
+	for rows.Next() {
+		item := &models.JobItem{}
+		if err := rows.Scan(
+			&item.ID,
+			&item.JobID,
+			&item.Position,
+			&item.Input,
+			&item.Status,
+			&item.Attempts,
+			&item.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan claimed job item: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over claimed job items: %v", err)
+	}
+
+	if len(items) > 0 {
+		query = `UPDATE jobs SET status = 'running'
+                 WHERE status = 'queued' AND id IN (SELECT job_id FROM job_items WHERE status = 'running')`
+		if _, err := r.db.Exec(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to mark jobs running: %v", err)
+		}
+	}
+
+	return items, nil
+}
+
+// CompleteJobItem stores the output of a finished item
+func (r *PostgresRepository) CompleteJobItem(ctx context.Context, item *models.JobItem) error {
+	query := `UPDATE job_items
+              SET status = 'completed', output = $1, error = NULL, updated_at = NOW()
+              WHERE id = $2`
+	_, err := r.db.Exec(ctx, query, item.Output, item.ID)
+	if err != nil {
+		return fmt.Errorf("failed to complete job item: %v", err)
+	}
+	return r.finishJobIfDone(ctx, item.JobID)
+}
+
+// FailJobItem records an error and requeues the item at retryAt, or fails it for good when retryAt is nil
+func (r *PostgresRepository) FailJobItem(ctx context.Context, item *models.JobItem, retryAt *time.Time) error {
+	status := JobStatusFailed
+	if retryAt != nil {
+		status = JobStatusQueued
+	}
+	query := `UPDATE job_items
+              SET status = $1, error = $2, run_after = COALESCE($3, run_after), updated_at = NOW()
+              WHERE id = $4`
+	_, err := r.db.Exec(ctx, query, status, item.Error, retryAt, item.ID)
+	if err != nil {
+		return fmt.Errorf("failed to fail job item: %v", err)
+	}
+	return r.finishJobIfDone(ctx, item.JobID)
+}
+
+// RequeueStaleJobItems puts back items left running by a worker that went
+// away. The stale run counted as an attempt when it was claimed, so items that
+// have used maxAttempts are failed instead of looping forever.
+func (r *PostgresRepository) RequeueStaleJobItems(ctx context.Context, olderThan time.Duration, maxAttempts int) (int64, error) {
+	query := `UPDATE job_items
+              SET status = CASE WHEN attempts >= $2 THEN 'failed' ELSE 'queued' END,
+                  error = $3, updated_at = NOW()
+              WHERE status = 'running' AND updated_at < $1
+              RETURNING job_id, status`
+	rows, err := r.db.Query(ctx, query, time.Now().Add(-olderThan), maxAttempts, StaleJobItemError)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stale job items: %v", err)
+	}
+	defer rows.Close()
+
+	var requeued int64
+	failedJobs := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var jobID uuid.UUID
+		var status string
+		if err := rows.Scan(&jobID, &status); err != nil {
+			return 0, fmt.Errorf("failed to scan stale job item: %v", err)
+		}
+		requeued++
+		if status == JobStatusFailed {
+			failedJobs[jobID] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating over stale job items: %v", err)
+	}
+
+	for jobID := range failedJobs {
+		if err := r.finishJobIfDone(ctx, jobID); err != nil {
+			return requeued, err
+		}
+	}
+	return requeued, nil
+}
+
+// finishJobIfDone closes out a job once none of its items are left to run
+func (r *PostgresRepository) finishJobIfDone(ctx context.Context, jobID uuid.UUID) error {
+	query := `UPDATE jobs
+              SET status = CASE
+                      WHEN EXISTS (SELECT 1 FROM job_items WHERE job_id = $1 AND status = 'failed') THEN 'failed'
+                      ELSE 'completed'
+                  END,
+                  finished_at = NOW()
+              WHERE id = $1
+                AND finished_at IS NULL
+                AND NOT EXISTS (SELECT 1 FROM job_items WHERE job_id = $1 AND status IN ('queued', 'running'))`
+	_, err := r.db.Exec(ctx, query, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to finish job: %v", err)
+	}
+	return nil
+}
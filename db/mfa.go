@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrTOTPNotEnrolled    = errors.New("totp is not set up for this user")
+	ErrTOTPAlreadyEnabled = errors.New("totp is already enabled for this user")
+)
+
+// CreatePendingTOTP stores a new secret awaiting confirmation, replacing any
+// earlier unconfirmed one. An enabled secret is never overwritten.
+func (r *PostgresRepository) CreatePendingTOTP(ctx context.Context, userID uuid.UUID, secret string) error {
+	query := `INSERT INTO user_totp (user_id, secret)
+              VALUES ($1, $2)
+              ON CONFLICT (user_id) DO UPDATE
+              SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+              WHERE user_totp.enabled_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, userID, secret)
+	if err != nil {
+		return fmt.Errorf("failed to create totp secret: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*models.UserTOTP, error) {
+	query := `SELECT user_id, secret, created_at, enabled_at, last_used_step FROM user_totp WHERE user_id = $1`
+	totp := &models.UserTOTP{}
+	err := r.db.QueryRow(ctx, query, userID).Scan(&totp.UserID, &totp.Secret, &totp.CreatedAt, &totp.EnabledAt, &totp.LastUsedStep)
+	if err == pgx.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get totp: %v", err)
+	}
+	return totp, nil
+}
+
+// IsMFAEnabled reports whether login needs a second factor for the user
+func (r *PostgresRepository) IsMFAEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	methods, err := r.GetMFAMethods(ctx, userID)
+	return len(methods) > 0, err
+}
+
+// GetMFAMethods lists the second factors the user can log in with: "totp" and "webauthn"
+func (r *PostgresRepository) GetMFAMethods(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL),
+                     EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)`
+	var totp, webauthn bool
+	if err := r.db.QueryRow(ctx, query, userID).Scan(&totp, &webauthn); err != nil {
+		return nil, fmt.Errorf("failed to check mfa: %v", err)
+	}
+	methods := []string{}
+	if totp {
+		methods = append(methods, "totp")
+	}
+	if webauthn {
+		methods = append(methods, "webauthn")
+	}
+	return methods, nil
+}
+
+// UseTOTPStep records step as used. It returns false when that step or a later
+// one was already used, so each code works once even across concurrent requests.
+func (r *PostgresRepository) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	query := `UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`
+	tag, err := r.db.Exec(ctx, query, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to record totp step: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// EnableTOTP confirms the pending secret and replaces the user's recovery codes
+func (r *PostgresRepository) EnableTOTP(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin totp transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE user_totp SET enabled_at = NOW(), last_used_step = $2 WHERE user_id = $1 AND enabled_at IS NULL`
+	tag, err := tx.Exec(ctx, query, userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to enable totp: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit totp: %v", err)
+	}
+	return nil
+}
+
+// DisableTOTP removes the secret and recovery codes
+func (r *PostgresRepository) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin totp transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete totp: %v", err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit totp removal: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin recovery code transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit recovery codes: %v", err)
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID uuid.UUID, codeHashes []string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %v", err)
+	}
+	rows := make([][]interface{}, len(codeHashes))
+	for i, hash := range codeHashes {
+		rows[i] = []interface{}{userID, hash}
+	}
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{"mfa_recovery_codes"}, []string{"user_id", "code_hash"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to create recovery codes: %v", err)
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used, returning false if there was none
+func (r *PostgresRepository) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	query := `UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *PostgresRepository) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	query := `SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL`
+	var count int
+	if err := r.db.QueryRow(ctx, query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %v", err)
+	}
+	return count, nil
+}
+
+// UseMFAChallenge records that the MFA challenge token jti completed a login.
+// It returns false when the token was already used, so a captured token cannot
+// be replayed for another login.
+func (r *PostgresRepository) UseMFAChallenge(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	query := `INSERT INTO used_mfa_challenges (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`
+	tag, err := r.db.Exec(ctx, query, jti, expiresAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to use mfa challenge: %v", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *PostgresRepository) DeleteExpiredMFAChallenges(ctx context.Context) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM used_mfa_challenges WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired mfa challenges: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
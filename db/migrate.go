@@ -0,0 +1,288 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so instances
+// starting together apply each migration once
+const migrationLockKey = 4120260046
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, nil if it is pending
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrator applies the migrations embedded in db/migrations
+type Migrator struct {
+	db         *pgxpool.Pool
+	migrations []Migration
+}
+
+// Migrator reads the embedded migrations. Every version needs both an up and a down file.
+func (r *PostgresRepository) Migrator() (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: r.pool, migrations: migrations}, nil
+}
+
+// LoadMigrations reads <version>_<name>.<up|down>.sql pairs from the migrations
+// directory of files, ordered by version
+func LoadMigrations(files fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.<up|down>.sql", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s has an invalid version", entry.Name())
+		}
+		data, err := fs.ReadFile(files, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", entry.Name(), err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest is the highest embedded version
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the last steps applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; !ok {
+				continue
+			}
+			if err := m.revert(ctx, conn, m.migrations[i]); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// To applies or reverts migrations until version is the last one applied
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("no migration has version %d", version)
+	}
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err := m.revert(ctx, conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.apply(ctx, conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status lists every embedded migration with when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+func (m *Migrator) known(version int64) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// withLock runs fn on one connection holding the migration lock, after making
+// sure schema_migrations exists and baselining databases created from tables.sql
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+                  version BIGINT PRIMARY KEY,
+                  name TEXT NOT NULL,
+                  applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+              )`
+	if _, err := conn.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	if err := m.baseline(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// baseline records the first migration as applied when the database already
+// has its tables but no migration history, which is how tables.sql left it.
+// The migrations after it then add whatever that tables.sql was missing.
+func (m *Migrator) baseline(ctx context.Context, conn *pgxpool.Conn) error {
+	if len(m.migrations) == 0 {
+		return nil
+	}
+	query := `INSERT INTO schema_migrations (version, name)
+              SELECT $1, $2
+              WHERE NOT EXISTS (SELECT 1 FROM schema_migrations) AND to_regclass('users') IS NOT NULL`
+	if _, err := conn.Exec(ctx, query, m.migrations[0].Version, m.migrations[0].Name); err != nil {
+		return fmt.Errorf("failed to baseline schema_migrations: %v", err)
+	}
+	return nil
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating applied migrations: %v", err)
+	}
+	return applied, nil
+}
+
+// apply runs the up migration and records it in one transaction
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration Migration) error {
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, migration.Up); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+// revert runs the down migration and removes its record in one transaction
+func (m *Migrator) revert(ctx context.Context, conn *pgxpool.Conn, migration Migration) error {
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, migration.Down); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revert migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	files := fstest.MapFS{
+		"migrations/0010_widgets.up.sql":   {Data: []byte("CREATE TABLE widgets (id INT)")},
+		"migrations/0010_widgets.down.sql": {Data: []byte("DROP TABLE widgets")},
+		"migrations/0002_users.up.sql":     {Data: []byte("CREATE TABLE users (id INT)")},
+		"migrations/0002_users.down.sql":   {Data: []byte("DROP TABLE users")},
+	}
+	migrations, err := LoadMigrations(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 2 || migrations[1].Version != 10 {
+		t.Fatalf("migrations = %+v, want versions 2 and 10 in order", migrations)
+	}
+	if m := migrations[1]; m.Name != "widgets" || m.Up != "CREATE TABLE widgets (id INT)" || m.Down != "DROP TABLE widgets" {
+		t.Fatalf("migration 10 = %+v", m)
+	}
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+	up := &fstest.MapFile{Data: []byte("SELECT 1")}
+	for _, tt := range []struct {
+		name  string
+		files fstest.MapFS
+		want  string
+	}{
+		{"no directory", fstest.MapFS{"other/0001_a.up.sql": up}, "failed to read migrations"},
+		{"bad name", fstest.MapFS{"migrations/add_users.sql": up}, "is not named"},
+		{"version zero", fstest.MapFS{"migrations/0000_a.up.sql": up, "migrations/0000_a.down.sql": up}, "invalid version"},
+		{"missing down", fstest.MapFS{"migrations/0001_a.up.sql": up}, "needs both an up and a down file"},
+		{"empty up", fstest.MapFS{"migrations/0001_a.up.sql": {}, "migrations/0001_a.down.sql": up}, "needs both an up and a down file"},
+		{"two names", fstest.MapFS{"migrations/0001_a.up.sql": up, "migrations/0001_b.down.sql": up}, "is named both"},
+	} {
+		if _, err := LoadMigrations(tt.files); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: LoadMigrations returned %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != int64(i+1) {
+			t.Fatalf("migration %d_%s follows version %d; versions must not skip", migration.Version, migration.Name, i)
+		}
+	}
+	if migrations[0].Name != "baseline" {
+		t.Fatalf("the first migration is %s, want baseline", migrations[0].Name)
+	}
+}
+
+// testMigrations create two tables, and the third fails after creating one
+var testMigrations = []Migration{
+	{Version: 1, Name: "users", Up: `CREATE TABLE users (id INT)`, Down: `DROP TABLE users`},
+	{Version: 2, Name: "widgets", Up: `CREATE TABLE widgets (id INT)`, Down: `DROP TABLE widgets`},
+	{Version: 3, Name: "broken", Up: `CREATE TABLE gadgets (id INT); SELECT * FROM missing_table`, Down: `DROP TABLE gadgets`},
+}
+
+// newTestMigrator returns a migrator of migrations that works in a schema of
+// its own in the database at TEST_DATABASE_URL, and the pool it uses
+func newTestMigrator(t *testing.T, migrations []Migration) (*Migrator, *pgxpool.Pool) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	admin, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(admin.Close)
+	schema := "migrate_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec(ctx, `CREATE SCHEMA `+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`) })
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return &Migrator{db: pool, migrations: migrations}, pool
+}
+
+func tableExists(t *testing.T, pool *pgxpool.Pool, table string) bool {
+	t.Helper()
+	var exists bool
+	if err := pool.QueryRow(context.Background(), `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+// expectApplied fails unless schema_migrations records exactly versions
+func expectApplied(t *testing.T, m *Migrator, versions ...int64) {
+	t.Helper()
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []int64
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			applied = append(applied, status.Version)
+		}
+	}
+	if len(applied) != len(versions) {
+		t.Fatalf("applied versions = %v, want %v", applied, versions)
+	}
+	for i := range versions {
+		if applied[i] != versions[i] {
+			t.Fatalf("applied versions = %v, want %v", applied, versions)
+		}
+	}
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	m, pool := newTestMigrator(t, testMigrations[:2])
+	ctx := context.Background()
+	expectApplied(t, m)
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1, 2)
+	if !tableExists(t, pool, "users") || !tableExists(t, pool, "widgets") {
+		t.Fatal("Up did not create the tables")
+	}
+	// Applying again has nothing to do
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Down reverts the newest first
+	if err := m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1)
+	if !tableExists(t, pool, "users") || tableExists(t, pool, "widgets") {
+		t.Fatal("Down 1 did not revert only the last migration")
+	}
+
+	if err := m.To(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1, 2)
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m)
+	if tableExists(t, pool, "users") || tableExists(t, pool, "widgets") {
+		t.Fatal("migrating to 0 left tables behind")
+	}
+	if err := m.To(ctx, 7); err == nil {
+		t.Fatal("To accepted a version with no migration")
+	}
+}
+
+func TestMigratorBaselinesExistingSchema(t *testing.T) {
+	m, pool := newTestMigrator(t, testMigrations[:2])
+	ctx := context.Background()
+	// A database created from tables.sql has users but no history
+	if _, err := pool.Exec(ctx, `CREATE TABLE users (id INT)`); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1)
+
+	// Running the baseline again would fail on the existing users table
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1, 2)
+}
+
+func TestMigratorRollsBackFailedMigration(t *testing.T) {
+	m, pool := newTestMigrator(t, testMigrations)
+	ctx := context.Background()
+	err := m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "3_broken") {
+		t.Fatalf("Up returned %v, want the broken migration's error", err)
+	}
+	// Each migration commits on its own, so the ones before it stay applied
+	expectApplied(t, m, 1, 2)
+	if tableExists(t, pool, "gadgets") {
+		t.Fatal("the failed migration left its table behind")
+	}
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS user_preferences CASCADE;
+DROP TABLE IF EXISTS chat_ai_models CASCADE;
+DROP TABLE IF EXISTS ai_models CASCADE;
+DROP TABLE IF EXISTS messages CASCADE;
+DROP TABLE IF EXISTS chats CASCADE;
+DROP TABLE IF EXISTS user_metadata CASCADE;
+DROP TABLE IF EXISTS users CASCADE;
@@ -1,10 +1,6 @@
-DROP TABLE IF EXISTS users CASCADE;
-DROP TABLE IF EXISTS user_metadata CASCADE;
-DROP TABLE IF EXISTS chats CASCADE;
-DROP TABLE IF EXISTS messages CASCADE;
-DROP TABLE IF EXISTS ai_models CASCADE;
-DROP TABLE IF EXISTS chat_ai_models CASCADE;
-DROP TABLE IF EXISTS user_preferences CASCADE;
+-- The schema as it was in tables.sql before migrations. Databases created
+-- from tables.sql are recorded as being at this version without running it,
+-- and the migrations after it bring them up to date.
 
 -- Enable the uuid-ossp extension if not already enabled
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
@@ -93,4 +89,4 @@ CREATE TABLE user_preferences (
 );
 
 -- Add foreign key constraint for chats in users table
-ALTER TABLE users ADD COLUMN last_chat_id UUID REFERENCES chats(id);
\ No newline at end of file
+ALTER TABLE users ADD COLUMN last_chat_id UUID REFERENCES chats(id);
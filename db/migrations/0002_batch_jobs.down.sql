@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS job_items CASCADE;
+DROP TABLE IF EXISTS jobs CASCADE;
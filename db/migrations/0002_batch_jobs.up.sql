@@ -0,0 +1,32 @@
+-- Batch jobs, one job_items row per input claimed by workers with SKIP LOCKED.
+-- IF NOT EXISTS lets databases created from a later tables.sql catch up too.
+CREATE TABLE IF NOT EXISTS jobs (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id),
+    pattern VARCHAR(100) NOT NULL,
+    variables JSONB,
+    ai_model_version VARCHAR(20),
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_user_id ON jobs(user_id);
+
+CREATE TABLE IF NOT EXISTS job_items (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    input TEXT NOT NULL,
+    output TEXT,
+    error TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    run_after TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_items_job_id ON job_items(job_id, position);
+CREATE INDEX IF NOT EXISTS idx_job_items_queue ON job_items(status, run_after);
@@ -0,0 +1,35 @@
+-- Scheduled recurring prompts, evaluated in the owner's timezone, and one
+-- schedule_runs row per run
+CREATE TABLE IF NOT EXISTS schedules (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id),
+    name VARCHAR(100) NOT NULL,
+    cron_expression VARCHAR(100) NOT NULL,
+    pattern VARCHAR(100),
+    prompt TEXT NOT NULL,
+    variables JSONB,
+    ai_model_version VARCHAR(20),
+    chat_id UUID REFERENCES chats(id) ON DELETE SET NULL,
+    append_to_chat BOOLEAN DEFAULT FALSE,
+    is_active BOOLEAN DEFAULT TRUE,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    last_run_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedules_user_id ON schedules(user_id);
+CREATE INDEX IF NOT EXISTS idx_schedules_next_run_at ON schedules(next_run_at) WHERE is_active;
+
+CREATE TABLE IF NOT EXISTS schedule_runs (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    schedule_id UUID REFERENCES schedules(id) ON DELETE CASCADE,
+    chat_id UUID REFERENCES chats(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    started_at TIMESTAMPTZ DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedule_runs_schedule_id ON schedule_runs(schedule_id, started_at);
@@ -0,0 +1,19 @@
+-- Sessions, one row per login. A refresh token family is the session it was
+-- issued for; families from before sessions existed are signed out.
+CREATE TABLE IF NOT EXISTS sessions (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT,
+    ip_address VARCHAR(45),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+DELETE FROM refresh_tokens WHERE family_id NOT IN (SELECT id FROM sessions);
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS refresh_tokens_family_id_fkey;
+ALTER TABLE refresh_tokens ADD CONSTRAINT refresh_tokens_family_id_fkey
+    FOREIGN KEY (family_id) REFERENCES sessions(id) ON DELETE CASCADE;
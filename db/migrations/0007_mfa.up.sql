@@ -0,0 +1,20 @@
+-- TOTP second factor; enabled_at stays NULL until the user confirms a first code
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    enabled_at TIMESTAMPTZ,
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+-- Single-use recovery codes, stored hashed
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id);
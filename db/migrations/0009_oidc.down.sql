@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS oidc_login_states CASCADE;
+DROP TABLE IF EXISTS user_identities CASCADE;
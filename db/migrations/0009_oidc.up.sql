@@ -0,0 +1,25 @@
+-- Accounts at external OpenID Connect providers linked to a user
+CREATE TABLE IF NOT EXISTS user_identities (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    groups TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_login_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+
+-- State, nonce and PKCE verifier of logins waiting on the identity provider
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,27 @@
+-- Passkeys; public_key is the COSE key from the authenticator
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    aaguid BYTEA,
+    attestation_format VARCHAR(32) NOT NULL,
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- Challenges of WebAuthn ceremonies in progress; each can be answered once
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    challenge VARCHAR(64) PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
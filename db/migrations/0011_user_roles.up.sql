@@ -0,0 +1,3 @@
+-- Every existing user starts as a plain user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'admin'));
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS security_events CASCADE;
+DROP TABLE IF EXISTS auth_throttles CASCADE;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS jwt_signing_keys CASCADE;
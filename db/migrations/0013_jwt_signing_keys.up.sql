@@ -0,0 +1,10 @@
+-- Keys that sign JWTs. A key is published in the JWKS from creation, signs
+-- from activates_at until a newer key activates, and verifies until expires_at.
+CREATE TABLE IF NOT EXISTS jwt_signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL,
+    private_key BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    activates_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,9 @@
+-- Shared chats go with their workspaces
+DELETE FROM chats WHERE workspace_id IS NOT NULL;
+DROP TABLE IF EXISTS workspace_models CASCADE;
+DROP TABLE IF EXISTS workspace_patterns CASCADE;
+DROP INDEX IF EXISTS idx_chats_workspace_id;
+ALTER TABLE chats DROP COLUMN IF EXISTS workspace_id;
+DROP TABLE IF EXISTS workspaces CASCADE;
+DROP TABLE IF EXISTS organization_members CASCADE;
+DROP TABLE IF EXISTS organizations CASCADE;
@@ -0,0 +1,51 @@
+-- Organizations group users; every member can use the organization's workspaces
+CREATE TABLE IF NOT EXISTS organizations (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Owners manage everything, admins manage members and workspaces, members use them
+CREATE TABLE IF NOT EXISTS organization_members (
+    organization_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_members_user_id ON organization_members(user_id);
+
+-- Team workspaces hold shared chats, patterns and a model allowlist
+CREATE TABLE IF NOT EXISTS workspaces (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (organization_id, name)
+);
+
+-- Chats without a workspace are personal to their user
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS workspace_id UUID REFERENCES workspaces(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS idx_chats_workspace_id ON chats(workspace_id, last_updated DESC);
+
+CREATE TABLE IF NOT EXISTS workspace_patterns (
+    workspace_id UUID REFERENCES workspaces(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    system_prompt TEXT NOT NULL,
+    user_prompt TEXT NOT NULL DEFAULT '',
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (workspace_id, name)
+);
+
+-- Models a workspace may use; a workspace without rows may use every active model
+CREATE TABLE IF NOT EXISTS workspace_models (
+    workspace_id UUID REFERENCES workspaces(id) ON DELETE CASCADE,
+    ai_model_id UUID REFERENCES ai_models(id) ON DELETE CASCADE,
+    PRIMARY KEY (workspace_id, ai_model_id)
+);
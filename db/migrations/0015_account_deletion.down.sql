@@ -0,0 +1,29 @@
+DROP TABLE IF EXISTS data_exports CASCADE;
+
+ALTER TABLE user_metadata DROP CONSTRAINT IF EXISTS user_metadata_user_id_fkey;
+ALTER TABLE user_metadata ADD CONSTRAINT user_metadata_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE NO ACTION;
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_user_id_fkey;
+ALTER TABLE chats ADD CONSTRAINT chats_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE NO ACTION;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_user_id_fkey;
+ALTER TABLE messages ADD CONSTRAINT messages_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE NO ACTION;
+ALTER TABLE chat_ai_models DROP CONSTRAINT IF EXISTS chat_ai_models_chat_id_fkey;
+ALTER TABLE chat_ai_models ADD CONSTRAINT chat_ai_models_chat_id_fkey
+    FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE NO ACTION;
+ALTER TABLE user_preferences DROP CONSTRAINT IF EXISTS user_preferences_user_id_fkey;
+ALTER TABLE user_preferences ADD CONSTRAINT user_preferences_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE NO ACTION;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_last_chat_id_fkey;
+ALTER TABLE users ADD CONSTRAINT users_last_chat_id_fkey
+    FOREIGN KEY (last_chat_id) REFERENCES chats(id) ON DELETE NO ACTION;
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS jobs_user_id_fkey;
+ALTER TABLE jobs ADD CONSTRAINT jobs_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE NO ACTION;
+ALTER TABLE schedules DROP CONSTRAINT IF EXISTS schedules_user_id_fkey;
+ALTER TABLE schedules ADD CONSTRAINT schedules_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE NO ACTION;
+
+DROP INDEX IF EXISTS idx_users_deletion_scheduled_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deletion_scheduled_at;
@@ -0,0 +1,48 @@
+-- Accounts scheduled for deletion are purged once deletion_scheduled_at
+-- passes. Deleting a user deletes what is theirs and keeps shared chats and
+-- messages without one.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
+
+ALTER TABLE user_metadata DROP CONSTRAINT IF EXISTS user_metadata_user_id_fkey;
+ALTER TABLE user_metadata ADD CONSTRAINT user_metadata_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_user_id_fkey;
+ALTER TABLE chats ADD CONSTRAINT chats_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_user_id_fkey;
+ALTER TABLE messages ADD CONSTRAINT messages_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE chat_ai_models DROP CONSTRAINT IF EXISTS chat_ai_models_chat_id_fkey;
+ALTER TABLE chat_ai_models ADD CONSTRAINT chat_ai_models_chat_id_fkey
+    FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE;
+ALTER TABLE user_preferences DROP CONSTRAINT IF EXISTS user_preferences_user_id_fkey;
+ALTER TABLE user_preferences ADD CONSTRAINT user_preferences_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_last_chat_id_fkey;
+ALTER TABLE users ADD CONSTRAINT users_last_chat_id_fkey
+    FOREIGN KEY (last_chat_id) REFERENCES chats(id) ON DELETE SET NULL;
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS jobs_user_id_fkey;
+ALTER TABLE jobs ADD CONSTRAINT jobs_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE schedules DROP CONSTRAINT IF EXISTS schedules_user_id_fkey;
+ALTER TABLE schedules ADD CONSTRAINT schedules_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+-- Requested exports of everything stored about a user; archive is the zip once built
+CREATE TABLE IF NOT EXISTS data_exports (
+    pk SERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    error TEXT,
+    archive BYTEA,
+    size BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_data_exports_queue ON data_exports(status, created_at);
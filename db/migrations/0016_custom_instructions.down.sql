@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS chat_instructions CASCADE;
+DROP TABLE IF EXISTS custom_instructions CASCADE;
@@ -0,0 +1,16 @@
+-- How the assistant should respond to a user, and which user_metadata fields
+-- they agreed to share with it
+CREATE TABLE IF NOT EXISTS custom_instructions (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    instructions TEXT NOT NULL DEFAULT '',
+    metadata_fields TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Per chat settings; instructions replace the user's own when set
+CREATE TABLE IF NOT EXISTS chat_instructions (
+    chat_id UUID PRIMARY KEY REFERENCES chats(id) ON DELETE CASCADE,
+    instructions TEXT,
+    personalization_disabled BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_messages_pending;
+ALTER TABLE messages DROP COLUMN IF EXISTS status;
@@ -0,0 +1,8 @@
+-- Deleting a chat or message moves it to the trash by setting deleted_at; a
+-- chat's messages are trashed with it at the same time. Trashed rows are
+-- purged once they are older than TRASH_RETENTION.
+ALTER TABLE chats ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX idx_chats_deleted_at ON chats(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_messages_deleted_at ON messages(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,7 @@
+-- MFA challenge tokens that completed a login, by jti, so each one works once.
+-- Rows are swept once the token has expired anyway.
+CREATE TABLE IF NOT EXISTS used_mfa_challenges (
+    jti VARCHAR(64) PRIMARY KEY,
+    used_at TIMESTAMPTZ DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,11 @@
+-- Policy per role, managed by admins. Users whose role requires MFA can only
+-- enroll a second factor until they have one; admin starts out required, as
+-- MFA_REQUIRED_ROLES defaulted to before.
+CREATE TABLE IF NOT EXISTS role_settings (
+    role VARCHAR(20) PRIMARY KEY CHECK (role IN ('user', 'admin')),
+    mfa_required BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO role_settings (role, mfa_required) VALUES ('user', FALSE), ('admin', TRUE)
+ON CONFLICT (role) DO NOTHING;
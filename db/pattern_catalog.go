@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSystemPatternFile = "system.md"
+	defaultUserPatternFile   = "user.md"
+	maxDescriptionLength     = 200
+)
+
+var (
+	validPatternName   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,99}$`)
+	ErrInvalidPattern  = errors.New("pattern names are lowercase letters, digits, _ and -, and the system prompt is required")
+	ErrPatternNotFound = errors.New("pattern not found")
+)
+
+// ValidPatternName reports whether name can be used for a pattern
+func ValidPatternName(name string) bool {
+	return validPatternName.MatchString(name)
+}
+
+// PatternCatalog keeps an indexed, in-memory copy of every pattern under Dir.
+// The index is rebuilt off to the side and swapped in atomically, so readers
+// never see a partially loaded catalog.
+type PatternCatalog struct {
+	Dir               string
+	SystemPatternFile string
+	UserPatternFile   string
+
+	current atomic.Pointer[patternIndex]
+}
+
+type patternIndex struct {
+	patterns    map[string]*Pattern
+	names       []string
+	etag        string
+	fingerprint string
+	loadedAt    time.Time
+}
+
+// NewPatternCatalog builds the catalog from the storage directory
+func NewPatternCatalog(storage *Storage) (*PatternCatalog, error) {
+	catalog := &PatternCatalog{
+		Dir:               storage.Dir,
+		SystemPatternFile: defaultSystemPatternFile,
+		UserPatternFile:   defaultUserPatternFile,
+	}
+	if _, err := catalog.Reload(); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Names returns the sorted pattern names
+func (o *PatternCatalog) Names() []string {
+	return o.current.Load().names
+}
+
+// ETag identifies the current catalog contents
+func (o *PatternCatalog) ETag() string {
+	return o.current.Load().etag
+}
+
+// LoadedAt is when the current catalog was built
+func (o *PatternCatalog) LoadedAt() time.Time {
+	return o.current.Load().loadedAt
+}
+
+// Get returns the cached pattern with the given name
+func (o *PatternCatalog) Get(name string) (*Pattern, bool) {
+	pattern, ok := o.current.Load().patterns[name]
+	return pattern, ok
+}
+
+// GetPattern finds a pattern by name and applies the variables to a copy of it
+func (o *PatternCatalog) GetPattern(name string, variables map[string]string) (ret *Pattern, err error) {
+	cached, ok := o.Get(name)
+	if !ok {
+		err = fmt.Errorf("pattern %s not found", name)
+		return
+	}
+
+	ret = cached.WithVariables(variables)
+	return
+}
+
+// WithVariables returns a copy of the pattern with the variables applied
+func (o Pattern) WithVariables(variables map[string]string) *Pattern {
+	for variableName, value := range variables {
+		o.Pattern = strings.ReplaceAll(o.Pattern, variableName, value)
+		o.User = strings.ReplaceAll(o.User, variableName, value)
+	}
+	return &o
+}
+
+// Reload rebuilds the catalog if anything under Dir changed since the last load
+func (o *PatternCatalog) Reload() (changed bool, err error) {
+	var fingerprint string
+	if fingerprint, err = o.fingerprint(); err != nil {
+		return
+	}
+
+	if current := o.current.Load(); current != nil && current.fingerprint == fingerprint {
+		return
+	}
+
+	var index *patternIndex
+	if index, err = o.load(); err != nil {
+		return
+	}
+	index.fingerprint = fingerprint
+	o.current.Store(index)
+	changed = true
+	return
+}
+
+// SavePattern creates or replaces a pattern on disk and reloads the catalog.
+// An empty user prompt removes the pattern's user.md.
+func (o *PatternCatalog) SavePattern(name string, system string, user string) error {
+	if !validPatternName.MatchString(name) || strings.TrimSpace(system) == "" {
+		return ErrInvalidPattern
+	}
+	dir := filepath.Join(o.Dir, name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("could not create pattern %s: %v", name, err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, o.SystemPatternFile), []byte(system)); err != nil {
+		return fmt.Errorf("could not save pattern %s: %v", name, err)
+	}
+	userPath := filepath.Join(dir, o.UserPatternFile)
+	if user == "" {
+		if err := os.Remove(userPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not save pattern %s: %v", name, err)
+		}
+	} else if err := writeFileAtomic(userPath, []byte(user)); err != nil {
+		return fmt.Errorf("could not save pattern %s: %v", name, err)
+	}
+	_, err := o.Reload()
+	return err
+}
+
+// DeletePattern removes a pattern's directory and reloads the catalog
+func (o *PatternCatalog) DeletePattern(name string) error {
+	if _, ok := o.Get(name); !ok || !validPatternName.MatchString(name) {
+		return ErrPatternNotFound
+	}
+	if err := os.RemoveAll(filepath.Join(o.Dir, name)); err != nil {
+		return fmt.Errorf("could not delete pattern %s: %v", name, err)
+	}
+	_, err := o.Reload()
+	return err
+}
+
+// writeFileAtomic writes through a temporary file so a concurrent reload
+// never reads a half-written prompt
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Watch polls Dir every interval and reloads the catalog when files change.
+// Polling is used rather than fs notifications so it works on any filesystem.
+func (o *PatternCatalog) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := o.Reload()
+			if err != nil {
+				log.Println("Failed to reload patterns [pc-001]", err)
+				continue
+			}
+			if changed {
+				log.Printf("Reloaded %d patterns", len(o.Names()))
+			}
+		}
+	}
+}
+
+// fingerprint summarizes the path, size and mod time of every file under Dir
+func (o *PatternCatalog) fingerprint() (string, error) {
+	hasher := sha256.New()
+	err := filepath.WalkDir(o.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hasher, "%s|%d|%d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not scan patterns directory: %v", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (o *PatternCatalog) load() (*patternIndex, error) {
+	entries, err := os.ReadDir(o.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read items from directory: %v", err)
+	}
+
+	index := &patternIndex{
+		patterns: make(map[string]*Pattern, len(entries)),
+		loadedAt: time.Now(),
+	}
+	catalogHasher := sha256.New()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		system, err := os.ReadFile(filepath.Join(o.Dir, name, o.SystemPatternFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("could not read pattern %s: %v", name, err)
+		}
+		user, err := os.ReadFile(filepath.Join(o.Dir, name, o.UserPatternFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not read pattern %s: %v", name, err)
+		}
+
+		pattern := &Pattern{
+			Name:        name,
+			Description: describePattern(string(system)),
+			Pattern:     string(system),
+			User:        string(user),
+		}
+		pattern.ETag = patternETag(name, pattern.Pattern, pattern.User)
+		index.patterns[name] = pattern
+		index.names = append(index.names, name)
+	}
+
+	sort.Strings(index.names)
+	for _, name := range index.names {
+		fmt.Fprintf(catalogHasher, "%s\n", index.patterns[name].ETag)
+	}
+	index.etag = quoteETag(catalogHasher.Sum(nil))
+	return index, nil
+}
+
+// describePattern uses the first line of prose in the system prompt as the description
+func describePattern(system string) string {
+	for _, line := range strings.Split(system, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) > maxDescriptionLength {
+			line = line[:maxDescriptionLength]
+		}
+		return line
+	}
+	return ""
+}
+
+func patternETag(parts ...string) string {
+	hasher := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(hasher, "%d:%s", len(part), part)
+	}
+	return quoteETag(hasher.Sum(nil))
+}
+
+func quoteETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
@@ -0,0 +1,191 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+)
+
+// writePattern writes the files of a pattern under dir; an empty user prompt writes no user.md
+func writePattern(t *testing.T, dir string, name string, system string, user string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name, "system.md"), []byte(system), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		if err := os.WriteFile(filepath.Join(dir, name, "user.md"), []byte(user), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newCatalog(t *testing.T, dir string) *db.PatternCatalog {
+	t.Helper()
+	catalog, err := db.NewPatternCatalog(&db.Storage{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func TestPatternCatalogLoad(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, dir, "summarize", "# IDENTITY\n\nYou summarize text.\n\nMore detail.", "Summarize this:")
+	writePattern(t, dir, "extract_wisdom", "You extract wisdom.", "")
+	// Directories without a system prompt and loose files are not patterns
+	if err := os.MkdirAll(filepath.Join(dir, "drafts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := newCatalog(t, dir)
+	if names := catalog.Names(); !reflect.DeepEqual(names, []string{"extract_wisdom", "summarize"}) {
+		t.Fatalf("Names() = %v", names)
+	}
+	pattern, ok := catalog.Get("summarize")
+	if !ok {
+		t.Fatal("summarize was not loaded")
+	}
+	if pattern.Description != "You summarize text." || pattern.User != "Summarize this:" || pattern.ETag == "" {
+		t.Fatalf("summarize = %+v", pattern)
+	}
+	if _, ok := catalog.Get("drafts"); ok {
+		t.Fatal("a directory without system.md was loaded")
+	}
+	if catalog.ETag() == "" || catalog.LoadedAt().IsZero() {
+		t.Fatalf("catalog has etag %q loaded at %v", catalog.ETag(), catalog.LoadedAt())
+	}
+}
+
+func TestPatternCatalogFailsOnMissingDir(t *testing.T) {
+	if _, err := db.NewPatternCatalog(&db.Storage{Dir: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("NewPatternCatalog accepted a directory that does not exist")
+	}
+}
+
+func TestPatternCatalogReload(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, dir, "summarize", "You summarize text.", "")
+	catalog := newCatalog(t, dir)
+	before, _ := catalog.Get("summarize")
+	etag := catalog.ETag()
+
+	changed, err := catalog.Reload()
+	if err != nil || changed {
+		t.Fatalf("Reload() of an unchanged directory = %v, %v; want false", changed, err)
+	}
+
+	writePattern(t, dir, "summarize", "You summarize text in three bullet points.", "")
+	writePattern(t, dir, "translate", "You translate text.", "")
+	changed, err = catalog.Reload()
+	if err != nil || !changed {
+		t.Fatalf("Reload() after an edit = %v, %v; want true", changed, err)
+	}
+	after, _ := catalog.Get("summarize")
+	if after.Pattern != "You summarize text in three bullet points." || after.ETag == before.ETag {
+		t.Fatalf("summarize after reload = %+v", after)
+	}
+	if catalog.ETag() == etag || len(catalog.Names()) != 2 {
+		t.Fatalf("catalog after reload has etag %s and names %v", catalog.ETag(), catalog.Names())
+	}
+	// Readers holding the old pattern keep a consistent copy
+	if before.Pattern != "You summarize text." {
+		t.Fatalf("reload changed a pattern already handed out: %q", before.Pattern)
+	}
+}
+
+func TestPatternCatalogWatch(t *testing.T) {
+	dir := t.TempDir()
+	catalog := newCatalog(t, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go catalog.Watch(ctx, 10*time.Millisecond)
+
+	writePattern(t, dir, "summarize", "You summarize text.", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := catalog.Get("summarize"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Watch did not pick up a new pattern")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPatternCatalogSaveAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	catalog := newCatalog(t, dir)
+
+	for _, tt := range []struct {
+		name   string
+		system string
+	}{
+		{"Summarize", "You summarize text."},
+		{"../escape", "You summarize text."},
+		{"summarize", "   "},
+	} {
+		if err := catalog.SavePattern(tt.name, tt.system, ""); !errors.Is(err, db.ErrInvalidPattern) {
+			t.Errorf("SavePattern(%q, %q) returned %v, want ErrInvalidPattern", tt.name, tt.system, err)
+		}
+	}
+
+	if err := catalog.SavePattern("summarize", "You summarize text.", "Summarize this:"); err != nil {
+		t.Fatal(err)
+	}
+	if pattern, ok := catalog.Get("summarize"); !ok || pattern.User != "Summarize this:" {
+		t.Fatalf("saved pattern = %+v, %v", pattern, ok)
+	}
+	// Saving without a user prompt removes the old one
+	if err := catalog.SavePattern("summarize", "You summarize text.", ""); err != nil {
+		t.Fatal(err)
+	}
+	if pattern, _ := catalog.Get("summarize"); pattern.User != "" {
+		t.Fatalf("user prompt is still %q", pattern.User)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "summarize", "user.md")); !os.IsNotExist(err) {
+		t.Fatalf("user.md was not removed: %v", err)
+	}
+
+	if err := catalog.DeletePattern("translate"); !errors.Is(err, db.ErrPatternNotFound) {
+		t.Fatalf("deleting an unknown pattern returned %v, want ErrPatternNotFound", err)
+	}
+	if err := catalog.DeletePattern("summarize"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := catalog.Get("summarize"); ok {
+		t.Fatal("deleted pattern is still in the catalog")
+	}
+}
+
+func TestPatternWithVariables(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, dir, "greet", "Greet {{name}}.", "Say hi to {{name}}")
+	catalog := newCatalog(t, dir)
+
+	pattern, err := catalog.GetPattern("greet", map[string]string{"{{name}}": "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pattern.Pattern != "Greet Ada." || pattern.User != "Say hi to Ada" {
+		t.Fatalf("pattern with variables = %+v", pattern)
+	}
+	if cached, _ := catalog.Get("greet"); cached.Pattern != "Greet {{name}}." {
+		t.Fatalf("applying variables changed the cached pattern to %q", cached.Pattern)
+	}
+	if _, err := catalog.GetPattern("missing", nil); err == nil {
+		t.Fatal("GetPattern found a pattern that does not exist")
+	}
+}
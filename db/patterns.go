@@ -55,7 +55,9 @@ func (o *Patterns) PrintLatestPatterns(latestNumber int) (err error) {
 }
 
 type Pattern struct {
-	Name        string
-	Description string
-	Pattern     string
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Pattern     string `json:"pattern"`
+	User        string `json:"user,omitempty"`
+	ETag        string `json:"-"`
 }
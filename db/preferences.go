@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrUserExists = errors.New("username or email already exists")
+
+// UpdateUserProfile changes the username and email. A new email has to be verified again.
+func (r *PostgresRepository) UpdateUserProfile(ctx context.Context, id uuid.UUID, username string, email string) error {
+	query := `UPDATE users SET username = $2, email = $3,
+                  email_verified_at = CASE WHEN LOWER(email) = LOWER($3) THEN email_verified_at END
+              WHERE id = $1`
+	tag, err := r.db.Exec(ctx, query, id, username, email)
+	if isPgError(err, uniqueViolation) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update user profile: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// GetUserPreferences returns the user's preferences, or the defaults if they never saved any
+func (r *PostgresRepository) GetUserPreferences(ctx context.Context, userID uuid.UUID) (*models.UserPreferences, error) {
+	query := `SELECT default_ai_model, COALESCE(theme, 'light'), COALESCE(message_display_count, 50), COALESCE(notifications_enabled, TRUE)
+              FROM user_preferences WHERE user_id = $1`
+	preferences := &models.UserPreferences{UserID: userID}
+	err := r.db.QueryRow(ctx, query, userID).Scan(
+		&preferences.DefaultAIModel,
+		&preferences.Theme,
+		&preferences.MessageDisplayCount,
+		&preferences.NotificationsEnabled)
+	if err == pgx.ErrNoRows {
+		preferences.Theme = "light"
+		preferences.MessageDisplayCount = 50
+		preferences.NotificationsEnabled = true
+		return preferences, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user preferences: %v", err)
+	}
+	return preferences, nil
+}
+
+func (r *PostgresRepository) SaveUserPreferences(ctx context.Context, preferences *models.UserPreferences) error {
+	query := `INSERT INTO user_preferences (user_id, default_ai_model, theme, message_display_count, notifications_enabled)
+              VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (user_id) DO UPDATE SET
+                  default_ai_model = EXCLUDED.default_ai_model,
+                  theme = EXCLUDED.theme,
+                  message_display_count = EXCLUDED.message_display_count,
+                  notifications_enabled = EXCLUDED.notifications_enabled`
+	_, err := r.db.Exec(ctx, query,
+		preferences.UserID,
+		preferences.DefaultAIModel,
+		preferences.Theme,
+		preferences.MessageDisplayCount,
+		preferences.NotificationsEnabled)
+	if isPgError(err, foreignKeyViolation) {
+		return ErrAIModelNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save user preferences: %v", err)
+	}
+	return nil
+}
+
+// GetDefaultAIModelVersion returns the version of the user's default model, or
+// "" when they have none or it has been deactivated
+func (r *PostgresRepository) GetDefaultAIModelVersion(ctx context.Context, userID uuid.UUID) (string, error) {
+	query := `SELECT m.version FROM user_preferences p
+              JOIN ai_models m ON m.id = p.default_ai_model
+              WHERE p.user_id = $1 AND m.is_active`
+	var version string
+	err := r.db.QueryRow(ctx, query, userID).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get default ai model: %v", err)
+	}
+	return version, nil
+}
+
+// GetUserMetadata returns the user's metadata, empty if they never saved any
+func (r *PostgresRepository) GetUserMetadata(ctx context.Context, userID uuid.UUID) (*models.UserMetadata, error) {
+	query := `SELECT COALESCE(preferred_language, ''), COALESCE(timezone, ''), COALESCE(interests, '{}'),
+                     COALESCE(profession, ''), COALESCE(education_level, ''), COALESCE(birth_year, 0),
+                     COALESCE(country, ''), last_updated
+              FROM user_metadata WHERE user_id = $1`
+	metadata := &models.UserMetadata{UserID: userID}
+	err := r.db.QueryRow(ctx, query, userID).Scan(
+		&metadata.PreferredLanguage,
+		&metadata.Timezone,
+		&metadata.Interests,
+		&metadata.Profession,
+		&metadata.EducationLevel,
+		&metadata.BirthYear,
+		&metadata.Country,
+		&metadata.LastUpdated)
+	if err == pgx.ErrNoRows {
+		metadata.Interests = []string{}
+		return metadata, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// SaveUserMetadata stores the metadata; empty fields are stored as NULL
+func (r *PostgresRepository) SaveUserMetadata(ctx context.Context, metadata *models.UserMetadata) error {
+	query := `INSERT INTO user_metadata (user_id, preferred_language, timezone, interests, profession, education_level, birth_year, country, last_updated)
+              VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, 0), NULLIF($8, ''), NOW())
+              ON CONFLICT (user_id) DO UPDATE SET
+                  preferred_language = EXCLUDED.preferred_language,
+                  timezone = EXCLUDED.timezone,
+                  interests = EXCLUDED.interests,
+                  profession = EXCLUDED.profession,
+                  education_level = EXCLUDED.education_level,
+                  birth_year = EXCLUDED.birth_year,
+                  country = EXCLUDED.country,
+                  last_updated = NOW()
+              RETURNING last_updated`
+	err := r.db.QueryRow(ctx, query,
+		metadata.UserID,
+		metadata.PreferredLanguage,
+		metadata.Timezone,
+		metadata.Interests,
+		metadata.Profession,
+		metadata.EducationLevel,
+		metadata.BirthYear,
+		metadata.Country).Scan(&metadata.LastUpdated)
+	if err != nil {
+		return fmt.Errorf("failed to save user metadata: %v", err)
+	}
+	return nil
+}
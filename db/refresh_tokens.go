@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is unknown, expired or revoked")
+	// ErrRefreshTokenReused means an already rotated token was presented again,
+	// so the token has likely been stolen and its whole family is revoked
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+func (r *PostgresRepository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at)
+              VALUES ($1, $2, $3, $4)
+              RETURNING id, created_at`
+	err := r.db.QueryRow(ctx, query,
+		token.FamilyID,
+		token.UserID,
+		token.TokenHash,
+		token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %v", err)
+	}
+	return nil
+}
+
+// RotateRefreshToken marks the token with oldHash as used and stores next in the
+// same family. Presenting a token that was already used revokes the family and its session.
+func (r *PostgresRepository) RotateRefreshToken(ctx context.Context, oldHash string, next *models.RefreshToken) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin refresh transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current := &models.RefreshToken{}
+	query := `SELECT id, family_id, user_id, expires_at, used_at, revoked_at
+              FROM refresh_tokens
+              WHERE token_hash = $1
+              FOR UPDATE`
+	err = tx.QueryRow(ctx, query, oldHash).Scan(
+		&current.ID,
+		&current.FamilyID,
+		&current.UserID,
+		&current.ExpiresAt,
+		&current.UsedAt,
+		&current.RevokedAt)
+	if err == pgx.ErrNoRows {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get refresh token: %v", err)
+	}
+
+	if current.RevokedAt != nil || current.ExpiresAt.Before(time.Now()) ||
+		current.FamilyID != next.FamilyID || current.UserID != next.UserID {
+		return ErrRefreshTokenInvalid
+	}
+
+	if current.UsedAt != nil {
+		_, err = tx.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, current.FamilyID)
+		if err != nil {
+			return fmt.Errorf("failed to revoke refresh token family: %v", err)
+		}
+		_, err = tx.Exec(ctx, `UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, current.FamilyID)
+		if err != nil {
+			return fmt.Errorf("failed to revoke session: %v", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit refresh token revocation: %v", err)
+		}
+		return ErrRefreshTokenReused
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, current.ID); err != nil {
+		return fmt.Errorf("failed to mark refresh token used: %v", err)
+	}
+
+	query = `INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at)
+             VALUES ($1, $2, $3, $4)
+             RETURNING id, created_at`
+	err = tx.QueryRow(ctx, query, next.FamilyID, next.UserID, next.TokenHash, next.ExpiresAt).Scan(&next.ID, &next.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create rotated refresh token: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit refresh token rotation: %v", err)
+	}
+	return nil
+}
+
+// GetRefreshTokenByHash retrieves a live refresh token record
+func (r *PostgresRepository) GetRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	query := `SELECT id, family_id, user_id, created_at, expires_at, used_at, revoked_at
+              FROM refresh_tokens
+              WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()`
+	token := &models.RefreshToken{TokenHash: tokenHash}
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(
+		&token.ID,
+		&token.FamilyID,
+		&token.UserID,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.RevokedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %v", err)
+	}
+	return token, nil
+}
+
+// DeleteExpiredRefreshTokens removes records that can no longer be presented.
+// Used tokens are kept until they expire so reuse can still be detected.
+func (r *PostgresRepository) DeleteExpiredRefreshTokens(ctx context.Context) (int64, error) {
+	query := `DELETE FROM refresh_tokens WHERE expires_at < NOW()`
+	tag, err := r.db.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired refresh tokens: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
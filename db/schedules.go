@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	ScheduleRunRunning   = "running"
+	ScheduleRunCompleted = "completed"
+	ScheduleRunFailed    = "failed"
+
+	// scheduleLockNamespace keeps schedule advisory locks apart from any others
+	scheduleLockNamespace = 30
+)
+
+const scheduleColumns = `s.id, s.user_id, s.name, s.cron_expression, COALESCE(s.pattern, ''), s.prompt, s.variables,
+              COALESCE(s.ai_model_version, ''), s.chat_id, s.append_to_chat, s.is_active, s.next_run_at, s.last_run_at,
+              s.created_at, COALESCE(um.timezone, '')`
+
+const scheduleFrom = `FROM schedules s
+              LEFT JOIN user_metadata um ON um.user_id = s.user_id`
+
+func scanSchedule(row pgx.Row) (*models.Schedule, error) {
+	schedule := &models.Schedule{}
+	err := row.Scan(
+		&schedule.ID,
+		&schedule.UserID,
+		&schedule.Name,
+		&schedule.CronExpression,
+		&schedule.Pattern,
+		&schedule.Prompt,
+		&schedule.Variables,
+		&schedule.AIModelVersion,
+		&schedule.ChatID,
+		&schedule.AppendToChat,
+		&schedule.IsActive,
+		&schedule.NextRunAt,
+		&schedule.LastRunAt,
+		&schedule.CreatedAt,
+		&schedule.Timezone)
+	return schedule, err
+}
+
+// GetUserTimezone returns the timezone from the user's metadata, or "" when none is set
+func (r *PostgresRepository) GetUserTimezone(ctx context.Context, userID uuid.UUID) (string, error) {
+	query := `SELECT COALESCE(timezone, '') FROM user_metadata WHERE user_id = $1`
+	var timezone string
+	err := r.db.QueryRow(ctx, query, userID).Scan(&timezone)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user timezone: %v", err)
+	}
+	return timezone, nil
+}
+
+func (r *PostgresRepository) CreateSchedule(ctx context.Context, schedule *models.Schedule) error {
+	query := `INSERT INTO schedules (user_id, name, cron_expression, pattern, prompt, variables, ai_model_version, chat_id, append_to_chat, is_active, next_run_at)
+              VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10, $11)
+              RETURNING id, created_at`
+	err := r.db.QueryRow(ctx, query,
+		schedule.UserID,
+		schedule.Name,
+		schedule.CronExpression,
+		schedule.Pattern,
+		schedule.Prompt,
+		schedule.Variables,
+		schedule.AIModelVersion,
+		schedule.ChatID,
+		schedule.AppendToChat,
+		schedule.IsActive,
+		schedule.NextRunAt).Scan(&schedule.ID, &schedule.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create schedule: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetScheduleByID(ctx context.Context, id uuid.UUID) (*models.Schedule, error) {
+	query := `SELECT ` + scheduleColumns + `
+              ` + scheduleFrom + `
+              WHERE s.id = $1`
+	schedule, err := scanSchedule(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule by ID: %v", err)
+	}
+	return schedule, nil
+}
+
+func (r *PostgresRepository) GetSchedulesByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Schedule, error) {
+	query := `SELECT ` + scheduleColumns + `
+              ` + scheduleFrom + `
+              WHERE s.user_id = $1
+              ORDER BY s.created_at DESC`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedules by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	var schedules []*models.Schedule
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %v", err)
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over schedules: %v", err)
+	}
+
+	return schedules, nil
+}
+
+func (r *PostgresRepository) UpdateSchedule(ctx context.Context, schedule *models.Schedule) error {
+	query := `UPDATE schedules
+              SET name = $1, cron_expression = $2, pattern = NULLIF($3, ''), prompt = $4, variables = $5,
+                  ai_model_version = $6, chat_id = $7, append_to_chat = $8, is_active = $9, next_run_at = $10
+              WHERE id = $11`
+	_, err := r.db.Exec(ctx, query,
+		schedule.Name,
+		schedule.CronExpression,
+		schedule.Pattern,
+		schedule.Prompt,
+		schedule.Variables,
+		schedule.AIModelVersion,
+		schedule.ChatID,
+		schedule.AppendToChat,
+		schedule.IsActive,
+		schedule.NextRunAt,
+		schedule.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) DeleteSchedule(ctx context.Context, id uuid.UUID) error {
+	query := `DELETE FROM schedules WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %v", err)
+	}
+	return nil
+}
+
+// SetScheduleChat pins the chat that later runs of the schedule append to
+func (r *PostgresRepository) SetScheduleChat(ctx context.Context, id uuid.UUID, chatID uuid.UUID) error {
+	query := `UPDATE schedules SET chat_id = $1 WHERE id = $2`
+	_, err := r.db.Exec(ctx, query, chatID, id)
+	if err != nil {
+		return fmt.Errorf("failed to set schedule chat: %v", err)
+	}
+	return nil
+}
+
+// DeactivateSchedule stops a schedule from running until its owner turns it back on
+func (r *PostgresRepository) DeactivateSchedule(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE schedules SET is_active = FALSE WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate schedule: %v", err)
+	}
+	return nil
+}
+
+// GetDueScheduleIDs lists active schedules whose next run is at or before now
+func (r *PostgresRepository) GetDueScheduleIDs(ctx context.Context, now time.Time) ([]uuid.UUID, error) {
+	query := `SELECT id FROM schedules WHERE is_active AND next_run_at <= $1 ORDER BY next_run_at`
+	rows, err := r.db.Query(ctx, query, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due schedules: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over due schedules: %v", err)
+	}
+
+	return ids, nil
+}
+
+// ClaimScheduleRun takes a transaction-scoped advisory lock on the schedule and,
+// if it is still due, advances next_run_at using next. Only one server instance
+// can claim a given run; the others either miss the lock or see it is no longer due.
+func (r *PostgresRepository) ClaimScheduleRun(ctx context.Context, id uuid.UUID, now time.Time, next func(*models.Schedule) (time.Time, error)) (*models.Schedule, bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin schedule transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	err = tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1, hashtext($2::text))`, scheduleLockNamespace, id).Scan(&locked)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lock schedule: %v", err)
+	}
+	if !locked {
+		return nil, false, nil
+	}
+
+	query := `SELECT ` + scheduleColumns + `
+              ` + scheduleFrom + `
+              WHERE s.id = $1 AND s.is_active AND s.next_run_at <= $2`
+	schedule, err := scanSchedule(tx.QueryRow(ctx, query, id, now))
+	if err == pgx.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get due schedule: %v", err)
+	}
+
+	nextRunAt, err := next(schedule)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = tx.Exec(ctx, `UPDATE schedules SET next_run_at = $1, last_run_at = $2 WHERE id = $3`, nextRunAt, now, id)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to advance schedule: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, fmt.Errorf("failed to commit schedule claim: %v", err)
+	}
+	schedule.LastRunAt = &now
+	schedule.NextRunAt = nextRunAt
+	return schedule, true, nil
+}
+
+func (r *PostgresRepository) CreateScheduleRun(ctx context.Context, run *models.ScheduleRun) error {
+	query := `INSERT INTO schedule_runs (schedule_id, status) VALUES ($1, $2) RETURNING id, started_at`
+	err := r.db.QueryRow(ctx, query, run.ScheduleID, run.Status).Scan(&run.ID, &run.StartedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create schedule run: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) FinishScheduleRun(ctx context.Context, run *models.ScheduleRun) error {
+	query := `UPDATE schedule_runs
+              SET status = $1, chat_id = $2, error = NULLIF($3, ''), finished_at = NOW()
+              WHERE id = $4`
+	_, err := r.db.Exec(ctx, query, run.Status, run.ChatID, run.Error, run.ID)
+	if err != nil {
+		return fmt.Errorf("failed to finish schedule run: %v", err)
+	}
+	return nil
+}
+
+// GetScheduleRuns lists every run of a schedule, newest first
+func (r *PostgresRepository) GetScheduleRuns(ctx context.Context, scheduleID uuid.UUID) ([]*models.ScheduleRun, error) {
+	query := `SELECT id, schedule_id, chat_id, status, COALESCE(error, ''), started_at, finished_at
+              FROM schedule_runs
+              WHERE schedule_id = $1
+              ORDER BY started_at DESC`
+	rows, err := r.db.Query(ctx, query, scheduleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []*models.ScheduleRun
+	for rows.Next() {
+		run := &models.ScheduleRun{}
+		if err := rows.Scan(
+			&run.ID,
+			&run.ScheduleID,
+			&run.ChatID,
+			&run.Status,
+			&run.Error,
+			&run.StartedAt,
+			&run.FinishedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule run: %v", err)
+		}
+		runs = append(runs, run)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over schedule runs: %v", err)
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	WebAuthnRegister = "register"
+	WebAuthnLogin    = "login"
+	WebAuthnMFA      = "mfa"
+)
+
+var (
+	ErrWebAuthnChallengeInvalid   = errors.New("webauthn challenge is unknown, expired or already used")
+	ErrWebAuthnCredentialNotFound = errors.New("webauthn credential not found")
+)
+
+func (r *PostgresRepository) CreateWebAuthnChallenge(ctx context.Context, challenge *models.WebAuthnChallenge) error {
+	query := `INSERT INTO webauthn_challenges (challenge, user_id, purpose, expires_at) VALUES ($1, $2, $3, $4)`
+	_, err := r.db.Exec(ctx, query, challenge.Challenge, challenge.UserID, challenge.Purpose, challenge.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create webauthn challenge: %v", err)
+	}
+	return nil
+}
+
+// ConsumeWebAuthnChallenge deletes and returns an unexpired challenge, so each ceremony completes once
+func (r *PostgresRepository) ConsumeWebAuthnChallenge(ctx context.Context, challenge string, purpose string) (*models.WebAuthnChallenge, error) {
+	query := `DELETE FROM webauthn_challenges
+              WHERE challenge = $1 AND purpose = $2 AND expires_at > NOW()
+              RETURNING challenge, user_id, purpose, expires_at`
+	result := &models.WebAuthnChallenge{}
+	err := r.db.QueryRow(ctx, query, challenge, purpose).Scan(&result.Challenge, &result.UserID, &result.Purpose, &result.ExpiresAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrWebAuthnChallengeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume webauthn challenge: %v", err)
+	}
+	return result, nil
+}
+
+func (r *PostgresRepository) DeleteExpiredWebAuthnChallenges(ctx context.Context) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM webauthn_challenges WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired webauthn challenges: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+const webAuthnCredentialColumns = `id, user_id, credential_id, public_key, sign_count, aaguid, attestation_format, transports, backup_eligible, name, created_at, last_used_at`
+
+func scanWebAuthnCredential(row pgx.Row) (*models.WebAuthnCredential, error) {
+	credential := &models.WebAuthnCredential{}
+	var signCount int64
+	err := row.Scan(
+		&credential.ID,
+		&credential.UserID,
+		&credential.CredentialID,
+		&credential.PublicKey,
+		&signCount,
+		&credential.AAGUID,
+		&credential.AttestationFormat,
+		&credential.Transports,
+		&credential.BackupEligible,
+		&credential.Name,
+		&credential.CreatedAt,
+		&credential.LastUsedAt)
+	credential.SignCount = uint32(signCount)
+	return credential, err
+}
+
+func (r *PostgresRepository) CreateWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error {
+	if credential.Transports == nil {
+		credential.Transports = []string{}
+	}
+	query := `INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, aaguid, attestation_format, transports, backup_eligible, name)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+              RETURNING id, created_at`
+	err := r.db.QueryRow(ctx, query,
+		credential.UserID,
+		credential.CredentialID,
+		credential.PublicKey,
+		int64(credential.SignCount),
+		credential.AAGUID,
+		credential.AttestationFormat,
+		credential.Transports,
+		credential.BackupEligible,
+		credential.Name).Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create webauthn credential: %v", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetWebAuthnCredentialByCredentialID(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE credential_id = $1`
+	credential, err := scanWebAuthnCredential(r.db.QueryRow(ctx, query, credentialID))
+	if err == pgx.ErrNoRows {
+		return nil, ErrWebAuthnCredentialNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webauthn credential: %v", err)
+	}
+	return credential, nil
+}
+
+func (r *PostgresRepository) GetWebAuthnCredentialsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + `
+              FROM webauthn_credentials
+              WHERE user_id = $1
+              ORDER BY created_at`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webauthn credentials by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	credentials := []*models.WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webauthn credential: %v", err)
+		}
+		credentials = append(credentials, credential)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over webauthn credentials: %v", err)
+	}
+	return credentials, nil
+}
+
+// UseWebAuthnCredential stores the new signature counter. It returns false if
+// another request already stored the same or a higher count, which means the
+// assertion was replayed or the credential cloned.
+func (r *PostgresRepository) UseWebAuthnCredential(ctx context.Context, id uuid.UUID, signCount uint32) (bool, error) {
+	query := `UPDATE webauthn_credentials
+              SET sign_count = $2, last_used_at = NOW()
+              WHERE id = $1 AND ($2 = 0 OR sign_count < $2)`
+	tag, err := r.db.Exec(ctx, query, id, int64(signCount))
+	if err != nil {
+		return false, fmt.Errorf("failed to update webauthn credential: %v", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *PostgresRepository) DeleteWebAuthnCredential(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webauthn credential: %v", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
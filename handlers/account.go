@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/mailer"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultDeletionGrace = 30 * 24 * time.Hour
+
+type accountDeletionRequest struct {
+	// Confirm must be the account's username
+	Confirm string `json:"confirm"`
+}
+
+// accountDeletionGrace is how long a deleted account can still be restored, from ACCOUNT_DELETION_GRACE
+func accountDeletionGrace() time.Duration {
+	raw := os.Getenv("ACCOUNT_DELETION_GRACE")
+	if raw == "" {
+		return defaultDeletionGrace
+	}
+	grace, err := time.ParseDuration(raw)
+	if err != nil || grace < 0 {
+		log.Println("Invalid ACCOUNT_DELETION_GRACE, using the default [adg-001]", raw)
+		return defaultDeletionGrace
+	}
+	return grace
+}
+
+// RequestDataExport queues a zip of everything stored about the caller
+func RequestDataExport(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [rde-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [rde-001]"})
+		}
+
+		export, err := repo.CreateDataExport(c.Request().Context(), userID)
+		if errors.Is(err, db.ErrExportInProgress) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "An export is already in progress [rde-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to create data export [rde-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rde-003]"})
+		}
+		return c.JSON(http.StatusAccepted, export)
+	}
+}
+
+func GetDataExports(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gde-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gde-001]"})
+		}
+
+		exports, err := repo.GetDataExportsByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get data exports [gde-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gde-002]"})
+		}
+		return c.JSON(http.StatusOK, exports)
+	}
+}
+
+func DownloadDataExport(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [dde-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [dde-001]"})
+		}
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid export ID [dde-002]"})
+		}
+
+		archive, err := repo.GetDataExportArchive(c.Request().Context(), id, userID)
+		if errors.Is(err, db.ErrExportNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Export not found, not finished or expired [dde-003]"})
+		}
+		if err != nil {
+			log.Println("Failed to get data export archive [dde-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dde-004]"})
+		}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="gippity-export-%s.zip"`, id))
+		return c.Blob(http.StatusOK, "application/zip", archive)
+	}
+}
+
+// RequestAccountDeletion schedules the caller's account to be purged once the
+// grace period passes. Until then it works as usual and the deletion can be
+// cancelled.
+func RequestAccountDeletion(repo repository.Repository, mail mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [rad-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [rad-001]"})
+		}
+
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUUID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user [rad-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rad-002]"})
+		}
+		var req accountDeletionRequest
+		if err := c.Bind(&req); err != nil || req.Confirm != user.Username {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "confirm must be your username [rad-003]"})
+		}
+
+		scheduledAt := time.Now().Add(accountDeletionGrace())
+		err = repo.ScheduleUserDeletion(ctx, userID, scheduledAt)
+		if errors.Is(err, db.ErrDeletionScheduled) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Account deletion is already scheduled [rad-004]"})
+		}
+		if err != nil {
+			log.Println("Failed to schedule user deletion [rad-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rad-005]"})
+		}
+		recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+			UserID:    &userID,
+			EventType: "deletion_requested",
+			IPAddress: c.RealIP(),
+			Detail:    map[string]string{"scheduled_at": scheduledAt.UTC().Format(time.RFC3339)},
+		})
+
+		// The deletion stands even if the notice cannot be sent
+		err = mail.Send(ctx, mailer.Message{
+			To:      user.Email,
+			Subject: "Your account will be deleted",
+			Body: fmt.Sprintf("Hi %s,\n\nYour account and everything in it will be deleted on %s. Until then you can sign in and cancel the deletion from your account settings at %s.\n\nIf you did not ask for this, sign in, cancel the deletion and change your password.\n",
+				user.Username, scheduledAt.UTC().Format("January 2, 2006 15:04 MST"), appURL()),
+		})
+		if err != nil {
+			log.Println("Failed to send deletion notice [rad-006]", err)
+		}
+
+		return c.JSON(http.StatusAccepted, map[string]time.Time{"deletion_scheduled_at": scheduledAt})
+	}
+}
+
+func CancelAccountDeletion(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [cad-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [cad-001]"})
+		}
+
+		ctx := c.Request().Context()
+		err = repo.CancelUserDeletion(ctx, userID)
+		if errors.Is(err, db.ErrDeletionNotScheduled) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Account deletion is not scheduled [cad-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to cancel user deletion [cad-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cad-003]"})
+		}
+		recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+			UserID:    &userID,
+			EventType: "deletion_cancelled",
+			IPAddress: c.RealIP(),
+		})
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func TestAccountDeletion(t *testing.T) {
+	t.Setenv("ACCOUNT_DELETION_GRACE", "48h")
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	outbox := newTestOutbox(t)
+	e := echo.New()
+	e.POST("/me/deletion", RequestAccountDeletion(repo, outbox), asUser(user.ID))
+	e.DELETE("/me/deletion", CancelAccountDeletion(repo), asUser(user.ID))
+
+	for _, body := range []string{"", `{"confirm": "ADA"}`, `{"confirm": "bob"}`} {
+		if rec := serve(e, http.MethodPost, "/me/deletion", body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "rad-003") {
+			t.Fatalf("confirming with %q got %d %s, want 400", body, rec.Code, rec.Body)
+		}
+	}
+
+	rec := serve(e, http.MethodPost, "/me/deletion", `{"confirm": "ada"}`)
+	var scheduled struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}
+	if rec.Code != http.StatusAccepted || json.Unmarshal(rec.Body.Bytes(), &scheduled) != nil {
+		t.Fatalf("requesting deletion returned %d: %s", rec.Code, rec.Body)
+	}
+	if wait := time.Until(scheduled.DeletionScheduledAt); wait < 47*time.Hour || wait > 48*time.Hour {
+		t.Fatalf("deletion is scheduled in %s, want ACCOUNT_DELETION_GRACE", wait)
+	}
+	if msg := waitForMail(t, outbox, 1); msg.To != user.Email || !strings.Contains(msg.Body, "cancel the deletion") {
+		t.Fatalf("deletion notice = %+v", msg)
+	}
+	if rec := serve(e, http.MethodPost, "/me/deletion", `{"confirm": "ada"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("requesting deletion twice got %d, want 409", rec.Code)
+	}
+
+	if rec := serve(e, http.MethodDelete, "/me/deletion", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("cancelling deletion returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(e, http.MethodDelete, "/me/deletion", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("cancelling deletion twice got %d, want 404", rec.Code)
+	}
+	// A cancelled deletion is never purged
+	if purged, err := repo.PurgeDeletedUsers(context.Background()); err != nil || purged != 0 {
+		t.Fatalf("PurgeDeletedUsers = %d, %v; want none", purged, err)
+	}
+
+	events, err := repo.GetSecurityEvents(context.Background(), &user.ID, 10, 0)
+	if err != nil || len(events) != 2 || events[0].EventType != "deletion_cancelled" || events[1].EventType != "deletion_requested" {
+		t.Fatalf("security events = %+v (%v)", events, err)
+	}
+	if events[1].Detail["scheduled_at"] != scheduled.DeletionScheduledAt.UTC().Format(time.RFC3339) {
+		t.Fatalf("the deletion_requested event has %v", events[1].Detail)
+	}
+}
+
+func TestAccountDeletionGrace(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultDeletionGrace},
+		{"1h", time.Hour},
+		{"0s", 0},
+		{"-1h", defaultDeletionGrace},
+		{"soon", defaultDeletionGrace},
+	} {
+		t.Setenv("ACCOUNT_DELETION_GRACE", tt.env)
+		if got := accountDeletionGrace(); got != tt.want {
+			t.Errorf("ACCOUNT_DELETION_GRACE=%q gives %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestDataExports(t *testing.T) {
+	repo := newTestRepo(t)
+	ada := createTestUser(t, repo, "ada", "correct horse")
+	bob := createTestUser(t, repo, "bob", "battery staple")
+	e := echo.New()
+	e.POST("/me/exports", RequestDataExport(repo), asUser(ada.ID))
+	e.GET("/me/exports", GetDataExports(repo), asUser(ada.ID))
+	e.GET("/me/exports/:id/download", DownloadDataExport(repo), asUser(ada.ID))
+	e.GET("/bob/exports/:id/download", DownloadDataExport(repo), asUser(bob.ID))
+
+	rec := serve(e, http.MethodPost, "/me/exports", "")
+	var export models.DataExport
+	if rec.Code != http.StatusAccepted || json.Unmarshal(rec.Body.Bytes(), &export) != nil || export.UserID != ada.ID {
+		t.Fatalf("requesting an export returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(e, http.MethodPost, "/me/exports", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("a second export got %d, want 409", rec.Code)
+	}
+	download := "/exports/" + export.ID.String() + "/download"
+	if rec := serve(e, http.MethodGet, "/me"+download, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("downloading a queued export got %d, want 404", rec.Code)
+	}
+
+	// Stand in for the export worker
+	ctx := context.Background()
+	if claimed, err := repo.ClaimDataExport(ctx, time.Hour); err != nil || claimed.ID != export.ID {
+		t.Fatalf("ClaimDataExport = %+v, %v", claimed, err)
+	}
+	if err := repo.CompleteDataExport(ctx, export.ID, []byte("PK"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var exports []*models.DataExport
+	if rec := serve(e, http.MethodGet, "/me/exports", ""); json.Unmarshal(rec.Body.Bytes(), &exports) != nil || len(exports) != 1 || exports[0].Size != 2 {
+		t.Fatalf("listing exports returned %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(e, http.MethodGet, "/me"+download, "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "PK" || rec.Header().Get(echo.HeaderContentType) != "application/zip" {
+		t.Fatalf("downloading the export returned %d %s: %q", rec.Code, rec.Header(), rec.Body)
+	}
+	if disposition := rec.Header().Get(echo.HeaderContentDisposition); !strings.Contains(disposition, "gippity-export-"+export.ID.String()+".zip") {
+		t.Fatalf("Content-Disposition = %q", disposition)
+	}
+	if rec := serve(e, http.MethodGet, "/bob"+download, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("another user downloading the export got %d, want 404", rec.Code)
+	}
+	if rec := serve(e, http.MethodGet, "/me/exports/nope/download", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid export ID got %d, want 400", rec.Code)
+	}
+	if rec := serve(e, http.MethodGet, "/me/exports/"+uuid.NewString()+"/download", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("an unknown export got %d, want 404", rec.Code)
+	}
+}
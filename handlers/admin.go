@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const maxAdminPageSize = 100
+
+type aiModelRequest struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	IsActive    *bool  `json:"is_active"`
+}
+
+type userActiveRequest struct {
+	IsActive *bool `json:"is_active"`
+}
+
+type userRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type roleSettingRequest struct {
+	MFARequired *bool `json:"mfa_required"`
+}
+
+type patternRequest struct {
+	System string `json:"system"`
+	User   string `json:"user"`
+}
+
+// getRoleFromContext returns the role from the access token. API keys carry no role.
+func getRoleFromContext(c echo.Context) string {
+	role, _ := c.Get("role").(string)
+	return role
+}
+
+// RequirePermission lets a request through only if the caller's role grants
+// permission. A second factor the role requires is checked by AuthMiddleware.
+func RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			role := getRoleFromContext(c)
+			if !auth.HasPermission(role, permission) {
+				return echo.NewHTTPError(http.StatusForbidden, "Missing the "+permission+" permission")
+			}
+			return next(c)
+		}
+	}
+}
+
+// pageParams reads ?limit= and ?offset=, returning an error message if they are invalid
+func pageParams(c echo.Context) (int, int, string) {
+	limit, offset := 50, 0
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAdminPageSize {
+			return 0, 0, "limit must be between 1 and 100"
+		}
+		limit = n
+	}
+	if raw := c.QueryParam("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return 0, 0, "offset must not be negative"
+		}
+		offset = n
+	}
+	return limit, offset, ""
+}
+
+// parseAIModelRequest validates the body of CreateAIModel and UpdateAIModel
+func parseAIModelRequest(c echo.Context, model *models.AIModel) string {
+	var req aiModelRequest
+	if err := c.Bind(&req); err != nil {
+		return "Invalid request payload"
+	}
+	model.Name = strings.TrimSpace(req.Name)
+	model.Version = strings.TrimSpace(req.Version)
+	model.Description = strings.TrimSpace(req.Description)
+	if model.Name == "" || len(model.Name) > 50 {
+		return "Name is required and at most 50 characters"
+	}
+	if model.Version == "" || len(model.Version) > 20 {
+		return "Version is required and at most 20 characters"
+	}
+	if req.IsActive != nil {
+		model.IsActive = *req.IsActive
+	}
+	return ""
+}
+
+func CreateAIModel(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		model := &models.AIModel{IsActive: true}
+		if msg := parseAIModelRequest(c, model); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg + " [cam-001]"})
+		}
+
+		err := repo.CreateAIModel(c.Request().Context(), model)
+		if errors.Is(err, db.ErrAIModelExists) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A model with this name already exists [cam-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to create ai model [cam-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cam-003]"})
+		}
+		return c.JSON(http.StatusCreated, model)
+	}
+}
+
+func UpdateAIModel(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid model ID [uam-001]"})
+		}
+		model, err := repo.GetAIModelByID(c.Request().Context(), id)
+		if errors.Is(err, db.ErrAIModelNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Model not found [uam-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to get ai model [uam-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uam-003]"})
+		}
+		if msg := parseAIModelRequest(c, model); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg + " [uam-004]"})
+		}
+
+		err = repo.UpdateAIModel(c.Request().Context(), model)
+		if errors.Is(err, db.ErrAIModelExists) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A model with this name already exists [uam-005]"})
+		}
+		if errors.Is(err, db.ErrAIModelNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Model not found [uam-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to update ai model [uam-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uam-006]"})
+		}
+		return c.JSON(http.StatusOK, model)
+	}
+}
+
+// DeleteAIModel removes a model nothing refers to. Models in use can be
+// deactivated with UpdateAIModel instead.
+func DeleteAIModel(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid model ID [dam-001]"})
+		}
+
+		err = repo.DeleteAIModel(c.Request().Context(), id)
+		if errors.Is(err, db.ErrAIModelNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Model not found [dam-002]"})
+		}
+		if errors.Is(err, db.ErrAIModelInUse) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Model is in use, deactivate it instead [dam-003]"})
+		}
+		if err != nil {
+			log.Println("Failed to delete ai model [dam-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dam-004]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetUsers pages through users with ?q= (username or email prefix), ?limit= and ?offset=
+func GetUsers(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, offset, msg := pageParams(c)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg + " [gu-001]"})
+		}
+
+		users, err := repo.ListUsers(c.Request().Context(), strings.TrimSpace(c.QueryParam("q")), limit, offset)
+		if err != nil {
+			log.Println("Failed to list users [gu-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gu-002]"})
+		}
+		return c.JSON(http.StatusOK, users)
+	}
+}
+
+func GetUserByID(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [gus-001]"})
+		}
+		user, err := repo.GetUserByUUID(c.Request().Context(), id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [gus-002]"})
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// UpdateUserActive activates or deactivates a user. Deactivating signs them
+// out everywhere and stops their API keys.
+func UpdateUserActive(repo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		adminID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [uua-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [uua-001]"})
+		}
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [uua-002]"})
+		}
+		var req userActiveRequest
+		if err := c.Bind(&req); err != nil || req.IsActive == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "is_active is required [uua-003]"})
+		}
+		if id == adminID && !*req.IsActive {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "You cannot deactivate your own account [uua-004]"})
+		}
+
+		ctx := c.Request().Context()
+		err = repo.SetUserActive(ctx, id, *req.IsActive)
+		if errors.Is(err, db.ErrUserNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [uua-005]"})
+		}
+		if err != nil {
+			log.Println("Failed to set user active [uua-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uua-006]"})
+		}
+		if !*req.IsActive {
+			revoked, err := repo.RevokeUserSessions(ctx, id)
+			if err != nil {
+				log.Println("Failed to revoke user sessions [uua-007]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uua-007]"})
+			}
+			sessions.Revoke(revoked...)
+		}
+		eventType := "user_activated"
+		if !*req.IsActive {
+			eventType = "user_deactivated"
+		}
+		recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+			UserID:    &id,
+			ActorID:   &adminID,
+			EventType: eventType,
+			IPAddress: c.RealIP(),
+		})
+
+		user, err := repo.GetUserByUUID(ctx, id)
+		if err != nil {
+			log.Println("Failed to get user [uua-008]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uua-008]"})
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// UpdateUserRole changes a user's role. A demotion signs them out so no
+// access token keeps the old role.
+func UpdateUserRole(repo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		adminID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [uur-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [uur-001]"})
+		}
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [uur-002]"})
+		}
+		var req userRoleRequest
+		if err := c.Bind(&req); err != nil || !auth.ValidRole(req.Role) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "role must be one of " + strings.Join(auth.Roles, ", ") + " [uur-003]"})
+		}
+		if id == adminID {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "You cannot change your own role [uur-004]"})
+		}
+
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUUID(ctx, id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [uur-005]"})
+		}
+		if user.Role != req.Role {
+			if err := changeUserRole(ctx, repo, sessions, id, user.Role, req.Role); err != nil {
+				log.Println("Failed to change user role [uur-006]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uur-006]"})
+			}
+			recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+				UserID:    &id,
+				ActorID:   &adminID,
+				EventType: "role_changed",
+				IPAddress: c.RealIP(),
+				Detail:    map[string]string{"from": user.Role, "to": req.Role},
+			})
+			user.Role = req.Role
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// UnlockUser clears the failed login count and lockout of a user's account
+func UnlockUser(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		adminID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [ulu-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [ulu-001]"})
+		}
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [ulu-002]"})
+		}
+
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUUID(ctx, id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [ulu-003]"})
+		}
+		cleared, err := repo.ClearAuthThrottle(ctx, accountThrottle.key(user.Username))
+		if err != nil {
+			log.Println("Failed to clear auth throttle [ulu-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [ulu-004]"})
+		}
+		if cleared {
+			recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+				UserID:    &id,
+				ActorID:   &adminID,
+				EventType: "account_unlocked",
+				IPAddress: c.RealIP(),
+			})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetSecurityEvents pages through security events with ?user_id=, ?limit= and ?offset=
+func GetSecurityEvents(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, offset, msg := pageParams(c)
+		if msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg + " [gse-001]"})
+		}
+		var userID *uuid.UUID
+		if raw := c.QueryParam("user_id"); raw != "" {
+			id, err := uuid.Parse(raw)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [gse-002]"})
+			}
+			userID = &id
+		}
+
+		events, err := repo.GetSecurityEvents(c.Request().Context(), userID, limit, offset)
+		if err != nil {
+			log.Println("Failed to get security events [gse-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gse-003]"})
+		}
+		return c.JSON(http.StatusOK, events)
+	}
+}
+
+// GetRoleSettings lists the policy for each role
+func GetRoleSettings(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		settings, err := repo.GetRoleSettings(c.Request().Context())
+		if err != nil {
+			log.Println("Failed to get role settings [grs-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [grs-001]"})
+		}
+		return c.JSON(http.StatusOK, settings)
+	}
+}
+
+// UpdateRoleSetting sets whether users with a role must have a second factor.
+// It applies to their sessions within the session cache TTL.
+func UpdateRoleSetting(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		adminID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [urs-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [urs-001]"})
+		}
+		role := c.Param("role")
+		if !auth.ValidRole(role) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "role must be one of " + strings.Join(auth.Roles, ", ") + " [urs-002]"})
+		}
+		var req roleSettingRequest
+		if err := c.Bind(&req); err != nil || req.MFARequired == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "mfa_required is required [urs-003]"})
+		}
+
+		ctx := c.Request().Context()
+		setting, err := repo.SetRoleMFARequired(ctx, role, *req.MFARequired)
+		if err != nil {
+			log.Println("Failed to update role setting [urs-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [urs-004]"})
+		}
+		recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+			ActorID:   &adminID,
+			EventType: "role_mfa_changed",
+			IPAddress: c.RealIP(),
+			Detail:    map[string]string{"role": role, "mfa_required": strconv.FormatBool(setting.MFARequired)},
+		})
+		return c.JSON(http.StatusOK, setting)
+	}
+}
+
+// SavePattern creates or replaces a global pattern
+func SavePattern(catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req patternRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [sp-001]"})
+		}
+
+		name := c.Param("name")
+		_, existed := catalog.Get(name)
+		err := catalog.SavePattern(name, req.System, req.User)
+		if errors.Is(err, db.ErrInvalidPattern) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Pattern names are lowercase letters, digits, _ and -, and system is required [sp-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to save pattern [sp-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [sp-003]"})
+		}
+
+		pattern, _ := catalog.Get(name)
+		if existed {
+			return c.JSON(http.StatusOK, pattern)
+		}
+		return c.JSON(http.StatusCreated, pattern)
+	}
+}
+
+func DeletePattern(catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := catalog.DeletePattern(c.Param("name"))
+		if errors.Is(err, db.ErrPatternNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Pattern not found [dp-001]"})
+		}
+		if err != nil {
+			log.Println("Failed to delete pattern [dp-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dp-002]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// changeUserRole saves a new role and, when it is a demotion, revokes the
+// user's sessions
+func changeUserRole(ctx context.Context, repo repository.Repository, sessions *SessionCache, userID uuid.UUID, from string, to string) error {
+	if err := repo.SetUserRole(ctx, userID, to); err != nil {
+		return err
+	}
+	if auth.HighestRole([]string{from, to}) != from {
+		return nil
+	}
+	revoked, err := repo.RevokeUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	sessions.Revoke(revoked...)
+	return nil
+}
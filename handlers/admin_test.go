@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// asRole stands in for AuthMiddleware with a login of userID in role
+func asRole(userID uuid.UUID, role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("userID", userID.String())
+			c.Set("role", role)
+			return next(c)
+		}
+	}
+}
+
+type adminTest struct {
+	repo     *memory.Repository
+	admin    *models.User
+	bob      *models.User
+	e        *echo.Echo
+	bobToken string
+}
+
+// newAdminTest routes the admin API as main does for the given role, and a
+// session-checked route bob is signed in to
+func newAdminTest(t *testing.T, role string) *adminTest {
+	t.Helper()
+	repo := newTestRepo(t)
+	admin := createTestUser(t, repo, "ada", "correct horse")
+	bob := createTestUser(t, repo, "bob", "battery staple")
+	catalog := newTestCatalog(t)
+	sessions := NewSessionCache(repo)
+
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+	e.GET("/me", GetMe(repo), AuthMiddleware(repo, sessions))
+	g := e.Group("/admin", asRole(admin.ID, role))
+	g.POST("/models", CreateAIModel(repo), RequirePermission(auth.PermissionManageModels))
+	g.PUT("/models/:id", UpdateAIModel(repo), RequirePermission(auth.PermissionManageModels))
+	g.DELETE("/models/:id", DeleteAIModel(repo), RequirePermission(auth.PermissionManageModels))
+	g.GET("/users", GetUsers(repo), RequirePermission(auth.PermissionManageUsers))
+	g.GET("/users/:id", GetUserByID(repo), RequirePermission(auth.PermissionManageUsers))
+	g.PUT("/users/:id/active", UpdateUserActive(repo, sessions), RequirePermission(auth.PermissionManageUsers))
+	g.PUT("/users/:id/role", UpdateUserRole(repo, sessions), RequirePermission(auth.PermissionManageUsers))
+	g.DELETE("/users/:id", DeleteUser(repo, sessions), RequirePermission(auth.PermissionManageUsers))
+	g.PUT("/patterns/:name", SavePattern(catalog), RequirePermission(auth.PermissionManagePatterns))
+	g.DELETE("/patterns/:name", DeletePattern(catalog), RequirePermission(auth.PermissionManagePatterns))
+
+	return &adminTest{repo: repo, admin: admin, bob: bob, e: e, bobToken: deviceLogin(t, e, "bob", "battery staple", "phone")}
+}
+
+func TestAdminRoutesNeedPermission(t *testing.T) {
+	for _, role := range []string{auth.RoleUser, ""} {
+		a := newAdminTest(t, role)
+		for _, route := range []struct{ method, target string }{
+			{http.MethodPost, "/admin/models"},
+			{http.MethodGet, "/admin/users"},
+			{http.MethodPut, "/admin/users/" + a.bob.ID.String() + "/active"},
+			{http.MethodPut, "/admin/patterns/summarize"},
+		} {
+			if rec := serve(a.e, route.method, route.target, `{}`); rec.Code != http.StatusForbidden {
+				t.Errorf("role %q got %d for %s %s, want 403", role, rec.Code, route.method, route.target)
+			}
+		}
+	}
+}
+
+func TestAdminAIModels(t *testing.T) {
+	a := newAdminTest(t, auth.RoleAdmin)
+	if rec := serve(a.e, http.MethodPost, "/admin/models", `{"name": " ", "version": "1"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "cam-001") {
+		t.Fatalf("a model without a name got %d %s", rec.Code, rec.Body)
+	}
+	rec := serve(a.e, http.MethodPost, "/admin/models", `{"name": "gpt-4o", "version": "2024-08-06"}`)
+	var model models.AIModel
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &model) != nil || !model.IsActive {
+		t.Fatalf("creating a model returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodPost, "/admin/models", `{"name": "gpt-4o", "version": "2"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("a duplicate model got %d, want 409", rec.Code)
+	}
+	modelPath := "/admin/models/" + model.ID.String()
+
+	rec = serve(a.e, http.MethodPut, modelPath, `{"name": "gpt-4o", "version": "2024-11-20", "is_active": false}`)
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &model) != nil || model.IsActive || model.Version != "2024-11-20" {
+		t.Fatalf("updating the model returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodPut, "/admin/models/"+uuid.NewString(), `{"name": "x", "version": "1"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("updating an unknown model got %d, want 404", rec.Code)
+	}
+
+	// A model someone chose as their default can only be deactivated
+	ctx := context.Background()
+	if err := a.repo.SaveUserPreferences(ctx, &models.UserPreferences{UserID: a.bob.ID, DefaultAIModel: &model.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(a.e, http.MethodDelete, modelPath, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("deleting a model in use got %d, want 409", rec.Code)
+	}
+	if err := a.repo.SaveUserPreferences(ctx, &models.UserPreferences{UserID: a.bob.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(a.e, http.MethodDelete, modelPath, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting the model returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodDelete, modelPath, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting the model twice got %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	a := newAdminTest(t, auth.RoleAdmin)
+
+	var users []*models.User
+	if rec := serve(a.e, http.MethodGet, "/admin/users?q=BO", ""); json.Unmarshal(rec.Body.Bytes(), &users) != nil || len(users) != 1 || users[0].ID != a.bob.ID {
+		t.Fatalf("searching users returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodGet, "/admin/users?limit=101", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an oversized page got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodGet, "/admin/users/"+uuid.NewString(), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("an unknown user got %d, want 404", rec.Code)
+	}
+
+	adminPath, bobPath := "/admin/users/"+a.admin.ID.String(), "/admin/users/"+a.bob.ID.String()
+	if rec := serve(a.e, http.MethodPut, adminPath+"/active", `{"is_active": false}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("deactivating yourself got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodPut, bobPath+"/active", `{}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("a request without is_active got %d, want 400", rec.Code)
+	}
+	rec := serve(a.e, http.MethodPut, bobPath+"/active", `{"is_active": false}`)
+	var bob models.User
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &bob) != nil || bob.IsActive {
+		t.Fatalf("deactivating bob returned %d: %s", rec.Code, rec.Body)
+	}
+	// Deactivation signs bob out and keeps them out
+	if rec := withToken(a.e, http.MethodGet, "/me", a.bobToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a deactivated user's session got %d, want 401", rec.Code)
+	}
+	if rec := basicLogin(a.e, "bob", "battery staple"); rec.Code != http.StatusForbidden {
+		t.Fatalf("a deactivated user logging in got %d, want 403", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodPut, bobPath+"/active", `{"is_active": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("reactivating bob returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := basicLogin(a.e, "bob", "battery staple"); rec.Code != http.StatusOK {
+		t.Fatalf("a reactivated user logging in got %d", rec.Code)
+	}
+
+	events, err := a.repo.GetSecurityEvents(context.Background(), &a.bob.ID, 10, 0)
+	if err != nil || len(events) < 2 || events[0].EventType != "user_activated" || events[1].EventType != "user_deactivated" {
+		t.Fatalf("security events = %+v (%v)", events, err)
+	}
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	a := newAdminTest(t, auth.RoleAdmin)
+	bobPath := "/admin/users/" + a.bob.ID.String()
+	if rec := serve(a.e, http.MethodDelete, "/admin/users/"+a.admin.ID.String(), ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("deleting yourself got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodDelete, "/admin/users/nope", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid user ID got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodDelete, "/admin/users/"+uuid.NewString(), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting an unknown user got %d, want 404", rec.Code)
+	}
+
+	if rec := serve(a.e, http.MethodDelete, bobPath, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting bob returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := withToken(a.e, http.MethodGet, "/me", a.bobToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a deleted user's session got %d, want 401", rec.Code)
+	}
+	if rec := basicLogin(a.e, "bob", "battery staple"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a deleted user logging in got %d, want 401", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodDelete, bobPath, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting bob twice got %d, want 404", rec.Code)
+	}
+
+	events, err := a.repo.GetSecurityEvents(context.Background(), nil, 10, 0)
+	if err != nil || len(events) == 0 || events[0].EventType != "user_deleted" || events[0].Detail["user_id"] != a.bob.ID.String() || *events[0].ActorID != a.admin.ID {
+		t.Fatalf("security events = %+v (%v)", events, err)
+	}
+}
+
+func TestAdminUserRoles(t *testing.T) {
+	a := newAdminTest(t, auth.RoleAdmin)
+	adminPath, bobPath := "/admin/users/"+a.admin.ID.String(), "/admin/users/"+a.bob.ID.String()
+
+	if rec := serve(a.e, http.MethodPut, bobPath+"/role", `{"role": "owner"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an unknown role got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodPut, adminPath+"/role", `{"role": "user"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("changing your own role got %d, want 400", rec.Code)
+	}
+
+	// A promotion keeps the user signed in
+	if rec := serve(a.e, http.MethodPut, bobPath+"/role", `{"role": "admin"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"role":"admin"`) {
+		t.Fatalf("promoting bob returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := withToken(a.e, http.MethodGet, "/me", a.bobToken); rec.Code != http.StatusOK {
+		t.Fatalf("a promoted user's session got %d", rec.Code)
+	}
+	// A demotion signs them out so no access token keeps the admin role
+	if rec := serve(a.e, http.MethodPut, bobPath+"/role", `{"role": "user"}`); rec.Code != http.StatusOK {
+		t.Fatalf("demoting bob returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := withToken(a.e, http.MethodGet, "/me", a.bobToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a demoted user's session got %d, want 401", rec.Code)
+	}
+}
+
+func TestAdminPatterns(t *testing.T) {
+	a := newAdminTest(t, auth.RoleAdmin)
+	if rec := serve(a.e, http.MethodPut, "/admin/patterns/Bad%20Name", `{"system": "You summarize."}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid name got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodPut, "/admin/patterns/summarize", `{"user": "only a user prompt"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("a pattern without a system prompt got %d, want 400", rec.Code)
+	}
+	if rec := serve(a.e, http.MethodPut, "/admin/patterns/summarize", `{"system": "You summarize."}`); rec.Code != http.StatusCreated {
+		t.Fatalf("creating a pattern returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodPut, "/admin/patterns/summarize", `{"system": "You summarize briefly."}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "briefly") {
+		t.Fatalf("replacing the pattern returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodDelete, "/admin/patterns/summarize", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting the pattern returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(a.e, http.MethodDelete, "/admin/patterns/summarize", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting the pattern twice got %d, want 404", rec.Code)
+	}
+}
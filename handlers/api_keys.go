@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+const maxAPIKeysPerUser = 25
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays of 0 creates a key that does not expire
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// getAPIKeyScopesFromContext returns the scopes of the API key that
+// authenticated the request, or nil when it came from a session
+func getAPIKeyScopesFromContext(c echo.Context) []string {
+	scopes, _ := c.Get("apiKeyScopes").([]string)
+	return scopes
+}
+
+func isAPIKeyRequest(c echo.Context) bool {
+	_, ok := c.Get("apiKeyID").(uuid.UUID)
+	return ok
+}
+
+// authenticateAPIKey is the AuthMiddleware path for API keys
+func authenticateAPIKey(c echo.Context, repo repository.Repository, key string) error {
+	apiKey, err := repo.GetActiveAPIKeyByHash(c.Request().Context(), auth.HashToken(key))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid API key")
+	}
+	if err := repo.TouchAPIKey(c.Request().Context(), apiKey.ID); err != nil {
+		log.Println("Failed to touch api key [ak-001]", err)
+	}
+
+	c.Set("userID", apiKey.UserID.String())
+	c.Set("apiKeyID", apiKey.ID)
+	c.Set("apiKeyScopes", apiKey.Scopes)
+	return nil
+}
+
+// RequireScope lets API keys through only if they have scope. Session logins are not restricted.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if isAPIKeyRequest(c) && !lo.Contains(getAPIKeyScopesFromContext(c), scope) {
+				return echo.NewHTTPError(http.StatusForbidden, "API key is missing the "+scope+" scope")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireSession keeps API keys out of account management routes
+func RequireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isAPIKeyRequest(c) {
+			return echo.NewHTTPError(http.StatusForbidden, "API keys cannot be used for this route")
+		}
+		return next(c)
+	}
+}
+
+// CreateAPIKey mints a key for the caller. The key is in the response only this once.
+func CreateAPIKey(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [cak-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [cak-001]"})
+		}
+
+		var req createAPIKeyRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [cak-002]"})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required and at most 100 characters [cak-003]"})
+		}
+		if len(req.Scopes) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "At least one scope is required [cak-004]"})
+		}
+		for _, scope := range req.Scopes {
+			if !auth.ValidScope(scope) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown scope " + scope + " [cak-005]"})
+			}
+		}
+		if req.ExpiresInDays < 0 || req.ExpiresInDays > 3650 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "expires_in_days must be between 0 and 3650 [cak-006]"})
+		}
+
+		existing, err := repo.GetAPIKeysByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get api keys [cak-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cak-007]"})
+		}
+		if len(existing) >= maxAPIKeysPerUser {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Too many API keys, revoke one first [cak-008]"})
+		}
+
+		key, prefix, err := auth.GenerateAPIKey()
+		if err != nil {
+			log.Println("Failed to generate api key [cak-009]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cak-009]"})
+		}
+		apiKey := &models.APIKey{
+			UserID:  userID,
+			Name:    req.Name,
+			Prefix:  prefix,
+			KeyHash: auth.HashToken(key),
+			Scopes:  lo.Uniq(req.Scopes),
+		}
+		if req.ExpiresInDays > 0 {
+			expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+			apiKey.ExpiresAt = &expiresAt
+		}
+		if err := repo.CreateAPIKey(c.Request().Context(), apiKey); err != nil {
+			log.Println("Failed to create api key [cak-010]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cak-010]"})
+		}
+
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"key":     key,
+			"api_key": apiKey,
+		})
+	}
+}
+
+// GetAPIKeys lists the caller's keys without the keys themselves
+func GetAPIKeys(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gak-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gak-001]"})
+		}
+
+		keys, err := repo.GetAPIKeysByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get api keys [gak-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gak-002]"})
+		}
+		return c.JSON(http.StatusOK, keys)
+	}
+}
+
+func DeleteAPIKey(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [dak-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [dak-001]"})
+		}
+
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid API key ID [dak-002]"})
+		}
+
+		revoked, err := repo.RevokeAPIKey(c.Request().Context(), id, userID)
+		if err != nil {
+			log.Println("Failed to revoke api key [dak-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dak-003]"})
+		}
+		if !revoked {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "API key not found [dak-004]"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// withBearer sends a JSON request with credentials in the Authorization header
+func withBearer(e *echo.Echo, method string, target string, credential string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+credential)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// newAPIKeyServer routes the API key endpoints and a route for each scope
+// behind AuthMiddleware, and returns an access token for ada
+func newAPIKeyServer(t *testing.T) (*echo.Echo, string) {
+	t.Helper()
+	repo := newTestRepo(t)
+	createTestUser(t, repo, "ada", "correct horse")
+	createTestUser(t, repo, "bob", "battery staple")
+	sessions := NewSessionCache(repo)
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	api := e.Group("/api/v1", AuthMiddleware(repo, sessions))
+	api.GET("/chat-history", ok, RequireScope(auth.ScopeHistoryRead))
+	api.POST("/conversation", ok, RequireScope(auth.ScopeChatWrite))
+	account := api.Group("", RequireSession)
+	account.POST("/api-keys", CreateAPIKey(repo))
+	account.GET("/api-keys", GetAPIKeys(repo))
+	account.DELETE("/api-keys/:id", DeleteAPIKey(repo))
+	return e, deviceLogin(t, e, "ada", "correct horse", "laptop")
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	e, access := newAPIKeyServer(t)
+	for _, tt := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no name", `{"name": "  ", "scopes": ["chat:write"]}`, "cak-003"},
+		{"long name", `{"name": "` + strings.Repeat("k", 101) + `", "scopes": ["chat:write"]}`, "cak-003"},
+		{"no scopes", `{"name": "ci"}`, "cak-004"},
+		{"unknown scope", `{"name": "ci", "scopes": ["admin"]}`, "cak-005"},
+		{"negative expiry", `{"name": "ci", "scopes": ["chat:write"], "expires_in_days": -1}`, "cak-006"},
+		{"long expiry", `{"name": "ci", "scopes": ["chat:write"], "expires_in_days": 3651}`, "cak-006"},
+	} {
+		if rec := withBearer(e, http.MethodPost, "/api/v1/api-keys", access, tt.body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want 400 with %s", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	for i := 0; i < maxAPIKeysPerUser; i++ {
+		if rec := withBearer(e, http.MethodPost, "/api/v1/api-keys", access, `{"name": "ci", "scopes": ["chat:write"]}`); rec.Code != http.StatusCreated {
+			t.Fatalf("creating key %d returned %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	if rec := withBearer(e, http.MethodPost, "/api/v1/api-keys", access, `{"name": "ci", "scopes": ["chat:write"]}`); rec.Code != http.StatusConflict {
+		t.Fatalf("a key over the limit got %d, want 409", rec.Code)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	e, access := newAPIKeyServer(t)
+
+	rec := withBearer(e, http.MethodPost, "/api/v1/api-keys", access, `{"name": " reader ", "scopes": ["history:read", "history:read"], "expires_in_days": 30}`)
+	var created struct {
+		Key    string        `json:"key"`
+		APIKey models.APIKey `json:"api_key"`
+	}
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &created) != nil {
+		t.Fatalf("creating a key returned %d: %s", rec.Code, rec.Body)
+	}
+	key := created.APIKey
+	if !auth.IsAPIKey(created.Key) || !strings.HasPrefix(created.Key, key.Prefix) || key.Name != "reader" || len(key.Scopes) != 1 {
+		t.Fatalf("created key = %+v", created)
+	}
+	if key.ExpiresAt == nil || key.ExpiresAt.Before(time.Now().AddDate(0, 0, 29)) {
+		t.Fatalf("key expires at %v, want in 30 days", key.ExpiresAt)
+	}
+
+	// A key only reaches routes its scopes allow, and never account management
+	if rec := withBearer(e, http.MethodGet, "/api/v1/chat-history", created.Key, ""); rec.Code != http.StatusOK {
+		t.Fatalf("a history:read key got %d reading history", rec.Code)
+	}
+	if rec := withBearer(e, http.MethodPost, "/api/v1/conversation", created.Key, ""); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), auth.ScopeChatWrite) {
+		t.Fatalf("a history:read key writing a chat got %d %s, want 403", rec.Code, rec.Body)
+	}
+	if rec := withBearer(e, http.MethodPost, "/api/v1/api-keys", created.Key, `{"name": "escalate", "scopes": ["chat:write"]}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("a key minting keys got %d, want 403", rec.Code)
+	}
+	// Session logins have every scope
+	if rec := withBearer(e, http.MethodPost, "/api/v1/conversation", access, ""); rec.Code != http.StatusOK {
+		t.Fatalf("a session writing a chat got %d", rec.Code)
+	}
+	if rec := withBearer(e, http.MethodGet, "/api/v1/chat-history", auth.APIKeyPrefix+"unknown", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("an unknown key got %d, want 401", rec.Code)
+	}
+
+	rec = withBearer(e, http.MethodGet, "/api/v1/api-keys", access, "")
+	var keys []*models.APIKey
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &keys) != nil || len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Fatalf("listing keys returned %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), created.Key) {
+		t.Fatal("the key list includes the key itself")
+	}
+
+	keyPath := "/api/v1/api-keys/" + key.ID.String()
+	bob := deviceLogin(t, e, "bob", "battery staple", "desktop")
+	if rec := withBearer(e, http.MethodDelete, keyPath, bob, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("another user revoking the key got %d, want 404", rec.Code)
+	}
+	if rec := withBearer(e, http.MethodDelete, "/api/v1/api-keys/nope", access, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid key ID got %d, want 400", rec.Code)
+	}
+	if rec := withBearer(e, http.MethodDelete, keyPath, access, ""); rec.Code != http.StatusOK {
+		t.Fatalf("revoking the key returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := withBearer(e, http.MethodGet, "/api/v1/chat-history", created.Key, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a revoked key got %d, want 401", rec.Code)
+	}
+	if rec := withBearer(e, http.MethodDelete, keyPath, access, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("revoking the key twice got %d, want 404", rec.Code)
+	}
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	e := echo.New()
+	e.GET("/chat-history", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, AuthMiddleware(repo, NewSessionCache(repo)))
+
+	key, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(-time.Minute)
+	err = repo.CreateAPIKey(context.Background(), &models.APIKey{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Name:      "old",
+		Prefix:    prefix,
+		KeyHash:   auth.HashToken(key),
+		Scopes:    []string{auth.ScopeHistoryRead},
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := withBearer(e, http.MethodGet, "/chat-history", key, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("an expired key got %d, want 401", rec.Code)
+	}
+}
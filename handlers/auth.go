@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -9,7 +11,10 @@ import (
 
 	"github.com/FiveEightyEight/gippity-serv/auth"
 	"github.com/FiveEightyEight/gippity-serv/db"
-	"github.com/FiveEightyEight/gippity-serv/utils"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/password"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,7 +23,10 @@ const (
 	refreshTokenCookieName = "mt"
 )
 
-func Login(repo *db.PostgresRepository) echo.HandlerFunc {
+// errAccountDisabled is returned by issueTokens for users an admin deactivated
+var errAccountDisabled = errors.New("account is disabled")
+
+func Login(repo repository.Repository, hasher *password.Hasher) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		authHeader := c.Request().Header.Get("Authorization")
 		if authHeader == "" || len(strings.Split(authHeader, " ")) != 2 {
@@ -30,102 +38,314 @@ func Login(repo *db.PostgresRepository) echo.HandlerFunc {
 			log.Printf("Error decoding credentials: %v", err)
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials encoding"})
 		}
-		credentials := strings.Split(string(decodedCreds), ":")
+		credentials := strings.SplitN(string(decodedCreds), ":", 2)
 		if len(credentials) != 2 {
 			log.Printf("Invalid credentials format: expected 2 parts, got %d", len(credentials))
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials format"})
 		}
-		username, password := credentials[0], credentials[1]
+		username, plaintext := credentials[0], credentials[1]
 
-		user, err := repo.GetUserByUsername(c.Request().Context(), username)
-		if err != nil {
+		// Unknown usernames are throttled and answered exactly like wrong
+		// passwords so responses and timing do not reveal which accounts exist
+		ctx := c.Request().Context()
+		if authLocked(c, repo, accountThrottle.key(username), ipThrottle.key(c.RealIP())) {
+			return nil
+		}
+
+		user, err := repo.GetUserByUsername(ctx, username)
+		if err != nil && !errors.Is(err, db.ErrUserNotFound) {
 			log.Printf("Error getting user by username: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+
+		var ok, needsRehash bool
+		var userID *uuid.UUID
+		if user == nil {
+			hasher.VerifyDecoy(plaintext)
+		} else {
+			userID = &user.ID
+			ok, needsRehash, err = hasher.Verify(plaintext, user.PasswordHash)
+			if err != nil {
+				log.Printf("Error verifying password: %v", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+			}
+		}
+
+		if !ok {
+			countAuthAttempt(c, repo, accountThrottle, username, userID)
+			countAuthAttempt(c, repo, ipThrottle, c.RealIP(), nil)
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 		}
+		if !user.IsActive {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is disabled"})
+		}
+
+		// Upgrade bcrypt, legacy SHA-256 and outdated argon2id hashes now that we have the plaintext
+		if needsRehash {
+			if rehashed, err := hasher.Hash(plaintext); err != nil {
+				log.Printf("Error rehashing password: %v", err)
+			} else if err := repo.UpdateUserPasswordHash(ctx, user.ID, rehashed); err != nil {
+				log.Printf("Error saving rehashed password: %v", err)
+			}
+		}
+
+		return completeLogin(c, repo, user.ID)
+	}
+}
+
+// issueTokens records a new session for a login, sets the refresh cookie and
+// returns the access token
+func issueTokens(c echo.Context, repo repository.Repository, userID uuid.UUID) (string, error) {
+	user, err := repo.GetUserByUUID(c.Request().Context(), userID)
+	if err != nil {
+		return "", err
+	}
+	if !user.IsActive {
+		return "", errAccountDisabled
+	}
+
+	session := &models.Session{
+		UserID:    userID,
+		UserAgent: c.Request().UserAgent(),
+		IPAddress: c.RealIP(),
+	}
+	if err := repo.CreateSession(c.Request().Context(), session); err != nil {
+		return "", err
+	}
+
+	accessToken, err := auth.GenerateAccessToken(userID.String(), session.ID.String(), user.Role)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate access token: %v", err)
+	}
+
+	refreshToken, err := auth.GenerateRefreshToken(userID.String(), session.ID.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	expiresAt := time.Now().Add(auth.RefreshTokenTTL)
+	err = repo.CreateRefreshToken(c.Request().Context(), &models.RefreshToken{
+		FamilyID:  session.ID,
+		UserID:    userID,
+		TokenHash: auth.HashToken(refreshToken),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", err
+	}
 
-		hashedPassword, err := utils.HashString(password)
+	setRefreshCookie(c, refreshToken, expiresAt)
+
+	return accessToken, nil
+}
+
+// AuthMiddleware to validate auth tokens and the session they belong to, or
+// an API key sent in their place
+func AuthMiddleware(repo repository.Repository, sessions *SessionCache) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			authHeader := c.Request().Header.Get("Authorization")
+			if authHeader == "" || len(strings.Split(authHeader, " ")) != 2 {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authorization header"})
+			}
+			tokenString := strings.Split(authHeader, " ")[1]
+			if tokenString == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Missing auth token")
+			}
+
+			if auth.IsAPIKey(tokenString) {
+				if err := authenticateAPIKey(c, repo, tokenString); err != nil {
+					return err
+				}
+				return next(c)
+			}
+
+			claims, err := auth.ValidateToken(tokenString, false)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid auth token")
+			}
+
+			userID, err := uuid.Parse(claims.UserID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid auth token")
+			}
+			sessionID, err := uuid.Parse(claims.SessionID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid auth token")
+			}
+			active, err := sessions.Active(c.Request().Context(), sessionID, userID)
+			if err != nil || !active {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Session has been revoked")
+			}
+			if !mfaEnrollmentRoutes[c.Path()] {
+				satisfied, err := sessions.MFASatisfied(c.Request().Context(), sessionID, userID, claims.Role)
+				if err != nil {
+					log.Println("Failed to check role mfa requirement [am-001]", err)
+					return echo.NewHTTPError(http.StatusInternalServerError, "Internal server error [am-001]")
+				}
+				if !satisfied {
+					return echo.NewHTTPError(http.StatusForbidden, "Two-factor authentication is required for the "+claims.Role+" role; enroll a second factor first")
+				}
+			}
+
+			c.Set("userID", claims.UserID)
+			c.Set("sessionID", sessionID)
+			c.Set("role", claims.Role)
+			return next(c)
+		}
+	}
+}
+
+// RefreshToken rotates the refresh token in the cookie. Each refresh token can
+// be used once; presenting a rotated one again revokes the whole login.
+func RefreshToken(repo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cookie, err := c.Cookie(refreshTokenCookieName)
 		if err != nil {
-			log.Printf("Error hashing password: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Refresh token cookie is missing"})
 		}
+		refreshToken := cookie.Value
 
-		if hashedPassword != user.PasswordHash {
-			log.Printf("Password mismatch for user: %s", username)
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		claims, err := auth.ValidateToken(refreshToken, true)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+		}
+		userID, err := uuid.Parse(claims.UserID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+		}
+		sessionID, err := uuid.Parse(claims.SessionID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
 		}
 
-		accessToken, err := auth.GenerateAccessToken(user.ID.String())
+		// The role is read again so changes made by an admin apply on the next refresh
+		user, err := repo.GetUserByUUID(c.Request().Context(), userID)
 		if err != nil {
-			log.Printf("Error generating access token: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+			log.Printf("Error getting user: %v", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+		}
+		if !user.IsActive {
+			clearRefreshCookie(c)
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is disabled"})
 		}
 
-		refreshToken, err := auth.GenerateRefreshToken(user.ID.String())
+		newRefreshToken, err := auth.GenerateRefreshToken(claims.UserID, claims.SessionID)
 		if err != nil {
 			log.Printf("Error generating refresh token: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while refreshing"})
+		}
+		expiresAt := time.Now().Add(auth.RefreshTokenTTL)
+		next := &models.RefreshToken{
+			FamilyID:  sessionID,
+			UserID:    userID,
+			TokenHash: auth.HashToken(newRefreshToken),
+			ExpiresAt: expiresAt,
 		}
 
-		// Set refresh token as HTTP-only cookie
-		c.SetCookie(&http.Cookie{
-			Name:     refreshTokenCookieName,
-			Value:    refreshToken,
-			Expires:  time.Now().Add(30 * 24 * time.Hour),
-			HttpOnly: true,
-			Secure:   true, // Ensure this is true in production (over HTTPS)
-			SameSite: http.SameSiteStrictMode,
-		})
+		err = repo.RotateRefreshToken(c.Request().Context(), auth.HashToken(refreshToken), next)
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			log.Printf("Refresh token reuse detected, revoked session %s", sessionID)
+			sessions.Revoke(sessionID)
+			clearRefreshCookie(c)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+		}
+		if errors.Is(err, db.ErrRefreshTokenInvalid) {
+			clearRefreshCookie(c)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+		}
+		if err != nil {
+			log.Printf("Error rotating refresh token: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while refreshing"})
+		}
+
+		newAccessToken, err := auth.GenerateAccessToken(claims.UserID, claims.SessionID, user.Role)
+		if err != nil {
+			log.Printf("Error generating access token: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while refreshing"})
+		}
+		if err := repo.TouchSession(c.Request().Context(), sessionID); err != nil {
+			log.Printf("Error touching session: %v", err)
+		}
+
+		setRefreshCookie(c, newRefreshToken, expiresAt)
 
 		return c.JSON(http.StatusOK, map[string]string{
-			"t": accessToken,
+			"t": newAccessToken,
 		})
 	}
 }
 
-// AuthMiddleware to validate auth tokens
-func AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+// Logout revokes the session that the refresh cookie belongs to
+func Logout(repo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		authHeader := c.Request().Header.Get("Authorization")
-		if authHeader == "" || len(strings.Split(authHeader, " ")) != 2 {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authorization header"})
+		token, err := currentRefreshToken(c, repo)
+		if err == nil {
+			if err := repo.RevokeSession(c.Request().Context(), token.FamilyID); err != nil {
+				log.Printf("Error revoking session: %v", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging out"})
+			}
+			sessions.Revoke(token.FamilyID)
 		}
-		tokenString := strings.Split(authHeader, " ")[1]
-		if tokenString == "" {
-			return echo.NewHTTPError(http.StatusUnauthorized, "Missing auth token")
+
+		clearRefreshCookie(c)
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// LogoutAll revokes every session of the user the refresh cookie belongs to
+func LogoutAll(repo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, err := currentRefreshToken(c, repo)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
 		}
 
-		claims, err := auth.ValidateToken(tokenString, false)
+		revoked, err := repo.RevokeUserSessions(c.Request().Context(), token.UserID)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid auth token")
+			log.Printf("Error revoking user sessions: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging out"})
 		}
+		sessions.Revoke(revoked...)
 
-		c.Set("userID", claims.UserID)
-		return next(c)
+		clearRefreshCookie(c)
+		return c.NoContent(http.StatusNoContent)
 	}
 }
 
-func RefreshToken(c echo.Context) error {
+// currentRefreshToken looks up the live record for the refresh cookie
+func currentRefreshToken(c echo.Context, repo repository.Repository) (*models.RefreshToken, error) {
 	cookie, err := c.Cookie(refreshTokenCookieName)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Refresh token cookie is missing"})
+		return nil, err
 	}
-	refreshToken := cookie.Value
-
-	newAccessToken, newRefreshToken, err := auth.RefreshTokens(refreshToken)
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+	if _, err := auth.ValidateToken(cookie.Value, true); err != nil {
+		return nil, err
 	}
+	return repo.GetRefreshTokenByHash(c.Request().Context(), auth.HashToken(cookie.Value))
+}
 
+// setRefreshCookie stores a refresh token in an HTTP-only cookie that is only
+// sent over HTTPS and never cross-site
+func setRefreshCookie(c echo.Context, refreshToken string, expiresAt time.Time) {
 	c.SetCookie(&http.Cookie{
 		Name:     refreshTokenCookieName,
-		Value:    newRefreshToken,
-		Expires:  time.Now().Add(30 * 24 * time.Hour),
+		Value:    refreshToken,
+		Expires:  expiresAt,
 		HttpOnly: true,
-		Secure:   false,                 // Ensure this is true in production (over HTTPS)
-		SameSite: http.SameSiteNoneMode, // Ensure this is true in production (over HTTPS)
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
 	})
+}
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"t": newAccessToken,
+func clearRefreshCookie(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name:     refreshTokenCookieName,
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
 	})
 }
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/labstack/echo/v4"
+)
+
+type refreshTest struct {
+	t    *testing.T
+	repo *memory.Repository
+	e    *echo.Echo
+}
+
+func newRefreshTest(t *testing.T) *refreshTest {
+	repo := newTestRepo(t)
+	createTestUser(t, repo, "ada", "correct horse")
+	sessions := NewSessionCache(repo)
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+	e.POST("/refresh", RefreshToken(repo, sessions))
+	e.POST("/logout", Logout(repo, sessions))
+	e.POST("/logout-all", LogoutAll(repo, sessions))
+	return &refreshTest{t: t, repo: repo, e: e}
+}
+
+// login signs in and returns the refresh cookie
+func (r *refreshTest) login() *http.Cookie {
+	r.t.Helper()
+	rec := basicLogin(r.e, "ada", "correct horse")
+	cookie := responseCookie(rec, refreshTokenCookieName)
+	if rec.Code != http.StatusOK || cookie == nil {
+		r.t.Fatalf("login returned %d without a refresh cookie: %s", rec.Code, rec.Body)
+	}
+	return cookie
+}
+
+func (r *refreshTest) post(target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+	return rec
+}
+
+// expectSecureCookie fails unless cookie can only travel over HTTPS to this site
+func expectSecureCookie(t *testing.T, cookie *http.Cookie) {
+	t.Helper()
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("refresh cookie is HttpOnly=%v Secure=%v SameSite=%v, want HttpOnly, Secure and Strict",
+			cookie.HttpOnly, cookie.Secure, cookie.SameSite)
+	}
+}
+
+func TestRefreshRotatesTheCookie(t *testing.T) {
+	r := newRefreshTest(t)
+	first := r.login()
+	expectSecureCookie(t, first)
+
+	rec := r.post("/refresh", first)
+	second := responseCookie(rec, refreshTokenCookieName)
+	if rec.Code != http.StatusOK || second == nil {
+		t.Fatalf("refresh returned %d without a cookie: %s", rec.Code, rec.Body)
+	}
+	expectSecureCookie(t, second)
+	if second.Value == first.Value {
+		t.Fatal("refresh kept the same token")
+	}
+
+	rec = r.post("/refresh", second)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refreshing with the rotated token returned %d: %s", rec.Code, rec.Body)
+	}
+	expectSecureCookie(t, responseCookie(rec, refreshTokenCookieName))
+}
+
+func TestRefreshTokenReuseRevokesTheSession(t *testing.T) {
+	r := newRefreshTest(t)
+	first := r.login()
+	rec := r.post("/refresh", first)
+	second := responseCookie(rec, refreshTokenCookieName)
+	if rec.Code != http.StatusOK || second == nil {
+		t.Fatalf("refresh returned %d: %s", rec.Code, rec.Body)
+	}
+
+	// Someone presenting the used token means it leaked: the whole login ends
+	if rec := r.post("/refresh", first); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reusing a rotated token returned %d, want 401", rec.Code)
+	}
+	if rec := r.post("/refresh", second); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("the latest token of a revoked login returned %d, want 401", rec.Code)
+	}
+	user, err := r.repo.GetUserByUsername(context.Background(), "ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := r.repo.GetActiveSessionsByUserID(context.Background(), user.ID); err != nil || len(sessions) != 0 {
+		t.Fatalf("user has %d active sessions (%v) after token reuse, want 0", len(sessions), err)
+	}
+}
+
+func TestLogoutRevokesTheSession(t *testing.T) {
+	r := newRefreshTest(t)
+	kept := r.login()
+	cookie := r.login()
+
+	rec := r.post("/logout", cookie)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout returned %d: %s", rec.Code, rec.Body)
+	}
+	if cleared := responseCookie(rec, refreshTokenCookieName); cleared == nil || cleared.Value != "" || cleared.MaxAge >= 0 {
+		t.Fatalf("logout did not clear the refresh cookie: %v", cleared)
+	}
+	if rec := r.post("/refresh", cookie); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout returned %d, want 401", rec.Code)
+	}
+	rec = r.post("/refresh", kept)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logging out one session ended another: %d", rec.Code)
+	}
+	kept = responseCookie(rec, refreshTokenCookieName)
+
+	other := r.login()
+	if rec := r.post("/logout-all", kept); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout-all returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := r.post("/refresh", other); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh of another session after logout-all returned %d, want 401", rec.Code)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -12,6 +11,7 @@ import (
 
 	"github.com/FiveEightyEight/gippity-serv/db"
 	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
@@ -33,19 +33,6 @@ func getEnvKey() string {
 	return apiKey
 }
 
-func loadTZLocation() *time.Location {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file")
-	}
-	locationENV := os.Getenv("LOCATION")
-	location, err := time.LoadLocation(locationENV)
-	if err != nil {
-		log.Fatalf("Error loading location %s", err)
-	}
-	return location
-}
-
 func getUserIDFromContext(c echo.Context) (uuid.UUID, error) {
 	userID := c.Get("userID")
 	if userID == nil {
@@ -86,7 +73,38 @@ func ChatCompletionStream(ctx context.Context, messages []models.MessageContent,
 	return c.CreateChatCompletionStream(ctx, req)
 }
 
-func Conversation(repo *db.PostgresRepository) echo.HandlerFunc {
+// ChatCompletion runs a completion without streaming and returns the full response
+func ChatCompletion(ctx context.Context, messages []models.MessageContent, aiModelVersion string) (string, error) {
+	c := openai.NewClient(getEnvKey())
+
+	openaiMessages := make([]openai.ChatCompletionMessage, len(messages))
+	for i, msg := range messages {
+		openaiMessages[i] = openai.ChatCompletionMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		}
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model:    openai.GPT3Dot5Turbo,
+		Messages: openaiMessages,
+	}
+
+	if aiModelVersion != "" {
+		req.Model = aiModelVersion
+	}
+
+	resp, err := c.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("chat completion returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+func Conversation(repo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID, err := getUserIDFromContext(c)
 		if err != nil {
@@ -107,31 +125,48 @@ func Conversation(repo *db.PostgresRepository) echo.HandlerFunc {
 		}
 
 		var isNewChat bool
+		var newChat *models.Chat
 		var chatID uuid.UUID
 		var aiModelVersion string
+		var workspaceID *uuid.UUID
 		messages := []models.MessageContent{}
-		timeLocation := loadTZLocation()
+		timeLocation := userLocation(c.Request().Context(), repo, userID)
 		// If no chat ID, create a new chat
 		if rawPayload["chat_id"] == "" {
 			isNewChat = true
+			aiModelVersion, _ = rawPayload["ai_model_version"].(string)
+			if aiModelVersion == "" {
+				aiModelVersion = defaultModelVersion(c.Request().Context(), repo, userID)
+			}
+			if rawWorkspaceID, ok := rawPayload["workspace_id"].(string); ok && rawWorkspaceID != "" {
+				parsed, err := uuid.Parse(rawWorkspaceID)
+				if err != nil {
+					log.Println("Failed to parse workspace_id [c-012]", err)
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid workspace_id format [c-012]"})
+				}
+				role, err := repo.GetWorkspaceRole(c.Request().Context(), parsed, userID)
+				if err != nil {
+					log.Println("Failed to get workspace role [c-013]", err)
+					return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-013]"})
+				}
+				if role == "" {
+					return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [c-014]"})
+				}
+				workspaceID = &parsed
+			}
 			currentTime := time.Now().In(timeLocation)
-			newChat := &models.Chat{
+			newChat = &models.Chat{
 				UserID:         userID,
 				Title:          rawPayload["content"].(string)[:min(50, len(rawPayload["content"].(string)))],
 				CreatedAt:      currentTime,
 				LastUpdated:    currentTime,
 				IsArchived:     false,
-				AIModelVersion: rawPayload["ai_model_version"].(string),
+				AIModelVersion: aiModelVersion,
+				WorkspaceID:    workspaceID,
 			}
-
-			createdChat, err := repo.CreateChat(c.Request().Context(), newChat)
-			if err != nil {
-				log.Println("Failed to create new chat [c-3]", err)
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-3]"})
+			if !workspaceModelAllowed(c, repo, newChat) {
+				return nil
 			}
-			aiModelVersion = createdChat.AIModelVersion
-			rawPayload["chat_id"] = createdChat.ID
-			chatID = createdChat.ID
 		} else {
 			rawChatID := rawPayload["chat_id"]
 			chatIDString, ok := rawChatID.(string)
@@ -145,10 +180,24 @@ func Conversation(repo *db.PostgresRepository) echo.HandlerFunc {
 				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat_id format [c-005]"})
 			}
 			chat, err := repo.GetChatByID(c.Request().Context(), chatIDParsed)
+			if errors.Is(err, db.ErrChatNotFound) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [c-018]"})
+			}
 			if err != nil {
 				log.Println("Failed to get chat [c-3]", err)
 				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-3]"})
 			}
+			canRead, _, err := db.ChatAccess(c.Request().Context(), repo, chat, userID)
+			if err != nil {
+				log.Println("Failed to check chat access [c-015]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-015]"})
+			}
+			if !canRead {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [c-016]"})
+			}
+			if !workspaceModelAllowed(c, repo, chat) {
+				return nil
+			}
 			aiModelVersion = chat.AIModelVersion
 			chatID = chat.ID
 		}
@@ -169,7 +218,6 @@ func Conversation(repo *db.PostgresRepository) echo.HandlerFunc {
 		// Use the parsed time in the message struct
 		// the user message
 		message := models.Message{
-			ChatID:    chatID,
 			Content:   rawPayload["content"].(string),
 			UserID:    userID,
 			Role:      "user",
@@ -194,78 +242,116 @@ func Conversation(repo *db.PostgresRepository) echo.HandlerFunc {
 			})
 		}
 
-		err = repo.CreateMessage(c.Request().Context(), &message)
+		// A new chat, the user message and the pending reply commit together,
+		// so a failure leaves no chat without its messages
+		reply := &models.Message{
+			UserID:    userID,
+			Role:      "assistant",
+			Status:    db.MessagePending,
+			CreatedAt: time.Now().In(timeLocation),
+		}
+		err = repo.InTx(c.Request().Context(), func(tx repository.ConversationTx) error {
+			if isNewChat {
+				createdChat, err := tx.CreateChat(c.Request().Context(), newChat)
+				if err != nil {
+					return err
+				}
+				chatID = createdChat.ID
+			}
+			message.ChatID = chatID
+			reply.ChatID = chatID
+			if err := tx.CreateMessage(c.Request().Context(), &message); err != nil {
+				return err
+			}
+			if err := tx.CreateMessage(c.Request().Context(), reply); err != nil {
+				return err
+			}
+			return tx.TouchChat(c.Request().Context(), chatID, reply.CreatedAt)
+		})
+		if errors.Is(err, db.ErrChatTrashed) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Chat is in the trash [c-017]"})
+		}
 		if err != nil {
 			log.Println("Failed to save message [c-5]", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-5]"})
 		}
 
+		// The preamble is compiled for every request, so edits apply to ongoing chats
+		if preamble := personalizationPreamble(c.Request().Context(), repo, userID, chatID); preamble != "" {
+			messages = append([]models.MessageContent{{Role: "system", Content: preamble}}, messages...)
+		}
+
 		stream, err := ChatCompletionStream(c.Request().Context(), messages, aiModelVersion)
 		if err != nil {
 			log.Println("Failed to create chat completion stream [c-6]", err)
+			finishReply(c.Request().Context(), repo, reply, "", db.MessageFailed, timeLocation)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-6]"})
 		}
 		defer stream.Close()
 
-		c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
-		c.Response().Header().Set("Connection", "keep-alive")
-		c.Response().Header().Set("X-Chat-Id", chatID.String())
-		c.Response().Header().Set("Access-Control-Expose-Headers", "X-Chat-Id")
-		c.Response().WriteHeader(http.StatusOK)
-
-		assistantResponse := ""
-		for {
-			response, err := stream.Recv()
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if err != nil {
-				log.Println("Stream error [c-7]:", err)
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-7]"})
-			}
-
-			content := response.Choices[0].Delta.Content
-			assistantResponse += content
-			_, err = c.Response().Write([]byte(content))
-			if err != nil {
-				log.Println("Failed to write response [c-8]:", err)
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-8]"})
-			}
-			c.Response().Flush()
-		}
+		setStreamHeaders(c, chatID)
 
-		// Save assistant's response as a new message
-		lastUpdated := time.Now().In(timeLocation)
-		assistantMessage := &models.Message{
-			ChatID:    chatID,
-			UserID:    userID,
-			Content:   assistantResponse,
-			Role:      "assistant",
-			CreatedAt: lastUpdated,
-		}
-		err = repo.CreateMessage(c.Request().Context(), assistantMessage)
+		assistantResponse, err := writeStream(newStreamWriter(c, false), stream)
 		if err != nil {
-			log.Println("Failed to save assistant message [c-9]", err)
-			// Note: We don't return an error here because the response has already been sent to the client
+			log.Println("Stream error [c-7]:", err)
+			finishReply(c.Request().Context(), repo, reply, assistantResponse, db.MessageFailed, timeLocation)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [c-7]"})
 		}
 
-		// Update the Chat's LastUpdated value
-		chat, err := repo.GetChatByID(c.Request().Context(), chatID)
-		if err != nil {
-			log.Println("Failed to get chat for updating LastUpdated [c-10]", err)
-		} else {
-			chat.LastUpdated = lastUpdated
-			err = repo.UpdateChat(c.Request().Context(), chat)
-			if err != nil {
-				log.Println("Failed to update chat's LastUpdated [c-11]", err)
-			}
+		finishReply(c.Request().Context(), repo, reply, assistantResponse, db.MessageComplete, timeLocation)
+		return nil
+	}
+}
+
+// ReplyTimeout is how long an assistant reply may stay pending before the
+// sweeper marks it failed. No stream runs this long, so a reply still pending
+// was abandoned by a server that stopped.
+const ReplyTimeout = time.Hour
+
+// finishReply saves the streamed reply with its final status and moves the
+// chat's last_updated together. It runs even when the client has gone away,
+// so the reply is not left pending, and only logs failures since the
+// response has already been sent.
+func finishReply(ctx context.Context, repo repository.Repository, reply *models.Message, content string, status string, location *time.Location) {
+	ctx = context.WithoutCancel(ctx)
+	reply.Content = content
+	reply.Status = status
+	err := repo.InTx(ctx, func(tx repository.ConversationTx) error {
+		if err := tx.FinishMessage(ctx, reply); err != nil {
+			return err
+		}
+		// A chat trashed while the reply streamed keeps it, so restoring the chat brings it back
+		err := tx.TouchChat(ctx, reply.ChatID, time.Now().In(location))
+		if errors.Is(err, db.ErrChatTrashed) {
+			return nil
 		}
+		return err
+	})
+	if err != nil {
+		log.Println("Failed to save assistant message [fr-001]", err)
+	}
+}
 
-		return nil
+// workspaceModelAllowed responds 403 and returns false if the chat is in a
+// workspace whose model allowlist does not include the chat's model
+func workspaceModelAllowed(c echo.Context, repo repository.Repository, chat *models.Chat) bool {
+	if chat.WorkspaceID == nil {
+		return true
+	}
+	allowed, err := repo.IsModelAllowedInWorkspace(c.Request().Context(), *chat.WorkspaceID, chat.AIModelVersion)
+	if err != nil {
+		log.Println("Failed to check workspace model [wma-001]", err)
+		c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [wma-001]"})
+		return false
 	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, map[string]string{"error": "This model is not allowed in the workspace [wma-002]"})
+		return false
+	}
+	return true
 }
 
-func GetConversation(repo *db.PostgresRepository) echo.HandlerFunc {
+func GetConversation(repo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		chatIDStr := c.QueryParam("id")
 		if chatIDStr == "" {
@@ -285,12 +371,20 @@ func GetConversation(repo *db.PostgresRepository) echo.HandlerFunc {
 		}
 
 		chat, err := repo.GetChatByID(c.Request().Context(), chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [gc-008]"})
+		}
 		if err != nil {
 			log.Println("Failed to get chat [gc-004]", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gc-004]"})
 		}
 
-		if chat.UserID != userID {
+		canRead, _, err := db.ChatAccess(c.Request().Context(), repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [gc-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gc-007]"})
+		}
+		if !canRead {
 			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [gc-005]"})
 		}
 
@@ -304,15 +398,32 @@ func GetConversation(repo *db.PostgresRepository) echo.HandlerFunc {
 	}
 }
 
-func GetChatHistory(repo *db.PostgresRepository) echo.HandlerFunc {
+func GetChatHistory(repo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID, err := getUserIDFromContext(c)
 		if err != nil {
 			log.Println("Failed to get userID from context [gch-001]", err)
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gch-001]"})
 		}
-		sortByDate := true
-		chats, err := repo.GetChatsByUserID(c.Request().Context(), userID, sortByDate)
+		var chats []*models.Chat
+		if raw := c.QueryParam("workspace_id"); raw != "" {
+			workspaceID, err := uuid.Parse(raw)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid workspace ID [gch-003]"})
+			}
+			role, err := repo.GetWorkspaceRole(c.Request().Context(), workspaceID, userID)
+			if err != nil {
+				log.Println("Failed to get workspace role [gch-004]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gch-004]"})
+			}
+			if role == "" {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [gch-005]"})
+			}
+			chats, err = repo.GetChatsByWorkspaceID(c.Request().Context(), workspaceID)
+		} else {
+			sortByDate := true
+			chats, err = repo.GetChatsByUserID(c.Request().Context(), userID, sortByDate)
+		}
 		if err != nil {
 			log.Println("Failed to get chat history [gch-002]", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gch-002]"})
@@ -322,7 +433,7 @@ func GetChatHistory(repo *db.PostgresRepository) echo.HandlerFunc {
 	}
 }
 
-func DeleteChat(repo *db.PostgresRepository) echo.HandlerFunc {
+func DeleteChat(repo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		chatID, err := uuid.Parse(c.Param("id"))
 		if err != nil {
@@ -337,12 +448,20 @@ func DeleteChat(repo *db.PostgresRepository) echo.HandlerFunc {
 		}
 
 		chat, err := repo.GetChatByID(c.Request().Context(), chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [dc-007]"})
+		}
 		if err != nil {
 			log.Println("Failed to get chat [dc-003]", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dc-003]"})
 		}
 
-		if chat.UserID != userID {
+		_, canManage, err := db.ChatAccess(c.Request().Context(), repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [dc-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dc-006]"})
+		}
+		if !canManage {
 			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [dc-004]"})
 		}
 
@@ -352,6 +471,245 @@ func DeleteChat(repo *db.PostgresRepository) echo.HandlerFunc {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dc-005]"})
 		}
 
-		return c.JSON(http.StatusOK, map[string]string{"message": "Chat deleted successfully"})
+		return c.JSON(http.StatusOK, map[string]string{"message": "Chat moved to trash"})
+	}
+}
+
+// GetChatTrash lists the caller's trashed chats, or a workspace's with ?workspace_id=
+func GetChatTrash(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gct-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gct-001]"})
+		}
+		var chats []*models.Chat
+		if raw := c.QueryParam("workspace_id"); raw != "" {
+			workspaceID, err := uuid.Parse(raw)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid workspace ID [gct-002]"})
+			}
+			role, err := repo.GetWorkspaceRole(c.Request().Context(), workspaceID, userID)
+			if err != nil {
+				log.Println("Failed to get workspace role [gct-003]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gct-003]"})
+			}
+			if role == "" {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [gct-004]"})
+			}
+			chats, err = repo.GetTrashedChatsByWorkspaceID(c.Request().Context(), workspaceID)
+		} else {
+			chats, err = repo.GetTrashedChatsByUserID(c.Request().Context(), userID)
+		}
+		if err != nil {
+			log.Println("Failed to get chat trash [gct-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gct-005]"})
+		}
+
+		return c.JSON(http.StatusOK, chats)
+	}
+}
+
+// RestoreChat takes a chat out of the trash; it needs the same access as deleting it
+func RestoreChat(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			log.Println("Invalid chat ID [rc-001]", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [rc-001]"})
+		}
+
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [rc-002]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [rc-002]"})
+		}
+
+		chat, err := repo.GetTrashedChatByID(c.Request().Context(), chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found in trash [rc-003]"})
+		}
+		if err != nil {
+			log.Println("Failed to get trashed chat [rc-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rc-004]"})
+		}
+
+		_, canManage, err := db.ChatAccess(c.Request().Context(), repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [rc-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rc-005]"})
+		}
+		if !canManage {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [rc-006]"})
+		}
+
+		err = repo.RestoreChat(c.Request().Context(), chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found in trash [rc-003]"})
+		}
+		if err != nil {
+			log.Println("Failed to restore chat [rc-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rc-007]"})
+		}
+
+		chat.DeletedAt = nil
+		return c.JSON(http.StatusOK, chat)
+	}
+}
+
+// DeleteMessage moves one message of a chat to the trash. Users who can write
+// to the chat can delete their own messages; deleting others' needs the same
+// access as deleting the chat.
+func DeleteMessage(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [dm-001]"})
+		}
+		messageID, err := uuid.Parse(c.Param("message_id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid message ID [dm-002]"})
+		}
+
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [dm-003]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [dm-003]"})
+		}
+
+		ctx := c.Request().Context()
+		message, err := repo.GetMessageByID(ctx, messageID)
+		if errors.Is(err, db.ErrMessageNotFound) || (err == nil && message.ChatID != chatID) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Message not found [dm-004]"})
+		}
+		if err != nil {
+			log.Println("Failed to get message [dm-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dm-005]"})
+		}
+		chat, err := repo.GetChatByID(ctx, chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [dm-010]"})
+		}
+		if err != nil {
+			log.Println("Failed to get chat [dm-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dm-006]"})
+		}
+
+		canWrite, canManage, err := db.ChatAccess(ctx, repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [dm-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dm-007]"})
+		}
+		if !canManage && !(canWrite && message.UserID == userID) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [dm-008]"})
+		}
+
+		if err := repo.DeleteMessage(ctx, messageID); err != nil {
+			log.Println("Failed to delete message [dm-009]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dm-009]"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Message moved to trash"})
+	}
+}
+
+// GetMessageTrash lists the messages deleted one by one from a chat
+func GetMessageTrash(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [gmt-001]"})
+		}
+
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gmt-002]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gmt-002]"})
+		}
+
+		ctx := c.Request().Context()
+		chat, err := repo.GetChatByID(ctx, chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [gmt-007]"})
+		}
+		if err != nil {
+			log.Println("Failed to get chat [gmt-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gmt-003]"})
+		}
+		canRead, _, err := db.ChatAccess(ctx, repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [gmt-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gmt-004]"})
+		}
+		if !canRead {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [gmt-005]"})
+		}
+
+		messages, err := repo.GetTrashedMessagesByChatID(ctx, chatID)
+		if err != nil {
+			log.Println("Failed to get message trash [gmt-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gmt-006]"})
+		}
+
+		return c.JSON(http.StatusOK, messages)
+	}
+}
+
+// RestoreMessage takes a message out of the trash; it needs the same access as deleting it
+func RestoreMessage(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [rm-001]"})
+		}
+		messageID, err := uuid.Parse(c.Param("message_id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid message ID [rm-002]"})
+		}
+
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [rm-003]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [rm-003]"})
+		}
+
+		ctx := c.Request().Context()
+		message, err := repo.GetTrashedMessageByID(ctx, messageID)
+		if errors.Is(err, db.ErrMessageNotFound) || (err == nil && message.ChatID != chatID) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Message not found in trash [rm-004]"})
+		}
+		if err != nil {
+			log.Println("Failed to get trashed message [rm-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rm-005]"})
+		}
+		chat, err := repo.GetChatByID(ctx, chatID)
+		if errors.Is(err, db.ErrChatNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [rm-010]"})
+		}
+		if err != nil {
+			log.Println("Failed to get chat [rm-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rm-006]"})
+		}
+
+		canWrite, canManage, err := db.ChatAccess(ctx, repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [rm-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rm-007]"})
+		}
+		if !canManage && !(canWrite && message.UserID == userID) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [rm-008]"})
+		}
+
+		err = repo.RestoreMessage(ctx, messageID)
+		if errors.Is(err, db.ErrMessageNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Message not found in trash [rm-004]"})
+		}
+		if err != nil {
+			log.Println("Failed to restore message [rm-009]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rm-009]"})
+		}
+
+		message.DeletedAt = nil
+		return c.JSON(http.StatusOK, message)
 	}
 }
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMessageTrash(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	owner := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: "x"}
+	other := &models.User{Username: "bob", Email: "bob@example.com", PasswordHash: "x"}
+	for _, user := range []*models.User{owner, other} {
+		if err := repo.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	chat, err := repo.CreateChat(ctx, &models.Chat{UserID: owner.ID, Title: "chat", CreatedAt: now, LastUpdated: now, AIModelVersion: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &models.Message{ChatID: chat.ID, UserID: owner.ID, Role: "user", Content: "hello", CreatedAt: now}
+	if err := repo.CreateMessage(ctx, message); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := func(e *echo.Echo) {
+		e.DELETE("/chat/:id/messages/:message_id", DeleteMessage(repo))
+		e.GET("/chat/:id/trash", GetMessageTrash(repo))
+		e.POST("/chat/:id/messages/:message_id/restore", RestoreMessage(repo))
+	}
+	asOwner, asOther := echo.New(), echo.New()
+	asOwner.Use(asUser(owner.ID))
+	asOther.Use(asUser(other.ID))
+	routes(asOwner)
+	routes(asOther)
+	messagePath := "/chat/" + chat.ID.String() + "/messages/" + message.ID.String()
+
+	if rec := serve(asOther, http.MethodDelete, messagePath, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("another user deleting the message got %d, want 403", rec.Code)
+	}
+	if rec := serve(asOwner, http.MethodDelete, "/chat/"+chat.ID.String()+"/messages/"+chat.ID.String(), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting an unknown message got %d, want 404", rec.Code)
+	}
+	if rec := serve(asOwner, http.MethodDelete, messagePath, ""); rec.Code != http.StatusOK {
+		t.Fatalf("deleting the message got %d: %s", rec.Code, rec.Body)
+	}
+	if messages, _ := repo.GetMessagesByChatID(ctx, chat.ID); len(messages) != 0 {
+		t.Fatalf("chat still shows %d messages after the delete", len(messages))
+	}
+
+	rec := serve(asOwner, http.MethodGet, "/chat/"+chat.ID.String()+"/trash", "")
+	var trash []*models.Message
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &trash) != nil {
+		t.Fatalf("listing the trash got %d: %s", rec.Code, rec.Body)
+	}
+	if len(trash) != 1 || trash[0].ID != message.ID || trash[0].DeletedAt == nil {
+		t.Fatalf("trash = %s, want the deleted message", rec.Body)
+	}
+	if rec := serve(asOther, http.MethodGet, "/chat/"+chat.ID.String()+"/trash", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("another user listing the trash got %d, want 403", rec.Code)
+	}
+
+	if rec := serve(asOther, http.MethodPost, messagePath+"/restore", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("another user restoring the message got %d, want 403", rec.Code)
+	}
+	if rec := serve(asOwner, http.MethodPost, messagePath+"/restore", ""); rec.Code != http.StatusOK {
+		t.Fatalf("restoring the message got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(asOwner, http.MethodPost, messagePath+"/restore", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("restoring the message twice got %d, want 404", rec.Code)
+	}
+	if messages, _ := repo.GetMessagesByChatID(ctx, chat.ID); len(messages) != 1 {
+		t.Fatalf("chat shows %d messages after the restore, want 1", len(messages))
+	}
+
+	// Messages trashed with their chat come back with the chat, not one by one
+	if rec := serve(asOwner, http.MethodDelete, messagePath, ""); rec.Code != http.StatusOK {
+		t.Fatalf("deleting the message again got %d", rec.Code)
+	}
+	if err := repo.DeleteChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(asOwner, http.MethodPost, messagePath+"/restore", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("restoring a message of a trashed chat got %d, want 404", rec.Code)
+	}
+}
+
+func TestTrashedOrMissingChatIsNotFound(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	owner := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: "x"}
+	if err := repo.CreateUser(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	chat, err := repo.CreateChat(ctx, &models.Chat{UserID: owner.ID, Title: "chat", CreatedAt: now, LastUpdated: now, AIModelVersion: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(asUser(owner.ID))
+	e.POST("/conversation", Conversation(repo))
+	e.GET("/chat", GetConversation(repo))
+	e.DELETE("/chat/:id", DeleteChat(repo))
+	for _, id := range []string{chat.ID.String(), uuid.NewString()} {
+		if rec := serve(e, http.MethodPost, "/conversation", `{"chat_id": "`+id+`", "content": "hello"}`); rec.Code != http.StatusNotFound {
+			t.Fatalf("posting to chat %s got %d, want 404: %s", id, rec.Code, rec.Body)
+		}
+		if rec := serve(e, http.MethodGet, "/chat?id="+id, ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("getting chat %s got %d, want 404: %s", id, rec.Code, rec.Body)
+		}
+		if rec := serve(e, http.MethodDelete, "/chat/"+id, ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("deleting chat %s got %d, want 404: %s", id, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestFinishReply(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newReply := func() (*models.Chat, *models.Message) {
+		t.Helper()
+		created := time.Now().Add(-time.Hour)
+		chat, err := repo.CreateChat(context.Background(), &models.Chat{UserID: user.ID, Title: "chat", CreatedAt: created, LastUpdated: created})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "assistant", Status: db.MessagePending, CreatedAt: created}
+		if err := repo.CreateMessage(context.Background(), reply); err != nil {
+			t.Fatal(err)
+		}
+		return chat, reply
+	}
+
+	// The reply is saved even after the client has gone away
+	chat, reply := newReply()
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	finishReply(gone, repo, reply, "partial answer", db.MessageFailed, tokyo)
+	saved, err := repo.GetMessageByID(context.Background(), reply.ID)
+	if err != nil || saved.Content != "partial answer" || saved.Status != db.MessageFailed {
+		t.Fatalf("the finished reply is %+v, %v", saved, err)
+	}
+	touched, err := repo.GetChatByID(context.Background(), chat.ID)
+	if err != nil || time.Since(touched.LastUpdated) > time.Minute {
+		t.Fatalf("last_updated is %v (%v), want now", touched.LastUpdated, err)
+	}
+
+	// A chat trashed while the reply streamed keeps the reply
+	chat, reply = newReply()
+	if err := repo.DeleteChat(context.Background(), chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	finishReply(context.Background(), repo, reply, "answer", db.MessageComplete, tokyo)
+	if err := repo.RestoreChat(context.Background(), chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := repo.GetMessageContentsByChatID(context.Background(), chat.ID)
+	if err != nil || len(contents) != 1 || contents[0].Content != "answer" {
+		t.Fatalf("the restored chat has %v (%v), want the reply", contents, err)
+	}
+}
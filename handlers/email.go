@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/mailer"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/password"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/labstack/echo/v4"
+)
+
+// emailTokenTTLs is how long each kind of emailed link stays usable
+var emailTokenTTLs = map[string]time.Duration{
+	db.EmailTokenVerify:    24 * time.Hour,
+	db.EmailTokenReset:     time.Hour,
+	db.EmailTokenMagicLink: 15 * time.Minute,
+}
+
+// emailTokenPaths are the frontend pages the links point at; the page posts the token back
+var emailTokenPaths = map[string]string{
+	db.EmailTokenVerify:    "/verify-email",
+	db.EmailTokenReset:     "/reset-password",
+	db.EmailTokenMagicLink: "/magic-link",
+}
+
+type emailTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// appURL is the base of links in emails, from APP_URL
+func appURL() string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "http://localhost:4321"
+	}
+	return strings.TrimRight(base, "/")
+}
+
+// sendEmailToken creates a token for purpose, replacing any unused one, and mails its link to the user
+func sendEmailToken(ctx context.Context, repo repository.Repository, mail mailer.Mailer, user *models.User, purpose string) error {
+	token, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	err = repo.CreateEmailToken(ctx, &models.EmailToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: time.Now().Add(emailTokenTTLs[purpose]),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s%s?token=%s", appURL(), emailTokenPaths[purpose], url.QueryEscape(token))
+	msg := mailer.Message{To: user.Email}
+	switch purpose {
+	case db.EmailTokenVerify:
+		msg.Subject = "Verify your email address"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening the link below. It expires in 24 hours.\n\n%s\n", user.Username, link)
+	case db.EmailTokenReset:
+		msg.Subject = "Reset your password"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nSomeone asked to reset your password. If it was you, open the link below within an hour. Otherwise you can ignore this email.\n\n%s\n", user.Username, link)
+	case db.EmailTokenMagicLink:
+		msg.Subject = "Your sign-in link"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nOpen the link below within 15 minutes to sign in. It can only be used once.\n\n%s\n", user.Username, link)
+	}
+	return mail.Send(ctx, msg)
+}
+
+// sendEmailTokenInBackground mails a token without holding up the request, so
+// the response time does not reveal whether the address has an account
+func sendEmailTokenInBackground(repo repository.Repository, mail mailer.Mailer, user *models.User, purpose string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := sendEmailToken(ctx, repo, mail, user, purpose); err != nil {
+			log.Println("Failed to send email token [et-001]", purpose, err)
+		}
+	}()
+}
+
+// SendVerificationEmail sends the signed in user a new verification link
+func SendVerificationEmail(repo repository.Repository, mail mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [sve-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+		user, err := repo.GetUserByUUID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get user [sve-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send verification email"})
+		}
+		if user.EmailVerifiedAt != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Email is already verified"})
+		}
+		if err := sendEmailToken(c.Request().Context(), repo, mail, user, db.EmailTokenVerify); err != nil {
+			log.Println("Failed to send verification email [sve-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send verification email"})
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// VerifyEmail consumes a verification token
+func VerifyEmail(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req emailTokenRequest
+		if err := c.Bind(&req); err != nil || req.Token == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Token is required"})
+		}
+
+		userID, err := repo.ConsumeEmailToken(c.Request().Context(), auth.HashToken(req.Token), db.EmailTokenVerify)
+		if errors.Is(err, db.ErrEmailTokenInvalid) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+		}
+		if err != nil {
+			log.Println("Failed to consume verification token [ve-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify email"})
+		}
+		if err := repo.MarkEmailVerified(c.Request().Context(), userID); err != nil {
+			log.Println("Failed to mark email verified [ve-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify email"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// RequestPasswordReset mails a reset link. It answers the same whether or not
+// the address has an account.
+func RequestPasswordReset(repo repository.Repository, mail mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req emailRequest
+		if err := c.Bind(&req); err != nil || req.Email == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email is required"})
+		}
+
+		if user, err := repo.GetUserByEmail(c.Request().Context(), req.Email); err == nil {
+			sendEmailTokenInBackground(repo, mail, user, db.EmailTokenReset)
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// ResetPassword sets a new password with a reset token and signs the user out everywhere
+func ResetPassword(repo repository.Repository, hasher *password.Hasher, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req resetPasswordRequest
+		if err := c.Bind(&req); err != nil || req.Token == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Token is required"})
+		}
+		// Check the policy before consuming the token so a rejected password does not burn the link
+		if err := hasher.Validate(req.Password); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		hashedPassword, err := hasher.Hash(req.Password)
+		if err != nil {
+			log.Println("Failed to hash password [pr-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
+		}
+
+		ctx := c.Request().Context()
+		userID, err := repo.ConsumeEmailToken(ctx, auth.HashToken(req.Token), db.EmailTokenReset)
+		if errors.Is(err, db.ErrEmailTokenInvalid) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+		}
+		if err != nil {
+			log.Println("Failed to consume reset token [pr-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
+		}
+
+		if err := repo.UpdateUserPasswordHash(ctx, userID, hashedPassword); err != nil {
+			log.Println("Failed to update password [pr-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
+		}
+		// The link reached their inbox, which is as good as verifying it
+		if err := repo.MarkEmailVerified(ctx, userID); err != nil {
+			log.Println("Failed to mark email verified [pr-004]", err)
+		}
+		revoked, err := repo.RevokeUserSessions(ctx, userID)
+		if err != nil {
+			log.Println("Failed to revoke sessions after reset [pr-005]", err)
+		}
+		sessions.Revoke(revoked...)
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// RequestMagicLink mails a single-use sign-in link. It answers the same
+// whether or not the address has an account.
+func RequestMagicLink(repo repository.Repository, mail mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req emailRequest
+		if err := c.Bind(&req); err != nil || req.Email == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email is required"})
+		}
+
+		if user, err := repo.GetUserByEmail(c.Request().Context(), req.Email); err == nil {
+			sendEmailTokenInBackground(repo, mail, user, db.EmailTokenMagicLink)
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// MagicLinkLogin signs a user in with a magic-link token, or returns an MFA challenge
+func MagicLinkLogin(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req emailTokenRequest
+		if err := c.Bind(&req); err != nil || req.Token == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Token is required"})
+		}
+
+		ctx := c.Request().Context()
+		userID, err := repo.ConsumeEmailToken(ctx, auth.HashToken(req.Token), db.EmailTokenMagicLink)
+		if errors.Is(err, db.ErrEmailTokenInvalid) {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired token"})
+		}
+		if err != nil {
+			log.Println("Failed to consume magic link token [ml-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		if err := repo.MarkEmailVerified(ctx, userID); err != nil {
+			log.Println("Failed to mark email verified [ml-002]", err)
+		}
+
+		// Email is one factor; users with 2FA still need their code
+		return completeLogin(c, repo, userID)
+	}
+}
+
+// RequireVerifiedEmail restricts routes to users who have verified their email
+func RequireVerifiedEmail(repo repository.Repository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, err := getUserIDFromContext(c)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+			}
+			verified, err := repo.IsEmailVerified(c.Request().Context(), userID)
+			if err != nil {
+				log.Println("Failed to check email verification [rve-001]", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check email verification")
+			}
+			if !verified {
+				return echo.NewHTTPError(http.StatusForbidden, "Verify your email address to use this feature")
+			}
+			return next(c)
+		}
+	}
+}
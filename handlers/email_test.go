@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/mailer"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestOutbox(t *testing.T) *mailer.OutboxMailer {
+	t.Helper()
+	outbox, err := mailer.NewOutboxMailer(t.TempDir(), "test <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbox
+}
+
+// waitForMail returns the nth message the outbox has sent, counting from one,
+// waiting for handlers that mail in the background
+func waitForMail(t *testing.T, outbox *mailer.OutboxMailer, n int) mailer.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sent := outbox.Sent(); len(sent) >= n {
+			return sent[n-1]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("message %d was not sent", n)
+	return mailer.Message{}
+}
+
+// linkToken returns the token in the link of an emailed message
+func linkToken(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+	start := strings.Index(msg.Body, "http")
+	if start < 0 {
+		t.Fatalf("no link in %q", msg.Body)
+	}
+	link, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+	if err != nil || link.Query().Get("token") == "" {
+		t.Fatalf("no token in the link of %q", msg.Body)
+	}
+	return link.Query().Get("token")
+}
+
+func TestVerifyEmail(t *testing.T) {
+	t.Setenv("APP_URL", "https://chat.example.com/")
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	outbox := newTestOutbox(t)
+	e := echo.New()
+	e.POST("/verify-email", VerifyEmail(repo))
+	account := e.Group("", asUser(user.ID))
+	account.POST("/me/verify-email", SendVerificationEmail(repo, outbox))
+	account.GET("/models", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, RequireVerifiedEmail(repo))
+
+	if rec := serve(e, http.MethodGet, "/models", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("an unverified user got %d, want 403", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/me/verify-email", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("asking for a verification email returned %d: %s", rec.Code, rec.Body)
+	}
+	msg := waitForMail(t, outbox, 1)
+	if msg.To != "ada@example.com" || !strings.Contains(msg.Body, "https://chat.example.com/verify-email?token=") {
+		t.Fatalf("verification email = %+v", msg)
+	}
+	token := linkToken(t, msg)
+
+	if rec := serve(e, http.MethodPost, "/verify-email", `{"token": "nope"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an unknown token returned %d, want 400", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/verify-email", `{"token": "`+token+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("verifying returned %d: %s", rec.Code, rec.Body)
+	}
+	// Tokens are single use
+	if rec := serve(e, http.MethodPost, "/verify-email", `{"token": "`+token+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reusing the token returned %d, want 400", rec.Code)
+	}
+	if rec := serve(e, http.MethodGet, "/models", ""); rec.Code != http.StatusOK {
+		t.Fatalf("a verified user got %d, want 200", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/me/verify-email", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("a verified user asking again got %d, want 409", rec.Code)
+	}
+}
+
+func TestEmailTokens(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	outbox := newTestOutbox(t)
+	e := echo.New()
+	e.POST("/verify-email", VerifyEmail(repo))
+	ctx := context.Background()
+
+	// A new link replaces the one before it
+	for i := 1; i <= 2; i++ {
+		if err := sendEmailToken(ctx, repo, outbox, user, db.EmailTokenVerify); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := serve(e, http.MethodPost, "/verify-email", `{"token": "`+linkToken(t, waitForMail(t, outbox, 1))+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("a replaced token returned %d, want 400", rec.Code)
+	}
+
+	// Tokens only work for their own purpose
+	if err := sendEmailToken(ctx, repo, outbox, user, db.EmailTokenReset); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(e, http.MethodPost, "/verify-email", `{"token": "`+linkToken(t, waitForMail(t, outbox, 3))+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("a reset token verified the email: %d", rec.Code)
+	}
+
+	expired, _ := auth.GenerateOpaqueToken()
+	err := repo.CreateEmailToken(ctx, &models.EmailToken{
+		UserID:    user.ID,
+		Purpose:   db.EmailTokenVerify,
+		TokenHash: auth.HashToken(expired),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(e, http.MethodPost, "/verify-email", `{"token": "`+expired+`"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an expired token returned %d, want 400", rec.Code)
+	}
+	if verified, _ := repo.IsEmailVerified(ctx, user.ID); verified {
+		t.Fatal("the email was verified without a valid token")
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	repo := newTestRepo(t)
+	createTestUser(t, repo, "ada", "correct horse")
+	outbox := newTestOutbox(t)
+	sessions := NewSessionCache(repo)
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+	e.POST("/password/forgot", RequestPasswordReset(repo, outbox))
+	e.POST("/password/reset", ResetPassword(repo, testHasher(), sessions))
+	e.GET("/sessions", GetSessions(repo), AuthMiddleware(repo, sessions))
+	access := deviceLogin(t, e, "ada", "correct horse", "laptop")
+
+	// Unknown addresses get the same answer and no mail
+	if rec := serve(e, http.MethodPost, "/password/forgot", `{"email": "nobody@example.com"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("an unknown address got %d, want 202", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/password/forgot", `{"email": "ada@example.com"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("asking for a reset returned %d: %s", rec.Code, rec.Body)
+	}
+	msg := waitForMail(t, outbox, 1)
+	if msg.To != "ada@example.com" || len(outbox.Sent()) != 1 {
+		t.Fatalf("sent %d messages, first to %s", len(outbox.Sent()), msg.To)
+	}
+	token := linkToken(t, msg)
+
+	// A password the policy rejects leaves the link usable
+	if rec := serve(e, http.MethodPost, "/password/reset", `{"token": "`+token+`", "password": "short"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("a short password returned %d, want 400", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/password/reset", `{"token": "`+token+`", "password": "staple battery"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("resetting returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(e, http.MethodPost, "/password/reset", `{"token": "`+token+`", "password": "another horse"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reusing the token returned %d, want 400", rec.Code)
+	}
+
+	if rec := basicLogin(e, "ada", "correct horse"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("the old password got %d, want 401", rec.Code)
+	}
+	if rec := basicLogin(e, "ada", "staple battery"); rec.Code != http.StatusOK {
+		t.Fatalf("the new password got %d: %s", rec.Code, rec.Body)
+	}
+	// Sessions from before the reset are signed out
+	if rec := withToken(e, http.MethodGet, "/sessions", access); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a session from before the reset got %d, want 401", rec.Code)
+	}
+	user, _ := repo.GetUserByUsername(context.Background(), "ada")
+	if verified, _ := repo.IsEmailVerified(context.Background(), user.ID); !verified {
+		t.Fatal("resetting through the emailed link did not verify the address")
+	}
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	repo := newTestRepo(t)
+	createTestUser(t, repo, "ada", "correct horse")
+	outbox := newTestOutbox(t)
+	e := echo.New()
+	e.POST("/magic-link", RequestMagicLink(repo, outbox))
+	e.POST("/magic-link/login", MagicLinkLogin(repo))
+
+	if rec := serve(e, http.MethodPost, "/magic-link", `{}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("a request without an email got %d, want 400", rec.Code)
+	}
+	if rec := serve(e, http.MethodPost, "/magic-link", `{"email": "ada@example.com"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("asking for a link returned %d: %s", rec.Code, rec.Body)
+	}
+	msg := waitForMail(t, outbox, 1)
+	if !strings.Contains(msg.Body, "/magic-link?token=") {
+		t.Fatalf("magic link email = %q", msg.Body)
+	}
+	token := linkToken(t, msg)
+
+	rec := serve(e, http.MethodPost, "/magic-link/login", `{"token": "`+token+`"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"t"`) {
+		t.Fatalf("logging in with the link returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(e, http.MethodPost, "/magic-link/login", `{"token": "`+token+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reusing the link returned %d, want 401", rec.Code)
+	}
+	user, _ := repo.GetUserByUsername(context.Background(), "ada")
+	if verified, _ := repo.IsEmailVerified(context.Background(), user.ID); !verified {
+		t.Fatal("signing in through the emailed link did not verify the address")
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/password"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestRepo returns an empty in-memory repository and signs tokens with a
+// key ring kept in it
+func newTestRepo(t *testing.T) *memory.Repository {
+	t.Helper()
+	repo := memory.New()
+	ring := auth.NewKeyRing(repo, auth.KeyRingConfig{
+		Algorithm:        auth.AlgorithmEdDSA,
+		RotationInterval: time.Hour,
+		PropagationDelay: time.Minute,
+	})
+	if err := ring.Refresh(context.Background()); err != nil {
+		t.Fatalf("failed to load signing keys: %v", err)
+	}
+	auth.SetKeyRing(ring)
+	return repo
+}
+
+// testHasher hashes with the lowest argon2id cost so tests stay fast
+func testHasher() *password.Hasher {
+	hasher := password.NewHasher()
+	hasher.Params.Memory = 64
+	hasher.Params.Iterations = 1
+	hasher.Params.Parallelism = 1
+	return hasher
+}
+
+// asUser stands in for AuthMiddleware with a login of userID
+func asUser(userID uuid.UUID) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("userID", userID.String())
+			return next(c)
+		}
+	}
+}
+
+// serve sends a JSON request to e and returns the response
+func serve(e *echo.Echo, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// createTestUser saves a user who logs in with username and plaintext
+func createTestUser(t *testing.T, repo *memory.Repository, username string, plaintext string) *models.User {
+	t.Helper()
+	hash, err := testHasher().Hash(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Username: username, Email: username + "@example.com", PasswordHash: hash}
+	if err := repo.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// basicLogin posts username and plaintext to /login the way clients send them
+func basicLogin(e *echo.Echo, username string, plaintext string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+plaintext)))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// responseCookie returns the cookie called name that rec sets, or nil
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const maxInstructionsLength = 1500
+
+// personalizationPreamble compiles the system message sent ahead of a chat's
+// messages, or "" when there is nothing to send. Failing to load any part of it
+// is logged rather than failing the conversation.
+func personalizationPreamble(ctx context.Context, repo repository.Repository, userID uuid.UUID, chatID uuid.UUID) string {
+	chat, err := repo.GetChatInstructions(ctx, chatID)
+	if err != nil {
+		log.Println("Failed to get chat instructions [pp-001]", err)
+		return ""
+	}
+	var instructions *models.CustomInstructions
+	var metadata *models.UserMetadata
+	if !chat.PersonalizationDisabled {
+		instructions, err = repo.GetCustomInstructions(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get custom instructions [pp-002]", err)
+			return ""
+		}
+		if len(instructions.MetadataFields) > 0 {
+			metadata, err = repo.GetUserMetadata(ctx, userID)
+			if err != nil {
+				log.Println("Failed to get user metadata [pp-003]", err)
+				return ""
+			}
+		}
+	}
+	return compilePreamble(instructions, metadata, chat)
+}
+
+// compilePreamble puts the shared metadata fields and the instructions into one
+// system prompt. A chat's own instructions replace the user's, and apply even
+// when personalization is disabled for the chat; instructions and metadata are
+// nil when it is.
+func compilePreamble(instructions *models.CustomInstructions, metadata *models.UserMetadata, chat *models.ChatInstructions) string {
+	var sections []string
+
+	if instructions != nil && metadata != nil {
+		var about []string
+		for _, field := range instructions.MetadataFields {
+			switch {
+			case field == "profession" && metadata.Profession != "":
+				about = append(about, "Profession: "+metadata.Profession)
+			case field == "interests" && len(metadata.Interests) > 0:
+				about = append(about, "Interests: "+strings.Join(metadata.Interests, ", "))
+			case field == "preferred_language" && metadata.PreferredLanguage != "":
+				about = append(about, "Preferred language: "+metadata.PreferredLanguage+" (reply in it unless asked otherwise)")
+			case field == "education_level" && metadata.EducationLevel != "":
+				about = append(about, "Education level: "+metadata.EducationLevel)
+			}
+		}
+		if len(about) > 0 {
+			sections = append(sections, "What the user has shared about themselves:\n"+strings.Join(about, "\n"))
+		}
+	}
+
+	text := ""
+	if chat != nil && chat.Instructions != nil {
+		text = *chat.Instructions
+	} else if instructions != nil {
+		text = instructions.Instructions
+	}
+	if text = strings.TrimSpace(text); text != "" {
+		sections = append(sections, "How the user would like you to respond:\n"+text)
+	}
+
+	return strings.Join(sections, "\n\n")
+}
+
+func GetCustomInstructions(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gci-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gci-001]"})
+		}
+		instructions, err := repo.GetCustomInstructions(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get custom instructions [gci-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gci-002]"})
+		}
+		return c.JSON(http.StatusOK, instructions)
+	}
+}
+
+// UpdateCustomInstructions saves the caller's instructions and the metadata
+// fields they share; fields left out keep their value
+func UpdateCustomInstructions(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [uci-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [uci-001]"})
+		}
+
+		ctx := c.Request().Context()
+		instructions, err := repo.GetCustomInstructions(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get custom instructions [uci-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uci-002]"})
+		}
+		if err := c.Bind(instructions); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [uci-003]"})
+		}
+		instructions.UserID = userID
+		if instructions.MetadataFields == nil {
+			instructions.MetadataFields = []string{}
+		}
+
+		if len(instructions.Instructions) > maxInstructionsLength {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("instructions are at most %d characters [uci-004]", maxInstructionsLength)})
+		}
+		for _, field := range instructions.MetadataFields {
+			if !db.ValidPersonalizationField(field) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "metadata_fields may contain " + strings.Join(db.PersonalizationFields, ", ") + " [uci-005]"})
+			}
+		}
+
+		if err := repo.SaveCustomInstructions(ctx, instructions); err != nil {
+			log.Println("Failed to save custom instructions [uci-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uci-006]"})
+		}
+		return c.JSON(http.StatusOK, instructions)
+	}
+}
+
+func GetChatInstructions(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [gchi-001]"})
+		}
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gchi-002]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gchi-002]"})
+		}
+
+		ctx := c.Request().Context()
+		chat, err := repo.GetChatByID(ctx, chatID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [gchi-003]"})
+		}
+		canRead, _, err := db.ChatAccess(ctx, repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [gchi-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gchi-004]"})
+		}
+		if !canRead {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [gchi-003]"})
+		}
+
+		instructions, err := repo.GetChatInstructions(ctx, chatID)
+		if err != nil {
+			log.Println("Failed to get chat instructions [gchi-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gchi-005]"})
+		}
+		return c.JSON(http.StatusOK, instructions)
+	}
+}
+
+// UpdateChatInstructions sets the chat's own instructions, null to use each
+// member's, and whether personalization is disabled for it
+func UpdateChatInstructions(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [uchi-001]"})
+		}
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [uchi-002]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [uchi-002]"})
+		}
+
+		ctx := c.Request().Context()
+		chat, err := repo.GetChatByID(ctx, chatID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [uchi-003]"})
+		}
+		canRead, canManage, err := db.ChatAccess(ctx, repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [uchi-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uchi-004]"})
+		}
+		if !canRead {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [uchi-003]"})
+		}
+		if !canManage {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [uchi-005]"})
+		}
+
+		instructions, err := repo.GetChatInstructions(ctx, chatID)
+		if err != nil {
+			log.Println("Failed to get chat instructions [uchi-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uchi-006]"})
+		}
+		if err := c.Bind(instructions); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [uchi-007]"})
+		}
+		instructions.ChatID = chatID
+		if instructions.Instructions != nil && len(*instructions.Instructions) > maxInstructionsLength {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("instructions are at most %d characters [uchi-008]", maxInstructionsLength)})
+		}
+
+		if err := repo.SaveChatInstructions(ctx, instructions); err != nil {
+			log.Println("Failed to save chat instructions [uchi-009]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uchi-009]"})
+		}
+		return c.JSON(http.StatusOK, instructions)
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCompilePreamble(t *testing.T) {
+	override, blank := "Answer in haiku.", "  "
+	instructions := &models.CustomInstructions{Instructions: "Be brief.", MetadataFields: []string{"interests", "profession", "education_level"}}
+	metadata := &models.UserMetadata{Profession: "mathematician", Interests: []string{"chess", "go"}, PreferredLanguage: "fr"}
+	for _, tt := range []struct {
+		name         string
+		instructions *models.CustomInstructions
+		metadata     *models.UserMetadata
+		chat         *models.ChatInstructions
+		want         string
+	}{
+		{"nothing", nil, nil, &models.ChatInstructions{}, ""},
+		{"instructions only", &models.CustomInstructions{Instructions: " Be brief. "}, nil, nil, "How the user would like you to respond:\nBe brief."},
+		// Fields are listed in the order the user chose, and empty or unshared ones are left out
+		{"metadata", instructions, metadata, &models.ChatInstructions{}, "What the user has shared about themselves:\nInterests: chess, go\nProfession: mathematician\n\nHow the user would like you to respond:\nBe brief."},
+		{"chat override", instructions, nil, &models.ChatInstructions{Instructions: &override}, "How the user would like you to respond:\nAnswer in haiku."},
+		{"blank chat override", instructions, nil, &models.ChatInstructions{Instructions: &blank}, ""},
+		{"personalization disabled", nil, nil, &models.ChatInstructions{Instructions: &override, PersonalizationDisabled: true}, "How the user would like you to respond:\nAnswer in haiku."},
+	} {
+		if got := compilePreamble(tt.instructions, tt.metadata, tt.chat); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPersonalizationPreamble(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	user := createTestUser(t, repo, "ada", "correct horse")
+	chat, err := repo.CreateChat(ctx, &models.Chat{UserID: user.ID, Title: "chat", CreatedAt: time.Now(), LastUpdated: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preamble := personalizationPreamble(ctx, repo, user.ID, chat.ID); preamble != "" {
+		t.Fatalf("the preamble without instructions is %q", preamble)
+	}
+
+	if err := repo.SaveUserMetadata(ctx, &models.UserMetadata{UserID: user.ID, PreferredLanguage: "fr", Interests: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveCustomInstructions(ctx, &models.CustomInstructions{UserID: user.ID, Instructions: "Be brief.", MetadataFields: []string{"preferred_language"}}); err != nil {
+		t.Fatal(err)
+	}
+	preamble := personalizationPreamble(ctx, repo, user.ID, chat.ID)
+	if !strings.Contains(preamble, "Preferred language: fr") || !strings.Contains(preamble, "Be brief.") {
+		t.Fatalf("the preamble is %q", preamble)
+	}
+
+	if err := repo.SaveChatInstructions(ctx, &models.ChatInstructions{ChatID: chat.ID, PersonalizationDisabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if preamble := personalizationPreamble(ctx, repo, user.ID, chat.ID); preamble != "" {
+		t.Fatalf("the preamble with personalization disabled is %q", preamble)
+	}
+}
+
+func TestCustomInstructions(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	e := echo.New()
+	e.GET("/me/instructions", GetCustomInstructions(repo), asUser(user.ID))
+	e.PUT("/me/instructions", UpdateCustomInstructions(repo), asUser(user.ID))
+
+	if rec := serve(e, http.MethodGet, "/me/instructions", ""); !strings.Contains(rec.Body.String(), `"metadata_fields":[]`) {
+		t.Fatalf("empty instructions are %s", rec.Body)
+	}
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{`{"instructions": "` + strings.Repeat("x", maxInstructionsLength+1) + `"}`, "uci-004"},
+		{`{"metadata_fields": ["birth_year"]}`, "uci-005"},
+		{`{"metadata_fields": "profession"}`, "uci-003"},
+	} {
+		if rec := serve(e, http.MethodPut, "/me/instructions", tt.body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%.40s: got %d %s, want 400 with %s", tt.body, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	if rec := serve(e, http.MethodPut, "/me/instructions", `{"instructions": "Be brief.", "metadata_fields": ["profession"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("saving instructions returned %d: %s", rec.Code, rec.Body)
+	}
+	// Fields left out keep their value
+	rec := serve(e, http.MethodPut, "/me/instructions", `{"instructions": "Be thorough."}`)
+	var instructions models.CustomInstructions
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &instructions) != nil {
+		t.Fatalf("saving instructions returned %d: %s", rec.Code, rec.Body)
+	}
+	if instructions.Instructions != "Be thorough." || len(instructions.MetadataFields) != 1 || instructions.UserID != user.ID {
+		t.Fatalf("saved instructions = %+v", instructions)
+	}
+}
+
+func TestChatInstructions(t *testing.T) {
+	repo := newTestRepo(t)
+	ada := createTestUser(t, repo, "ada", "correct horse")
+	bob := createTestUser(t, repo, "bob", "battery staple")
+	chat, err := repo.CreateChat(context.Background(), &models.Chat{UserID: ada.ID, Title: "chat", CreatedAt: time.Now(), LastUpdated: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.GET("/chat/:id/instructions", GetChatInstructions(repo), asUser(ada.ID))
+	e.PUT("/chat/:id/instructions", UpdateChatInstructions(repo), asUser(ada.ID))
+	e.GET("/bob/chat/:id/instructions", GetChatInstructions(repo), asUser(bob.ID))
+	e.PUT("/bob/chat/:id/instructions", UpdateChatInstructions(repo), asUser(bob.ID))
+
+	path := "/chat/" + chat.ID.String() + "/instructions"
+	if rec := serve(e, http.MethodGet, "/chat/nope/instructions", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid chat ID got %d, want 400", rec.Code)
+	}
+	if rec := serve(e, http.MethodGet, "/bob"+path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("another user reading the instructions got %d, want 404", rec.Code)
+	}
+	if rec := serve(e, http.MethodPut, "/bob"+path, `{"personalization_disabled": true}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("another user changing the instructions got %d, want 404", rec.Code)
+	}
+	if rec := serve(e, http.MethodPut, path, `{"instructions": "`+strings.Repeat("x", maxInstructionsLength+1)+`"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "uchi-008") {
+		t.Fatalf("oversized instructions got %d %s, want 400", rec.Code, rec.Body)
+	}
+
+	if rec := serve(e, http.MethodPut, path, `{"instructions": "Answer in haiku."}`); rec.Code != http.StatusOK {
+		t.Fatalf("saving chat instructions returned %d: %s", rec.Code, rec.Body)
+	}
+	rec := serve(e, http.MethodPut, path, `{"personalization_disabled": true}`)
+	var instructions models.ChatInstructions
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &instructions) != nil {
+		t.Fatalf("saving chat instructions returned %d: %s", rec.Code, rec.Body)
+	}
+	if instructions.Instructions == nil || *instructions.Instructions != "Answer in haiku." || !instructions.PersonalizationDisabled {
+		t.Fatalf("saved chat instructions = %+v", instructions)
+	}
+	// null goes back to the user's own instructions
+	if rec := serve(e, http.MethodPut, path, `{"instructions": null}`); rec.Code != http.StatusOK {
+		t.Fatalf("clearing chat instructions returned %d", rec.Code)
+	}
+	rec = serve(e, http.MethodGet, path, "")
+	instructions = models.ChatInstructions{}
+	if json.Unmarshal(rec.Body.Bytes(), &instructions) != nil || instructions.Instructions != nil || !instructions.PersonalizationDisabled {
+		t.Fatalf("chat instructions are %s", rec.Body)
+	}
+}
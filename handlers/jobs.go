@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxJobItems         = 10000
+	defaultJobItemLimit = 100
+	maxJobItemLimit     = 1000
+	jobResultsPageSize  = 500
+)
+
+type createJobRequest struct {
+	Pattern        string            `json:"pattern" form:"pattern"`
+	Inputs         []string          `json:"inputs" form:"-"`
+	Variables      map[string]string `json:"variables" form:"-"`
+	AIModelVersion string            `json:"ai_model_version" form:"ai_model_version"`
+}
+
+// jobResult is one line of the downloadable results file
+type jobResult struct {
+	Position int    `json:"position"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CreateJob queues a pattern to run over many inputs, given as a JSON list or a JSONL upload
+func CreateJob(repo repository.Repository, catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [cj-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [cj-001]"})
+		}
+
+		req, err := bindCreateJobRequest(c)
+		if err != nil {
+			log.Println("Failed to bind job request [cj-002]", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body [cj-002]"})
+		}
+		if len(req.Inputs) == 0 || len(req.Inputs) > maxJobItems {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Between 1 and %d inputs are required [cj-003]", maxJobItems)})
+		}
+		if _, ok := catalog.Get(req.Pattern); !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Pattern not found [cj-004]"})
+		}
+
+		job := &models.Job{
+			UserID:         userID,
+			Pattern:        req.Pattern,
+			Variables:      req.Variables,
+			AIModelVersion: req.AIModelVersion,
+		}
+		if err := repo.CreateJob(c.Request().Context(), job, req.Inputs); err != nil {
+			log.Println("Failed to create job [cj-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cj-005]"})
+		}
+
+		return c.JSON(http.StatusAccepted, job)
+	}
+}
+
+func GetJobs(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gjs-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gjs-001]"})
+		}
+
+		jobs, err := repo.GetJobsByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get jobs [gjs-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gjs-002]"})
+		}
+
+		return c.JSON(http.StatusOK, jobs)
+	}
+}
+
+func GetJob(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		job, err := getOwnedJob(c, repo)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, job)
+	}
+}
+
+func GetJobItems(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		job, err := getOwnedJob(c, repo)
+		if err != nil {
+			return err
+		}
+
+		offset, _ := strconv.Atoi(c.QueryParam("offset"))
+		limit, _ := strconv.Atoi(c.QueryParam("limit"))
+		if limit <= 0 {
+			limit = defaultJobItemLimit
+		}
+		limit = min(limit, maxJobItemLimit)
+
+		items, err := repo.GetJobItems(c.Request().Context(), job.ID, max(offset, 0), limit)
+		if err != nil {
+			log.Println("Failed to get job items [gji-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gji-001]"})
+		}
+
+		return c.JSON(http.StatusOK, items)
+	}
+}
+
+// GetJobResults streams every item's output as JSONL, in input order
+func GetJobResults(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		job, err := getOwnedJob(c, repo)
+		if err != nil {
+			return err
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.jsonl"`, job.ID))
+		c.Response().WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(c.Response())
+		for offset := 0; ; offset += jobResultsPageSize {
+			items, err := repo.GetJobItems(c.Request().Context(), job.ID, offset, jobResultsPageSize)
+			if err != nil {
+				// Headers are already sent, so the download just ends early
+				log.Println("Failed to get job items [gjr-001]", err)
+				return nil
+			}
+			for _, item := range items {
+				if err := encoder.Encode(jobResult{Position: item.Position, Status: item.Status, Output: item.Output, Error: item.Error}); err != nil {
+					log.Println("Failed to write job results [gjr-002]", err)
+					return nil
+				}
+			}
+			if len(items) < jobResultsPageSize {
+				return nil
+			}
+		}
+	}
+}
+
+// getOwnedJob loads the job in the :id param and checks it belongs to the caller
+func getOwnedJob(c echo.Context, repo repository.Repository) (*models.Job, error) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		log.Println("Failed to get userID from context [gj-001]", err)
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized [gj-001]")
+	}
+
+	jobID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid job ID [gj-002]")
+	}
+
+	job, err := repo.GetJobByID(c.Request().Context(), jobID)
+	if err != nil {
+		log.Println("Failed to get job [gj-003]", err)
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Job not found [gj-003]")
+	}
+
+	if job.UserID != userID {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Access denied [gj-004]")
+	}
+	return job, nil
+}
+
+// bindCreateJobRequest accepts a JSON body, or a multipart form with an "inputs" JSONL file
+// where each line is either a JSON string or an object with an "input" field
+func bindCreateJobRequest(c echo.Context) (*createJobRequest, error) {
+	req := &createJobRequest{}
+	if err := c.Bind(req); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return req, nil
+	}
+
+	if raw := c.FormValue("variables"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &req.Variables); err != nil {
+			return nil, fmt.Errorf("invalid variables: %v", err)
+		}
+	}
+
+	fileHeader, err := c.FormFile("inputs")
+	if err != nil {
+		return nil, err
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxAttachmentSize)
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		var input string
+		if strings.HasPrefix(raw, "{") {
+			var item struct {
+				Input string `json:"input"`
+			}
+			if err := json.Unmarshal([]byte(raw), &item); err != nil {
+				return nil, fmt.Errorf("invalid JSONL on line %d: %v", line, err)
+			}
+			input = item.Input
+		} else if err := json.Unmarshal([]byte(raw), &input); err != nil {
+			return nil, fmt.Errorf("invalid JSONL on line %d: %v", line, err)
+		}
+		req.Inputs = append(req.Inputs, input)
+		if len(req.Inputs) > maxJobItems {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCreateJob(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	catalog := newTestCatalog(t)
+	if err := catalog.SavePattern("summarize", "You summarize text.", ""); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(asUser(user.ID))
+	e.POST("/jobs", CreateJob(repo, catalog))
+
+	for _, tt := range []struct {
+		name string
+		body string
+		code int
+		want string
+	}{
+		{"no inputs", `{"pattern": "summarize", "inputs": []}`, http.StatusBadRequest, "cj-003"},
+		{"too many inputs", `{"pattern": "summarize", "inputs": [` + strings.Repeat(`"x",`, maxJobItems) + `"x"]}`, http.StatusBadRequest, "cj-003"},
+		{"unknown pattern", `{"pattern": "translate", "inputs": ["text"]}`, http.StatusNotFound, "cj-004"},
+	} {
+		if rec := serve(e, http.MethodPost, "/jobs", tt.body); rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want %d with %s", tt.name, rec.Code, rec.Body, tt.code, tt.want)
+		}
+	}
+
+	rec := serve(e, http.MethodPost, "/jobs", `{"pattern": "summarize", "inputs": ["one", "two"], "variables": {"{{lang}}": "fr"}}`)
+	var job models.Job
+	if rec.Code != http.StatusAccepted || json.Unmarshal(rec.Body.Bytes(), &job) != nil {
+		t.Fatalf("creating a job returned %d: %s", rec.Code, rec.Body)
+	}
+	if job.Status != "queued" || job.TotalItems != 2 || job.UserID != user.ID || job.Variables["{{lang}}"] != "fr" {
+		t.Fatalf("job = %+v", job)
+	}
+
+	// Inputs can be uploaded as JSONL, each line a string or an object with an input
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("pattern", "summarize")
+	file, _ := form.CreateFormFile("inputs", "inputs.jsonl")
+	file.Write([]byte("\"one\"\n\n{\"input\": \"two\"}\n\"three\"\n"))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/jobs", &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	upload := httptest.NewRecorder()
+	e.ServeHTTP(upload, req)
+	if upload.Code != http.StatusAccepted || json.Unmarshal(upload.Body.Bytes(), &job) != nil || job.TotalItems != 3 {
+		t.Fatalf("uploading JSONL returned %d: %s", upload.Code, upload.Body)
+	}
+	items, err := repo.GetJobItems(context.Background(), job.ID, 0, 10)
+	if err != nil || len(items) != 3 || items[1].Input != "two" {
+		t.Fatalf("uploaded items = %+v, %v", items, err)
+	}
+}
+
+func TestJobsAreOnlyShownToTheirOwner(t *testing.T) {
+	repo := newTestRepo(t)
+	owner := createTestUser(t, repo, "ada", "correct horse")
+	other := createTestUser(t, repo, "bob", "battery staple")
+	job := &models.Job{UserID: owner.ID, Pattern: "summarize"}
+	if err := repo.CreateJob(context.Background(), job, []string{"one", "two"}); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := repo.ClaimJobItems(context.Background(), 1)
+	items[0].Output = "ONE"
+	if err := repo.CompleteJobItem(context.Background(), items[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := func(userID uuid.UUID) *echo.Echo {
+		e := echo.New()
+		e.Use(asUser(userID))
+		e.GET("/jobs", GetJobs(repo))
+		e.GET("/jobs/:id", GetJob(repo))
+		e.GET("/jobs/:id/items", GetJobItems(repo))
+		e.GET("/jobs/:id/results.jsonl", GetJobResults(repo))
+		return e
+	}
+	asOwner, asOther := routes(owner.ID), routes(other.ID)
+	jobPath := "/jobs/" + job.ID.String()
+
+	for _, target := range []string{jobPath, jobPath + "/items", jobPath + "/results.jsonl"} {
+		if rec := serve(asOther, http.MethodGet, target, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("another user got %d for %s, want 403", rec.Code, target)
+		}
+	}
+	if rec := serve(asOwner, http.MethodGet, "/jobs/"+uuid.NewString(), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("an unknown job returned %d, want 404", rec.Code)
+	}
+	if rec := serve(asOwner, http.MethodGet, "/jobs/nope", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("an invalid job ID returned %d, want 400", rec.Code)
+	}
+
+	var jobs []*models.Job
+	if rec := serve(asOther, http.MethodGet, "/jobs", ""); json.Unmarshal(rec.Body.Bytes(), &jobs) != nil || len(jobs) != 0 {
+		t.Errorf("another user's job list = %s", rec.Body)
+	}
+	if rec := serve(asOwner, http.MethodGet, "/jobs", ""); json.Unmarshal(rec.Body.Bytes(), &jobs) != nil || len(jobs) != 1 || jobs[0].CompletedItems != 1 {
+		t.Errorf("the owner's job list = %s", rec.Body)
+	}
+
+	rec := serve(asOwner, http.MethodGet, jobPath+"/items?limit=1&offset=1", "")
+	var page []*models.JobItem
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &page) != nil || len(page) != 1 || page[0].Position != 1 {
+		t.Fatalf("the second page of items = %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(asOwner, http.MethodGet, jobPath+"/results.jsonl", "")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("results = %d %q", rec.Code, rec.Body)
+	}
+	var first jobResult
+	if json.Unmarshal([]byte(lines[items[0].Position]), &first) != nil || first.Status != "completed" || first.Output != "ONE" {
+		t.Fatalf("result of the finished item = %s", lines[items[0].Position])
+	}
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/labstack/echo/v4"
+)
+
+// JWKS publishes the public keys that verify our tokens, so other services can check them
+func JWKS(ring *auth.KeyRing) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// New keys are published well before they sign, so a short cache is safe
+		c.Response().Header().Set("Cache-Control", "public, max-age=300")
+		return c.JSON(http.StatusOK, ring.JWKS())
+	}
+}
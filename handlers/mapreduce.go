@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/utils"
+	openai "github.com/sashabaranov/go-openai"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultContextWindow   = 16385
+	reservedOutputTokens   = 4096
+	chunkOverlapTokens     = 200
+	defaultMapParallelism  = 4
+	reducePromptTokenSlack = 256
+)
+
+// contextWindows are the input limits, in tokens, of the models we seed
+var contextWindows = map[string]int{
+	"gpt-3.5-turbo-0125": 16385,
+	"gpt-4-turbo":        128000,
+	"gpt-4o":             128000,
+	"gpt-4o-mini":        128000,
+}
+
+// chunkProgress is sent to the client as each chunk moves through the map and reduce steps
+type chunkProgress struct {
+	Stage  string `json:"stage"`
+	Chunk  int    `json:"chunk"`
+	Total  int    `json:"total"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// inputBudget is how many input tokens fit next to the pattern while leaving room for output
+func inputBudget(pattern *db.Pattern, aiModelVersion string) int {
+	if aiModelVersion == "" {
+		aiModelVersion = openai.GPT3Dot5Turbo
+	}
+	window, ok := contextWindows[aiModelVersion]
+	if !ok {
+		window = defaultContextWindow
+	}
+	return window - reservedOutputTokens - utils.EstimateTokens(pattern.Pattern) - utils.EstimateTokens(pattern.User)
+}
+
+func mapParallelism() int {
+	parallelism, err := strconv.Atoi(os.Getenv("MAP_REDUCE_PARALLELISM"))
+	if err != nil || parallelism < 1 {
+		return defaultMapParallelism
+	}
+	return parallelism
+}
+
+// mapChunks runs the pattern over every chunk with bounded parallelism and
+// returns the partial results in chunk order
+func mapChunks(ctx context.Context, w *streamWriter, stage string, chunks []string, aiModelVersion string, buildMessages func(string) []models.MessageContent) ([]string, error) {
+	results := make([]string, len(chunks))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(mapParallelism())
+
+	for i, chunk := range chunks {
+		group.Go(func() error {
+			w.Event("progress", chunkProgress{Stage: stage, Chunk: i + 1, Total: len(chunks), Status: "started"})
+			result, err := ChatCompletion(groupCtx, buildMessages(chunk), aiModelVersion)
+			if err != nil {
+				w.Event("progress", chunkProgress{Stage: stage, Chunk: i + 1, Total: len(chunks), Status: "failed", Error: err.Error()})
+				return fmt.Errorf("chunk %d of %d failed: %v", i+1, len(chunks), err)
+			}
+			results[i] = result
+			w.Event("progress", chunkProgress{Stage: stage, Chunk: i + 1, Total: len(chunks), Status: "done"})
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// runMapReduce splits oversized input into chunks, runs the pattern on each
+// and streams a final reduce step that merges the partial results
+func runMapReduce(ctx context.Context, w *streamWriter, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+	partials, err := mapReducePartials(ctx, w, pattern, input, aiModelVersion)
+	if err != nil {
+		return "", err
+	}
+
+	w.Event("progress", chunkProgress{Stage: "final", Chunk: 1, Total: 1, Status: "started"})
+	stream, err := ChatCompletionStream(ctx, reduceMessages(pattern, joinPartials(partials)), aiModelVersion)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	output, err := writeStream(w, stream)
+	if err != nil {
+		return output, err
+	}
+	w.Event("progress", chunkProgress{Stage: "final", Chunk: 1, Total: 1, Status: "done"})
+	return output, nil
+}
+
+// CompletePattern runs a pattern over input without streaming, splitting
+// oversized input into chunks the same way RunPattern does
+func CompletePattern(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+	if utils.EstimateTokens(input) <= inputBudget(pattern, aiModelVersion) {
+		return ChatCompletion(ctx, patternMessages(pattern, input), aiModelVersion)
+	}
+
+	partials, err := mapReducePartials(ctx, nil, pattern, input, aiModelVersion)
+	if err != nil {
+		return "", err
+	}
+	return ChatCompletion(ctx, reduceMessages(pattern, joinPartials(partials)), aiModelVersion)
+}
+
+// mapReducePartials maps the pattern over every chunk of input, then reduces
+// the partial results in groups until they all fit in a single request
+func mapReducePartials(ctx context.Context, w *streamWriter, pattern *db.Pattern, input string, aiModelVersion string) ([]string, error) {
+	budget := inputBudget(pattern, aiModelVersion)
+	if budget <= 0 {
+		return nil, fmt.Errorf("pattern %s leaves no room for input in %s", pattern.Name, aiModelVersion)
+	}
+	chunks := utils.ChunkText(input, budget, chunkOverlapTokens)
+
+	partials, err := mapChunks(ctx, w, "map", chunks, aiModelVersion, func(chunk string) []models.MessageContent {
+		return patternMessages(pattern, chunk)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reduceBudget := budget - reducePromptTokenSlack
+	for utils.EstimateTokens(joinPartials(partials)) > reduceBudget && len(partials) > 1 {
+		groups := groupPartials(partials, reduceBudget)
+		if len(groups) == len(partials) {
+			break
+		}
+		partials, err = mapChunks(ctx, w, "reduce", groups, aiModelVersion, func(group string) []models.MessageContent {
+			return reduceMessages(pattern, group)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return partials, nil
+}
+
+// groupPartials packs consecutive partial results into groups that fit the budget
+func groupPartials(partials []string, budget int) []string {
+	var groups []string
+	var current []string
+	currentTokens := 0
+	for _, partial := range partials {
+		tokens := utils.EstimateTokens(partial)
+		if currentTokens+tokens > budget && len(current) > 0 {
+			groups = append(groups, joinPartials(current))
+			current, currentTokens = nil, 0
+		}
+		current = append(current, partial)
+		currentTokens += tokens
+	}
+	if len(current) > 0 {
+		groups = append(groups, joinPartials(current))
+	}
+	return groups
+}
+
+func joinPartials(partials []string) string {
+	var b strings.Builder
+	for i, partial := range partials {
+		fmt.Fprintf(&b, "## PART %d\n\n%s\n\n", i+1, strings.TrimSpace(partial))
+	}
+	return b.String()
+}
+
+// reduceMessages asks the model to merge partial results using the original pattern's output format
+func reduceMessages(pattern *db.Pattern, partials string) []models.MessageContent {
+	return []models.MessageContent{
+		{Role: "system", Content: pattern.Pattern},
+		{Role: "user", Content: "The input was too large to process at once, so it was split into consecutive parts and the instructions above were applied to each part. " +
+			"Combine the partial results below into a single result that follows the same instructions and output format, merging duplicates and keeping the most important items.\n\n" + partials},
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/utils"
+	"github.com/labstack/echo/v4"
+)
+
+func TestInputBudget(t *testing.T) {
+	pattern := &db.Pattern{Pattern: strings.Repeat("a", 4000), User: strings.Repeat("b", 400)}
+	if got, want := inputBudget(pattern, "gpt-4o"), 128000-reservedOutputTokens-1100; got != want {
+		t.Errorf("budget for gpt-4o = %d, want %d", got, want)
+	}
+	// Unknown models and the default model get the smallest window
+	for _, model := range []string{"", "some-new-model"} {
+		if got, want := inputBudget(pattern, model), defaultContextWindow-reservedOutputTokens-1100; got != want {
+			t.Errorf("budget for %q = %d, want %d", model, got, want)
+		}
+	}
+}
+
+func TestGroupPartialsFitTheBudget(t *testing.T) {
+	partials := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40), strings.Repeat("d", 200)}
+	groups := groupPartials(partials, 25)
+	if len(groups) != 3 {
+		t.Fatalf("groupPartials made %d groups, want 3: %q", len(groups), groups)
+	}
+	if !strings.Contains(groups[0], "aaa") || !strings.Contains(groups[0], "bbb") || strings.Contains(groups[0], "ccc") {
+		t.Fatalf("first group = %q, want the first two partials", groups[0])
+	}
+	// A partial larger than the budget is a group of its own
+	if !strings.Contains(groups[2], "ddd") || strings.Contains(groups[2], "ccc") {
+		t.Fatalf("last group = %q", groups[2])
+	}
+}
+
+func TestPatternTooLongForTheModel(t *testing.T) {
+	huge := &db.Pattern{Name: "huge", Pattern: strings.Repeat("You summarize text. ", defaultContextWindow)}
+	if budget := inputBudget(huge, ""); budget > 0 {
+		t.Fatalf("test pattern leaves a budget of %d", budget)
+	}
+	if chunks := utils.ChunkText("some input", inputBudget(huge, ""), chunkOverlapTokens); len(chunks) != 1 {
+		t.Fatalf("ChunkText without a budget returned %d chunks", len(chunks))
+	}
+	// No chunk could fit, so nothing is sent to the model
+	if _, err := CompletePattern(context.Background(), huge, "some input", ""); err == nil || !strings.Contains(err.Error(), "no room for input") {
+		t.Fatalf("CompletePattern returned %v, want an error", err)
+	}
+
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	catalog := newTestCatalog(t)
+	if err := catalog.SavePattern(huge.Name, huge.Pattern, ""); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.POST("/patterns/:name/run", RunPattern(repo, catalog), asUser(user.ID))
+	rec := serve(e, http.MethodPost, "/patterns/huge/run", `{"input": "some input"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "rp-015") {
+		t.Fatalf("running a pattern that fills the context window returned %d: %s", rec.Code, rec.Body)
+	}
+	chats, err := repo.GetChatsByUserID(context.Background(), user.ID, false)
+	if err != nil || len(chats) != 0 {
+		t.Fatalf("a refused run saved %d chats (%v)", len(chats), err)
+	}
+}
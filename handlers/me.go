@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/jobs"
+	"github.com/FiveEightyEight/gippity-serv/mailer"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+var validThemes = []string{"light", "dark", "system"}
+
+type profileRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// userLocation is the timezone in the user's metadata, falling back to LOCATION
+func userLocation(ctx context.Context, repo repository.Repository, userID uuid.UUID) *time.Location {
+	timezone, err := repo.GetUserTimezone(ctx, userID)
+	if err != nil {
+		log.Println("Failed to get user timezone [ul-001]", err)
+	}
+	return jobs.ScheduleLocation(timezone)
+}
+
+// defaultModelVersion is the version of the user's default model, or "" for the server default
+func defaultModelVersion(ctx context.Context, repo repository.Repository, userID uuid.UUID) string {
+	version, err := repo.GetDefaultAIModelVersion(ctx, userID)
+	if err != nil {
+		log.Println("Failed to get default ai model [dmv-001]", err)
+	}
+	return version
+}
+
+func GetMe(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gme-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gme-001]"})
+		}
+		user, err := repo.GetUserByUUID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get user [gme-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gme-002]"})
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+// UpdateMe changes the username and email. Fields left out keep their value;
+// a new email is unverified until the link sent to it is followed.
+func UpdateMe(repo repository.Repository, mail mailer.Mailer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [ume-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [ume-001]"})
+		}
+
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUUID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user [ume-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [ume-002]"})
+		}
+		req := profileRequest{Username: user.Username, Email: user.Email}
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [ume-003]"})
+		}
+		req.Username = strings.TrimSpace(req.Username)
+		req.Email = strings.TrimSpace(req.Email)
+		if req.Username == "" || len(req.Username) > 50 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Username is required and at most 50 characters [ume-004]"})
+		}
+		if !strings.Contains(req.Email, "@") || len(req.Email) > 255 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email address [ume-005]"})
+		}
+
+		err = repo.UpdateUserProfile(ctx, userID, req.Username, req.Email)
+		if errors.Is(err, db.ErrUserExists) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Username or email already exists [ume-006]"})
+		}
+		if err != nil {
+			log.Println("Failed to update user profile [ume-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [ume-007]"})
+		}
+
+		emailChanged := !strings.EqualFold(req.Email, user.Email)
+		user, err = repo.GetUserByUUID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user [ume-008]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [ume-008]"})
+		}
+		if emailChanged {
+			if err := sendEmailToken(ctx, repo, mail, user, db.EmailTokenVerify); err != nil {
+				log.Println("Failed to send verification email [ume-009]", err)
+			}
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+}
+
+func GetPreferences(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gpr-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gpr-001]"})
+		}
+		preferences, err := repo.GetUserPreferences(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get user preferences [gpr-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gpr-002]"})
+		}
+		return c.JSON(http.StatusOK, preferences)
+	}
+}
+
+// UpdatePreferences saves the preferences; fields left out keep their value
+func UpdatePreferences(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [upr-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [upr-001]"})
+		}
+
+		ctx := c.Request().Context()
+		preferences, err := repo.GetUserPreferences(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user preferences [upr-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [upr-002]"})
+		}
+		if err := c.Bind(preferences); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [upr-003]"})
+		}
+		preferences.UserID = userID
+
+		validTheme := false
+		for _, theme := range validThemes {
+			validTheme = validTheme || preferences.Theme == theme
+		}
+		if !validTheme {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "theme must be one of " + strings.Join(validThemes, ", ") + " [upr-004]"})
+		}
+		if preferences.MessageDisplayCount < 1 || preferences.MessageDisplayCount > 500 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "message_display_count must be between 1 and 500 [upr-005]"})
+		}
+		if preferences.DefaultAIModel != nil {
+			model, err := repo.GetAIModelByID(ctx, *preferences.DefaultAIModel)
+			if errors.Is(err, db.ErrAIModelNotFound) || (err == nil && !model.IsActive) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "default_ai_model must be an active model [upr-006]"})
+			}
+			if err != nil {
+				log.Println("Failed to get ai model [upr-007]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [upr-007]"})
+			}
+		}
+
+		err = repo.SaveUserPreferences(ctx, preferences)
+		if errors.Is(err, db.ErrAIModelNotFound) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "default_ai_model must be an active model [upr-006]"})
+		}
+		if err != nil {
+			log.Println("Failed to save user preferences [upr-008]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [upr-008]"})
+		}
+		return c.JSON(http.StatusOK, preferences)
+	}
+}
+
+func GetMetadata(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gmd-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gmd-001]"})
+		}
+		metadata, err := repo.GetUserMetadata(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get user metadata [gmd-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gmd-002]"})
+		}
+		return c.JSON(http.StatusOK, metadata)
+	}
+}
+
+// UpdateMetadata saves the profile metadata; fields left out keep their value.
+// The timezone is used for chat timestamps and schedules.
+func UpdateMetadata(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [umd-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [umd-001]"})
+		}
+
+		ctx := c.Request().Context()
+		metadata, err := repo.GetUserMetadata(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user metadata [umd-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [umd-002]"})
+		}
+		if err := c.Bind(metadata); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [umd-003]"})
+		}
+		metadata.UserID = userID
+		if metadata.Interests == nil {
+			metadata.Interests = []string{}
+		}
+
+		if msg := validateMetadataFields(metadata.PreferredLanguage, metadata.Profession, metadata.EducationLevel, metadata.Country); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg + " [umd-004]"})
+		}
+		if metadata.Timezone != "" {
+			if _, err := time.LoadLocation(metadata.Timezone); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "timezone must be an IANA name such as America/New_York [umd-005]"})
+			}
+		}
+		if metadata.BirthYear != 0 && (metadata.BirthYear < 1900 || metadata.BirthYear > time.Now().Year()) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "birth_year is not a valid year [umd-006]"})
+		}
+		if len(metadata.Interests) > 20 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "At most 20 interests [umd-007]"})
+		}
+		for _, interest := range metadata.Interests {
+			if strings.TrimSpace(interest) == "" || len(interest) > 50 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Interests must be 1 to 50 characters [umd-008]"})
+			}
+		}
+
+		if err := repo.SaveUserMetadata(ctx, metadata); err != nil {
+			log.Println("Failed to save user metadata [umd-009]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [umd-009]"})
+		}
+		return c.JSON(http.StatusOK, metadata)
+	}
+}
+
+// validateMetadataFields checks the free text fields against their column sizes
+func validateMetadataFields(preferredLanguage string, profession string, educationLevel string, country string) string {
+	switch {
+	case len(preferredLanguage) > 10:
+		return "preferred_language is at most 10 characters"
+	case len(profession) > 100:
+		return "profession is at most 100 characters"
+	case len(educationLevel) > 50:
+		return "education_level is at most 50 characters"
+	case len(country) > 50:
+		return "country is at most 50 characters"
+	}
+	return ""
+}
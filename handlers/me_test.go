@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/labstack/echo/v4"
+)
+
+func TestUpdateMe(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	createTestUser(t, repo, "bob", "battery staple")
+	if err := repo.MarkEmailVerified(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	outbox := newTestOutbox(t)
+	e := echo.New()
+	e.GET("/me", GetMe(repo), asUser(user.ID))
+	e.PUT("/me", UpdateMe(repo, outbox), asUser(user.ID))
+
+	for _, tt := range []struct {
+		body string
+		code int
+		want string
+	}{
+		{`{"username": "  "}`, http.StatusBadRequest, "ume-004"},
+		{`{"username": "` + strings.Repeat("a", 51) + `"}`, http.StatusBadRequest, "ume-004"},
+		{`{"email": "ada.example.com"}`, http.StatusBadRequest, "ume-005"},
+		{`{"username": "bob"}`, http.StatusConflict, "ume-006"},
+		{`{"email": "bob@example.com"}`, http.StatusConflict, "ume-006"},
+	} {
+		if rec := serve(e, http.MethodPut, "/me", tt.body); rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want %d with %s", tt.body, rec.Code, rec.Body, tt.code, tt.want)
+		}
+	}
+
+	// A new username keeps the email and its verification
+	rec := serve(e, http.MethodPut, "/me", `{"username": " lovelace "}`)
+	var me models.User
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &me) != nil || me.Username != "lovelace" || me.Email != user.Email || me.EmailVerifiedAt == nil {
+		t.Fatalf("renaming returned %d: %s", rec.Code, rec.Body)
+	}
+	if sent := outbox.Sent(); len(sent) != 0 {
+		t.Fatalf("renaming sent %+v", sent)
+	}
+
+	// A new email has to be verified again
+	rec = serve(e, http.MethodPut, "/me", `{"email": "lovelace@example.com"}`)
+	me = models.User{}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &me) != nil || me.Username != "lovelace" || me.EmailVerifiedAt != nil {
+		t.Fatalf("changing the email returned %d: %s", rec.Code, rec.Body)
+	}
+	if msg := waitForMail(t, outbox, 1); msg.To != "lovelace@example.com" {
+		t.Fatalf("the verification link went to %s", msg.To)
+	}
+	if rec := serve(e, http.MethodGet, "/me", ""); !strings.Contains(rec.Body.String(), `"lovelace@example.com"`) || strings.Contains(rec.Body.String(), "password") {
+		t.Fatalf("GET /me returned %s", rec.Body)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	user := createTestUser(t, repo, "ada", "correct horse")
+	active := &models.AIModel{Name: "gpt-4o", Version: "gpt-4o-2024-08-06", IsActive: true}
+	retired := &models.AIModel{Name: "gpt-3", Version: "gpt-3", IsActive: false}
+	for _, model := range []*models.AIModel{active, retired} {
+		if err := repo.CreateAIModel(ctx, model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := echo.New()
+	e.GET("/me/preferences", GetPreferences(repo), asUser(user.ID))
+	e.PUT("/me/preferences", UpdatePreferences(repo), asUser(user.ID))
+
+	var preferences models.UserPreferences
+	if rec := serve(e, http.MethodGet, "/me/preferences", ""); json.Unmarshal(rec.Body.Bytes(), &preferences) != nil || preferences.Theme != "light" || preferences.MessageDisplayCount != 50 || !preferences.NotificationsEnabled {
+		t.Fatalf("default preferences are %s", rec.Body)
+	}
+	if version := defaultModelVersion(ctx, repo, user.ID); version != "" {
+		t.Fatalf("defaultModelVersion without a default = %q", version)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{`{"theme": "blue"}`, "upr-004"},
+		{`{"message_display_count": 0}`, "upr-005"},
+		{`{"message_display_count": 501}`, "upr-005"},
+		{`{"default_ai_model": "` + retired.ID.String() + `"}`, "upr-006"},
+		{`{"default_ai_model": "` + user.ID.String() + `"}`, "upr-006"},
+		{`{"theme": 1}`, "upr-003"},
+	} {
+		if rec := serve(e, http.MethodPut, "/me/preferences", tt.body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want 400 with %s", tt.body, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	rec := serve(e, http.MethodPut, "/me/preferences", `{"theme": "dark", "default_ai_model": "`+active.ID.String()+`"}`)
+	preferences = models.UserPreferences{}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &preferences) != nil {
+		t.Fatalf("saving preferences returned %d: %s", rec.Code, rec.Body)
+	}
+	// Fields left out keep their value
+	if preferences.Theme != "dark" || preferences.MessageDisplayCount != 50 || preferences.UserID != user.ID {
+		t.Fatalf("saved preferences = %+v", preferences)
+	}
+	if version := defaultModelVersion(ctx, repo, user.ID); version != active.Version {
+		t.Fatalf("defaultModelVersion = %q, want %q", version, active.Version)
+	}
+	// A deactivated default falls back to the server default
+	active.IsActive = false
+	if err := repo.UpdateAIModel(ctx, active); err != nil {
+		t.Fatal(err)
+	}
+	if version := defaultModelVersion(ctx, repo, user.ID); version != "" {
+		t.Fatalf("defaultModelVersion of a deactivated model = %q", version)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	t.Setenv("LOCATION", "Europe/London")
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	user := createTestUser(t, repo, "ada", "correct horse")
+	e := echo.New()
+	e.GET("/me/metadata", GetMetadata(repo), asUser(user.ID))
+	e.PUT("/me/metadata", UpdateMetadata(repo), asUser(user.ID))
+
+	if rec := serve(e, http.MethodGet, "/me/metadata", ""); !strings.Contains(rec.Body.String(), `"interests":[]`) {
+		t.Fatalf("empty metadata is %s", rec.Body)
+	}
+	if location := userLocation(ctx, repo, user.ID); location.String() != "Europe/London" {
+		t.Fatalf("without a timezone the location is %s, want LOCATION", location)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{`{"preferred_language": "` + strings.Repeat("x", 11) + `"}`, "umd-004"},
+		{`{"country": "` + strings.Repeat("x", 51) + `"}`, "umd-004"},
+		{`{"timezone": "Mars/Olympus_Mons"}`, "umd-005"},
+		{`{"birth_year": 1850}`, "umd-006"},
+		{`{"interests": ["` + strings.Repeat(`a", "`, 20) + `a"]}`, "umd-007"},
+		{`{"interests": [" "]}`, "umd-008"},
+	} {
+		if rec := serve(e, http.MethodPut, "/me/metadata", tt.body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%.40s: got %d %s, want 400 with %s", tt.body, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	rec := serve(e, http.MethodPut, "/me/metadata", `{"timezone": "Asia/Tokyo", "interests": ["chess"], "birth_year": 1990}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("saving metadata returned %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(e, http.MethodPut, "/me/metadata", `{"profession": "mathematician"}`)
+	var metadata models.UserMetadata
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &metadata) != nil {
+		t.Fatalf("saving metadata returned %d: %s", rec.Code, rec.Body)
+	}
+	if metadata.Timezone != "Asia/Tokyo" || len(metadata.Interests) != 1 || metadata.BirthYear != 1990 || metadata.Profession != "mathematician" {
+		t.Fatalf("saved metadata = %+v", metadata)
+	}
+	// Chat timestamps follow the user's timezone over LOCATION
+	if location := userLocation(ctx, repo, user.ID); location.String() != "Asia/Tokyo" {
+		t.Fatalf("the location is %s, want the user's timezone", location)
+	}
+}
@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/totp"
+	"github.com/FiveEightyEight/gippity-serv/webauthn"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+const recoveryCodeCount = 10
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type mfaLoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	// WebAuthn is a passkey assertion for options from BeginPasskeyMFA
+	WebAuthn *webauthn.AssertionResponse `json:"webauthn"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// completeLogin finishes a first factor login: it issues tokens, or an MFA
+// challenge when the user has a second factor. Failed logins of the account
+// are only forgotten once tokens are issued, so with a second factor LoginMFA
+// does it.
+func completeLogin(c echo.Context, repo repository.Repository, userID uuid.UUID) error {
+	methods, err := repo.GetMFAMethods(c.Request().Context(), userID)
+	if err != nil {
+		log.Println("Failed to check mfa [cl-001]", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+	}
+	if len(methods) > 0 {
+		mfaToken, err := auth.GenerateMFAToken(userID.String())
+		if err != nil {
+			log.Println("Failed to generate mfa token [cl-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"mfa_methods":  methods,
+		})
+	}
+
+	// Without a second factor, a role that requires one only lets the user enroll it
+	user, err := repo.GetUserByUUID(c.Request().Context(), userID)
+	if err != nil {
+		log.Println("Failed to get user [cl-004]", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+	}
+	enrollmentRequired, err := repo.RoleRequiresMFA(c.Request().Context(), user.Role)
+	if err != nil {
+		log.Println("Failed to check role mfa requirement [cl-005]", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+	}
+
+	accessToken, err := issueTokens(c, repo, userID)
+	if errors.Is(err, errAccountDisabled) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is disabled"})
+	}
+	if err != nil {
+		log.Println("Failed to issue tokens [cl-003]", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+	}
+	clearAccountThrottle(c, repo, user.Username)
+	if enrollmentRequired {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"t":                       accessToken,
+			"mfa_enrollment_required": true,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"t": accessToken,
+	})
+}
+
+// mfaEnrollmentRoutes stay open to users who still have to enroll the second
+// factor their role requires
+var mfaEnrollmentRoutes = map[string]bool{
+	"/api/v1/me/mfa":                      true,
+	"/api/v1/me/mfa/totp":                 true,
+	"/api/v1/me/mfa/totp/confirm":         true,
+	"/api/v1/me/passkeys":                 true,
+	"/api/v1/me/passkeys/register/begin":  true,
+	"/api/v1/me/passkeys/register/finish": true,
+}
+
+// mfaSatisfied reports whether the user has the second factor their role requires, if any
+func mfaSatisfied(ctx context.Context, repo repository.Repository, userID uuid.UUID, role string) (bool, error) {
+	required, err := repo.RoleRequiresMFA(ctx, role)
+	if err != nil {
+		return false, err
+	}
+	if !required {
+		return true, nil
+	}
+	return repo.IsMFAEnabled(ctx, userID)
+}
+
+// LoginMFA is the second login step: it trades an MFA challenge token and a
+// TOTP code, recovery code or passkey assertion for tokens
+func LoginMFA(repo repository.Repository, wa *webauthn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req mfaLoginRequest
+		if err := c.Bind(&req); err != nil || req.MFAToken == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "mfa_token is required"})
+		}
+		if req.Code == "" && req.RecoveryCode == "" && req.WebAuthn == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "code, recovery_code or webauthn is required"})
+		}
+
+		userID, claims, err := parseMFAToken(req.MFAToken)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired mfa token"})
+		}
+
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUUID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user [lm-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		// Wrong codes count against the same keys as wrong passwords, so
+		// logging in again for a fresh challenge does not reset them
+		if authLocked(c, repo, accountThrottle.key(user.Username), ipThrottle.key(c.RealIP())) {
+			return nil
+		}
+
+		// Each challenge is good for one attempt. It is claimed before the
+		// factor is checked, so a replayed token cannot burn a recovery code
+		// or TOTP step, and a wrong code means logging in again.
+		fresh, err := repo.UseMFAChallenge(ctx, claims.ID, claims.ExpiresAt.Time)
+		if err != nil {
+			log.Println("Failed to record mfa challenge [lm-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		if !fresh {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired mfa token"})
+		}
+
+		var ok bool
+		switch {
+		case req.WebAuthn != nil:
+			_, _, err = verifyPasskeyAssertion(ctx, repo, wa, req.WebAuthn, db.WebAuthnMFA, &userID)
+			if err != nil {
+				log.Println("Failed to verify passkey [lm-003]", err)
+			}
+			ok, err = err == nil, nil
+		case req.RecoveryCode != "":
+			ok, err = repo.UseRecoveryCode(ctx, userID, auth.HashToken(normalizeRecoveryCode(req.RecoveryCode)))
+		default:
+			ok, err = verifyTOTP(c, repo, userID, req.Code)
+		}
+		if err != nil {
+			log.Println("Failed to verify second factor [lm-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		if !ok {
+			countAuthAttempt(c, repo, accountThrottle, user.Username, &userID)
+			countAuthAttempt(c, repo, ipThrottle, c.RealIP(), nil)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid code, log in again"})
+		}
+
+		accessToken, err := issueTokens(c, repo, userID)
+		if errors.Is(err, errAccountDisabled) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is disabled"})
+		}
+		if err != nil {
+			log.Println("Failed to issue tokens [lm-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		clearAccountThrottle(c, repo, user.Username)
+		return c.JSON(http.StatusOK, map[string]string{
+			"t": accessToken,
+		})
+	}
+}
+
+// parseMFAToken validates an MFA challenge token and returns the user it is for
+func parseMFAToken(token string) (uuid.UUID, *auth.Claims, error) {
+	claims, err := auth.ValidateMFAToken(token)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return userID, claims, nil
+}
+
+// verifyTOTP checks code against the user's enabled secret and burns its step
+func verifyTOTP(c echo.Context, repo repository.Repository, userID uuid.UUID, code string) (bool, error) {
+	secret, err := repo.GetTOTP(c.Request().Context(), userID)
+	if errors.Is(err, db.ErrTOTPNotEnrolled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if secret.EnabledAt == nil {
+		return false, nil
+	}
+	step, ok := totp.Validate(secret.Secret, code, time.Now(), secret.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+	return repo.UseTOTPStep(c.Request().Context(), userID, step)
+}
+
+// GetMFAStatus reports which second factors the signed in user has and how many recovery codes are left
+func GetMFAStatus(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gms-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+		methods, err := repo.GetMFAMethods(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to check mfa [gms-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get 2FA status"})
+		}
+		remaining, err := repo.CountRecoveryCodes(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to count recovery codes [gms-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get 2FA status"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"totp_enabled":             lo.Contains(methods, "totp"),
+			"methods":                  methods,
+			"recovery_codes_remaining": remaining,
+		})
+	}
+}
+
+// EnrollTOTP starts enrollment with a fresh secret. 2FA is not enabled until
+// ConfirmTOTP sees a code from it.
+func EnrollTOTP(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [etp-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+		user, err := repo.GetUserByUUID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get user [etp-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start 2FA enrollment"})
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			log.Println("Failed to generate totp secret [etp-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start 2FA enrollment"})
+		}
+		err = repo.CreatePendingTOTP(c.Request().Context(), userID, secret)
+		if errors.Is(err, db.ErrTOTPAlreadyEnabled) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "2FA is already enabled"})
+		}
+		if err != nil {
+			log.Println("Failed to save totp secret [etp-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start 2FA enrollment"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"secret":           secret,
+			"provisioning_uri": totp.ProvisioningURI(mfaIssuer(), user.Email, secret),
+		})
+	}
+}
+
+// ConfirmTOTP enables 2FA once the user proves their app produces codes, and
+// returns recovery codes. They are shown only this once.
+func ConfirmTOTP(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [ct-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+		var req mfaCodeRequest
+		if err := c.Bind(&req); err != nil || req.Code == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Code is required"})
+		}
+
+		pending, err := repo.GetTOTP(c.Request().Context(), userID)
+		if errors.Is(err, db.ErrTOTPNotEnrolled) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Start 2FA enrollment first"})
+		}
+		if err != nil {
+			log.Println("Failed to get totp [ct-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to enable 2FA"})
+		}
+		if pending.EnabledAt != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "2FA is already enabled"})
+		}
+		step, ok := totp.Validate(pending.Secret, req.Code, time.Now(), pending.LastUsedStep)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid code"})
+		}
+
+		codes, hashes, err := generateRecoveryCodes()
+		if err != nil {
+			log.Println("Failed to generate recovery codes [ct-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to enable 2FA"})
+		}
+		err = repo.EnableTOTP(c.Request().Context(), userID, step, hashes)
+		if errors.Is(err, db.ErrTOTPAlreadyEnabled) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "2FA is already enabled"})
+		}
+		if err != nil {
+			log.Println("Failed to enable totp [ct-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to enable 2FA"})
+		}
+
+		return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+// DisableTOTP turns 2FA off after checking a current code or a recovery code
+func DisableTOTP(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [dt-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+		var req mfaLoginRequest
+		if err := c.Bind(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "code or recovery_code is required"})
+		}
+
+		var ok bool
+		if req.RecoveryCode != "" {
+			ok, err = repo.UseRecoveryCode(c.Request().Context(), userID, auth.HashToken(normalizeRecoveryCode(req.RecoveryCode)))
+		} else {
+			ok, err = verifyTOTP(c, repo, userID, req.Code)
+		}
+		if err != nil {
+			log.Println("Failed to verify second factor [dt-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to disable 2FA"})
+		}
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid code"})
+		}
+
+		if err := repo.DisableTOTP(c.Request().Context(), userID); err != nil {
+			log.Println("Failed to disable totp [dt-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to disable 2FA"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a current TOTP code
+func RegenerateRecoveryCodes(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [rrc-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+		var req mfaCodeRequest
+		if err := c.Bind(&req); err != nil || req.Code == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Code is required"})
+		}
+
+		ok, err := verifyTOTP(c, repo, userID, req.Code)
+		if err != nil {
+			log.Println("Failed to verify totp [rrc-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to regenerate recovery codes"})
+		}
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid code"})
+		}
+
+		codes, hashes, err := generateRecoveryCodes()
+		if err != nil {
+			log.Println("Failed to generate recovery codes [rrc-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to regenerate recovery codes"})
+		}
+		if err := repo.ReplaceRecoveryCodes(c.Request().Context(), userID, hashes); err != nil {
+			log.Println("Failed to save recovery codes [rrc-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to regenerate recovery codes"})
+		}
+		return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+// generateRecoveryCodes returns codes formatted as xxxxx-xxxxx and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = auth.HashToken(raw)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode accepts codes typed with any case, spaces or dashes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// mfaIssuer is the account name shown in authenticator apps, from MFA_ISSUER
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "gippity-serv"
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/totp"
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoginMFARejectsReplayedChallenge(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	user := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: "x"}
+	if err := repo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreatePendingTOTP(ctx, user.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.EnableTOTP(ctx, user.ID, 1, hashes); err != nil {
+		t.Fatal(err)
+	}
+	mfaToken, err := auth.GenerateMFAToken(user.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.POST("/login/mfa", LoginMFA(repo, nil))
+	login := func(recoveryCode string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(mfaLoginRequest{MFAToken: mfaToken, RecoveryCode: recoveryCode})
+		req := httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(string(body)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := login(codes[0]); rec.Code != http.StatusOK {
+		t.Fatalf("first login returned %d: %s", rec.Code, rec.Body)
+	}
+	// The second factor is valid, but the challenge already completed a login
+	if rec := login(codes[1]); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed challenge returned %d: %s", rec.Code, rec.Body)
+	}
+	sessions, err := repo.GetActiveSessionsByUserID(ctx, user.ID)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("user has %d sessions (%v), want 1", len(sessions), err)
+	}
+
+	// The replay was refused before the recovery code was looked at, so it
+	// still completes a login with a fresh challenge
+	if mfaToken, err = auth.GenerateMFAToken(user.ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := login(codes[1]); rec.Code != http.StatusOK {
+		t.Fatalf("login with the recovery code the replay carried returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// wrongTOTPCode returns a code that no step Validate accepts right now matches
+func wrongTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+	valid := map[string]bool{}
+	now := totp.Step(time.Now())
+	for step := now - totp.Skew - 1; step <= now+totp.Skew+1; step++ {
+		code, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid[code] = true
+	}
+	for n := 0; ; n++ {
+		if code := fmt.Sprintf("%06d", n); !valid[code] {
+			return code
+		}
+	}
+}
+
+func TestLoginMFAWrongCodesLockTheAccount(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+	user := createTestUser(t, repo, "ada", "correct horse")
+	const secret = "JBSWY3DPEHPK3PXP"
+	if err := repo.CreatePendingTOTP(ctx, user.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.EnableTOTP(ctx, user.ID, 1, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+	e.POST("/login/mfa", LoginMFA(repo, nil))
+	login := func() *httptest.ResponseRecorder {
+		return basicLogin(e, "ada", "correct horse")
+	}
+	loginMFA := func(req mfaLoginRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		return serve(e, http.MethodPost, "/login/mfa", string(body))
+	}
+
+	// Every password login hands out a fresh challenge, but the wrong codes
+	// sent with them add up on the account
+	wrong := wrongTOTPCode(t, secret)
+	for attempt := 1; attempt <= accountThrottle.free+1; attempt++ {
+		rec := login()
+		var resp struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.MFAToken == "" {
+			t.Fatalf("password login %d returned %d: %s", attempt, rec.Code, rec.Body)
+		}
+		if rec := loginMFA(mfaLoginRequest{MFAToken: resp.MFAToken, Code: wrong}); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d returned %d: %s", attempt, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := login(); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("password login after repeated wrong codes returned %d, want 429", rec.Code)
+	}
+	mfaToken, err := auth.GenerateMFAToken(user.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := loginMFA(mfaLoginRequest{MFAToken: mfaToken, RecoveryCode: codes[0]}); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second factor on a locked account returned %d, want 429", rec.Code)
+	}
+	if remaining, err := repo.CountRecoveryCodes(ctx, user.ID); err != nil || remaining != len(codes) {
+		t.Fatalf("%d recovery codes remain (%v), want all %d", remaining, err, len(codes))
+	}
+}
@@ -3,12 +3,12 @@ package handlers
 import (
 	"net/http"
 
-	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/repository"
 	"github.com/labstack/echo/v4"
 )
 
 // GetAllAIModels returns a handler function to fetch all AI models
-func GetAllAIModels(repo *db.PostgresRepository) echo.HandlerFunc {
+func GetAllAIModels(repo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		models, err := repo.GetAllAIModels(c.Request().Context())
 		if err != nil {
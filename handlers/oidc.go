@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/oidc"
+	"github.com/FiveEightyEight/gippity-serv/password"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// oidcLoginTTL is how long a user has to finish signing in at the identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+var unsafeUsernameChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// OIDCLogin sends the browser to the identity provider
+func OIDCLogin(repo repository.Repository, providers map[string]*oidc.Provider) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown identity provider [ol-001]"})
+		}
+
+		login, err := provider.Begin(c.Request().Context())
+		if err != nil {
+			log.Println("Failed to start oidc login [ol-002]", err)
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "Identity provider is unavailable [ol-002]"})
+		}
+		err = repo.CreateOIDCLoginState(c.Request().Context(), &models.OIDCLoginState{
+			StateHash:    auth.HashToken(login.State),
+			Provider:     provider.Config.Name,
+			Nonce:        login.Nonce,
+			CodeVerifier: login.CodeVerifier,
+			ExpiresAt:    time.Now().Add(oidcLoginTTL),
+		})
+		if err != nil {
+			log.Println("Failed to save oidc login state [ol-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [ol-003]"})
+		}
+
+		return c.Redirect(http.StatusFound, login.URL)
+	}
+}
+
+// OIDCCallback finishes the login the identity provider redirects back with.
+// It sets the refresh cookie and sends the browser to the frontend, which
+// calls /refresh for an access token; users with 2FA get an MFA token instead.
+func OIDCCallback(repo repository.Repository, providers map[string]*oidc.Provider, hasher *password.Hasher, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown identity provider [oc-001]"})
+		}
+		if idpError := c.QueryParam("error"); idpError != "" {
+			log.Println("Identity provider returned an error [oc-002]", provider.Config.Name, idpError, c.QueryParam("error_description"))
+			return oidcFailure(c, "sso_denied")
+		}
+
+		ctx := c.Request().Context()
+		state, err := repo.ConsumeOIDCLoginState(ctx, auth.HashToken(c.QueryParam("state")), provider.Config.Name)
+		if errors.Is(err, db.ErrOIDCStateInvalid) {
+			return oidcFailure(c, "sso_expired")
+		}
+		if err != nil {
+			log.Println("Failed to consume oidc login state [oc-003]", err)
+			return oidcFailure(c, "sso_failed")
+		}
+
+		identity, err := provider.Exchange(ctx, c.QueryParam("code"), state.CodeVerifier, state.Nonce)
+		if err != nil {
+			log.Println("Failed to exchange oidc code [oc-004]", err)
+			return oidcFailure(c, "sso_failed")
+		}
+
+		userID, reason, err := resolveOIDCUser(ctx, repo, hasher, provider.Config.Name, identity)
+		if err != nil {
+			log.Println("Failed to resolve oidc user [oc-005]", err)
+			return oidcFailure(c, reason)
+		}
+		err = repo.UpsertIdentity(ctx, &models.UserIdentity{
+			UserID:   userID,
+			Provider: provider.Config.Name,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+			Groups:   identity.Groups,
+		})
+		if err != nil {
+			log.Println("Failed to save identity [oc-006]", err)
+			return oidcFailure(c, "sso_failed")
+		}
+		if identity.EmailVerified {
+			if err := repo.MarkEmailVerified(ctx, userID); err != nil {
+				log.Println("Failed to mark email verified [oc-007]", err)
+			}
+		}
+		// With a role map the identity provider owns the role: it is synced on every login
+		if len(provider.Config.RoleMap) > 0 {
+			if err := syncOIDCRole(ctx, repo, sessions, userID, provider.Config.Roles(identity.Groups)); err != nil {
+				log.Println("Failed to sync oidc role [oc-011]", err)
+				return oidcFailure(c, "sso_failed")
+			}
+		}
+
+		enabled, err := repo.IsMFAEnabled(ctx, userID)
+		if err != nil {
+			log.Println("Failed to check mfa [oc-008]", err)
+			return oidcFailure(c, "sso_failed")
+		}
+		if enabled {
+			mfaToken, err := auth.GenerateMFAToken(userID.String())
+			if err != nil {
+				log.Println("Failed to generate mfa token [oc-009]", err)
+				return oidcFailure(c, "sso_failed")
+			}
+			// The fragment keeps the token out of server logs and Referer headers
+			return c.Redirect(http.StatusFound, appURL()+"/login/mfa#mfa_token="+url.QueryEscape(mfaToken))
+		}
+
+		_, err = issueTokens(c, repo, userID)
+		if errors.Is(err, errAccountDisabled) {
+			return oidcFailure(c, "account_disabled")
+		}
+		if err != nil {
+			log.Println("Failed to issue tokens [oc-010]", err)
+			return oidcFailure(c, "sso_failed")
+		}
+		return c.Redirect(http.StatusFound, appURL()+"/auth/callback")
+	}
+}
+
+// resolveOIDCUser finds the user an identity belongs to: an existing link, an
+// existing account with the same verified email, or a new account. On error
+// it also returns the reason shown to the user.
+//
+// An account whose owner never proved the email is not linked: anyone can
+// register with an address they do not own, and linking would let them keep
+// signing in with their password to the account its real owner now uses.
+func resolveOIDCUser(ctx context.Context, repo repository.Repository, hasher *password.Hasher, provider string, identity *oidc.Identity) (uuid.UUID, string, error) {
+	userID, err := repo.GetUserIDByIdentity(ctx, provider, identity.Subject)
+	if err == nil {
+		return userID, "", nil
+	}
+	if !errors.Is(err, db.ErrIdentityNotFound) {
+		return uuid.Nil, "sso_failed", err
+	}
+
+	if identity.Email == "" {
+		return uuid.Nil, "sso_email_required", errors.New("identity provider did not share an email")
+	}
+	// Only the provider vouching for the address lets it take over an account
+	// or claim the address for a new one
+	if !identity.EmailVerified {
+		return uuid.Nil, "sso_email_unverified", errors.New("identity provider has not verified the email")
+	}
+	existing, err := repo.GetUserByEmail(ctx, identity.Email)
+	if err == nil {
+		if existing.EmailVerifiedAt == nil {
+			return uuid.Nil, "sso_email_conflict", errors.New("an account with an unverified email has the identity's address")
+		}
+		return existing.ID, "", nil
+	}
+
+	// Nobody knows this password, so the account can only sign in through SSO
+	// until the user sets one with a password reset
+	secret, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return uuid.Nil, "sso_failed", err
+	}
+	passwordHash, err := hasher.Hash(secret)
+	if err != nil {
+		return uuid.Nil, "sso_failed", err
+	}
+
+	base := oidcUsername(identity)
+	user := &models.User{Email: identity.Email, PasswordHash: passwordHash}
+	for attempt := 0; attempt < 5; attempt++ {
+		user.Username = base
+		if attempt > 0 {
+			suffix := make([]byte, 3)
+			if _, err := rand.Read(suffix); err != nil {
+				return uuid.Nil, "sso_failed", err
+			}
+			user.Username = base + "-" + hex.EncodeToString(suffix)
+		}
+		if _, err := repo.GetUserByUsername(ctx, user.Username); err == nil {
+			continue
+		}
+		if err := repo.CreateUser(ctx, user); err != nil {
+			return uuid.Nil, "sso_failed", err
+		}
+		return user.ID, "", nil
+	}
+	return uuid.Nil, "sso_failed", errors.New("could not find a free username")
+}
+
+// syncOIDCRole gives the user the highest role their groups map to, or the
+// default role when none do
+func syncOIDCRole(ctx context.Context, repo repository.Repository, sessions *SessionCache, userID uuid.UUID, roles []string) error {
+	user, err := repo.GetUserByUUID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	role := auth.HighestRole(roles)
+	if user.Role == role {
+		return nil
+	}
+	log.Printf("Identity provider changed the role of user %s from %s to %s", userID, user.Role, role)
+	return changeUserRole(ctx, repo, sessions, userID, user.Role, role)
+}
+
+// oidcUsername picks a username from the preferred_username or email local part
+func oidcUsername(identity *oidc.Identity) string {
+	name := identity.Username
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+	name = strings.Trim(unsafeUsernameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	if name == "" {
+		name = "user"
+	}
+	return name
+}
+
+func oidcFailure(c echo.Context, reason string) error {
+	return c.Redirect(http.StatusFound, appURL()+"/login?error="+url.QueryEscape(reason))
+}
+
+// GetIdentities lists the identity providers linked to the caller's account
+func GetIdentities(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gid-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gid-001]"})
+		}
+
+		identities, err := repo.GetIdentitiesByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get identities [gid-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gid-002]"})
+		}
+		return c.JSON(http.StatusOK, identities)
+	}
+}
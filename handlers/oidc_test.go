@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/oidc"
+	"github.com/FiveEightyEight/gippity-serv/oidc/oidctest"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+type oidcTest struct {
+	t    *testing.T
+	idp  *oidctest.Server
+	repo *memory.Repository
+	e    *echo.Echo
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Setenv("APP_URL", "https://app.example.com")
+	idp := oidctest.NewServer(t)
+	repo := newTestRepo(t)
+	providers := map[string]*oidc.Provider{
+		"test": oidc.NewProvider(oidc.Config{
+			Name:         "test",
+			Issuer:       idp.URL,
+			ClientID:     oidctest.ClientID,
+			ClientSecret: oidctest.ClientSecret,
+			RedirectURL:  "https://api.example.com/auth/oidc/test/callback",
+			Scopes:       []string{"openid", "email", "profile"},
+			GroupsClaim:  "groups",
+			RoleMap:      map[string]string{},
+		}, idp.Client()),
+	}
+
+	e := echo.New()
+	e.GET("/auth/oidc/:provider/login", OIDCLogin(repo, providers))
+	e.GET("/auth/oidc/:provider/callback", OIDCCallback(repo, providers, testHasher(), NewSessionCache(repo)))
+	return &oidcTest{t: t, idp: idp, repo: repo, e: e}
+}
+
+func (o *oidcTest) get(target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	o.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+// begin starts a login and returns the code and state the provider sends back
+func (o *oidcTest) begin() (code string, state string) {
+	o.t.Helper()
+	rec := o.get("/auth/oidc/test/login")
+	if rec.Code != http.StatusFound {
+		o.t.Fatalf("login returned %d: %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, o.idp.URL+"/authorize?") {
+		o.t.Fatalf("login redirected to %s, want the provider", location)
+	}
+	return o.idp.Authorize(location)
+}
+
+func (o *oidcTest) callback(code string, state string) *httptest.ResponseRecorder {
+	return o.get("/auth/oidc/test/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+}
+
+func (o *oidcTest) expectFailure(rec *httptest.ResponseRecorder, reason string) {
+	o.t.Helper()
+	want := "https://app.example.com/login?error=" + reason
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != want {
+		o.t.Fatalf("callback returned %d to %q, want a redirect to %q", rec.Code, rec.Header().Get("Location"), want)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		o.t.Fatal("callback set a cookie on a failed login")
+	}
+}
+
+func TestOIDCLoginProvisionsVerifiedUser(t *testing.T) {
+	o := newOIDCTest(t)
+	rec := o.callback(o.begin())
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://app.example.com/auth/callback" {
+		t.Fatalf("callback returned %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	refresh := responseCookie(rec, refreshTokenCookieName)
+	if refresh == nil || refresh.Value == "" || !refresh.HttpOnly {
+		t.Fatalf("callback did not set the refresh cookie: %v", rec.Result().Cookies())
+	}
+
+	ctx := context.Background()
+	user, err := o.repo.GetUserByEmail(ctx, "ada@example.com")
+	if err != nil {
+		t.Fatalf("user was not provisioned: %v", err)
+	}
+	if user.Username != "ada" || user.EmailVerifiedAt == nil {
+		t.Errorf("user = %+v, want username ada with a verified email", user)
+	}
+	linked, err := o.repo.GetUserIDByIdentity(ctx, "test", oidctest.Subject)
+	if err != nil || linked != user.ID {
+		t.Errorf("identity links to %s (%v), want %s", linked, err, user.ID)
+	}
+
+	// Signing in again uses the link instead of provisioning another account
+	if rec := o.callback(o.begin()); rec.Header().Get("Location") != "https://app.example.com/auth/callback" {
+		t.Fatalf("second login redirected to %q", rec.Header().Get("Location"))
+	}
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	o := newOIDCTest(t)
+	code, state := o.begin()
+	o.expectFailure(o.callback(code, state+"x"), "sso_expired")
+	o.expectFailure(o.callback(code, ""), "sso_expired")
+
+	// The state is consumed by the first callback and cannot be replayed
+	if rec := o.callback(code, state); rec.Header().Get("Location") != "https://app.example.com/auth/callback" {
+		t.Fatalf("callback redirected to %q", rec.Header().Get("Location"))
+	}
+	o.expectFailure(o.callback(code, state), "sso_expired")
+}
+
+func TestOIDCCallbackRejectsInvalidIDToken(t *testing.T) {
+	for name, edit := range map[string]func(jwt.MapClaims){
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"audience": func(c jwt.MapClaims) { c["aud"] = "another-client" },
+		"nonce":    func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			o := newOIDCTest(t)
+			o.idp.Claims = edit
+			o.expectFailure(o.callback(o.begin()), "sso_failed")
+			if _, err := o.repo.GetUserByEmail(context.Background(), "ada@example.com"); err == nil {
+				t.Fatal("a user was provisioned from an invalid id token")
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRequiresVerifiedEmail(t *testing.T) {
+	unverified := func(c jwt.MapClaims) { c["email_verified"] = false }
+
+	t.Run("provisioning", func(t *testing.T) {
+		o := newOIDCTest(t)
+		o.idp.Claims = unverified
+		o.expectFailure(o.callback(o.begin()), "sso_email_unverified")
+		if _, err := o.repo.GetUserByEmail(context.Background(), "ada@example.com"); err == nil {
+			t.Fatal("a user was provisioned with an unverified email")
+		}
+	})
+
+	t.Run("linking", func(t *testing.T) {
+		o := newOIDCTest(t)
+		ctx := context.Background()
+		existing := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: "x"}
+		if err := o.repo.CreateUser(ctx, existing); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.repo.MarkEmailVerified(ctx, existing.ID); err != nil {
+			t.Fatal(err)
+		}
+		o.idp.Claims = unverified
+		o.expectFailure(o.callback(o.begin()), "sso_email_unverified")
+		if _, err := o.repo.GetUserIDByIdentity(ctx, "test", oidctest.Subject); err == nil {
+			t.Fatal("an unverified email was linked to an existing account")
+		}
+
+		o.idp.Claims = nil
+		if rec := o.callback(o.begin()); rec.Header().Get("Location") != "https://app.example.com/auth/callback" {
+			t.Fatalf("callback redirected to %q", rec.Header().Get("Location"))
+		}
+		linked, err := o.repo.GetUserIDByIdentity(ctx, "test", oidctest.Subject)
+		if err != nil || linked != existing.ID {
+			t.Fatalf("identity links to %s (%v), want the existing account %s", linked, err, existing.ID)
+		}
+	})
+}
+
+func TestOIDCCallbackDoesNotLinkUnverifiedAccount(t *testing.T) {
+	o := newOIDCTest(t)
+	ctx := context.Background()
+	// Someone registered the employee's address with a password they know
+	squatter := &models.User{Username: "squatter", Email: "ada@example.com", PasswordHash: "x"}
+	if err := o.repo.CreateUser(ctx, squatter); err != nil {
+		t.Fatal(err)
+	}
+
+	o.expectFailure(o.callback(o.begin()), "sso_email_conflict")
+	if _, err := o.repo.GetUserIDByIdentity(ctx, "test", oidctest.Subject); err == nil {
+		t.Fatal("the identity was linked to an account that never verified its email")
+	}
+	if verified, err := o.repo.IsEmailVerified(ctx, squatter.ID); err != nil || verified {
+		t.Fatalf("the unverified account's email was marked verified (%v)", err)
+	}
+	if sessions, err := o.repo.GetActiveSessionsByUserID(ctx, squatter.ID); err != nil || len(sessions) != 0 {
+		t.Fatalf("the unverified account got %d sessions (%v)", len(sessions), err)
+	}
+}
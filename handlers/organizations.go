@@ -0,0 +1,631 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type organizationRequest struct {
+	Name string `json:"name"`
+}
+
+type organizationMemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type workspaceModelsRequest struct {
+	ModelIDs []uuid.UUID `json:"model_ids"`
+}
+
+type moveChatRequest struct {
+	// WorkspaceID is the workspace to move the chat to; null moves it back to its owner's personal space
+	WorkspaceID *uuid.UUID `json:"workspace_id"`
+}
+
+// orgAccess loads the caller's role in the organization named by the :id
+// param. Organizations the caller is not a member of are reported as not found.
+func orgAccess(c echo.Context, repo repository.Repository) (uuid.UUID, uuid.UUID, string, error) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		log.Println("Failed to get userID from context [oa-001]", err)
+		return uuid.Nil, uuid.Nil, "", echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized [oa-001]")
+	}
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, "", echo.NewHTTPError(http.StatusBadRequest, "Invalid organization ID [oa-002]")
+	}
+	role, err := repo.GetOrganizationRole(c.Request().Context(), orgID, userID)
+	if err != nil {
+		log.Println("Failed to get organization role [oa-003]", err)
+		return uuid.Nil, uuid.Nil, "", echo.NewHTTPError(http.StatusInternalServerError, "Internal server error [oa-003]")
+	}
+	if role == "" {
+		return uuid.Nil, uuid.Nil, "", echo.NewHTTPError(http.StatusNotFound, "Organization not found [oa-004]")
+	}
+	return userID, orgID, role, nil
+}
+
+// workspaceAccess loads the workspace named by the :id param and the caller's
+// role in its organization. Workspaces outside the caller's organizations are
+// reported as not found.
+func workspaceAccess(c echo.Context, repo repository.Repository) (uuid.UUID, *models.Workspace, string, error) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		log.Println("Failed to get userID from context [wa-001]", err)
+		return uuid.Nil, nil, "", echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized [wa-001]")
+	}
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return uuid.Nil, nil, "", echo.NewHTTPError(http.StatusBadRequest, "Invalid workspace ID [wa-002]")
+	}
+	ctx := c.Request().Context()
+	role, err := repo.GetWorkspaceRole(ctx, workspaceID, userID)
+	if err != nil {
+		log.Println("Failed to get workspace role [wa-003]", err)
+		return uuid.Nil, nil, "", echo.NewHTTPError(http.StatusInternalServerError, "Internal server error [wa-003]")
+	}
+	if role == "" {
+		return uuid.Nil, nil, "", echo.NewHTTPError(http.StatusNotFound, "Workspace not found [wa-004]")
+	}
+	workspace, err := repo.GetWorkspaceByID(ctx, workspaceID)
+	if errors.Is(err, db.ErrWorkspaceNotFound) {
+		return uuid.Nil, nil, "", echo.NewHTTPError(http.StatusNotFound, "Workspace not found [wa-004]")
+	}
+	if err != nil {
+		log.Println("Failed to get workspace [wa-005]", err)
+		return uuid.Nil, nil, "", echo.NewHTTPError(http.StatusInternalServerError, "Internal server error [wa-005]")
+	}
+	return userID, workspace, role, nil
+}
+
+func CreateOrganization(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [co-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [co-001]"})
+		}
+		var req organizationRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [co-002]"})
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required and at most 100 characters [co-003]"})
+		}
+
+		org := &models.Organization{Name: name}
+		if err := repo.CreateOrganization(c.Request().Context(), org, userID); err != nil {
+			log.Println("Failed to create organization [co-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [co-004]"})
+		}
+		return c.JSON(http.StatusCreated, org)
+	}
+}
+
+// GetOrganizations lists the caller's organizations with their role in each
+func GetOrganizations(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [go-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [go-001]"})
+		}
+		orgs, err := repo.GetOrganizationsByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get organizations [go-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [go-002]"})
+		}
+		return c.JSON(http.StatusOK, orgs)
+	}
+}
+
+func UpdateOrganization(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, role, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can rename the organization [uo-001]"})
+		}
+		var req organizationRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [uo-002]"})
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required and at most 100 characters [uo-003]"})
+		}
+
+		err = repo.RenameOrganization(c.Request().Context(), orgID, name)
+		if errors.Is(err, db.ErrOrganizationNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Organization not found [uo-004]"})
+		}
+		if err != nil {
+			log.Println("Failed to rename organization [uo-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uo-005]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// DeleteOrganization removes the organization, its workspaces and every chat in them
+func DeleteOrganization(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, role, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if role != db.OrgRoleOwner {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners can delete the organization [do-001]"})
+		}
+
+		err = repo.DeleteOrganization(c.Request().Context(), orgID)
+		if errors.Is(err, db.ErrOrganizationNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Organization not found [do-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to delete organization [do-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [do-003]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func GetOrganizationMembers(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, _, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		members, err := repo.GetOrganizationMembers(c.Request().Context(), orgID)
+		if err != nil {
+			log.Println("Failed to get organization members [gom-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gom-001]"})
+		}
+		return c.JSON(http.StatusOK, members)
+	}
+}
+
+// AddOrganizationMember adds a user by username. Only owners can add other owners.
+func AddOrganizationMember(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, role, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can add members [aom-001]"})
+		}
+		var req organizationMemberRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [aom-002]"})
+		}
+		if req.Role == "" {
+			req.Role = db.OrgRoleMember
+		}
+		if !db.ValidOrgRole(req.Role) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "role must be one of " + strings.Join(db.OrgRoles, ", ") + " [aom-003]"})
+		}
+		if req.Role == db.OrgRoleOwner && role != db.OrgRoleOwner {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners can add owners [aom-004]"})
+		}
+
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUsername(ctx, strings.TrimSpace(req.Username))
+		if errors.Is(err, db.ErrUserNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [aom-005]"})
+		}
+		if err != nil {
+			log.Println("Failed to get user [aom-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [aom-006]"})
+		}
+
+		member := &models.OrganizationMember{OrganizationID: orgID, UserID: user.ID, Username: user.Username, Role: req.Role}
+		err = repo.AddOrganizationMember(ctx, member)
+		if errors.Is(err, db.ErrMemberExists) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "User is already a member [aom-007]"})
+		}
+		if errors.Is(err, db.ErrUserNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [aom-005]"})
+		}
+		if err != nil {
+			log.Println("Failed to add organization member [aom-008]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [aom-008]"})
+		}
+		return c.JSON(http.StatusCreated, member)
+	}
+}
+
+// UpdateOrganizationMember changes a member's role. Only owners can grant or
+// take away the owner role, and the last owner cannot be demoted.
+func UpdateOrganizationMember(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, role, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can change roles [uom-001]"})
+		}
+		memberID, err := uuid.Parse(c.Param("user_id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [uom-002]"})
+		}
+		var req organizationMemberRequest
+		if err := c.Bind(&req); err != nil || !db.ValidOrgRole(req.Role) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "role must be one of " + strings.Join(db.OrgRoles, ", ") + " [uom-003]"})
+		}
+
+		ctx := c.Request().Context()
+		current, err := repo.GetOrganizationRole(ctx, orgID, memberID)
+		if err != nil {
+			log.Println("Failed to get organization role [uom-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uom-004]"})
+		}
+		if current == "" {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found [uom-005]"})
+		}
+		if (current == db.OrgRoleOwner || req.Role == db.OrgRoleOwner) && role != db.OrgRoleOwner {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners can change the owner role [uom-006]"})
+		}
+
+		err = repo.SetOrganizationMemberRole(ctx, orgID, memberID, req.Role)
+		if errors.Is(err, db.ErrMemberNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found [uom-005]"})
+		}
+		if errors.Is(err, db.ErrLastOwner) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "The organization needs at least one owner [uom-007]"})
+		}
+		if err != nil {
+			log.Println("Failed to set organization member role [uom-008]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uom-008]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// RemoveOrganizationMember takes a member out of the organization. Anyone can
+// leave; owners and admins can remove others, but only owners remove owners.
+func RemoveOrganizationMember(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, orgID, role, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		memberID, err := uuid.Parse(c.Param("user_id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [rom-001]"})
+		}
+
+		ctx := c.Request().Context()
+		if memberID != userID {
+			if !db.CanManageOrg(role) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can remove members [rom-002]"})
+			}
+			current, err := repo.GetOrganizationRole(ctx, orgID, memberID)
+			if err != nil {
+				log.Println("Failed to get organization role [rom-003]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rom-003]"})
+			}
+			if current == db.OrgRoleOwner && role != db.OrgRoleOwner {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners can remove owners [rom-004]"})
+			}
+		}
+
+		err = repo.RemoveOrganizationMember(ctx, orgID, memberID)
+		if errors.Is(err, db.ErrMemberNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found [rom-005]"})
+		}
+		if errors.Is(err, db.ErrLastOwner) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "The organization needs at least one owner [rom-006]"})
+		}
+		if err != nil {
+			log.Println("Failed to remove organization member [rom-007]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rom-007]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func CreateWorkspace(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, role, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can create workspaces [cw-001]"})
+		}
+		var req organizationRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [cw-002]"})
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required and at most 100 characters [cw-003]"})
+		}
+
+		workspace := &models.Workspace{OrganizationID: orgID, Name: name}
+		err = repo.CreateWorkspace(c.Request().Context(), workspace)
+		if errors.Is(err, db.ErrWorkspaceExists) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A workspace with this name already exists [cw-004]"})
+		}
+		if err != nil {
+			log.Println("Failed to create workspace [cw-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cw-005]"})
+		}
+		return c.JSON(http.StatusCreated, workspace)
+	}
+}
+
+func GetWorkspaces(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, orgID, _, err := orgAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		workspaces, err := repo.GetWorkspacesByOrganizationID(c.Request().Context(), orgID)
+		if err != nil {
+			log.Println("Failed to get workspaces [gws-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gws-001]"})
+		}
+		return c.JSON(http.StatusOK, workspaces)
+	}
+}
+
+func UpdateWorkspace(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, workspace, role, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can rename workspaces [uw-001]"})
+		}
+		var req organizationRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [uw-002]"})
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required and at most 100 characters [uw-003]"})
+		}
+
+		err = repo.RenameWorkspace(c.Request().Context(), workspace.ID, name)
+		if errors.Is(err, db.ErrWorkspaceExists) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A workspace with this name already exists [uw-004]"})
+		}
+		if errors.Is(err, db.ErrWorkspaceNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [uw-005]"})
+		}
+		if err != nil {
+			log.Println("Failed to rename workspace [uw-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [uw-006]"})
+		}
+		workspace.Name = name
+		return c.JSON(http.StatusOK, workspace)
+	}
+}
+
+// DeleteWorkspace removes the workspace with its shared chats and patterns
+func DeleteWorkspace(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, workspace, role, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can delete workspaces [dw-001]"})
+		}
+
+		err = repo.DeleteWorkspace(c.Request().Context(), workspace.ID)
+		if errors.Is(err, db.ErrWorkspaceNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [dw-002]"})
+		}
+		if err != nil {
+			log.Println("Failed to delete workspace [dw-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dw-003]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// GetWorkspaceModels returns the workspace's model allowlist; an empty list allows every model
+func GetWorkspaceModels(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, workspace, _, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		list, err := repo.GetWorkspaceModels(c.Request().Context(), workspace.ID)
+		if err != nil {
+			log.Println("Failed to get workspace models [gwm-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gwm-001]"})
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// SetWorkspaceModels replaces the workspace's model allowlist
+func SetWorkspaceModels(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, workspace, role, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		if !db.CanManageOrg(role) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Only owners and admins can change workspace models [swm-001]"})
+		}
+		var req workspaceModelsRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [swm-002]"})
+		}
+
+		ctx := c.Request().Context()
+		err = repo.SetWorkspaceModels(ctx, workspace.ID, req.ModelIDs)
+		if errors.Is(err, db.ErrAIModelNotFound) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown model ID [swm-003]"})
+		}
+		if err != nil {
+			log.Println("Failed to set workspace models [swm-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [swm-004]"})
+		}
+		list, err := repo.GetWorkspaceModels(ctx, workspace.ID)
+		if err != nil {
+			log.Println("Failed to get workspace models [swm-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [swm-005]"})
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+func GetWorkspacePatterns(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, workspace, _, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		patterns, err := repo.GetWorkspacePatterns(c.Request().Context(), workspace.ID)
+		if err != nil {
+			log.Println("Failed to get workspace patterns [gwp-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gwp-001]"})
+		}
+		return c.JSON(http.StatusOK, patterns)
+	}
+}
+
+// SaveWorkspacePattern creates or replaces a pattern shared with the
+// workspace. It takes precedence over a global pattern of the same name when
+// run in the workspace.
+func SaveWorkspacePattern(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, workspace, _, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		var req patternRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [swp-001]"})
+		}
+
+		pattern := &models.WorkspacePattern{
+			WorkspaceID: workspace.ID,
+			Name:        c.Param("name"),
+			System:      req.System,
+			User:        req.User,
+			CreatedBy:   &userID,
+		}
+		created, err := repo.SaveWorkspacePattern(c.Request().Context(), pattern)
+		if errors.Is(err, db.ErrInvalidPattern) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Pattern names are lowercase letters, digits, _ and -, and system is required [swp-002]"})
+		}
+		if errors.Is(err, db.ErrWorkspaceNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [swp-003]"})
+		}
+		if err != nil {
+			log.Println("Failed to save workspace pattern [swp-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [swp-004]"})
+		}
+		if created {
+			return c.JSON(http.StatusCreated, pattern)
+		}
+		return c.JSON(http.StatusOK, pattern)
+	}
+}
+
+func DeleteWorkspacePattern(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, workspace, _, err := workspaceAccess(c, repo)
+		if err != nil {
+			return err
+		}
+		err = repo.DeleteWorkspacePattern(c.Request().Context(), workspace.ID, c.Param("name"))
+		if errors.Is(err, db.ErrPatternNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Pattern not found [dwp-001]"})
+		}
+		if err != nil {
+			log.Println("Failed to delete workspace pattern [dwp-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dwp-002]"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// MoveChat moves a chat into a workspace, between workspaces or back to its
+// owner's personal space. Only the owner can take a chat out of a workspace;
+// workspace admins can move it to another workspace they belong to.
+func MoveChat(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid chat ID [mc-001]"})
+		}
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [mc-002]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [mc-002]"})
+		}
+		var req moveChatRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload [mc-003]"})
+		}
+
+		ctx := c.Request().Context()
+		chat, err := repo.GetChatByID(ctx, chatID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [mc-004]"})
+		}
+		canRead, canManage, err := db.ChatAccess(ctx, repo, chat, userID)
+		if err != nil {
+			log.Println("Failed to check chat access [mc-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [mc-005]"})
+		}
+		if !canRead {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found [mc-004]"})
+		}
+		if !canManage {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [mc-006]"})
+		}
+
+		if req.WorkspaceID == nil {
+			if chat.UserID != userID {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Only the chat's owner can make it personal [mc-007]"})
+			}
+		} else {
+			role, err := repo.GetWorkspaceRole(ctx, *req.WorkspaceID, userID)
+			if err != nil {
+				log.Println("Failed to get workspace role [mc-008]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [mc-008]"})
+			}
+			if role == "" {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [mc-009]"})
+			}
+			allowed, err := repo.IsModelAllowedInWorkspace(ctx, *req.WorkspaceID, chat.AIModelVersion)
+			if err != nil {
+				log.Println("Failed to check workspace model [mc-010]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [mc-010]"})
+			}
+			if !allowed {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "The chat's model is not allowed in this workspace [mc-011]"})
+			}
+		}
+
+		chat.WorkspaceID = req.WorkspaceID
+		if err := repo.UpdateChat(ctx, chat); err != nil {
+			log.Println("Failed to move chat [mc-012]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [mc-012]"})
+		}
+		return c.JSON(http.StatusOK, chat)
+	}
+}
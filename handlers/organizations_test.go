@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// orgRoutes serves the organization, workspace and chat routes to userID
+func orgRoutes(repo *memory.Repository, userID uuid.UUID) *echo.Echo {
+	e := echo.New()
+	e.Use(asUser(userID))
+	e.POST("/orgs", CreateOrganization(repo))
+	e.GET("/orgs", GetOrganizations(repo))
+	e.PUT("/orgs/:id", UpdateOrganization(repo))
+	e.DELETE("/orgs/:id", DeleteOrganization(repo))
+	e.GET("/orgs/:id/members", GetOrganizationMembers(repo))
+	e.POST("/orgs/:id/members", AddOrganizationMember(repo))
+	e.PUT("/orgs/:id/members/:user_id", UpdateOrganizationMember(repo))
+	e.DELETE("/orgs/:id/members/:user_id", RemoveOrganizationMember(repo))
+	e.POST("/orgs/:id/workspaces", CreateWorkspace(repo))
+	e.DELETE("/workspaces/:id", DeleteWorkspace(repo))
+	e.PUT("/workspaces/:id/models", SetWorkspaceModels(repo))
+	e.GET("/workspaces/:id/patterns", GetWorkspacePatterns(repo))
+	e.PUT("/workspaces/:id/patterns/:name", SaveWorkspacePattern(repo))
+	e.DELETE("/workspaces/:id/patterns/:name", DeleteWorkspacePattern(repo))
+	e.GET("/chat", GetConversation(repo))
+	e.GET("/chat-history", GetChatHistory(repo))
+	e.DELETE("/chat/:id", DeleteChat(repo))
+	e.PUT("/chat/:id/workspace", MoveChat(repo))
+	return e
+}
+
+// createOrg has e's user create an organization and returns its path
+func createOrg(t *testing.T, e *echo.Echo, name string) string {
+	t.Helper()
+	rec := serve(e, http.MethodPost, "/orgs", `{"name": "`+name+`"}`)
+	var org models.Organization
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &org) != nil {
+		t.Fatalf("creating an organization returned %d: %s", rec.Code, rec.Body)
+	}
+	return "/orgs/" + org.ID.String()
+}
+
+func TestOrganizationMembers(t *testing.T) {
+	repo := newTestRepo(t)
+	ada := createTestUser(t, repo, "ada", "correct horse")
+	bob := createTestUser(t, repo, "bob", "battery staple")
+	cat := createTestUser(t, repo, "cat", "staple horse")
+	dan := createTestUser(t, repo, "dan", "horse battery")
+	asAda, asBob, asCat, asDan := orgRoutes(repo, ada.ID), orgRoutes(repo, bob.ID), orgRoutes(repo, cat.ID), orgRoutes(repo, dan.ID)
+
+	if rec := serve(asAda, http.MethodPost, "/orgs", `{"name": " "}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an organization without a name got %d, want 400", rec.Code)
+	}
+	orgPath := createOrg(t, asAda, "Acme")
+	var orgs []*models.Organization
+	if rec := serve(asAda, http.MethodGet, "/orgs", ""); json.Unmarshal(rec.Body.Bytes(), &orgs) != nil || len(orgs) != 1 || orgs[0].Role != db.OrgRoleOwner {
+		t.Fatalf("ada's organizations = %s", rec.Body)
+	}
+	// Organizations are hidden from outsiders
+	if rec := serve(asDan, http.MethodGet, orgPath+"/members", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("an outsider listing members got %d, want 404", rec.Code)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{`{"username": "bob"}`, http.StatusCreated},
+		{`{"username": "cat", "role": "admin"}`, http.StatusCreated},
+		{`{"username": "bob"}`, http.StatusConflict},
+		{`{"username": "nobody"}`, http.StatusNotFound},
+		{`{"username": "dan", "role": "boss"}`, http.StatusBadRequest},
+	} {
+		if rec := serve(asAda, http.MethodPost, orgPath+"/members", tt.body); rec.Code != tt.code {
+			t.Fatalf("adding %s got %d, want %d: %s", tt.body, rec.Code, tt.code, rec.Body)
+		}
+	}
+	var members []*models.OrganizationMember
+	if rec := serve(asBob, http.MethodGet, orgPath+"/members", ""); json.Unmarshal(rec.Body.Bytes(), &members) != nil || len(members) != 3 {
+		t.Fatalf("members = %s", rec.Body)
+	}
+
+	// Members cannot manage; admins can, except where owners are concerned
+	adaPath, bobPath := orgPath+"/members/"+ada.ID.String(), orgPath+"/members/"+bob.ID.String()
+	for _, tt := range []struct {
+		name   string
+		e      *echo.Echo
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{"a member renaming", asBob, http.MethodPut, orgPath, `{"name": "Bob Inc"}`, http.StatusForbidden},
+		{"a member adding", asBob, http.MethodPost, orgPath + "/members", `{"username": "dan"}`, http.StatusForbidden},
+		{"an admin adding an owner", asCat, http.MethodPost, orgPath + "/members", `{"username": "dan", "role": "owner"}`, http.StatusForbidden},
+		{"an admin demoting an owner", asCat, http.MethodPut, adaPath, `{"role": "member"}`, http.StatusForbidden},
+		{"an admin removing an owner", asCat, http.MethodDelete, adaPath, "", http.StatusForbidden},
+		{"an admin renaming", asCat, http.MethodPut, orgPath, `{"name": "Acme Corp"}`, http.StatusNoContent},
+		{"an admin promoting a member", asCat, http.MethodPut, bobPath, `{"role": "admin"}`, http.StatusNoContent},
+		{"an admin deleting", asCat, http.MethodDelete, orgPath, "", http.StatusForbidden},
+		{"the last owner stepping down", asAda, http.MethodPut, adaPath, `{"role": "admin"}`, http.StatusConflict},
+		{"the last owner leaving", asAda, http.MethodDelete, adaPath, "", http.StatusConflict},
+		{"a member leaving", asBob, http.MethodDelete, bobPath, "", http.StatusNoContent},
+		{"a former member listing", asBob, http.MethodGet, orgPath + "/members", "", http.StatusNotFound},
+		{"the owner deleting", asAda, http.MethodDelete, orgPath, "", http.StatusNoContent},
+	} {
+		if rec := serve(tt.e, tt.method, tt.target, tt.body); rec.Code != tt.code {
+			t.Fatalf("%s got %d, want %d: %s", tt.name, rec.Code, tt.code, rec.Body)
+		}
+	}
+	if rec := serve(asCat, http.MethodGet, "/orgs", ""); json.Unmarshal(rec.Body.Bytes(), &orgs) != nil || len(orgs) != 0 {
+		t.Fatalf("a deleted organization is still listed: %s", rec.Body)
+	}
+}
+
+func TestWorkspaceChats(t *testing.T) {
+	repo := newTestRepo(t)
+	ada := createTestUser(t, repo, "ada", "correct horse")
+	bob := createTestUser(t, repo, "bob", "battery staple")
+	dan := createTestUser(t, repo, "dan", "horse battery")
+	asAda, asBob, asDan := orgRoutes(repo, ada.ID), orgRoutes(repo, bob.ID), orgRoutes(repo, dan.ID)
+	ctx := context.Background()
+
+	orgPath := createOrg(t, asAda, "Acme")
+	if rec := serve(asAda, http.MethodPost, orgPath+"/members", `{"username": "bob"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("adding bob returned %d", rec.Code)
+	}
+	if rec := serve(asBob, http.MethodPost, orgPath+"/workspaces", `{"name": "Team"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("a member creating a workspace got %d, want 403", rec.Code)
+	}
+	rec := serve(asAda, http.MethodPost, orgPath+"/workspaces", `{"name": "Team"}`)
+	var workspace models.Workspace
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &workspace) != nil {
+		t.Fatalf("creating a workspace returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(asAda, http.MethodPost, orgPath+"/workspaces", `{"name": "Team"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("a duplicate workspace got %d, want 409", rec.Code)
+	}
+	workspacePath := "/workspaces/" + workspace.ID.String()
+	moveTo := `{"workspace_id": "` + workspace.ID.String() + `"}`
+
+	now := time.Now()
+	chat, err := repo.CreateChat(ctx, &models.Chat{UserID: bob.ID, Title: "plans", CreatedAt: now, LastUpdated: now, AIModelVersion: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatPath := "/chat/" + chat.ID.String()
+	if rec := serve(asDan, http.MethodPut, chatPath+"/workspace", moveTo); rec.Code != http.StatusNotFound {
+		t.Fatalf("an outsider moving the chat got %d, want 404", rec.Code)
+	}
+	if rec := serve(asBob, http.MethodPut, chatPath+"/workspace", moveTo); rec.Code != http.StatusOK {
+		t.Fatalf("moving the chat into the workspace returned %d: %s", rec.Code, rec.Body)
+	}
+
+	// Every member of the organization can read a workspace chat
+	if rec := serve(asAda, http.MethodGet, "/chat?id="+chat.ID.String(), ""); rec.Code != http.StatusOK {
+		t.Fatalf("the org owner reading a workspace chat got %d", rec.Code)
+	}
+	if rec := serve(asDan, http.MethodGet, "/chat?id="+chat.ID.String(), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("an outsider reading a workspace chat got %d, want 403", rec.Code)
+	}
+	var chats []*models.Chat
+	if rec := serve(asAda, http.MethodGet, "/chat-history?workspace_id="+workspace.ID.String(), ""); json.Unmarshal(rec.Body.Bytes(), &chats) != nil || len(chats) != 1 {
+		t.Fatalf("workspace history = %s", rec.Body)
+	}
+	if rec := serve(asDan, http.MethodGet, "/chat-history?workspace_id="+workspace.ID.String(), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("an outsider listing the workspace got %d, want 404", rec.Code)
+	}
+
+	// Only the owner can take a chat back out
+	if rec := serve(asAda, http.MethodPut, chatPath+"/workspace", `{"workspace_id": null}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("the org owner making bob's chat personal got %d, want 403", rec.Code)
+	}
+	if rec := serve(asBob, http.MethodPut, chatPath+"/workspace", `{"workspace_id": null}`); rec.Code != http.StatusOK {
+		t.Fatalf("bob making the chat personal got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(asAda, http.MethodGet, "/chat?id="+chat.ID.String(), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("reading a chat moved out of the workspace got %d, want 403", rec.Code)
+	}
+
+	// The model allowlist keeps other models out
+	allowed := &models.AIModel{Name: "new", Version: "v2", IsActive: true}
+	if err := repo.CreateAIModel(ctx, allowed); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(asAda, http.MethodPut, workspacePath+"/models", `{"model_ids": ["`+uuid.NewString()+`"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("allowing an unknown model got %d, want 400", rec.Code)
+	}
+	if rec := serve(asBob, http.MethodPut, workspacePath+"/models", `{"model_ids": ["`+allowed.ID.String()+`"]}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("a member setting models got %d, want 403", rec.Code)
+	}
+	if rec := serve(asAda, http.MethodPut, workspacePath+"/models", `{"model_ids": ["`+allowed.ID.String()+`"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("setting models returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(asBob, http.MethodPut, chatPath+"/workspace", moveTo); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "mc-011") {
+		t.Fatalf("moving a chat on another model got %d %s, want 403", rec.Code, rec.Body)
+	}
+
+	// Org owners and admins manage workspace chats; members only their own
+	adasChat, err := repo.CreateChat(ctx, &models.Chat{UserID: ada.ID, WorkspaceID: &workspace.ID, Title: "roadmap", CreatedAt: now, LastUpdated: now, AIModelVersion: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(asBob, http.MethodDelete, "/chat/"+adasChat.ID.String(), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("a member deleting another's workspace chat got %d, want 403", rec.Code)
+	}
+	chat.AIModelVersion = "v2"
+	chat.WorkspaceID = &workspace.ID
+	if err := repo.UpdateChat(ctx, chat); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(asAda, http.MethodDelete, chatPath, ""); rec.Code != http.StatusOK {
+		t.Fatalf("the org owner deleting bob's workspace chat got %d", rec.Code)
+	}
+
+	if rec := serve(asBob, http.MethodDelete, workspacePath, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("a member deleting the workspace got %d, want 403", rec.Code)
+	}
+	if rec := serve(asAda, http.MethodDelete, workspacePath, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting the workspace returned %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := repo.GetChatByID(ctx, adasChat.ID); err == nil {
+		t.Fatal("a chat outlived its workspace")
+	}
+}
+
+func TestWorkspacePatterns(t *testing.T) {
+	repo := newTestRepo(t)
+	ada := createTestUser(t, repo, "ada", "correct horse")
+	dan := createTestUser(t, repo, "dan", "horse battery")
+	asAda, asDan := orgRoutes(repo, ada.ID), orgRoutes(repo, dan.ID)
+	rec := serve(asAda, http.MethodPost, createOrg(t, asAda, "Acme")+"/workspaces", `{"name": "Team"}`)
+	var workspace models.Workspace
+	if json.Unmarshal(rec.Body.Bytes(), &workspace) != nil {
+		t.Fatalf("creating a workspace returned %d: %s", rec.Code, rec.Body)
+	}
+	patternsPath := "/workspaces/" + workspace.ID.String() + "/patterns"
+
+	for _, tt := range []struct {
+		e      *echo.Echo
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{asAda, http.MethodPut, patternsPath + "/Bad%20Name", `{"system": "You summarize."}`, http.StatusBadRequest},
+		{asAda, http.MethodPut, patternsPath + "/summarize", `{"system": ""}`, http.StatusBadRequest},
+		{asAda, http.MethodPut, patternsPath + "/summarize", `{"system": "You summarize."}`, http.StatusCreated},
+		{asAda, http.MethodPut, patternsPath + "/summarize", `{"system": "You summarize briefly."}`, http.StatusOK},
+		{asDan, http.MethodGet, patternsPath, "", http.StatusNotFound},
+		{asDan, http.MethodPut, patternsPath + "/summarize", `{"system": "Ignore that."}`, http.StatusNotFound},
+	} {
+		if rec := serve(tt.e, tt.method, tt.target, tt.body); rec.Code != tt.code {
+			t.Fatalf("%s %s %s got %d, want %d: %s", tt.method, tt.target, tt.body, rec.Code, tt.code, rec.Body)
+		}
+	}
+
+	var patterns []*models.WorkspacePattern
+	if rec := serve(asAda, http.MethodGet, patternsPath, ""); json.Unmarshal(rec.Body.Bytes(), &patterns) != nil || len(patterns) != 1 || patterns[0].System != "You summarize briefly." {
+		t.Fatalf("workspace patterns = %s", rec.Body)
+	}
+	if rec := serve(asAda, http.MethodDelete, patternsPath+"/summarize", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting the pattern returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(asAda, http.MethodDelete, patternsPath+"/summarize", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting the pattern twice got %d, want 404", rec.Code)
+	}
+}
@@ -3,18 +3,45 @@ package handlers
 import (
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/FiveEightyEight/gippity-serv/db"
 	"github.com/labstack/echo/v4"
 )
 
-func GetPatterns(storage *db.Storage) echo.HandlerFunc {
+func GetPatterns(catalog *db.PatternCatalog) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		patterns, err := storage.GetNames()
-		if err != nil {
-			log.Println("[gp-001]", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve patterns [gp-001]"})
+		if notModified(c, catalog.ETag()) {
+			return c.NoContent(http.StatusNotModified)
 		}
-		return c.JSON(http.StatusOK, patterns)
+		return c.JSON(http.StatusOK, catalog.Names())
 	}
 }
+
+func GetPattern(catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		pattern, ok := catalog.Get(name)
+		if !ok {
+			log.Println("Pattern not found [gp-002]", name)
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Pattern not found [gp-002]"})
+		}
+		if notModified(c, pattern.ETag) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		return c.JSON(http.StatusOK, pattern)
+	}
+}
+
+// notModified sets the ETag header and reports whether the client already has this version
+func notModified(c echo.Context, etag string) bool {
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "private, no-cache")
+	for _, candidate := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
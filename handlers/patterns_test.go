@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestCatalog returns a catalog of an empty temporary patterns directory
+func newTestCatalog(t *testing.T) *db.PatternCatalog {
+	t.Helper()
+	catalog, err := db.NewPatternCatalog(&db.Storage{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func TestPatternsAnswerNotModified(t *testing.T) {
+	catalog := newTestCatalog(t)
+	if err := catalog.SavePattern("summarize", "You summarize text.", ""); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.GET("/patterns", GetPatterns(catalog))
+	e.GET("/patterns/:name", GetPattern(catalog))
+	get := func(target string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, target := range []string{"/patterns", "/patterns/summarize"} {
+		rec := get(target, "")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || etag == "" {
+			t.Fatalf("GET %s returned %d with etag %q", target, rec.Code, etag)
+		}
+		if rec := get(target, `"stale", W/`+etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("GET %s with a matching etag returned %d: %s", target, rec.Code, rec.Body)
+		}
+
+		// A changed pattern has a new etag, so the client's copy is stale
+		if err := catalog.SavePattern("summarize", "You summarize text in "+target+".", ""); err != nil {
+			t.Fatal(err)
+		}
+		if rec := get(target, etag); rec.Code != http.StatusOK {
+			t.Fatalf("GET %s after a change returned %d, want 200", target, rec.Code)
+		}
+	}
+
+	if rec := get("/patterns/missing", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET of a missing pattern returned %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/labstack/echo/v4"
+)
+
+type roleMFATest struct {
+	t    *testing.T
+	repo *memory.Repository
+	user *models.User
+	e    *echo.Echo
+}
+
+// newRoleMFATest serves the login and a few account and admin routes to an
+// admin without a second factor
+func newRoleMFATest(t *testing.T) *roleMFATest {
+	repo := newTestRepo(t)
+	hasher := testHasher()
+	hash, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	user := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: hash}
+	if err := repo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetUserRole(ctx, user.ID, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.POST("/login", Login(repo, hasher))
+	api := e.Group("/api/v1")
+	api.Use(AuthMiddleware(repo, NewSessionCache(repo)))
+	api.GET("/me", GetMe(repo))
+	api.GET("/me/mfa", GetMFAStatus(repo))
+	api.GET("/admin/roles", GetRoleSettings(repo), RequirePermission(auth.PermissionManageUsers))
+	api.PUT("/admin/roles/:role", UpdateRoleSetting(repo), RequirePermission(auth.PermissionManageUsers))
+	return &roleMFATest{t: t, repo: repo, user: user, e: e}
+}
+
+func (r *roleMFATest) do(method string, target string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+	return rec
+}
+
+// login signs in with a password and returns the access token and whether the
+// response asks the user to enroll a second factor
+func (r *roleMFATest) login() (string, bool) {
+	r.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte("ada:correct horse")))
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+	var resp struct {
+		T                     string `json:"t"`
+		MFAEnrollmentRequired bool   `json:"mfa_enrollment_required"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.T == "" {
+		r.t.Fatalf("login returned %d: %s", rec.Code, rec.Body)
+	}
+	return resp.T, resp.MFAEnrollmentRequired
+}
+
+func (r *roleMFATest) enrollTOTP() {
+	r.t.Helper()
+	ctx := context.Background()
+	if err := r.repo.CreatePendingTOTP(ctx, r.user.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := r.repo.EnableTOTP(ctx, r.user.ID, 1, nil); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func TestRoleMFARequirementLimitsLoginToEnrollment(t *testing.T) {
+	r := newRoleMFATest(t)
+	token, enroll := r.login()
+	if !enroll {
+		t.Fatal("login did not ask an admin without a second factor to enroll one")
+	}
+	if rec := r.do(http.MethodGet, "/api/v1/me/mfa", token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("enrollment route returned %d: %s", rec.Code, rec.Body)
+	}
+	for _, target := range []string{"/api/v1/me", "/api/v1/admin/roles"} {
+		if rec := r.do(http.MethodGet, target, token, ""); rec.Code != http.StatusForbidden {
+			t.Fatalf("%s returned %d before enrollment, want 403", target, rec.Code)
+		}
+	}
+
+	// Enrolling unlocks the same session on its next request
+	r.enrollTOTP()
+	for _, target := range []string{"/api/v1/me", "/api/v1/admin/roles"} {
+		if rec := r.do(http.MethodGet, target, token, ""); rec.Code != http.StatusOK {
+			t.Fatalf("%s returned %d after enrollment: %s", target, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestRoleMFARequirementIsManagedByAdmins(t *testing.T) {
+	r := newRoleMFATest(t)
+	ctx := context.Background()
+	if _, err := r.repo.SetRoleMFARequired(ctx, auth.RoleAdmin, false); err != nil {
+		t.Fatal(err)
+	}
+	token, enroll := r.login()
+	if enroll {
+		t.Fatal("login asked for enrollment after the requirement was lifted")
+	}
+
+	for _, tt := range []struct {
+		target string
+		body   string
+		code   int
+	}{
+		{"/api/v1/admin/roles/owner", `{"mfa_required": true}`, http.StatusNotFound},
+		{"/api/v1/admin/roles/user", `{}`, http.StatusBadRequest},
+		{"/api/v1/admin/roles/user", `{"mfa_required": true}`, http.StatusOK},
+	} {
+		if rec := r.do(http.MethodPut, tt.target, token, tt.body); rec.Code != tt.code {
+			t.Fatalf("PUT %s %s returned %d, want %d: %s", tt.target, tt.body, rec.Code, tt.code, rec.Body)
+		}
+	}
+	required, err := r.repo.RoleRequiresMFA(ctx, auth.RoleUser)
+	if err != nil || !required {
+		t.Fatalf("user role requires mfa = %v (%v), want true", required, err)
+	}
+
+	rec := r.do(http.MethodGet, "/api/v1/admin/roles", token, "")
+	var settings []*models.RoleSetting
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &settings) != nil {
+		t.Fatalf("listing role settings returned %d: %s", rec.Code, rec.Body)
+	}
+	if len(settings) != 2 || settings[0].Role != auth.RoleAdmin || settings[0].MFARequired || settings[1].Role != auth.RoleUser || !settings[1].MFARequired {
+		t.Fatalf("role settings = %s", rec.Body)
+	}
+}
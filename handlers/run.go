@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/utils"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const maxAttachmentSize = 10 << 20
+
+type runPatternRequest struct {
+	Input          string            `json:"input" form:"input"`
+	Variables      map[string]string `json:"variables" form:"-"`
+	AIModelVersion string            `json:"ai_model_version" form:"ai_model_version"`
+	// Ephemeral skips saving the run as a chat
+	Ephemeral bool `json:"ephemeral" form:"ephemeral"`
+	// Progress frames the stream as server-sent events so chunk progress can be reported.
+	// Without it an input too large for one request sends nothing while its
+	// chunks are mapped, and output only starts with the final merge.
+	Progress bool `json:"progress" form:"progress"`
+	// WorkspaceID runs the workspace's pattern of that name if it has one and saves the chat there
+	WorkspaceID string `json:"workspace_id" form:"workspace_id"`
+}
+
+// RunPattern runs a pattern once over the given input and streams the result,
+// the same way piping input into fabric does on the command line
+func RunPattern(repo repository.Repository, catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [rp-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [rp-001]"})
+		}
+
+		req, err := bindRunPatternRequest(c)
+		if err != nil {
+			log.Println("Failed to bind run request [rp-002]", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body [rp-002]"})
+		}
+		if strings.TrimSpace(req.Input) == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Input or attachment is required [rp-003]"})
+		}
+		if req.AIModelVersion == "" {
+			req.AIModelVersion = defaultModelVersion(c.Request().Context(), repo, userID)
+		}
+
+		var workspaceID *uuid.UUID
+		var pattern *db.Pattern
+		if req.WorkspaceID != "" {
+			parsed, err := uuid.Parse(req.WorkspaceID)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid workspace_id [rp-011]"})
+			}
+			workspaceID = &parsed
+			role, err := repo.GetWorkspaceRole(c.Request().Context(), parsed, userID)
+			if err != nil {
+				log.Println("Failed to get workspace role [rp-012]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rp-012]"})
+			}
+			if role == "" {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Workspace not found [rp-013]"})
+			}
+			if !workspaceModelAllowed(c, repo, &models.Chat{WorkspaceID: workspaceID, AIModelVersion: req.AIModelVersion}) {
+				return nil
+			}
+			shared, err := repo.GetWorkspacePattern(c.Request().Context(), parsed, c.Param("name"))
+			if err != nil && !errors.Is(err, db.ErrPatternNotFound) {
+				log.Println("Failed to get workspace pattern [rp-014]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rp-014]"})
+			}
+			if shared != nil {
+				pattern = db.Pattern{Name: shared.Name, Pattern: shared.System, User: shared.User}.WithVariables(req.Variables)
+			}
+		}
+		if pattern == nil {
+			pattern, err = catalog.GetPattern(c.Param("name"), req.Variables)
+			if err != nil {
+				log.Println("Failed to get pattern [rp-004]", err)
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Pattern not found [rp-004]"})
+			}
+		}
+
+		if inputBudget(pattern, req.AIModelVersion) <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Pattern is too long for this model [rp-015]"})
+		}
+
+		messages := patternMessages(pattern, req.Input)
+
+		chatID := uuid.Nil
+		var reply *models.Message
+		timeLocation := userLocation(c.Request().Context(), repo, userID)
+		if !req.Ephemeral {
+			// The chat, the pattern's messages and the pending reply commit together
+			currentTime := time.Now().In(timeLocation)
+			reply = &models.Message{UserID: userID, Role: "assistant", Status: db.MessagePending}
+			err := repo.InTx(c.Request().Context(), func(tx repository.ConversationTx) error {
+				chat, err := tx.CreateChat(c.Request().Context(), &models.Chat{
+					UserID:         userID,
+					Title:          pattern.Name,
+					CreatedAt:      currentTime,
+					LastUpdated:    currentTime,
+					AIModelVersion: req.AIModelVersion,
+					WorkspaceID:    workspaceID,
+				})
+				if err != nil {
+					return err
+				}
+				reply.ChatID = chat.ID
+				for _, content := range messages {
+					message := &models.Message{
+						ChatID:    chat.ID,
+						UserID:    userID,
+						Role:      content.Role,
+						Content:   content.Content,
+						CreatedAt: currentTime,
+					}
+					if err := tx.CreateMessage(c.Request().Context(), message); err != nil {
+						return err
+					}
+				}
+				reply.CreatedAt = time.Now().In(timeLocation)
+				return tx.CreateMessage(c.Request().Context(), reply)
+			})
+			if err != nil {
+				log.Println("Failed to save chat [rp-005]", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rp-005]"})
+			}
+			chatID = reply.ChatID
+		}
+
+		// failReply marks the pending reply failed with whatever was streamed
+		failReply := func(output string) {
+			if reply != nil {
+				finishReply(c.Request().Context(), repo, reply, output, db.MessageFailed, timeLocation)
+			}
+		}
+
+		w := newStreamWriter(c, req.Progress)
+		var output string
+		if utils.EstimateTokens(req.Input) > inputBudget(pattern, req.AIModelVersion) {
+			setStreamHeaders(c, chatID)
+			output, err = runMapReduce(c.Request().Context(), w, pattern, req.Input, req.AIModelVersion)
+			if err != nil {
+				log.Println("Map reduce failed [rp-010]:", err)
+				failReply(output)
+				w.Event("error", map[string]string{"error": "Internal server error [rp-010]"})
+				return nil
+			}
+		} else {
+			stream, err := ChatCompletionStream(c.Request().Context(), messages, req.AIModelVersion)
+			if err != nil {
+				log.Println("Failed to create chat completion stream [rp-007]", err)
+				failReply("")
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rp-007]"})
+			}
+			defer stream.Close()
+
+			setStreamHeaders(c, chatID)
+
+			output, err = writeStream(w, stream)
+			if err != nil {
+				log.Println("Stream error [rp-008]:", err)
+				failReply(output)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [rp-008]"})
+			}
+		}
+		w.Event("done", map[string]string{"chat_id": chatIDString(chatID)})
+
+		if req.Ephemeral {
+			return nil
+		}
+
+		finishReply(c.Request().Context(), repo, reply, output, db.MessageComplete, timeLocation)
+		return nil
+	}
+}
+
+func chatIDString(chatID uuid.UUID) string {
+	if chatID == uuid.Nil {
+		return ""
+	}
+	return chatID.String()
+}
+
+// patternMessages builds the system and user messages for a single pattern run
+func patternMessages(pattern *db.Pattern, input string) []models.MessageContent {
+	if pattern.User != "" {
+		input = pattern.User + "\n\n" + input
+	}
+	return []models.MessageContent{
+		{Role: "system", Content: pattern.Pattern},
+		{Role: "user", Content: input},
+	}
+}
+
+// bindRunPatternRequest accepts either a JSON body or a multipart form with an attachment
+func bindRunPatternRequest(c echo.Context) (*runPatternRequest, error) {
+	req := &runPatternRequest{}
+	if err := c.Bind(req); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return req, nil
+	}
+
+	if raw := c.FormValue("variables"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &req.Variables); err != nil {
+			return nil, fmt.Errorf("invalid variables: %v", err)
+		}
+	}
+
+	fileHeader, err := c.FormFile("attachment")
+	if err == http.ErrMissingFile {
+		return req, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fileHeader.Size > maxAttachmentSize {
+		return nil, fmt.Errorf("attachment is larger than %d bytes", maxAttachmentSize)
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	attachment, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize))
+	if err != nil {
+		return nil, err
+	}
+	if req.Input == "" {
+		req.Input = string(attachment)
+	} else {
+		req.Input = req.Input + "\n\n" + string(attachment)
+	}
+	return req, nil
+}
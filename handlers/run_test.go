@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// multipartRequest builds a form post of fields and, if attachment is not empty, a file
+func multipartRequest(t *testing.T, fields map[string]string, attachment string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if attachment != "" {
+		file, err := form.CreateFormFile("attachment", "notes.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(attachment))
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/patterns/summarize/run", &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	return req
+}
+
+func TestBindRunPatternRequest(t *testing.T) {
+	e := echo.New()
+	bind := func(req *http.Request) (*runPatternRequest, error) {
+		return bindRunPatternRequest(e.NewContext(req, httptest.NewRecorder()))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/patterns/summarize/run",
+		strings.NewReader(`{"input": "text", "variables": {"{{lang}}": "fr"}, "ephemeral": true, "progress": true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	run, err := bind(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Input != "text" || run.Variables["{{lang}}"] != "fr" || !run.Ephemeral || !run.Progress {
+		t.Fatalf("JSON request = %+v", run)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		fields     map[string]string
+		attachment string
+		want       string
+	}{
+		{"attachment only", nil, "file text", "file text"},
+		{"input and attachment", map[string]string{"input": "Summarize this"}, "file text", "Summarize this\n\nfile text"},
+		{"input only", map[string]string{"input": "Summarize this"}, "", "Summarize this"},
+	} {
+		run, err := bind(multipartRequest(t, tt.fields, tt.attachment))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if run.Input != tt.want {
+			t.Errorf("%s: input = %q, want %q", tt.name, run.Input, tt.want)
+		}
+	}
+
+	run, err = bind(multipartRequest(t, map[string]string{"input": "text", "variables": `{"{{lang}}": "fr"}`, "ephemeral": "true"}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Variables["{{lang}}"] != "fr" || !run.Ephemeral {
+		t.Fatalf("form request = %+v", run)
+	}
+	if _, err := bind(multipartRequest(t, map[string]string{"input": "text", "variables": "lang=fr"}, "")); err == nil {
+		t.Fatal("variables that are not JSON were accepted")
+	}
+}
+
+func TestPatternMessages(t *testing.T) {
+	messages := patternMessages(&db.Pattern{Pattern: "You summarize text.", User: "Summarize this:"}, "some input")
+	if len(messages) != 2 || messages[0].Role != "system" || messages[0].Content != "You summarize text." {
+		t.Fatalf("messages = %+v", messages)
+	}
+	if messages[1].Role != "user" || messages[1].Content != "Summarize this:\n\nsome input" {
+		t.Fatalf("user message = %+v", messages[1])
+	}
+	if messages := patternMessages(&db.Pattern{Pattern: "You summarize text."}, "some input"); messages[1].Content != "some input" {
+		t.Fatalf("user message without a user prompt = %q", messages[1].Content)
+	}
+}
+
+func TestRunPatternRejectsBadRequests(t *testing.T) {
+	repo := newTestRepo(t)
+	user := createTestUser(t, repo, "ada", "correct horse")
+	catalog := newTestCatalog(t)
+	if err := catalog.SavePattern("summarize", "You summarize text.", ""); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.POST("/patterns/:name/run", RunPattern(repo, catalog), asUser(user.ID))
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		body   string
+		code   int
+		want   string
+	}{
+		{"malformed body", "/patterns/summarize/run", `{"input": `, http.StatusBadRequest, "rp-002"},
+		{"no input", "/patterns/summarize/run", `{"input": "  "}`, http.StatusBadRequest, "rp-003"},
+		{"unknown pattern", "/patterns/translate/run", `{"input": "text"}`, http.StatusNotFound, "rp-004"},
+		{"invalid workspace", "/patterns/summarize/run", `{"input": "text", "workspace_id": "nope"}`, http.StatusBadRequest, "rp-011"},
+		{"someone else's workspace", "/patterns/summarize/run", `{"input": "text", "workspace_id": "` + uuid.NewString() + `"}`, http.StatusNotFound, "rp-013"},
+	} {
+		rec := serve(e, http.MethodPost, tt.target, tt.body)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want %d with %s", tt.name, rec.Code, rec.Body, tt.code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/jobs"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type scheduleRequest struct {
+	Name           string            `json:"name"`
+	CronExpression string            `json:"cron_expression"`
+	Pattern        string            `json:"pattern"`
+	Prompt         string            `json:"prompt"`
+	Variables      map[string]string `json:"variables"`
+	AIModelVersion string            `json:"ai_model_version"`
+	ChatID         *uuid.UUID        `json:"chat_id"`
+	AppendToChat   bool              `json:"append_to_chat"`
+	IsActive       *bool             `json:"is_active"`
+}
+
+// apply validates the request and copies it onto schedule, working out the next run
+func (req *scheduleRequest) apply(c echo.Context, repo repository.Repository, catalog *db.PatternCatalog, schedule *models.Schedule) error {
+	if strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.Prompt) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name and prompt are required [sr-001]")
+	}
+	if req.Pattern != "" {
+		if _, ok := catalog.Get(req.Pattern); !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Pattern not found [sr-002]")
+		}
+	}
+	if req.ChatID != nil {
+		chat, err := repo.GetChatByID(c.Request().Context(), *req.ChatID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid chat_id [sr-003]")
+		}
+		canWrite, _, err := db.ChatAccess(c.Request().Context(), repo, chat, schedule.UserID)
+		if err != nil {
+			log.Println("Failed to check chat access [sr-006]", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Internal server error [sr-006]")
+		}
+		if !canWrite {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid chat_id [sr-003]")
+		}
+	}
+
+	timezone, err := repo.GetUserTimezone(c.Request().Context(), schedule.UserID)
+	if err != nil {
+		log.Println("Failed to get user timezone [sr-004]", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Internal server error [sr-004]")
+	}
+
+	schedule.Name = req.Name
+	schedule.CronExpression = req.CronExpression
+	schedule.Pattern = req.Pattern
+	schedule.Prompt = req.Prompt
+	schedule.Variables = req.Variables
+	schedule.AIModelVersion = req.AIModelVersion
+	if req.ChatID != nil || !req.AppendToChat {
+		// Leaving chat_id out while still appending keeps the chat pinned by earlier runs
+		schedule.ChatID = req.ChatID
+	}
+	schedule.AppendToChat = req.AppendToChat || req.ChatID != nil
+	schedule.Timezone = timezone
+	if req.IsActive != nil {
+		schedule.IsActive = *req.IsActive
+	}
+
+	if schedule.NextRunAt, err = jobs.NextRun(schedule, time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid cron_expression [sr-005]")
+	}
+	return nil
+}
+
+func CreateSchedule(repo repository.Repository, catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [cs-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [cs-001]"})
+		}
+
+		req := &scheduleRequest{}
+		if err := c.Bind(req); err != nil {
+			log.Println("Failed to bind schedule [cs-002]", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body [cs-002]"})
+		}
+
+		schedule := &models.Schedule{UserID: userID, IsActive: true}
+		if err := req.apply(c, repo, catalog, schedule); err != nil {
+			return err
+		}
+
+		if err := repo.CreateSchedule(c.Request().Context(), schedule); err != nil {
+			log.Println("Failed to create schedule [cs-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [cs-003]"})
+		}
+
+		return c.JSON(http.StatusCreated, schedule)
+	}
+}
+
+func GetSchedules(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gss-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gss-001]"})
+		}
+
+		schedules, err := repo.GetSchedulesByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get schedules [gss-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gss-002]"})
+		}
+
+		return c.JSON(http.StatusOK, schedules)
+	}
+}
+
+func GetSchedule(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		schedule, err := getOwnedSchedule(c, repo)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, schedule)
+	}
+}
+
+func UpdateSchedule(repo repository.Repository, catalog *db.PatternCatalog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		schedule, err := getOwnedSchedule(c, repo)
+		if err != nil {
+			return err
+		}
+
+		req := &scheduleRequest{}
+		if err := c.Bind(req); err != nil {
+			log.Println("Failed to bind schedule [us-001]", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body [us-001]"})
+		}
+		if err := req.apply(c, repo, catalog, schedule); err != nil {
+			return err
+		}
+
+		if err := repo.UpdateSchedule(c.Request().Context(), schedule); err != nil {
+			log.Println("Failed to update schedule [us-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [us-002]"})
+		}
+
+		return c.JSON(http.StatusOK, schedule)
+	}
+}
+
+func DeleteSchedule(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		schedule, err := getOwnedSchedule(c, repo)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.DeleteSchedule(c.Request().Context(), schedule.ID); err != nil {
+			log.Println("Failed to delete schedule [ds-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [ds-001]"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Schedule deleted successfully"})
+	}
+}
+
+// GetScheduleRuns lists every run of a schedule along with the chat it wrote to
+func GetScheduleRuns(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		schedule, err := getOwnedSchedule(c, repo)
+		if err != nil {
+			return err
+		}
+
+		runs, err := repo.GetScheduleRuns(c.Request().Context(), schedule.ID)
+		if err != nil {
+			log.Println("Failed to get schedule runs [gsr-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gsr-001]"})
+		}
+
+		return c.JSON(http.StatusOK, runs)
+	}
+}
+
+// getOwnedSchedule loads the schedule in the :id param and checks it belongs to the caller
+func getOwnedSchedule(c echo.Context, repo repository.Repository) (*models.Schedule, error) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		log.Println("Failed to get userID from context [gs-001]", err)
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized [gs-001]")
+	}
+
+	scheduleID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid schedule ID [gs-002]")
+	}
+
+	schedule, err := repo.GetScheduleByID(c.Request().Context(), scheduleID)
+	if err != nil {
+		log.Println("Failed to get schedule [gs-003]", err)
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Schedule not found [gs-003]")
+	}
+
+	if schedule.UserID != userID {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Access denied [gs-004]")
+	}
+	return schedule, nil
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func TestSchedules(t *testing.T) {
+	repo := newTestRepo(t)
+	owner := createTestUser(t, repo, "ada", "correct horse")
+	other := createTestUser(t, repo, "bob", "battery staple")
+	catalog := newTestCatalog(t)
+	if err := catalog.SavePattern("summarize", "You summarize text.", ""); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	othersChat, err := repo.CreateChat(context.Background(), &models.Chat{UserID: other.ID, Title: "chat", CreatedAt: now, LastUpdated: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := func(userID uuid.UUID) *echo.Echo {
+		e := echo.New()
+		e.Use(asUser(userID))
+		e.POST("/schedules", CreateSchedule(repo, catalog))
+		e.GET("/schedules/:id", GetSchedule(repo))
+		e.PUT("/schedules/:id", UpdateSchedule(repo, catalog))
+		e.DELETE("/schedules/:id", DeleteSchedule(repo))
+		return e
+	}
+	asOwner, asOther := routes(owner.ID), routes(other.ID)
+
+	for _, tt := range []struct {
+		name string
+		body string
+		code int
+		want string
+	}{
+		{"no prompt", `{"name": "Standup", "cron_expression": "0 9 * * *"}`, http.StatusBadRequest, "sr-001"},
+		{"unknown pattern", `{"name": "Standup", "prompt": "hi", "pattern": "translate", "cron_expression": "0 9 * * *"}`, http.StatusNotFound, "sr-002"},
+		{"someone else's chat", `{"name": "Standup", "prompt": "hi", "chat_id": "` + othersChat.ID.String() + `", "cron_expression": "0 9 * * *"}`, http.StatusBadRequest, "sr-003"},
+		{"invalid cron", `{"name": "Standup", "prompt": "hi", "cron_expression": "daily"}`, http.StatusBadRequest, "sr-005"},
+	} {
+		if rec := serve(asOwner, http.MethodPost, "/schedules", tt.body); rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %s, want %d with %s", tt.name, rec.Code, rec.Body, tt.code, tt.want)
+		}
+	}
+
+	rec := serve(asOwner, http.MethodPost, "/schedules", `{"name": "Standup", "prompt": "What is on today?", "pattern": "summarize", "cron_expression": "0 9 * * *"}`)
+	var schedule models.Schedule
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &schedule) != nil {
+		t.Fatalf("creating a schedule returned %d: %s", rec.Code, rec.Body)
+	}
+	if !schedule.IsActive || !schedule.NextRunAt.After(now) || schedule.AppendToChat {
+		t.Fatalf("schedule = %+v", schedule)
+	}
+	schedulePath := "/schedules/" + schedule.ID.String()
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		if rec := serve(asOther, method, schedulePath, `{"name": "Mine", "prompt": "hi", "cron_expression": "0 9 * * *"}`); rec.Code != http.StatusForbidden {
+			t.Errorf("another user's %s got %d, want 403", method, rec.Code)
+		}
+	}
+
+	rec = serve(asOwner, http.MethodPut, schedulePath, `{"name": "Standup", "prompt": "What is on today?", "cron_expression": "0 9 * * MON", "is_active": false}`)
+	var updated models.Schedule
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &updated) != nil {
+		t.Fatalf("updating the schedule returned %d: %s", rec.Code, rec.Body)
+	}
+	if updated.IsActive || updated.Pattern != "" || updated.CronExpression != "0 9 * * MON" || updated.NextRunAt.Weekday() != time.Monday {
+		t.Fatalf("updated schedule = %+v", updated)
+	}
+
+	if rec := serve(asOwner, http.MethodDelete, schedulePath, ""); rec.Code != http.StatusOK {
+		t.Fatalf("deleting the schedule returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(asOwner, http.MethodGet, schedulePath, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("a deleted schedule returned %d, want 404", rec.Code)
+	}
+}
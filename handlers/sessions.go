@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const sessionCacheTTL = 30 * time.Second
+
+type sessionCacheEntry struct {
+	userID    uuid.UUID
+	active    bool
+	checkedAt time.Time
+	// mfaSatisfied is set once the user's role is known not to block the login
+	mfaSatisfied bool
+}
+
+// SessionCache remembers for a short while whether a session is still active,
+// so AuthMiddleware does not hit the database on every request. Revocations
+// made on this instance apply immediately; on other instances within the TTL.
+type SessionCache struct {
+	repo    repository.Repository
+	mu      sync.Mutex
+	entries map[uuid.UUID]sessionCacheEntry
+}
+
+func NewSessionCache(repo repository.Repository) *SessionCache {
+	return &SessionCache{repo: repo, entries: make(map[uuid.UUID]sessionCacheEntry)}
+}
+
+// Active reports whether the session exists, belongs to userID and has not been revoked
+func (s *SessionCache) Active(ctx context.Context, sessionID uuid.UUID, userID uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[sessionID]
+	s.mu.Unlock()
+	if ok && time.Since(entry.checkedAt) < sessionCacheTTL {
+		return entry.active && entry.userID == userID, nil
+	}
+
+	session, err := s.repo.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		return false, err
+	}
+	entry = sessionCacheEntry{userID: session.UserID, active: session.RevokedAt == nil, checkedAt: time.Now()}
+	if entry.active {
+		// A cache miss happens at most once per TTL, which is often enough for last-used
+		if err := s.repo.TouchSession(ctx, sessionID); err != nil {
+			log.Println("Failed to touch session [sc-001]", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.entries[sessionID] = entry
+	if len(s.entries) > 10000 {
+		s.evictLocked()
+	}
+	s.mu.Unlock()
+	return entry.active && entry.userID == userID, nil
+}
+
+// MFASatisfied reports whether the user has the second factor their role
+// requires. Only a satisfied check is cached, so enrolling takes effect on the
+// next request and a new requirement within the TTL.
+func (s *SessionCache) MFASatisfied(ctx context.Context, sessionID uuid.UUID, userID uuid.UUID, role string) (bool, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[sessionID]
+	s.mu.Unlock()
+	if ok && entry.mfaSatisfied && time.Since(entry.checkedAt) < sessionCacheTTL {
+		return true, nil
+	}
+
+	satisfied, err := mfaSatisfied(ctx, s.repo, userID, role)
+	if err != nil || !satisfied {
+		return false, err
+	}
+	s.mu.Lock()
+	if entry, ok := s.entries[sessionID]; ok && entry.active {
+		entry.mfaSatisfied = true
+		s.entries[sessionID] = entry
+	}
+	s.mu.Unlock()
+	return true, nil
+}
+
+// Revoke marks sessions inactive on this instance without waiting for the TTL
+func (s *SessionCache) Revoke(sessionIDs ...uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range sessionIDs {
+		s.entries[id] = sessionCacheEntry{active: false, checkedAt: time.Now()}
+	}
+}
+
+func (s *SessionCache) evictLocked() {
+	for id, entry := range s.entries {
+		if time.Since(entry.checkedAt) >= sessionCacheTTL {
+			delete(s.entries, id)
+		}
+	}
+}
+
+func getSessionIDFromContext(c echo.Context) uuid.UUID {
+	sessionID, _ := c.Get("sessionID").(uuid.UUID)
+	return sessionID
+}
+
+// GetSessions lists the caller's active logins, marking the one making the request
+func GetSessions(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gse-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gse-001]"})
+		}
+
+		sessions, err := repo.GetActiveSessionsByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get sessions [gse-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gse-002]"})
+		}
+
+		current := getSessionIDFromContext(c)
+		for _, session := range sessions {
+			session.Current = session.ID == current
+		}
+		return c.JSON(http.StatusOK, sessions)
+	}
+}
+
+// DeleteSession revokes one of the caller's logins, including its access tokens
+func DeleteSession(repo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [dse-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [dse-001]"})
+		}
+
+		sessionID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid session ID [dse-002]"})
+		}
+
+		session, err := repo.GetSessionByID(c.Request().Context(), sessionID)
+		if err != nil {
+			log.Println("Failed to get session [dse-003]", err)
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found [dse-003]"})
+		}
+		if session.UserID != userID {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Access denied [dse-004]"})
+		}
+
+		if err := repo.RevokeSession(c.Request().Context(), sessionID); err != nil {
+			log.Println("Failed to revoke session [dse-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dse-005]"})
+		}
+		sessions.Revoke(sessionID)
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked successfully"})
+	}
+}
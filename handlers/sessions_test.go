@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// deviceLogin logs in from a device named by its user agent and returns the access token
+func deviceLogin(t *testing.T, e *echo.Echo, username string, plaintext string, userAgent string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+plaintext)))
+	req.Header.Set("User-Agent", userAgent)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var body map[string]string
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body["t"] == "" {
+		t.Fatalf("login from %s returned %d: %s", userAgent, rec.Code, rec.Body)
+	}
+	return body["t"]
+}
+
+// withToken sends a request with an access token
+func withToken(e *echo.Echo, method string, target string, token string) *httptest.ResponseRecorder {
+	return withBearer(e, method, target, token, "")
+}
+
+func TestSessions(t *testing.T) {
+	repo := newTestRepo(t)
+	createTestUser(t, repo, "ada", "correct horse")
+	createTestUser(t, repo, "bob", "battery staple")
+	sessions := NewSessionCache(repo)
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+	api := e.Group("/api/v1", AuthMiddleware(repo, sessions))
+	api.GET("/sessions", GetSessions(repo))
+	api.DELETE("/sessions/:id", DeleteSession(repo, sessions))
+
+	laptop := deviceLogin(t, e, "ada", "correct horse", "laptop")
+	phone := deviceLogin(t, e, "ada", "correct horse", "phone")
+	bob := deviceLogin(t, e, "bob", "battery staple", "desktop")
+
+	rec := withToken(e, http.MethodGet, "/api/v1/sessions", laptop)
+	var list []*models.Session
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list) != 2 {
+		t.Fatalf("listing sessions returned %d: %s", rec.Code, rec.Body)
+	}
+	var phoneSession *models.Session
+	for _, session := range list {
+		if session.Current != (session.UserAgent == "laptop") {
+			t.Fatalf("session from %s has current = %v", session.UserAgent, session.Current)
+		}
+		if session.UserAgent == "phone" {
+			phoneSession = session
+		}
+	}
+	phonePath := "/api/v1/sessions/" + phoneSession.ID.String()
+
+	if rec := withToken(e, http.MethodDelete, phonePath, bob); rec.Code != http.StatusForbidden {
+		t.Fatalf("another user revoking the session got %d, want 403", rec.Code)
+	}
+	if rec := withToken(e, http.MethodDelete, "/api/v1/sessions/nope", laptop); rec.Code != http.StatusBadRequest {
+		t.Fatalf("an invalid session ID got %d, want 400", rec.Code)
+	}
+	if rec := withToken(e, http.MethodDelete, "/api/v1/sessions/"+uuid.NewString(), laptop); rec.Code != http.StatusNotFound {
+		t.Fatalf("an unknown session got %d, want 404", rec.Code)
+	}
+	if rec := withToken(e, http.MethodGet, "/api/v1/sessions", phone); rec.Code != http.StatusOK {
+		t.Fatalf("the phone could not use its session: %d", rec.Code)
+	}
+
+	if rec := withToken(e, http.MethodDelete, phonePath, laptop); rec.Code != http.StatusOK {
+		t.Fatalf("revoking the phone's session got %d: %s", rec.Code, rec.Body)
+	}
+	// The phone's unexpired access token stops working at once
+	if rec := withToken(e, http.MethodGet, "/api/v1/sessions", phone); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a revoked session's access token got %d, want 401", rec.Code)
+	}
+	if rec := withToken(e, http.MethodGet, "/api/v1/sessions", laptop); rec.Code != http.StatusOK {
+		t.Fatalf("revoking the phone ended the laptop's session: %d", rec.Code)
+	}
+
+	// Other instances learn of the revocation from the database
+	fresh := NewSessionCache(repo)
+	if active, err := fresh.Active(context.Background(), phoneSession.ID, phoneSession.UserID); err != nil || active {
+		t.Fatalf("a new cache sees the revoked session as active = %v (%v)", active, err)
+	}
+	if active, err := fresh.Active(context.Background(), list[0].ID, phoneSession.UserID); err != nil || active != (list[0].ID != phoneSession.ID) {
+		t.Fatalf("a new cache sees session %s as active = %v (%v)", list[0].ID, active, err)
+	}
+}
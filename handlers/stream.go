@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// streamWriter writes model output to the client. By default deltas are
+// written raw, the way chat has always streamed. When events are enabled
+// every write is framed as a server-sent event so progress can be mixed in.
+type streamWriter struct {
+	mu     sync.Mutex
+	c      echo.Context
+	events bool
+}
+
+func newStreamWriter(c echo.Context, events bool) *streamWriter {
+	return &streamWriter{c: c, events: events}
+}
+
+// Delta writes a piece of model output
+func (w *streamWriter) Delta(content string) error {
+	if w.events {
+		return w.Event("delta", content)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.c.Response().Write([]byte(content)); err != nil {
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+	w.c.Response().Flush()
+	return nil
+}
+
+// Event writes a named event, and is a no-op when events are disabled or there is no client
+func (w *streamWriter) Event(name string, data interface{}) error {
+	if w == nil || !w.events {
+		return nil
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %v", name, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := fmt.Fprintf(w.c.Response(), "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+	w.c.Response().Flush()
+	return nil
+}
+
+// setStreamHeaders starts an event stream response, exposing the chat ID when there is one
+func setStreamHeaders(c echo.Context, chatID uuid.UUID) {
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set("Connection", "keep-alive")
+	if chatID != uuid.Nil {
+		c.Response().Header().Set("X-Chat-Id", chatID.String())
+		c.Response().Header().Set("Access-Control-Expose-Headers", "X-Chat-Id")
+	}
+	c.Response().WriteHeader(http.StatusOK)
+}
+
+// writeStream forwards each completion delta to the client and returns the full response
+func writeStream(w *streamWriter, stream *openai.ChatCompletionStream) (string, error) {
+	var response []byte
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return string(response), nil
+		}
+		if err != nil {
+			return string(response), err
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		content := chunk.Choices[0].Delta.Content
+		response = append(response, content...)
+		if err := w.Delta(content); err != nil {
+			return string(response), err
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// maxAuthDelay is the longest a throttle key is locked, and how long a lockout lasts
+const maxAuthDelay = 15 * time.Minute
+
+// AuthThrottleWindow is how long a failed attempt counts towards a lockout
+const AuthThrottleWindow = 24 * time.Hour
+
+// throttlePolicy says how attempts against one kind of key are slowed down.
+// After free attempts each further one locks the key for twice as long as the
+// last, starting at a second; at lockout the key is locked for maxAuthDelay
+// and a security event is recorded.
+type throttlePolicy struct {
+	prefix  string
+	free    int
+	lockout int
+	window  time.Duration
+	event   string
+}
+
+var (
+	// accountThrottle counts failed logins per username, whether or not the user exists
+	accountThrottle = throttlePolicy{prefix: "login:", free: 3, lockout: 10, window: AuthThrottleWindow, event: "account_locked"}
+	// ipThrottle counts failed logins per client address across all usernames
+	ipThrottle = throttlePolicy{prefix: "ip:", free: 20, lockout: 50, window: AuthThrottleWindow, event: "ip_locked"}
+	// registerThrottle counts every registration attempt per client address
+	registerThrottle = throttlePolicy{prefix: "register:", free: 10, lockout: 30, window: time.Hour, event: "registration_locked"}
+)
+
+func (p throttlePolicy) key(subject string) string {
+	return p.prefix + strings.ToLower(subject)
+}
+
+func (p throttlePolicy) delay(attempts int) time.Duration {
+	if attempts <= p.free {
+		return 0
+	}
+	if attempts >= p.lockout {
+		return maxAuthDelay
+	}
+	seconds := math.Pow(2, float64(attempts-p.free-1))
+	return min(time.Duration(seconds)*time.Second, maxAuthDelay)
+}
+
+// authLocked responds 429 and returns true if any of keys is locked. On a
+// database error it lets the attempt through rather than lock everyone out.
+func authLocked(c echo.Context, repo repository.Repository, keys ...string) bool {
+	lockedUntil, err := repo.GetAuthLockedUntil(c.Request().Context(), keys)
+	if err != nil {
+		log.Println("Failed to check auth throttle [at-001]", err)
+		return false
+	}
+	if lockedUntil == nil {
+		return false
+	}
+	retryAfter := int(math.Ceil(time.Until(*lockedUntil).Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many attempts, try again later"})
+	return true
+}
+
+// countAuthAttempt counts an attempt against subject and locks it once the
+// policy says so. userID is set when subject is a known account.
+func countAuthAttempt(c echo.Context, repo repository.Repository, policy throttlePolicy, subject string, userID *uuid.UUID) {
+	ctx := c.Request().Context()
+	key := policy.key(subject)
+	attempts, err := repo.IncrementAuthThrottle(ctx, key, policy.window)
+	if err != nil {
+		log.Println("Failed to count auth attempt [at-002]", err)
+		return
+	}
+	delay := policy.delay(attempts)
+	if delay == 0 {
+		return
+	}
+	lockedUntil := time.Now().Add(delay)
+	if err := repo.LockAuthThrottle(ctx, key, lockedUntil); err != nil {
+		log.Println("Failed to lock auth throttle [at-003]", err)
+		return
+	}
+	if attempts >= policy.lockout {
+		recordSecurityEvent(ctx, repo, &models.SecurityEvent{
+			UserID:    userID,
+			EventType: policy.event,
+			IPAddress: c.RealIP(),
+			Detail: map[string]string{
+				"key":          key,
+				"attempts":     strconv.Itoa(attempts),
+				"locked_until": lockedUntil.UTC().Format(time.RFC3339),
+			},
+		})
+	}
+}
+
+// clearAccountThrottle forgets the failed logins of an account once it has
+// signed in with every factor it has
+func clearAccountThrottle(c echo.Context, repo repository.Repository, username string) {
+	if _, err := repo.ClearAuthThrottle(c.Request().Context(), accountThrottle.key(username)); err != nil {
+		log.Println("Failed to clear auth throttle [at-005]", err)
+	}
+}
+
+// recordSecurityEvent saves and logs an event. Failing to save one does not fail the request.
+func recordSecurityEvent(ctx context.Context, repo repository.Repository, event *models.SecurityEvent) {
+	log.Printf("Security event %s from %s: %v", event.EventType, event.IPAddress, event.Detail)
+	if err := repo.CreateSecurityEvent(ctx, event); err != nil {
+		log.Println("Failed to record security event [at-004]", err)
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/labstack/echo/v4"
+)
+
+// httptest requests come from this address
+const testClientIP = "192.0.2.1"
+
+func TestThrottleDelay(t *testing.T) {
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{accountThrottle.free, 0},
+		{accountThrottle.free + 1, time.Second},
+		{accountThrottle.free + 2, 2 * time.Second},
+		{accountThrottle.lockout - 1, 32 * time.Second},
+		{accountThrottle.lockout, maxAuthDelay},
+		{accountThrottle.lockout + 100, maxAuthDelay},
+	} {
+		if got := accountThrottle.delay(tt.attempts); got != tt.want {
+			t.Errorf("delay after %d attempts = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+	if accountThrottle.key("Ada") != accountThrottle.key("ada") {
+		t.Error("throttle keys depend on the case of the username")
+	}
+}
+
+// failAttempts counts attempts against key without locking it, as if they
+// were spread out enough to wait out each delay
+func failAttempts(t *testing.T, repo *memory.Repository, key string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := repo.IncrementAuthThrottle(context.Background(), key, AuthThrottleWindow); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newLoginThrottleTest(t *testing.T) (*memory.Repository, *echo.Echo) {
+	t.Helper()
+	repo := newTestRepo(t)
+	createTestUser(t, repo, "ada", "correct horse")
+	e := echo.New()
+	e.POST("/login", Login(repo, testHasher()))
+	return repo, e
+}
+
+func TestLoginBackoff(t *testing.T) {
+	_, e := newLoginThrottleTest(t)
+
+	// Unknown usernames are answered and throttled like wrong passwords
+	for _, username := range []string{"ada", "nobody"} {
+		var bodies []string
+		for attempt := 1; attempt <= accountThrottle.free+1; attempt++ {
+			rec := basicLogin(e, username, "wrong horse")
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("%s: attempt %d returned %d, want 401", username, attempt, rec.Code)
+			}
+			bodies = append(bodies, rec.Body.String())
+		}
+		if bodies[0] != bodies[len(bodies)-1] {
+			t.Fatalf("%s: responses differ: %q", username, bodies)
+		}
+		rec := basicLogin(e, username, "correct horse")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+			t.Fatalf("%s: a login while backed off returned %d with Retry-After %q, want 429 and 1", username, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	repo, e := newLoginThrottleTest(t)
+	ctx := context.Background()
+	ada, _ := repo.GetUserByUsername(ctx, "ada")
+	admin := createTestUser(t, repo, "root", "correct horse")
+	e.POST("/admin/users/:id/unlock", UnlockUser(repo), asRole(admin.ID, auth.RoleAdmin))
+
+	failAttempts(t, repo, accountThrottle.key("ada"), accountThrottle.lockout-1)
+	if rec := basicLogin(e, "ada", "wrong horse"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("the last attempt returned %d, want 401", rec.Code)
+	}
+	rec := basicLogin(e, "ada", "correct horse")
+	retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if rec.Code != http.StatusTooManyRequests || retryAfter < int(maxAuthDelay.Seconds())-5 {
+		t.Fatalf("a locked account returned %d with Retry-After %d", rec.Code, retryAfter)
+	}
+	events, _ := repo.GetSecurityEvents(ctx, &ada.ID, 10, 0)
+	if len(events) != 1 || events[0].EventType != "account_locked" || events[0].Detail["attempts"] != strconv.Itoa(accountThrottle.lockout) {
+		t.Fatalf("security events = %+v", events)
+	}
+
+	if rec := serve(e, http.MethodPost, "/admin/users/"+ada.ID.String()+"/unlock", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("unlocking returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := basicLogin(e, "ada", "correct horse"); rec.Code != http.StatusOK {
+		t.Fatalf("a login after the unlock returned %d: %s", rec.Code, rec.Body)
+	}
+	// Unlocking an account that is not locked records nothing
+	if rec := serve(e, http.MethodPost, "/admin/users/"+ada.ID.String()+"/unlock", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("unlocking again returned %d", rec.Code)
+	}
+	events, _ = repo.GetSecurityEvents(ctx, &ada.ID, 10, 0)
+	if len(events) != 2 || events[0].EventType != "account_unlocked" || *events[0].ActorID != admin.ID {
+		t.Fatalf("security events = %+v", events)
+	}
+}
+
+func TestSuccessfulLoginClearsFailures(t *testing.T) {
+	repo, e := newLoginThrottleTest(t)
+	failAttempts(t, repo, accountThrottle.key("ada"), accountThrottle.free)
+	if rec := basicLogin(e, "ada", "correct horse"); rec.Code != http.StatusOK {
+		t.Fatalf("login returned %d", rec.Code)
+	}
+	// The count starts over, so one more mistake is free again
+	if rec := basicLogin(e, "ada", "wrong horse"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("a wrong password returned %d", rec.Code)
+	}
+	if rec := basicLogin(e, "ada", "correct horse"); rec.Code != http.StatusOK {
+		t.Fatalf("login after one mistake returned %d, want 200", rec.Code)
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	repo, e := newLoginThrottleTest(t)
+	failAttempts(t, repo, ipThrottle.key(testClientIP), ipThrottle.lockout-1)
+	if rec := basicLogin(e, "someone", "guess"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("the last attempt returned %d, want 401", rec.Code)
+	}
+	// Every account is locked from that address
+	if rec := basicLogin(e, "ada", "correct horse"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("a login from a locked address returned %d, want 429", rec.Code)
+	}
+	events, _ := repo.GetSecurityEvents(context.Background(), nil, 10, 0)
+	if len(events) != 1 || events[0].EventType != "ip_locked" || events[0].UserID != nil {
+		t.Fatalf("security events = %+v", events)
+	}
+}
+
+func TestRegistrationThrottle(t *testing.T) {
+	repo := newTestRepo(t)
+	e := echo.New()
+	e.POST("/register", CreateUser(repo, testHasher(), newTestOutbox(t)))
+
+	// Every attempt counts, even malformed ones
+	for attempt := 1; attempt <= registerThrottle.free+1; attempt++ {
+		if rec := serve(e, http.MethodPost, "/register", ""); rec.Code != http.StatusBadRequest {
+			t.Fatalf("attempt %d returned %d, want 400", attempt, rec.Code)
+		}
+	}
+	if rec := serve(e, http.MethodPost, "/register", ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("a registration while backed off returned %d, want 429", rec.Code)
+	}
+}
@@ -3,19 +3,30 @@ package handlers
 import (
 	"context"
 	"encoding/base64"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/mailer"
 	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/password"
+	"github.com/FiveEightyEight/gippity-serv/repository"
 	"github.com/FiveEightyEight/gippity-serv/utils"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
-func CreateUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
+func CreateUser(userRepo repository.Repository, hasher *password.Hasher, mail mailer.Mailer) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		// Every attempt counts so the endpoint cannot be used to probe usernames in bulk
+		if authLocked(c, userRepo, registerThrottle.key(c.RealIP())) {
+			return nil
+		}
+		countAuthAttempt(c, userRepo, registerThrottle, c.RealIP(), nil)
+
 		authHeader := c.Request().Header.Get("Authorization")
 		if authHeader == "" || len(strings.Split(authHeader, " ")) != 2 {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid authorization header"})
@@ -25,23 +36,27 @@ func CreateUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
 		if err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid credentials encoding"})
 		}
-		credentials := strings.Split(string(decodedCreds), ":")
+		credentials := strings.SplitN(string(decodedCreds), ":", 3)
 		if len(credentials) != 3 {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid credentials format"})
 		}
-		username, email, password := credentials[0], credentials[1], credentials[2]
+		username, email, plaintext := credentials[0], credentials[1], credentials[2]
 
-		if username == "" || email == "" || password == "" {
+		if username == "" || email == "" || plaintext == "" {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Username, email, and password are required"})
 		}
 
+		if err := hasher.Validate(plaintext); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
 		// Check if username or email already exists
 		existingUser, err := userRepo.GetUserByUsername(context.Background(), username)
 		if err == nil && existingUser != nil {
 			return echo.NewHTTPError(http.StatusConflict, "username or email already exists [cu-101]")
 		}
 
-		hashedPassword, err := utils.HashString(password)
+		hashedPassword, err := hasher.Hash(plaintext)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "an error occurred while creating the user [cu-102]")
 		}
@@ -56,6 +71,11 @@ func CreateUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create user [cu-103]")
 		}
 
+		// A failed email should not fail the signup; the user can ask for another one
+		if err := sendEmailToken(c.Request().Context(), userRepo, mail, user, db.EmailTokenVerify); err != nil {
+			log.Println("Failed to send verification email [cu-105]", err)
+		}
+
 		// Generate and return a login token
 		token, err := utils.GenerateToken(user.ID.String())
 		if err != nil {
@@ -66,7 +86,7 @@ func CreateUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
 	}
 }
 
-func GetUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
+func GetUser(userRepo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
@@ -82,7 +102,7 @@ func GetUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
 	}
 }
 
-func UpdateUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
+func UpdateUser(userRepo repository.Repository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id := c.Param("id")
 		if id == "" {
@@ -108,16 +128,45 @@ func UpdateUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
 	}
 }
 
-func DeleteUser(userRepo *db.PostgresRepository) echo.HandlerFunc {
+// DeleteUser purges a user's account right away, without the grace period of
+// a self-service deletion
+func DeleteUser(userRepo repository.Repository, sessions *SessionCache) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		id, err := strconv.Atoi(c.Param("id"))
+		adminID, err := getUserIDFromContext(c)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "Invalid user ID")
+			log.Println("Failed to get userID from context [du-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [du-001]"})
+		}
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID [du-002]"})
+		}
+		if id == adminID {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Delete your own account from /me/deletion [du-003]"})
 		}
 
-		if err := userRepo.DeleteUser(context.Background(), id); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete user")
+		ctx := c.Request().Context()
+		revoked, err := userRepo.RevokeUserSessions(ctx, id)
+		if err != nil {
+			log.Println("Failed to revoke user sessions [du-004]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [du-004]"})
 		}
+		sessions.Revoke(revoked...)
+
+		err = userRepo.DeleteUser(ctx, id)
+		if errors.Is(err, db.ErrUserNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found [du-005]"})
+		}
+		if err != nil {
+			log.Println("Failed to delete user [du-006]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [du-006]"})
+		}
+		recordSecurityEvent(ctx, userRepo, &models.SecurityEvent{
+			ActorID:   &adminID,
+			EventType: "user_deleted",
+			IPAddress: c.RealIP(),
+			Detail:    map[string]string{"user_id": id.String()},
+		})
 
 		return c.NoContent(http.StatusNoContent)
 	}
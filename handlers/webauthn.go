@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/webauthn"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const maxPasskeysPerUser = 20
+
+type finishPasskeyRegistrationRequest struct {
+	Name       string                         `json:"name"`
+	Credential *webauthn.RegistrationResponse `json:"credential"`
+}
+
+type finishPasskeyLoginRequest struct {
+	Credential *webauthn.AssertionResponse `json:"credential"`
+}
+
+type beginPasskeyMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+// saveWebAuthnChallenge creates and stores a challenge for one ceremony
+func saveWebAuthnChallenge(ctx context.Context, repo repository.Repository, wa *webauthn.Config, userID *uuid.UUID, purpose string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	err = repo.CreateWebAuthnChallenge(ctx, &models.WebAuthnChallenge{
+		Challenge: challenge,
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(wa.Timeout),
+	})
+	return challenge, err
+}
+
+// verifyPasskeyAssertion checks an assertion for a ceremony started with purpose.
+// When userID is set the credential must belong to that user.
+func verifyPasskeyAssertion(ctx context.Context, repo repository.Repository, wa *webauthn.Config, resp *webauthn.AssertionResponse, purpose string, userID *uuid.UUID) (*models.WebAuthnCredential, *webauthn.AssertionResult, error) {
+	challenge, err := resp.Challenge()
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, err := repo.ConsumeWebAuthnChallenge(ctx, challenge, purpose)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userID != nil && (stored.UserID == nil || *stored.UserID != *userID) {
+		return nil, nil, errors.New("challenge was issued to another user")
+	}
+
+	credentialID, err := resp.CredentialID()
+	if err != nil {
+		return nil, nil, err
+	}
+	credential, err := repo.GetWebAuthnCredentialByCredentialID(ctx, credentialID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userID != nil && credential.UserID != *userID {
+		return nil, nil, errors.New("credential belongs to another user")
+	}
+
+	result, err := wa.VerifyAssertion(resp, stored.Challenge, credential.PublicKey, credential.SignCount)
+	if errors.Is(err, webauthn.ErrSignCountRegressed) {
+		log.Println("Passkey signature counter went backwards, it may be cloned [vpa-001]", credential.ID)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	used, err := repo.UseWebAuthnCredential(ctx, credential.ID, result.SignCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !used {
+		return nil, nil, webauthn.ErrSignCountRegressed
+	}
+	return credential, result, nil
+}
+
+// BeginPasskeyRegistration returns creation options for navigator.credentials.create
+func BeginPasskeyRegistration(repo repository.Repository, wa *webauthn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [bpr-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [bpr-001]"})
+		}
+		ctx := c.Request().Context()
+		user, err := repo.GetUserByUUID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get user [bpr-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [bpr-002]"})
+		}
+		existing, err := repo.GetWebAuthnCredentialsByUserID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get passkeys [bpr-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [bpr-003]"})
+		}
+		if len(existing) >= maxPasskeysPerUser {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Too many passkeys, remove one first [bpr-004]"})
+		}
+
+		challenge, err := saveWebAuthnChallenge(ctx, repo, wa, &userID, db.WebAuthnRegister)
+		if err != nil {
+			log.Println("Failed to save webauthn challenge [bpr-005]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [bpr-005]"})
+		}
+
+		// Excluding registered credentials stops the same authenticator being added twice
+		exclude := make([]webauthn.CredentialDescriptor, len(existing))
+		for i, credential := range existing {
+			exclude[i] = webauthn.NewCredentialDescriptor(credential.CredentialID, credential.Transports)
+		}
+		return c.JSON(http.StatusOK, wa.CreationOptions(challenge, userID[:], user.Username, user.Username, exclude))
+	}
+}
+
+// FinishPasskeyRegistration verifies the new credential and stores it
+func FinishPasskeyRegistration(repo repository.Repository, wa *webauthn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [fpr-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [fpr-001]"})
+		}
+		var req finishPasskeyRegistrationRequest
+		if err := c.Bind(&req); err != nil || req.Credential == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "credential is required [fpr-002]"})
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			req.Name = "Passkey"
+		}
+		if len(req.Name) > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name must be at most 100 characters [fpr-003]"})
+		}
+
+		ctx := c.Request().Context()
+		challenge, err := req.Credential.Challenge()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid credential [fpr-004]"})
+		}
+		stored, err := repo.ConsumeWebAuthnChallenge(ctx, challenge, db.WebAuthnRegister)
+		if err != nil || stored.UserID == nil || *stored.UserID != userID {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Registration expired, start again [fpr-005]"})
+		}
+
+		verified, err := wa.VerifyRegistration(req.Credential, stored.Challenge)
+		if err != nil {
+			log.Println("Failed to verify passkey registration [fpr-006]", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Passkey could not be verified [fpr-006]"})
+		}
+		if _, err := repo.GetWebAuthnCredentialByCredentialID(ctx, verified.ID); err == nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Passkey is already registered [fpr-007]"})
+		}
+
+		credential := &models.WebAuthnCredential{
+			UserID:            userID,
+			CredentialID:      verified.ID,
+			PublicKey:         verified.PublicKey,
+			SignCount:         verified.SignCount,
+			AAGUID:            verified.AAGUID,
+			AttestationFormat: verified.AttestationFormat,
+			Transports:        verified.Transports,
+			BackupEligible:    verified.BackupEligible,
+			Name:              req.Name,
+		}
+		if err := repo.CreateWebAuthnCredential(ctx, credential); err != nil {
+			log.Println("Failed to save passkey [fpr-008]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [fpr-008]"})
+		}
+		return c.JSON(http.StatusCreated, credential)
+	}
+}
+
+// GetPasskeys lists the caller's passkeys
+func GetPasskeys(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [gpk-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [gpk-001]"})
+		}
+		credentials, err := repo.GetWebAuthnCredentialsByUserID(c.Request().Context(), userID)
+		if err != nil {
+			log.Println("Failed to get passkeys [gpk-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [gpk-002]"})
+		}
+		return c.JSON(http.StatusOK, credentials)
+	}
+}
+
+func DeletePasskey(repo repository.Repository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserIDFromContext(c)
+		if err != nil {
+			log.Println("Failed to get userID from context [dpk-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized [dpk-001]"})
+		}
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid passkey ID [dpk-002]"})
+		}
+
+		deleted, err := repo.DeleteWebAuthnCredential(c.Request().Context(), id, userID)
+		if err != nil {
+			log.Println("Failed to delete passkey [dpk-003]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [dpk-003]"})
+		}
+		if !deleted {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Passkey not found [dpk-004]"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Passkey removed successfully"})
+	}
+}
+
+// BeginPasskeyLogin returns request options for a passwordless login. The
+// allow list is empty so the browser offers any discoverable passkey for this
+// site, and nothing reveals which usernames exist.
+func BeginPasskeyLogin(repo repository.Repository, wa *webauthn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		challenge, err := saveWebAuthnChallenge(c.Request().Context(), repo, wa, nil, db.WebAuthnLogin)
+		if err != nil {
+			log.Println("Failed to save webauthn challenge [bpl-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error [bpl-001]"})
+		}
+		options := wa.RequestOptions(challenge, nil)
+		// Without a password the passkey has to be both factors
+		options.UserVerification = "required"
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+// FinishPasskeyLogin signs a user in with a passkey in place of their password
+func FinishPasskeyLogin(repo repository.Repository, wa *webauthn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req finishPasskeyLoginRequest
+		if err := c.Bind(&req); err != nil || req.Credential == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "credential is required"})
+		}
+
+		credential, result, err := verifyPasskeyAssertion(c.Request().Context(), repo, wa, req.Credential, db.WebAuthnLogin, nil)
+		if err != nil {
+			log.Println("Failed to verify passkey login [fpl-001]", err)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		}
+		if !result.UserVerified {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Passkey did not verify the user"})
+		}
+		// Discoverable passkeys name their user; it has to be the one the credential is registered to
+		if handle, err := req.Credential.UserHandle(); err != nil || (handle != nil && !bytes.Equal(handle, credential.UserID[:])) {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		}
+
+		accessToken, err := issueTokens(c, repo, credential.UserID)
+		if errors.Is(err, errAccountDisabled) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is disabled"})
+		}
+		if err != nil {
+			log.Println("Failed to issue tokens [fpl-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"t": accessToken,
+		})
+	}
+}
+
+// BeginPasskeyMFA returns request options for using a passkey as the second
+// login step, limited to the passkeys of the user the MFA token is for
+func BeginPasskeyMFA(repo repository.Repository, wa *webauthn.Config) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req beginPasskeyMFARequest
+		if err := c.Bind(&req); err != nil || req.MFAToken == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "mfa_token is required"})
+		}
+		userID, _, err := parseMFAToken(req.MFAToken)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired mfa token"})
+		}
+
+		ctx := c.Request().Context()
+		credentials, err := repo.GetWebAuthnCredentialsByUserID(ctx, userID)
+		if err != nil {
+			log.Println("Failed to get passkeys [bpm-001]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+		if len(credentials) == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No passkeys are registered"})
+		}
+		challenge, err := saveWebAuthnChallenge(ctx, repo, wa, &userID, db.WebAuthnMFA)
+		if err != nil {
+			log.Println("Failed to save webauthn challenge [bpm-002]", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "An error occurred while logging in"})
+		}
+
+		allow := make([]webauthn.CredentialDescriptor, len(credentials))
+		for i, credential := range credentials {
+			allow[i] = webauthn.NewCredentialDescriptor(credential.CredentialID, credential.Transports)
+		}
+		return c.JSON(http.StatusOK, wa.RequestOptions(challenge, allow))
+	}
+}
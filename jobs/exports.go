@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+)
+
+const exportReadme = `This archive holds everything gippity-serv stores about your account, one
+JSON file per kind of record. Files you attached to a pattern run or batch job
+were sent to the model as text, so they are part of the message or job item
+they were attached to. usage.json sums up your messages by model and role.
+`
+
+// ExportWorker builds queued data exports one at a time. Any number of
+// instances can run one; each export is claimed by exactly one of them.
+type ExportWorker struct {
+	Repo repository.Repository
+
+	// PollInterval is how long to wait when there is nothing to export
+	PollInterval time.Duration
+	// StaleAfter is how long an export may sit in running before it is claimed again
+	StaleAfter time.Duration
+	// TTL is how long a finished export can be downloaded
+	TTL time.Duration
+}
+
+func NewExportWorker(repo repository.Repository) *ExportWorker {
+	return &ExportWorker{
+		Repo:         repo,
+		PollInterval: 5 * time.Second,
+		StaleAfter:   15 * time.Minute,
+		TTL:          7 * 24 * time.Hour,
+	}
+}
+
+// Start builds exports until ctx is cancelled
+func (w *ExportWorker) Start(ctx context.Context) {
+	for {
+		export, err := w.Repo.ClaimDataExport(ctx, w.StaleAfter)
+		if err != nil {
+			log.Println("Failed to claim data export [ew-001]", err)
+		}
+		if export != nil {
+			w.process(ctx, export)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.PollInterval):
+		}
+	}
+}
+
+func (w *ExportWorker) process(ctx context.Context, export *models.DataExport) {
+	expiresAt := time.Now().Add(w.TTL)
+	archive, err := w.build(ctx, export)
+	if err != nil {
+		log.Println("Failed to build data export [ew-002]", err)
+		if err := w.Repo.FailDataExport(ctx, export.ID, err.Error(), expiresAt); err != nil {
+			log.Println("Failed to record data export failure [ew-003]", err)
+		}
+		return
+	}
+	if err := w.Repo.CompleteDataExport(ctx, export.ID, archive, expiresAt); err != nil {
+		log.Println("Failed to complete data export [ew-004]", err)
+	}
+}
+
+// build zips the user's export files with a README explaining them
+func (w *ExportWorker) build(ctx context.Context, export *models.DataExport) ([]byte, error) {
+	files, err := w.Repo.GetUserExportFiles(ctx, export.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	files = append([]models.ExportFile{{Name: "README.txt", Data: []byte(exportReadme)}}, files...)
+	for _, file := range files {
+		data := file.Data
+		var indented bytes.Buffer
+		if json.Indent(&indented, data, "", "  ") == nil {
+			data = indented.Bytes()
+		}
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: export.CreatedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
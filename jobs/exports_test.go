@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+)
+
+func TestExportWorker(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.New()
+	user := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: "x"}
+	if err := repo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	export, err := repo.CreateDataExport(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewExportWorker(repo)
+	w.PollInterval = 5 * time.Millisecond
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var archive []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for archive == nil && time.Now().Before(deadline) {
+		archive, _ = repo.GetDataExportArchive(context.Background(), export.ID, user.ID)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if archive == nil {
+		t.Fatal("the export did not finish")
+	}
+	exports, _ := repo.GetDataExportsByUserID(context.Background(), user.ID)
+	if len(exports) != 1 || exports[0].Status != db.ExportStatusDone || exports[0].ExpiresAt == nil || exports[0].ExpiresAt.Before(time.Now().Add(w.TTL-time.Minute)) {
+		t.Fatalf("exports = %+v", exports)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	if r.File[0].Name != "README.txt" || files["README.txt"] != exportReadme {
+		t.Fatalf("the archive starts with %s", r.File[0].Name)
+	}
+	// JSON files are indented so they can be read as they are
+	if profile := files["profile.json"]; !strings.Contains(profile, "\n  ") || !strings.Contains(profile, `"ada@example.com"`) {
+		t.Fatalf("profile.json = %s", profile)
+	}
+}
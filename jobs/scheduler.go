@@ -0,0 +1,236 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+)
+
+// CompleteFunc runs a plain list of messages and returns the response
+type CompleteFunc func(ctx context.Context, messages []models.MessageContent, aiModelVersion string) (string, error)
+
+// Scheduler runs due schedules in-process. Every server instance can run one;
+// advisory locks in ClaimScheduleRun make sure each run happens only once.
+type Scheduler struct {
+	Repo     repository.Repository
+	Catalog  *db.PatternCatalog
+	Run      RunFunc
+	Complete CompleteFunc
+
+	// TickInterval is how often due schedules are checked
+	TickInterval time.Duration
+}
+
+// NewScheduler creates a scheduler that checks for due schedules every 30 seconds
+func NewScheduler(repo repository.Repository, catalog *db.PatternCatalog, run RunFunc, complete CompleteFunc) *Scheduler {
+	return &Scheduler{
+		Repo:         repo,
+		Catalog:      catalog,
+		Run:          run,
+		Complete:     complete,
+		TickInterval: 30 * time.Second,
+	}
+}
+
+// ScheduleLocation is the timezone a schedule's cron expression is evaluated in
+func ScheduleLocation(timezone string) *time.Location {
+	for _, name := range []string{timezone, os.Getenv("LOCATION")} {
+		if name == "" {
+			continue
+		}
+		if location, err := time.LoadLocation(name); err == nil {
+			return location
+		}
+	}
+	return time.UTC
+}
+
+// NextRun returns the first time after after that the schedule should run
+func NextRun(schedule *models.Schedule, after time.Time) (time.Time, error) {
+	spec, err := cron.ParseStandard(schedule.CronExpression)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %v", err)
+	}
+	next := spec.Next(after.In(ScheduleLocation(schedule.Timezone)))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression %q never runs", schedule.CronExpression)
+	}
+	return next, nil
+}
+
+// Start checks for due schedules until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		s.tick(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context) {
+	now := time.Now()
+	ids, err := s.Repo.GetDueScheduleIDs(ctx, now)
+	if err != nil {
+		log.Println("Failed to get due schedules [js-001]", err)
+		return
+	}
+
+	for _, id := range ids {
+		schedule, claimed, err := s.Repo.ClaimScheduleRun(ctx, id, now, func(schedule *models.Schedule) (time.Time, error) {
+			return NextRun(schedule, now)
+		})
+		if err != nil {
+			log.Println("Failed to claim schedule run [js-002]", err)
+			continue
+		}
+		if claimed {
+			go s.execute(ctx, schedule)
+		}
+	}
+}
+
+// execute runs the schedule once and records the result as a chat and a run
+func (s *Scheduler) execute(ctx context.Context, schedule *models.Schedule) {
+	run := &models.ScheduleRun{ScheduleID: schedule.ID, Status: db.ScheduleRunRunning}
+	if err := s.Repo.CreateScheduleRun(ctx, run); err != nil {
+		log.Println("Failed to create schedule run [js-003]", err)
+		return
+	}
+
+	chatID, err := s.runOnce(ctx, schedule)
+	if err != nil {
+		log.Println("Scheduled run failed [js-004]", err)
+		run.Status = db.ScheduleRunFailed
+		run.Error = err.Error()
+	} else {
+		run.Status = db.ScheduleRunCompleted
+		run.ChatID = &chatID
+	}
+
+	if err := s.Repo.FinishScheduleRun(ctx, run); err != nil {
+		log.Println("Failed to finish schedule run [js-005]", err)
+	}
+}
+
+func (s *Scheduler) runOnce(ctx context.Context, schedule *models.Schedule) (uuid.UUID, error) {
+	appendTo := schedule.AppendToChat && schedule.ChatID != nil
+	if appendTo {
+		if err := s.checkChatAccess(ctx, schedule); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	var output string
+	var err error
+	if schedule.Pattern != "" {
+		pattern, err := s.Catalog.GetPattern(schedule.Pattern, schedule.Variables)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		output, err = s.Run(ctx, pattern, schedule.Prompt, schedule.AIModelVersion)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	} else {
+		messages := []models.MessageContent{{Role: "user", Content: schedule.Prompt}}
+		if output, err = s.Complete(ctx, messages, schedule.AIModelVersion); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	location := ScheduleLocation(schedule.Timezone)
+	now := time.Now().In(location)
+
+	// The chat and both messages commit together, so a failed run leaves no empty chat
+	chatID := uuid.Nil
+	newChat := !appendTo
+	err = s.Repo.InTx(ctx, func(tx repository.ConversationTx) error {
+		if newChat {
+			title := schedule.Name
+			if !schedule.AppendToChat {
+				title = fmt.Sprintf("%s (%s)", schedule.Name, now.Format("2006-01-02 15:04"))
+			}
+			chat, err := tx.CreateChat(ctx, &models.Chat{
+				UserID:         schedule.UserID,
+				Title:          title[:min(len(title), 255)],
+				CreatedAt:      now,
+				LastUpdated:    now,
+				AIModelVersion: schedule.AIModelVersion,
+			})
+			if err != nil {
+				return err
+			}
+			chatID = chat.ID
+		} else {
+			chatID = *schedule.ChatID
+		}
+		for _, message := range []*models.Message{
+			{ChatID: chatID, UserID: schedule.UserID, Role: "user", Content: schedule.Prompt, CreatedAt: now},
+			{ChatID: chatID, UserID: schedule.UserID, Role: "assistant", Content: output, CreatedAt: time.Now().In(location)},
+		} {
+			if err := tx.CreateMessage(ctx, message); err != nil {
+				return err
+			}
+		}
+		return tx.TouchChat(ctx, chatID, now)
+	})
+	// The chat can be trashed while the model runs
+	if errors.Is(err, db.ErrChatTrashed) {
+		return uuid.Nil, s.pause(ctx, schedule, fmt.Sprintf("chat %s is in the trash", chatID))
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if newChat && schedule.AppendToChat {
+		if err := s.Repo.SetScheduleChat(ctx, schedule.ID, chatID); err != nil {
+			return chatID, err
+		}
+	}
+	return chatID, nil
+}
+
+// checkChatAccess makes sure the owner can still write to the chat the
+// schedule appends to. Access can be lost after the schedule was saved, for
+// example by leaving the workspace, so a schedule that fails is deactivated.
+// So is one whose chat is in the trash, where its runs would be hidden; the
+// owner can turn it back on after restoring the chat.
+func (s *Scheduler) checkChatAccess(ctx context.Context, schedule *models.Schedule) error {
+	chat, err := s.Repo.GetChatByID(ctx, *schedule.ChatID)
+	if err != nil {
+		if _, trashErr := s.Repo.GetTrashedChatByID(ctx, *schedule.ChatID); trashErr == nil {
+			return s.pause(ctx, schedule, fmt.Sprintf("chat %s is in the trash", *schedule.ChatID))
+		}
+		return err
+	}
+	canWrite, _, err := db.ChatAccess(ctx, s.Repo, chat, schedule.UserID)
+	if err != nil {
+		return err
+	}
+	if canWrite {
+		return nil
+	}
+	return s.pause(ctx, schedule, fmt.Sprintf("schedule owner can no longer write to chat %s", chat.ID))
+}
+
+// pause deactivates a schedule that cannot run and returns why as the run's error
+func (s *Scheduler) pause(ctx context.Context, schedule *models.Schedule, reason string) error {
+	if err := s.Repo.DeactivateSchedule(ctx, schedule.ID); err != nil {
+		log.Println("Failed to deactivate schedule [js-006]", err)
+	}
+	return fmt.Errorf("%s, schedule deactivated", reason)
+}
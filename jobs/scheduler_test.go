@@ -0,0 +1,207 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/google/uuid"
+)
+
+func TestNextRun(t *testing.T) {
+	after := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		cron     string
+		timezone string
+		want     time.Time
+	}{
+		{"0 9 * * *", "", time.Date(2024, 1, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * *", "America/New_York", time.Date(2024, 1, 15, 14, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", "Asia/Tokyo", time.Date(2024, 1, 15, 12, 15, 0, 0, time.UTC)},
+		{"0 9 * * MON", "", time.Date(2024, 1, 22, 9, 0, 0, 0, time.UTC)},
+	} {
+		t.Setenv("LOCATION", "")
+		next, err := NextRun(&models.Schedule{CronExpression: tt.cron, Timezone: tt.timezone}, after)
+		if err != nil {
+			t.Fatalf("%s in %q: %v", tt.cron, tt.timezone, err)
+		}
+		if !next.Equal(tt.want) {
+			t.Errorf("%s in %q runs next at %s, want %s", tt.cron, tt.timezone, next.UTC(), tt.want)
+		}
+	}
+
+	for _, cron := range []string{"", "every day", "61 * * * *", "0 0 30 2 *"} {
+		if _, err := NextRun(&models.Schedule{CronExpression: cron}, after); err == nil {
+			t.Errorf("NextRun accepted %q", cron)
+		}
+	}
+}
+
+func TestScheduleLocation(t *testing.T) {
+	t.Setenv("LOCATION", "Europe/Paris")
+	for _, tt := range []struct {
+		timezone string
+		want     string
+	}{
+		{"Asia/Tokyo", "Asia/Tokyo"},
+		{"", "Europe/Paris"},
+		{"Not/AZone", "Europe/Paris"},
+	} {
+		if got := ScheduleLocation(tt.timezone).String(); got != tt.want {
+			t.Errorf("ScheduleLocation(%q) = %s, want %s", tt.timezone, got, tt.want)
+		}
+	}
+	t.Setenv("LOCATION", "")
+	if got := ScheduleLocation("Not/AZone"); got != time.UTC {
+		t.Errorf("ScheduleLocation without a valid zone = %s, want UTC", got)
+	}
+}
+
+// newTestScheduler returns a scheduler whose model echoes the prompt, and a user to own schedules
+func newTestScheduler(t *testing.T) (*Scheduler, *memory.Repository, *models.User) {
+	t.Helper()
+	w, repo, user := newTestWorker(t, func(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+		return pattern.Pattern + " " + input, nil
+	})
+	complete := func(ctx context.Context, messages []models.MessageContent, aiModelVersion string) (string, error) {
+		return "reply to " + messages[len(messages)-1].Content, nil
+	}
+	return NewScheduler(repo, w.Catalog, w.Run, complete), repo, user
+}
+
+func createSchedule(t *testing.T, repo *memory.Repository, schedule *models.Schedule) *models.Schedule {
+	t.Helper()
+	schedule.CronExpression = "0 9 * * *"
+	schedule.IsActive = true
+	schedule.NextRunAt = time.Now().Add(-time.Minute)
+	if err := repo.CreateSchedule(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	return schedule
+}
+
+// lastRun returns the schedule's newest run once it has finished
+func lastRun(t *testing.T, repo *memory.Repository, scheduleID uuid.UUID) *models.ScheduleRun {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runs, err := repo.GetScheduleRuns(context.Background(), scheduleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) > 0 && runs[0].FinishedAt != nil {
+			return runs[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("the schedule did not run")
+	return nil
+}
+
+func TestSchedulerRunsDueSchedulesOnce(t *testing.T) {
+	s, repo, user := newTestScheduler(t)
+	ctx := context.Background()
+	schedule := createSchedule(t, repo, &models.Schedule{UserID: user.ID, Name: "Standup", Prompt: "What is on today?"})
+
+	s.tick(ctx)
+	run := lastRun(t, repo, schedule.ID)
+	if run.Status != db.ScheduleRunCompleted || run.ChatID == nil {
+		t.Fatalf("run = %+v", run)
+	}
+	chat, err := repo.GetChatByID(ctx, *run.ChatID)
+	if err != nil || !strings.HasPrefix(chat.Title, "Standup (") {
+		t.Fatalf("chat of the run = %+v, %v", chat, err)
+	}
+	messages, err := repo.GetMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(messages) != 2 || messages[1].Content != "reply to What is on today?" {
+		t.Fatalf("messages of the run = %+v, %v", messages, err)
+	}
+
+	stored, _ := repo.GetScheduleByID(ctx, schedule.ID)
+	if !stored.NextRunAt.After(time.Now()) || stored.LastRunAt == nil {
+		t.Fatalf("schedule after its run = %+v", stored)
+	}
+	// It is not due again until its next run
+	s.tick(ctx)
+	time.Sleep(20 * time.Millisecond)
+	if runs, _ := repo.GetScheduleRuns(ctx, schedule.ID); len(runs) != 1 {
+		t.Fatalf("the schedule ran %d times, want once", len(runs))
+	}
+}
+
+func TestSchedulerAppendsToOneChat(t *testing.T) {
+	s, repo, user := newTestScheduler(t)
+	ctx := context.Background()
+	schedule := createSchedule(t, repo, &models.Schedule{UserID: user.ID, Name: "Digest", Pattern: "summarize", Prompt: "news", AppendToChat: true})
+
+	s.execute(ctx, schedule)
+	first := lastRun(t, repo, schedule.ID)
+	if first.Status != db.ScheduleRunCompleted {
+		t.Fatalf("first run = %+v", first)
+	}
+	// The first run pins the chat it made, and later runs add to it
+	stored, _ := repo.GetScheduleByID(ctx, schedule.ID)
+	if stored.ChatID == nil || *stored.ChatID != *first.ChatID {
+		t.Fatalf("schedule chat = %v, want %s", stored.ChatID, first.ChatID)
+	}
+	s.execute(ctx, stored)
+	if second := lastRun(t, repo, schedule.ID); *second.ChatID != *first.ChatID {
+		t.Fatalf("second run wrote to %s, want %s", second.ChatID, first.ChatID)
+	}
+	messages, _ := repo.GetMessagesByChatID(ctx, *first.ChatID)
+	if len(messages) != 4 || messages[3].Content != "You summarize text in {{lang}}. news" {
+		t.Fatalf("chat has %d messages, last %+v", len(messages), messages[len(messages)-1])
+	}
+}
+
+func TestSchedulerDeactivatesSchedulesOfTrashedChats(t *testing.T) {
+	s, repo, user := newTestScheduler(t)
+	ctx := context.Background()
+	now := time.Now()
+	chat, err := repo.CreateChat(ctx, &models.Chat{UserID: user.ID, Title: "Digest", CreatedAt: now, LastUpdated: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := createSchedule(t, repo, &models.Schedule{UserID: user.ID, Name: "Digest", Prompt: "news", ChatID: &chat.ID, AppendToChat: true})
+	if err := repo.DeleteChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	s.execute(ctx, schedule)
+	run := lastRun(t, repo, schedule.ID)
+	if run.Status != db.ScheduleRunFailed || !strings.Contains(run.Error, "trash") {
+		t.Fatalf("run = %+v", run)
+	}
+	if stored, _ := repo.GetScheduleByID(ctx, schedule.ID); stored.IsActive {
+		t.Fatal("the schedule is still active")
+	}
+	if err := repo.RestoreChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := repo.GetMessagesByChatID(ctx, chat.ID); len(messages) != 0 {
+		t.Fatalf("the run wrote %d messages to the trashed chat", len(messages))
+	}
+}
+
+func TestSchedulerRecordsFailedRuns(t *testing.T) {
+	s, repo, user := newTestScheduler(t)
+	s.Complete = func(ctx context.Context, messages []models.MessageContent, aiModelVersion string) (string, error) {
+		return "", errors.New("model unavailable")
+	}
+	ctx := context.Background()
+	schedule := createSchedule(t, repo, &models.Schedule{UserID: user.ID, Name: "Standup", Prompt: "What is on today?"})
+
+	s.execute(ctx, schedule)
+	run := lastRun(t, repo, schedule.ID)
+	if run.Status != db.ScheduleRunFailed || run.Error != "model unavailable" || run.ChatID != nil {
+		t.Fatalf("run = %+v", run)
+	}
+	if chats, _ := repo.GetChatsByUserID(ctx, user.ID, false); len(chats) != 0 {
+		t.Fatalf("a failed run left %d chats", len(chats))
+	}
+}
@@ -0,0 +1,32 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// SweepFunc deletes or updates whatever has aged out and returns how many rows it touched
+type SweepFunc func(ctx context.Context) (int64, error)
+
+// Sweep runs fn every interval until ctx is cancelled
+func Sweep(ctx context.Context, name string, interval time.Duration, fn SweepFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := fn(ctx)
+			if err != nil {
+				log.Printf("Failed to sweep %s [sw-001] %v", name, err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Swept %d %s", n, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+)
+
+// RunFunc runs a pattern over one input and returns the output
+type RunFunc func(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error)
+
+// Worker pulls queued job items from Postgres and runs them. Any number of
+// workers, across any number of server instances, can share the same queue.
+type Worker struct {
+	Repo    repository.Repository
+	Catalog *db.PatternCatalog
+	Run     RunFunc
+
+	// Concurrency is how many items this worker runs at once
+	Concurrency int
+	// MaxAttempts is how many times an item is tried before it is marked failed
+	MaxAttempts int
+	// PollInterval is how long to wait when the queue is empty
+	PollInterval time.Duration
+	// StaleAfter is how long an item may sit in running before it is requeued
+	StaleAfter time.Duration
+	// RunTimeout bounds one run of an item. It is kept shorter than StaleAfter
+	// so a slow run fails here before the sweep hands the item to another worker.
+	RunTimeout time.Duration
+}
+
+// NewWorker creates a worker with the default limits
+func NewWorker(repo repository.Repository, catalog *db.PatternCatalog, run RunFunc) *Worker {
+	return &Worker{
+		Repo:         repo,
+		Catalog:      catalog,
+		Run:          run,
+		Concurrency:  4,
+		MaxAttempts:  3,
+		PollInterval: 2 * time.Second,
+		StaleAfter:   15 * time.Minute,
+		RunTimeout:   10 * time.Minute,
+	}
+}
+
+// Start processes items until ctx is cancelled, then waits for in-flight items
+func (w *Worker) Start(ctx context.Context) {
+	slots := make(chan struct{}, w.Concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	lastStaleCheck := time.Time{}
+	for {
+		if time.Since(lastStaleCheck) > w.StaleAfter/2 {
+			if n, err := w.Repo.RequeueStaleJobItems(ctx, w.StaleAfter, w.MaxAttempts); err != nil {
+				log.Println("Failed to requeue stale job items [jw-001]", err)
+			} else if n > 0 {
+				log.Printf("Requeued %d stale job items", n)
+			}
+			lastStaleCheck = time.Now()
+		}
+
+		var items []*models.JobItem
+		if free := cap(slots) - len(slots); free > 0 {
+			var err error
+			if items, err = w.Repo.ClaimJobItems(ctx, free); err != nil {
+				log.Println("Failed to claim job items [jw-002]", err)
+			}
+		}
+
+		for _, item := range items {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				w.process(ctx, item)
+			}()
+		}
+
+		if len(items) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.PollInterval):
+		}
+	}
+}
+
+func (w *Worker) process(ctx context.Context, item *models.JobItem) {
+	job, err := w.Repo.GetJobByID(ctx, item.JobID)
+	if err != nil {
+		log.Println("Failed to get job for item [jw-003]", err)
+		w.fail(ctx, item, err)
+		return
+	}
+
+	pattern, err := w.Catalog.GetPattern(job.Pattern, job.Variables)
+	if err != nil {
+		// The pattern will not come back by retrying, so do not
+		item.Attempts = w.MaxAttempts
+		w.fail(ctx, item, err)
+		return
+	}
+
+	runTimeout := w.RunTimeout
+	if runTimeout <= 0 || runTimeout >= w.StaleAfter {
+		runTimeout = w.StaleAfter * 2 / 3
+	}
+	runCtx, cancel := context.WithTimeout(ctx, runTimeout)
+	defer cancel()
+	item.Output, err = w.Run(runCtx, pattern, item.Input, job.AIModelVersion)
+	if err != nil {
+		w.fail(ctx, item, err)
+		return
+	}
+
+	if err := w.Repo.CompleteJobItem(ctx, item); err != nil {
+		log.Println("Failed to complete job item [jw-004]", err)
+	}
+}
+
+// fail requeues the item with exponential backoff until it runs out of attempts
+func (w *Worker) fail(ctx context.Context, item *models.JobItem, cause error) {
+	item.Error = cause.Error()
+
+	var retryAt *time.Time
+	if item.Attempts < w.MaxAttempts {
+		next := time.Now().Add(time.Duration(1<<item.Attempts) * 10 * time.Second)
+		retryAt = &next
+	}
+
+	if err := w.Repo.FailJobItem(ctx, item, retryAt); err != nil {
+		log.Println("Failed to record job item failure [jw-005]", err)
+	}
+}
@@ -0,0 +1,191 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+)
+
+// newTestWorker returns a worker over a memory repository with a summarize pattern, and a user to own jobs
+func newTestWorker(t *testing.T, run RunFunc) (*Worker, *memory.Repository, *models.User) {
+	t.Helper()
+	repo := memory.New()
+	user := &models.User{Username: "ada", Email: "ada@example.com", PasswordHash: "x"}
+	if err := repo.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := db.NewPatternCatalog(&db.Storage{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.SavePattern("summarize", "You summarize text in {{lang}}.", ""); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorker(repo, catalog, run)
+	w.PollInterval = 5 * time.Millisecond
+	return w, repo, user
+}
+
+func createJob(t *testing.T, repo *memory.Repository, user *models.User, pattern string, inputs ...string) *models.Job {
+	t.Helper()
+	job := &models.Job{UserID: user.ID, Pattern: pattern, Variables: map[string]string{"{{lang}}": "French"}}
+	if err := repo.CreateJob(context.Background(), job, inputs); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// waitForJob runs the worker until the job finishes and returns it
+func waitForJob(t *testing.T, w *Worker, job *models.Job) *models.Job {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		finished, err := w.Repo.GetJobByID(context.Background(), job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished.FinishedAt != nil {
+			return finished
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("the job did not finish")
+	return nil
+}
+
+func TestWorkerRunsEveryItem(t *testing.T) {
+	w, repo, user := newTestWorker(t, func(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+		return pattern.Pattern + " " + strings.ToUpper(input), nil
+	})
+	job := createJob(t, repo, user, "summarize", "one", "two", "three")
+
+	finished := waitForJob(t, w, job)
+	if finished.Status != db.JobStatusCompleted || finished.CompletedItems != 3 || finished.FailedItems != 0 {
+		t.Fatalf("job = %+v", finished)
+	}
+	items, err := repo.GetJobItems(context.Background(), job.ID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"ONE", "TWO", "THREE"} {
+		// The job's variables are applied to the pattern
+		if items[i].Position != i || items[i].Output != "You summarize text in French. "+want {
+			t.Fatalf("item %d = %+v", i, items[i])
+		}
+	}
+}
+
+func TestWorkerRetriesFailedItems(t *testing.T) {
+	w, repo, user := newTestWorker(t, func(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+		return "", errors.New("model unavailable")
+	})
+	job := createJob(t, repo, user, "summarize", "one")
+	ctx := context.Background()
+
+	items, err := repo.ClaimJobItems(ctx, 10)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("claimed %d items (%v)", len(items), err)
+	}
+	w.process(ctx, items[0])
+	stored, _ := repo.GetJobItems(ctx, job.ID, 0, 10)
+	if stored[0].Status != db.JobStatusQueued || stored[0].Error != "model unavailable" {
+		t.Fatalf("after one failure the item is %+v, want it queued again", stored[0])
+	}
+	// It waits out its backoff before it can be claimed again
+	if items, _ := repo.ClaimJobItems(ctx, 10); len(items) != 0 {
+		t.Fatal("a failed item was claimed again before its backoff")
+	}
+
+	// The last attempt fails it for good
+	items[0].Attempts = w.MaxAttempts
+	w.process(ctx, items[0])
+	finished, _ := repo.GetJobByID(ctx, job.ID)
+	if finished.Status != db.JobStatusFailed || finished.FailedItems != 1 || finished.FinishedAt == nil {
+		t.Fatalf("job after the last attempt = %+v", finished)
+	}
+}
+
+func TestWorkerFailsItemsOfMissingPatterns(t *testing.T) {
+	w, repo, user := newTestWorker(t, func(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+		t.Error("ran an item whose pattern is missing")
+		return "", nil
+	})
+	job := createJob(t, repo, user, "translate", "one")
+
+	// Retrying cannot bring the pattern back, so the first attempt is the last
+	finished := waitForJob(t, w, job)
+	if finished.Status != db.JobStatusFailed || finished.FailedItems != 1 {
+		t.Fatalf("job = %+v", finished)
+	}
+}
+
+func TestWorkerTimesOutRuns(t *testing.T) {
+	w, repo, user := newTestWorker(t, func(ctx context.Context, pattern *db.Pattern, input string, aiModelVersion string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	w.RunTimeout = 10 * time.Millisecond
+	job := createJob(t, repo, user, "summarize", "one")
+	ctx := context.Background()
+
+	items, _ := repo.ClaimJobItems(ctx, 10)
+	start := time.Now()
+	w.process(ctx, items[0])
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the run was not cut off, it took %s", elapsed)
+	}
+	stored, _ := repo.GetJobItems(ctx, job.ID, 0, 10)
+	if !strings.Contains(stored[0].Error, context.DeadlineExceeded.Error()) {
+		t.Fatalf("item error = %q, want a deadline", stored[0].Error)
+	}
+}
+
+func TestRequeueStaleJobItems(t *testing.T) {
+	_, repo, user := newTestWorker(t, nil)
+	job := createJob(t, repo, user, "summarize", "one", "two")
+	ctx := context.Background()
+
+	items, _ := repo.ClaimJobItems(ctx, 1)
+	time.Sleep(time.Millisecond)
+	// One attempt left to use: the item goes back in the queue
+	if n, err := repo.RequeueStaleJobItems(ctx, 0, 2); err != nil || n != 1 {
+		t.Fatalf("requeued %d items (%v), want 1", n, err)
+	}
+	stored, _ := repo.GetJobItems(ctx, job.ID, 0, 10)
+	if stored[items[0].Position].Status != db.JobStatusQueued || stored[items[0].Position].Error != db.StaleJobItemError {
+		t.Fatalf("stale item = %+v", stored[items[0].Position])
+	}
+
+	// Claimed again, the first item has used both attempts and fails
+	if items, _ := repo.ClaimJobItems(ctx, 2); len(items) != 2 {
+		t.Fatalf("claimed %d items, want both", len(items))
+	}
+	time.Sleep(time.Millisecond)
+	if n, err := repo.RequeueStaleJobItems(ctx, 0, 2); err != nil || n != 2 {
+		t.Fatalf("requeued %d items (%v), want 2", n, err)
+	}
+	stored, _ = repo.GetJobItems(ctx, job.ID, 0, 10)
+	if first := stored[items[0].Position]; first.Status != db.JobStatusFailed {
+		t.Fatalf("a stale item out of attempts is %s, want failed", first.Status)
+	}
+	if second := stored[1-items[0].Position]; second.Status != db.JobStatusQueued {
+		t.Fatalf("a stale item with an attempt left is %s, want queued", second.Status)
+	}
+}
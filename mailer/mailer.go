@@ -0,0 +1,53 @@
+// Package mailer sends transactional email such as verification and password reset links.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers a message or returns why it could not
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewFromEnv picks a mailer with MAIL_DRIVER: "smtp" sends through SMTP_HOST,
+// anything else writes messages to MAIL_OUTBOX_DIR (./outbox by default)
+func NewFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "gippity-serv <no-reply@localhost>"
+	}
+
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is not set in the environment")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	default:
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "./outbox"
+		}
+		return NewOutboxMailer(dir, from)
+	}
+}
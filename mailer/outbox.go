@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._@-]+`)
+
+// headerSanitizer stops header values from starting new headers
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", "")
+
+// OutboxMailer writes every message to Dir as an .eml file instead of sending
+// it, for local development and tests
+type OutboxMailer struct {
+	Dir  string
+	From string
+
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewOutboxMailer(dir string, from string) (*OutboxMailer, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create outbox directory: %v", err)
+	}
+	return &OutboxMailer{Dir: dir, From: from}, nil
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	if err := os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0644); err != nil {
+		return fmt.Errorf("could not write %s to outbox: %v", name, err)
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages this mailer has written since it was created
+func (m *OutboxMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
+
+// format renders msg as a plain text RFC 5322 message
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerSanitizer.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerSanitizer.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerSanitizer.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
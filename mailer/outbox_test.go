@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboxMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m, err := NewOutboxMailer(dir, "gippity-serv <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{To: "ada@example.com", Subject: "Hello\r\nBcc: eve@example.com", Body: "line one\nline two\n"}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := m.Sent(); len(sent) != 1 || sent[0] != msg {
+		t.Fatalf("sent = %+v", sent)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0].Name(), "-ada@example.com.eml") {
+		t.Fatalf("outbox has %v (%v)", files, err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, body, _ := strings.Cut(string(raw), "\r\n\r\n")
+	// A subject cannot add headers of its own
+	if strings.Contains(headers, "\r\nBcc:") || !strings.Contains(headers, "Subject: HelloBcc: eve@example.com\r\n") {
+		t.Fatalf("headers = %q", headers)
+	}
+	if body != "line one\r\nline two\r\n" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv("MAIL_DRIVER", "smtp")
+	t.Setenv("SMTP_HOST", "")
+	if _, err := NewFromEnv(); err == nil {
+		t.Fatal("the smtp driver was configured without SMTP_HOST")
+	}
+	t.Setenv("SMTP_HOST", "mail.example.com")
+	m, err := NewFromEnv()
+	if smtp, ok := m.(*SMTPMailer); err != nil || !ok || smtp.Port != "587" {
+		t.Fatalf("smtp mailer = %+v (%v)", m, err)
+	}
+
+	t.Setenv("MAIL_DRIVER", "")
+	t.Setenv("MAIL_OUTBOX_DIR", t.TempDir())
+	if m, err := NewFromEnv(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := m.(*OutboxMailer); !ok {
+		t.Fatalf("the default mailer is %T, want an outbox", m)
+	}
+}
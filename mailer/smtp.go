@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends mail through an SMTP server, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{msg.To}, format(m.From, msg))
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send mail: %v", err)
+		}
+		return nil
+	}
+}
@@ -15,6 +15,11 @@ type User struct {
 	LastLogin    *time.Time `json:"last_login,omitempty"`
 	IsActive     bool       `json:"is_active"`
 	LastChatID   *uuid.UUID `json:"last_chat_id,omitempty"`
+	// EmailVerifiedAt is nil until the user follows their verification link
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	Role            string     `json:"role"`
+	// DeletionScheduledAt is when the account will be purged, if the user asked to delete it
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
 }
 
 type UserMetadata struct {
@@ -37,6 +42,10 @@ type Chat struct {
 	LastUpdated    time.Time `json:"last_updated"`
 	IsArchived     bool      `json:"is_archived"`
 	AIModelVersion string    `json:"ai_model_version"`
+	// WorkspaceID is set when the chat is shared with a team workspace
+	WorkspaceID *uuid.UUID `json:"workspace_id,omitempty"`
+	// DeletedAt is when the chat was moved to the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Message struct {
@@ -47,6 +56,10 @@ type Message struct {
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
 	IsEdited  bool      `json:"is_edited"`
+	// Status is pending while an assistant reply streams, then complete or failed
+	Status string `json:"status"`
+	// DeletedAt is when the message was moved to the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type AIModel struct {
@@ -63,11 +76,260 @@ type ChatAIModel struct {
 }
 
 type UserPreferences struct {
-	UserID               uuid.UUID `json:"user_id"`
-	DefaultAIModel       uuid.UUID `json:"default_ai_model"`
-	Theme                string    `json:"theme"`
-	MessageDisplayCount  int       `json:"message_display_count"`
-	NotificationsEnabled bool      `json:"notifications_enabled"`
+	UserID               uuid.UUID  `json:"user_id"`
+	DefaultAIModel       *uuid.UUID `json:"default_ai_model"`
+	Theme                string     `json:"theme"`
+	MessageDisplayCount  int        `json:"message_display_count"`
+	NotificationsEnabled bool       `json:"notifications_enabled"`
+}
+
+type Job struct {
+	ID             uuid.UUID         `json:"id"`
+	UserID         uuid.UUID         `json:"user_id"`
+	Pattern        string            `json:"pattern"`
+	Variables      map[string]string `json:"variables,omitempty"`
+	AIModelVersion string            `json:"ai_model_version"`
+	Status         string            `json:"status"`
+	TotalItems     int               `json:"total_items"`
+	CompletedItems int               `json:"completed_items"`
+	FailedItems    int               `json:"failed_items"`
+	CreatedAt      time.Time         `json:"created_at"`
+	FinishedAt     *time.Time        `json:"finished_at,omitempty"`
+}
+
+type JobItem struct {
+	ID        uuid.UUID `json:"id"`
+	JobID     uuid.UUID `json:"job_id"`
+	Position  int       `json:"position"`
+	Input     string    `json:"input"`
+	Output    string    `json:"output,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Schedule struct {
+	ID             uuid.UUID         `json:"id"`
+	UserID         uuid.UUID         `json:"user_id"`
+	Name           string            `json:"name"`
+	CronExpression string            `json:"cron_expression"`
+	Pattern        string            `json:"pattern,omitempty"`
+	Prompt         string            `json:"prompt"`
+	Variables      map[string]string `json:"variables,omitempty"`
+	AIModelVersion string            `json:"ai_model_version"`
+	ChatID         *uuid.UUID        `json:"chat_id,omitempty"`
+	AppendToChat   bool              `json:"append_to_chat"`
+	IsActive       bool              `json:"is_active"`
+	NextRunAt      time.Time         `json:"next_run_at"`
+	LastRunAt      *time.Time        `json:"last_run_at,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	// Timezone comes from the owner's metadata and is what CronExpression is evaluated in
+	Timezone string `json:"timezone"`
+}
+
+type ScheduleRun struct {
+	ID         uuid.UUID  `json:"id"`
+	ScheduleID uuid.UUID  `json:"schedule_id"`
+	ChatID     *uuid.UUID `json:"chat_id,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type Session struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Current    bool       `json:"current"`
+}
+
+type RefreshToken struct {
+	ID        uuid.UUID  `json:"id"`
+	FamilyID  uuid.UUID  `json:"family_id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	TokenHash string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type EmailToken struct {
+	ID        uuid.UUID  `json:"id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Purpose   string     `json:"purpose"`
+	TokenHash string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+type UserTOTP struct {
+	UserID       uuid.UUID  `json:"user_id"`
+	Secret       string     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	EnabledAt    *time.Time `json:"enabled_at,omitempty"`
+	LastUsedStep int64      `json:"-"`
+}
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type UserIdentity struct {
+	ID          uuid.UUID `json:"id"`
+	UserID      uuid.UUID `json:"user_id"`
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email,omitempty"`
+	Groups      []string  `json:"groups"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+type OIDCLoginState struct {
+	StateHash    string    `json:"-"`
+	Provider     string    `json:"provider"`
+	Nonce        string    `json:"-"`
+	CodeVerifier string    `json:"-"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type WebAuthnCredential struct {
+	ID                uuid.UUID  `json:"id"`
+	UserID            uuid.UUID  `json:"user_id"`
+	CredentialID      []byte     `json:"-"`
+	PublicKey         []byte     `json:"-"`
+	SignCount         uint32     `json:"-"`
+	AAGUID            []byte     `json:"-"`
+	AttestationFormat string     `json:"attestation_format"`
+	Transports        []string   `json:"transports"`
+	BackupEligible    bool       `json:"backup_eligible"`
+	Name              string     `json:"name"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at,omitempty"`
+}
+
+type WebAuthnChallenge struct {
+	Challenge string     `json:"-"`
+	UserID    *uuid.UUID `json:"user_id,omitempty"`
+	Purpose   string     `json:"purpose"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// SecurityEvent records a lockout or another security relevant change.
+// ActorID is the admin who made the change, if any.
+type SecurityEvent struct {
+	ID        uuid.UUID         `json:"id"`
+	UserID    *uuid.UUID        `json:"user_id,omitempty"`
+	ActorID   *uuid.UUID        `json:"actor_id,omitempty"`
+	EventType string            `json:"event_type"`
+	IPAddress string            `json:"ip_address"`
+	Detail    map[string]string `json:"detail"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// SigningKey is a JWT signing key; PrivateKey is PKCS #8 DER
+type SigningKey struct {
+	ID          string
+	Algorithm   string
+	PrivateKey  []byte
+	CreatedAt   time.Time
+	ActivatesAt time.Time
+	ExpiresAt   time.Time
+}
+
+// RoleSetting is the policy for every user with Role
+type RoleSetting struct {
+	Role string `json:"role"`
+	// MFARequired limits users with the role to enrolling a second factor until they have one
+	MFARequired bool      `json:"mfa_required"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type Organization struct {
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	CreatedBy *uuid.UUID `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// Role is the requesting user's role in the organization
+	Role string `json:"role,omitempty"`
+}
+
+type OrganizationMember struct {
+	OrganizationID uuid.UUID `json:"organization_id"`
+	UserID         uuid.UUID `json:"user_id"`
+	Username       string    `json:"username"`
+	Role           string    `json:"role"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Workspace is a team space in an organization; every member of the organization can use it
+type Workspace struct {
+	ID             uuid.UUID `json:"id"`
+	OrganizationID uuid.UUID `json:"organization_id"`
+	Name           string    `json:"name"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type WorkspacePattern struct {
+	WorkspaceID uuid.UUID  `json:"workspace_id"`
+	Name        string     `json:"name"`
+	System      string     `json:"system"`
+	User        string     `json:"user,omitempty"`
+	CreatedBy   *uuid.UUID `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// DataExport is a requested zip of everything stored about a user
+type DataExport struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Size       int64      `json:"size"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// ExportFile is one file of a data export archive
+type ExportFile struct {
+	Name string
+	Data []byte
+}
+
+// CustomInstructions tell the assistant how to respond to a user.
+// MetadataFields names the UserMetadata fields shared with it.
+type CustomInstructions struct {
+	UserID         uuid.UUID `json:"user_id"`
+	Instructions   string    `json:"instructions"`
+	MetadataFields []string  `json:"metadata_fields"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ChatInstructions override the user's custom instructions for one chat
+type ChatInstructions struct {
+	ChatID                  uuid.UUID `json:"chat_id"`
+	Instructions            *string   `json:"instructions"`
+	PersonalizationDisabled bool      `json:"personalization_disabled"`
+	UpdatedAt               time.Time `json:"updated_at"`
 }
 
 type MessageContent struct {
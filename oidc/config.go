@@ -0,0 +1,98 @@
+// Package oidc signs users in with an OpenID Connect identity provider using
+// the authorization code flow with PKCE.
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/auth"
+)
+
+// Config describes one identity provider. Name is the path segment in
+// /auth/oidc/:provider and the key identities are stored under.
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// GroupsClaim is the ID token claim listing the user's groups
+	GroupsClaim string
+	// RoleMap maps IdP group names to role names
+	RoleMap map[string]string
+}
+
+// ProvidersFromEnv reads OIDC_PROVIDERS, a comma separated list of names, and
+// for each name the OIDC_<NAME>_* variables documented in the README
+func ProvidersFromEnv() (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+	raw := os.Getenv("OIDC_PROVIDERS")
+	if raw == "" {
+		return providers, nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		env := func(key string) string {
+			return os.Getenv("OIDC_" + strings.ToUpper(name) + "_" + key)
+		}
+
+		config := Config{
+			Name:         name,
+			Issuer:       strings.TrimRight(env("ISSUER"), "/"),
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			RedirectURL:  env("REDIRECT_URL"),
+			Scopes:       []string{"openid", "email", "profile"},
+			GroupsClaim:  "groups",
+			RoleMap:      make(map[string]string),
+		}
+		if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %s needs ISSUER, CLIENT_ID and REDIRECT_URL", name)
+		}
+		if scopes := env("SCOPES"); scopes != "" {
+			config.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+		if claim := env("GROUPS_CLAIM"); claim != "" {
+			config.GroupsClaim = claim
+		}
+		if roleMap := env("ROLE_MAP"); roleMap != "" {
+			for _, pair := range strings.Split(roleMap, ",") {
+				group, role, ok := strings.Cut(pair, "=")
+				if !ok {
+					return nil, fmt.Errorf("OIDC provider %s has an invalid ROLE_MAP entry %q, want group=role", name, pair)
+				}
+				role = strings.TrimSpace(role)
+				if !auth.ValidRole(role) {
+					return nil, fmt.Errorf("OIDC provider %s maps to unknown role %q", name, role)
+				}
+				config.RoleMap[strings.TrimSpace(group)] = role
+			}
+		}
+
+		providers[name] = NewProvider(config, client)
+	}
+	return providers, nil
+}
+
+// Roles maps groups to roles through RoleMap, skipping groups with no role
+func (c Config) Roles(groups []string) []string {
+	var roles []string
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		if role, ok := c.RoleMap[group]; ok && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,138 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// minKeyRefresh stops unknown kids from making us hammer the jwks endpoint
+const minKeyRefresh = time.Minute
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the provider's signing keys, refetching when a token names a kid it has not seen
+type keySet struct {
+	uri   string
+	fetch func(ctx context.Context, url string, v interface{}) error
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newKeySet(uri string, fetch func(ctx context.Context, url string, v interface{}) error) *keySet {
+	return &keySet{uri: uri, fetch: fetch}
+}
+
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.lookupLocked(kid); ok {
+		return key, nil
+	}
+	if time.Since(s.fetchedAt) < minKeyRefresh && s.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := s.fetch(ctx, s.uri, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	s.keys, s.fetchedAt = keys, time.Now()
+
+	if key, ok := s.lookupLocked(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupLocked finds kid, or the only key when the token names none
+func (s *keySet) lookupLocked(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key %s is not on curve %s", k.Kid, k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key parameter: %v", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,171 @@
+// Package oidctest runs an in-process OpenID Connect identity provider for
+// tests of the login flow.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Credentials the server accepts at its token endpoint
+const (
+	ClientID     = "client-id"
+	ClientSecret = "client-secret"
+)
+
+// Subject is the sub claim of the ID tokens the server issues
+const Subject = "subject-1"
+
+type authorization struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+// Server serves discovery, a JWKS and a token endpoint that checks PKCE the
+// way a real provider would. Tests change the ID tokens it issues with Claims
+// and Sign.
+type Server struct {
+	*httptest.Server
+	Key   *rsa.PrivateKey
+	KeyID string
+
+	t     testing.TB
+	mu    sync.Mutex
+	codes map[string]authorization
+	// Claims edits the claims of each ID token before it is signed
+	Claims func(claims jwt.MapClaims)
+	// Sign replaces RS256 signing with the server's key
+	Sign func(claims jwt.MapClaims) string
+}
+
+// NewServer starts a provider whose issuer is its URL; it is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	s := &Server{Key: key, KeyID: "test-key", t: t, codes: make(map[string]authorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": s.KeyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Authorize plays the user signing in at the login URL and returns the code
+// and state the browser is redirected back with
+func (s *Server) Authorize(loginURL string) (code string, state string) {
+	s.t.Helper()
+	parsed, err := url.Parse(loginURL)
+	if err != nil {
+		s.t.Fatalf("invalid login url: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		s.t.Fatalf("login url is not a PKCE code flow: %s", loginURL)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	code = base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	s.codes[code] = authorization{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectURI: query.Get("redirect_uri"),
+	}
+	s.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != ClientID || secret != ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are single use whether or not the exchange succeeds
+	s.mu.Lock()
+	auth, ok := s.codes[r.Form.Get("code")]
+	delete(s.codes, r.Form.Get("code"))
+	s.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || auth.redirectURI != r.Form.Get("redirect_uri") || base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.URL,
+		"sub":            Subject,
+		"aud":            ClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          auth.nonce,
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada Lovelace",
+		"groups":         []string{"engineering"},
+	}
+	if s.Claims != nil {
+		s.Claims(claims)
+	}
+	var idToken string
+	if s.Sign != nil {
+		idToken = s.Sign(claims)
+	} else {
+		idToken = s.SignRS256(claims)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+}
+
+// SignRS256 signs claims with the key published in the JWKS
+func (s *Server) SignRS256(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.KeyID
+	signed, err := token.SignedString(s.Key)
+	if err != nil {
+		s.t.Fatalf("failed to sign id token: %v", err)
+	}
+	return signed
+}
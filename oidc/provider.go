@@ -0,0 +1,251 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// discoveryTTL is how long the provider metadata is trusted before it is fetched again
+const discoveryTTL = time.Hour
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one identity provider. Metadata and signing keys are
+// fetched on first use and cached.
+type Provider struct {
+	Config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	meta      *discovery
+	fetchedAt time.Time
+	keys      *keySet
+}
+
+func NewProvider(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Provider{Config: config, client: client}
+}
+
+// Identity is what the ID token says about the user
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Name          string
+	Groups        []string
+}
+
+// LoginRequest holds the values that must survive the round trip to the IdP
+type LoginRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	URL          string
+}
+
+func (p *Provider) metadata(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && time.Since(p.fetchedAt) < discoveryTTL {
+		return p.meta, nil
+	}
+
+	var meta discovery
+	if err := p.getJSON(ctx, p.Config.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("failed to fetch openid configuration: %v", err)
+	}
+	if strings.TrimRight(meta.Issuer, "/") != p.Config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: configured %s, provider says %s", p.Config.Issuer, meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("openid configuration is missing endpoints")
+	}
+	if p.keys == nil || p.keys.uri != meta.JWKSURI {
+		p.keys = newKeySet(meta.JWKSURI, p.getJSON)
+	}
+	p.meta, p.fetchedAt = &meta, time.Now()
+	return p.meta, nil
+}
+
+// Begin creates the state, nonce and PKCE verifier for a login and the URL
+// to send the browser to
+func (p *Provider) Begin(ctx context.Context) (*LoginRequest, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &LoginRequest{}
+	for _, value := range []*string{&req.State, &req.Nonce, &req.CodeVerifier} {
+		if *value, err = randomString(); err != nil {
+			return nil, err
+		}
+	}
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.Config.ClientID)
+	params.Set("redirect_uri", p.Config.RedirectURL)
+	params.Set("scope", strings.Join(p.Config.Scopes, " "))
+	params.Set("state", req.State)
+	params.Set("nonce", req.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	req.URL = meta.AuthorizationEndpoint + separator + params.Encode()
+	return req, nil
+}
+
+// Exchange redeems an authorization code and verifies the ID token that comes back
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*Identity, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	if p.Config.ClientSecret == "" {
+		// Public clients identify themselves in the body
+		form.Set("client_id", p.Config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem code: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return p.verifyIDToken(ctx, meta, tokens.IDToken, nonce)
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, meta *discovery, idToken string, nonce string) (*Identity, error) {
+	p.mu.Lock()
+	keys := p.keys
+	p.mu.Unlock()
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256"}),
+		jwt.WithIssuer(meta.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %v", err)
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+
+	identity := &Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return nil, errors.New("invalid id token: missing sub")
+	}
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims["preferred_username"].(string)
+	identity.Name, _ = claims["name"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		// Some providers send it as a string
+		identity.EmailVerified = verified == "true"
+	}
+	switch groups := claims[p.Config.GroupsClaim].(type) {
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+	return identity, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,181 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testProvider(idp *oidctest.Server) *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "https://app.example.com/auth/oidc/test/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+		GroupsClaim:  "groups",
+		RoleMap:      map[string]string{},
+	}, idp.Client())
+}
+
+// login runs Begin, the user's visit to the provider and Exchange
+func login(t *testing.T, provider *Provider, idp *oidctest.Server) (*Identity, error) {
+	t.Helper()
+	ctx := context.Background()
+	req, err := provider.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	code, state := idp.Authorize(req.URL)
+	if state != req.State {
+		t.Fatalf("state in login url = %q, want %q", state, req.State)
+	}
+	return provider.Exchange(ctx, code, req.CodeVerifier, req.Nonce)
+}
+
+func TestPKCERoundTrip(t *testing.T) {
+	idp := oidctest.NewServer(t)
+	identity, err := login(t, testProvider(idp), idp)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Subject != oidctest.Subject || identity.Email != "ada@example.com" || !identity.EmailVerified {
+		t.Errorf("identity = %+v", identity)
+	}
+	if len(identity.Groups) != 1 || identity.Groups[0] != "engineering" {
+		t.Errorf("groups = %v", identity.Groups)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := oidctest.NewServer(t)
+	provider := testProvider(idp)
+	ctx := context.Background()
+
+	req, err := provider.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	code, _ := idp.Authorize(req.URL)
+	other, err := provider.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := provider.Exchange(ctx, code, other.CodeVerifier, req.Nonce); err == nil {
+		t.Fatal("Exchange succeeded with another login's code verifier")
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		sign   func(idp *oidctest.Server) func(claims jwt.MapClaims) string
+		want   string
+	}{
+		{name: "wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, want: "issuer"},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-client" }, want: "audience"},
+		{name: "wrong nonce", claims: func(c jwt.MapClaims) { c["nonce"] = "replayed" }, want: "nonce"},
+		{name: "missing nonce", claims: func(c jwt.MapClaims) { delete(c, "nonce") }, want: "nonce"},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, want: "expired"},
+		{name: "missing expiry", claims: func(c jwt.MapClaims) { delete(c, "exp") }, want: "exp"},
+		{name: "missing subject", claims: func(c jwt.MapClaims) { delete(c, "sub") }, want: "sub"},
+		{
+			name: "alg none",
+			sign: func(idp *oidctest.Server) func(jwt.MapClaims) string {
+				return func(claims jwt.MapClaims) string {
+					signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+					return signed
+				}
+			},
+			want: "signing method none",
+		},
+		{
+			// HS256 keyed with the public key is the classic algorithm confusion attack
+			name: "alg HS256 with the public key",
+			sign: func(idp *oidctest.Server) func(jwt.MapClaims) string {
+				return func(claims jwt.MapClaims) string {
+					token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+					token.Header["kid"] = idp.KeyID
+					signed, _ := token.SignedString(idp.Key.N.Bytes())
+					return signed
+				}
+			},
+			want: "signing method HS256",
+		},
+		{
+			name: "signed by another key",
+			sign: func(idp *oidctest.Server) func(jwt.MapClaims) string {
+				other, _ := rsa.GenerateKey(rand.Reader, 2048)
+				return func(claims jwt.MapClaims) string {
+					token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+					token.Header["kid"] = idp.KeyID
+					signed, _ := token.SignedString(other)
+					return signed
+				}
+			},
+			want: "verification error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := oidctest.NewServer(t)
+			idp.Claims = tt.claims
+			if tt.sign != nil {
+				idp.Sign = tt.sign(idp)
+			}
+			identity, err := login(t, testProvider(idp), idp)
+			if err == nil {
+				t.Fatalf("Exchange accepted the id token: %+v", identity)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Exchange error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	idp := oidctest.NewServer(t)
+	provider := testProvider(idp)
+	provider.Config.Issuer = strings.Replace(idp.URL, "127.0.0.1", "localhost", 1)
+	if _, err := provider.Begin(context.Background()); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Fatalf("Begin error = %v, want issuer mismatch", err)
+	}
+}
+
+func TestEmailVerifiedClaim(t *testing.T) {
+	for _, tt := range []struct {
+		value interface{}
+		want  bool
+	}{
+		{true, true},
+		{"true", true},
+		{false, false},
+		{"false", false},
+		{nil, false},
+	} {
+		idp := oidctest.NewServer(t)
+		idp.Claims = func(c jwt.MapClaims) {
+			if tt.value == nil {
+				delete(c, "email_verified")
+			} else {
+				c["email_verified"] = tt.value
+			}
+		}
+		identity, err := login(t, testProvider(idp), idp)
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		if identity.EmailVerified != tt.want {
+			t.Errorf("email_verified %v: EmailVerified = %v, want %v", tt.value, identity.EmailVerified, tt.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Package password hashes and verifies user passwords.
+//
+// New hashes use argon2id with a random per-user salt, encoded together with
+// their parameters so they can be changed later without breaking old hashes.
+// bcrypt hashes and the original salted SHA-256 hashes still verify, and
+// Verify reports when a hash should be replaced with a fresh argon2id one.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/FiveEightyEight/gippity-serv/utils"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Params are the argon2id cost parameters
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams follow the OWASP recommendation for argon2id
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var ErrInvalidHash = errors.New("password hash is not in a recognized format")
+
+// Hasher creates and verifies password hashes
+type Hasher struct {
+	Params Params
+	// Policy is checked by Validate before a new password is accepted
+	Policy Policy
+
+	decoyOnce sync.Once
+	decoyHash string
+}
+
+// NewHasher creates a hasher using the default parameters, overridden by
+// ARGON2_MEMORY, ARGON2_ITERATIONS and ARGON2_PARALLELISM when set
+func NewHasher() *Hasher {
+	params := DefaultParams
+	if memory, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil && memory > 0 {
+		params.Memory = uint32(memory)
+	}
+	if iterations, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil && iterations > 0 {
+		params.Iterations = uint32(iterations)
+	}
+	if parallelism, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil && parallelism > 0 {
+		params.Parallelism = uint8(parallelism)
+	}
+	return &Hasher{Params: params, Policy: PolicyFromEnv()}
+}
+
+// Validate checks a new password against the policy
+func (h *Hasher) Validate(password string) error {
+	return h.Policy.Validate(password)
+}
+
+// Hash returns an encoded argon2id hash of password
+func (h *Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Params.Memory,
+		h.Params.Iterations,
+		h.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether password matches encoded, and whether encoded should
+// be replaced by a new hash because it uses an old algorithm or parameters.
+// Comparisons are constant-time.
+func (h *Hasher) Verify(password, encoded string) (ok bool, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		var params Params
+		var salt, key []byte
+		if params, salt, key, err = decodeArgon2id(encoded); err != nil {
+			return
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		ok = subtle.ConstantTimeCompare(candidate, key) == 1
+		needsRehash = params.Memory != h.Params.Memory ||
+			params.Iterations != h.Params.Iterations ||
+			params.Parallelism != h.Params.Parallelism ||
+			params.KeyLength != h.Params.KeyLength
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			err = nil
+			return
+		}
+		ok, needsRehash = err == nil, true
+	case isLegacyHash(encoded):
+		// Hashes from before this package were hex SHA-256 of password + HASH_SALT
+		var legacy string
+		if legacy, err = utils.HashString(password); err != nil {
+			return
+		}
+		ok = subtle.ConstantTimeCompare([]byte(legacy), []byte(encoded)) == 1
+		needsRehash = true
+	default:
+		err = ErrInvalidHash
+	}
+	return
+}
+
+// VerifyDecoy does the work of Verify against a throwaway hash. Logins for
+// unknown users call it so they take as long as a wrong password.
+func (h *Hasher) VerifyDecoy(password string) {
+	h.decoyOnce.Do(func() {
+		h.decoyHash, _ = h.Hash("decoy")
+	})
+	h.Verify(password, h.decoyHash)
+}
+
+func isLegacyHash(encoded string) bool {
+	if len(encoded) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func decodeArgon2id(encoded string) (params Params, salt []byte, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		err = ErrInvalidHash
+		return
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		err = ErrInvalidHash
+		return
+	}
+	if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %d", version)
+		return
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		err = ErrInvalidHash
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		err = ErrInvalidHash
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		err = ErrInvalidHash
+		return
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return
+}
@@ -0,0 +1,202 @@
+package password
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testParams keep argon2id cheap; the encoded hash records them either way
+var testParams = Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func newTestHasher() *Hasher {
+	return &Hasher{Params: testParams, Policy: DefaultPolicy}
+}
+
+// useLegacySalt sets HASH_SALT, and runs the test from a directory with a
+// .env file since the legacy hash loads one
+func useLegacySalt(t *testing.T, salt string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("HASH_SALT="+salt+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("HASH_SALT", salt)
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	hasher := newTestHasher()
+	encoded, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash %q does not record its parameters", encoded)
+	}
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != testParams || len(salt) != 16 || len(key) != 32 {
+		t.Fatalf("decoded %+v with a %d byte salt and %d byte key", params, len(salt), len(key))
+	}
+
+	if again, _ := hasher.Hash("correct horse"); again == encoded {
+		t.Fatal("two hashes of the same password share a salt")
+	}
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{
+		{"correct horse", true},
+		{"correct horse ", false},
+		{"Correct horse", false},
+		{"", false},
+	} {
+		ok, needsRehash, err := hasher.Verify(tt.password, encoded)
+		if err != nil || ok != tt.ok || needsRehash {
+			t.Errorf("Verify(%q) = %v, %v, %v; want %v, false, nil", tt.password, ok, needsRehash, err, tt.ok)
+		}
+	}
+}
+
+func TestVerifyNeedsRehashForOutdatedParams(t *testing.T) {
+	old := newTestHasher()
+	encoded, err := old.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(*Params)
+	}{
+		{"memory", func(p *Params) { p.Memory = 128 }},
+		{"iterations", func(p *Params) { p.Iterations = 2 }},
+		{"parallelism", func(p *Params) { p.Parallelism = 2 }},
+		{"key length", func(p *Params) { p.KeyLength = 64 }},
+	} {
+		current := newTestHasher()
+		tt.change(&current.Params)
+		ok, needsRehash, err := current.Verify("correct horse", encoded)
+		if err != nil || !ok || !needsRehash {
+			t.Errorf("%s changed: Verify = %v, %v, %v; want true, true, nil", tt.name, ok, needsRehash, err)
+		}
+	}
+
+	// A longer salt alone is not worth a rehash
+	current := newTestHasher()
+	current.Params.SaltLength = 32
+	if _, needsRehash, _ := current.Verify("correct horse", encoded); needsRehash {
+		t.Error("a different salt length asked for a rehash")
+	}
+}
+
+func TestVerifyUpgradesOldHashes(t *testing.T) {
+	useLegacySalt(t, "pepper")
+	legacy := sha256.Sum256([]byte("correct horse" + "pepper"))
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := newTestHasher()
+
+	for _, tt := range []struct {
+		name    string
+		encoded string
+	}{
+		{"bcrypt", string(bcryptHash)},
+		{"bcrypt $2y$", "$2y$" + strings.TrimPrefix(string(bcryptHash), "$2a$")},
+		{"legacy sha-256", hex.EncodeToString(legacy[:])},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := hasher.Verify("correct horse", tt.encoded)
+			if err != nil || !ok || !needsRehash {
+				t.Fatalf("Verify = %v, %v, %v; want true, true, nil", ok, needsRehash, err)
+			}
+			if ok, _, err := hasher.Verify("wrong horse", tt.encoded); err != nil || ok {
+				t.Fatalf("a wrong password returned %v, %v", ok, err)
+			}
+
+			// The login replaces the hash, and the new one needs nothing more
+			upgraded, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, needsRehash, err := hasher.Verify("correct horse", upgraded); err != nil || !ok || needsRehash {
+				t.Fatalf("upgraded hash verifies as %v, %v, %v", ok, needsRehash, err)
+			}
+		})
+	}
+}
+
+func TestVerifyDecoy(t *testing.T) {
+	hasher := newTestHasher()
+	hasher.VerifyDecoy("correct horse")
+	decoy := hasher.decoyHash
+	if !strings.HasPrefix(decoy, "$argon2id$") {
+		t.Fatalf("decoy hash %q is not argon2id, so it would not take as long as a real login", decoy)
+	}
+	hasher.VerifyDecoy("another guess")
+	if hasher.decoyHash != decoy {
+		t.Fatal("the decoy hash was created again")
+	}
+}
+
+func TestVerifyRejectsMalformedHashes(t *testing.T) {
+	hasher := newTestHasher()
+	encoded, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(encoded, "$")
+
+	for _, tt := range []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"plaintext", "correct horse"},
+		{"unknown scheme", "$scrypt$ln=16,r=8,p=1$c2FsdA$aGFzaA"},
+		{"short hex", strings.Repeat("a", 63)},
+		{"long hex", strings.Repeat("a", 65)},
+		{"missing part", strings.Join(parts[:5], "$")},
+		{"extra part", encoded + "$extra"},
+		{"bad version", strings.Replace(encoded, "v=19", "v=x", 1)},
+		{"old version", strings.Replace(encoded, "v=19", "v=16", 1)},
+		{"bad params", strings.Replace(encoded, "m=64,t=1,p=1", "m=64;t=1;p=1", 1)},
+		{"bad salt", strings.Join(append(parts[:4:4], "!!", parts[5]), "$")},
+		{"bad key", strings.Join(append(parts[:5:5], "!!"), "$")},
+	} {
+		if ok, _, err := hasher.Verify("correct horse", tt.encoded); ok || err == nil {
+			t.Errorf("%s: Verify(%q) = %v, %v; want an error", tt.name, tt.encoded, ok, err)
+		}
+	}
+	if _, _, err := hasher.Verify("correct horse", "$argon2id$"); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("a truncated argon2id hash returned %v, want ErrInvalidHash", err)
+	}
+}
+
+func TestNewHasherReadsEnv(t *testing.T) {
+	t.Setenv("ARGON2_MEMORY", "32768")
+	t.Setenv("ARGON2_ITERATIONS", "4")
+	t.Setenv("ARGON2_PARALLELISM", "not a number")
+	params := NewHasher().Params
+	if params.Memory != 32768 || params.Iterations != 4 || params.Parallelism != DefaultParams.Parallelism {
+		t.Fatalf("params = %+v", params)
+	}
+}
@@ -0,0 +1,89 @@
+package password
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy describes what a new password must contain
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// DefaultPolicy only enforces length, following NIST 800-63B
+var DefaultPolicy = Policy{
+	MinLength: 8,
+	MaxLength: 128,
+}
+
+// PolicyFromEnv starts from DefaultPolicy and applies PASSWORD_MIN_LENGTH,
+// PASSWORD_MAX_LENGTH and PASSWORD_REQUIRE, a comma separated list of
+// upper, lower, digit and symbol
+func PolicyFromEnv() Policy {
+	policy := DefaultPolicy
+	if minLength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && minLength > 0 {
+		policy.MinLength = minLength
+	}
+	if maxLength, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err == nil && maxLength > 0 {
+		policy.MaxLength = maxLength
+	}
+	for _, requirement := range strings.Split(os.Getenv("PASSWORD_REQUIRE"), ",") {
+		switch strings.TrimSpace(requirement) {
+		case "upper":
+			policy.RequireUpper = true
+		case "lower":
+			policy.RequireLower = true
+		case "digit":
+			policy.RequireDigit = true
+		case "symbol":
+			policy.RequireSymbol = true
+		}
+	}
+	return policy
+}
+
+// Validate returns an error describing the first rule password breaks
+func (p Policy) Validate(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	switch {
+	case p.RequireUpper && !hasUpper:
+		return fmt.Errorf("password must contain an uppercase letter")
+	case p.RequireLower && !hasLower:
+		return fmt.Errorf("password must contain a lowercase letter")
+	case p.RequireDigit && !hasDigit:
+		return fmt.Errorf("password must contain a digit")
+	case p.RequireSymbol && !hasSymbol:
+		return fmt.Errorf("password must contain a symbol")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		policy   Policy
+		password string
+		want     string
+	}{
+		{"long enough", DefaultPolicy, "correct horse", ""},
+		{"too short", DefaultPolicy, "short", "at least 8"},
+		{"length counts characters, not bytes", DefaultPolicy, "ääääääää", ""},
+		{"too long", DefaultPolicy, strings.Repeat("a", 129), "at most 128"},
+		{"no maximum", Policy{MinLength: 1}, strings.Repeat("a", 1000), ""},
+		{"upper missing", Policy{RequireUpper: true}, "lowercase", "uppercase"},
+		{"upper present", Policy{RequireUpper: true}, "Uppercase", ""},
+		{"lower missing", Policy{RequireLower: true}, "UPPERCASE", "lowercase"},
+		{"lower present", Policy{RequireLower: true}, "UPPERCASe", ""},
+		{"digit missing", Policy{RequireDigit: true}, "no digits", "digit"},
+		{"digit present", Policy{RequireDigit: true}, "one 1", ""},
+		{"symbol missing", Policy{RequireSymbol: true}, "letters1", "symbol"},
+		{"punctuation is a symbol", Policy{RequireSymbol: true}, "letters!", ""},
+		{"a space is a symbol", Policy{RequireSymbol: true}, "two words", ""},
+		{"first broken rule is reported", Policy{RequireUpper: true, RequireDigit: true}, "lower", "uppercase"},
+		{"every rule", Policy{MinLength: 8, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}, "Tr0ub4dor&3", ""},
+	} {
+		err := tt.policy.Validate(tt.password)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: Validate(%q) = %v, want nil", tt.name, tt.password, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: Validate(%q) = %v, want an error about %q", tt.name, tt.password, err, tt.want)
+		}
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_MAX_LENGTH", "0")
+	t.Setenv("PASSWORD_REQUIRE", "upper, digit,unknown")
+	want := Policy{MinLength: 12, MaxLength: 128, RequireUpper: true, RequireDigit: true}
+	if policy := PolicyFromEnv(); policy != want {
+		t.Fatalf("PolicyFromEnv() = %+v, want %+v", policy, want)
+	}
+}
@@ -0,0 +1,638 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+// ScheduleUserDeletion marks the account to be purged at the given time
+func (r *Repository) ScheduleUserDeletion(ctx context.Context, id uuid.UUID, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[id]
+	if !ok || row.DeletionScheduledAt != nil {
+		return db.ErrDeletionScheduled
+	}
+	row.DeletionScheduledAt = &at
+	return nil
+}
+
+func (r *Repository) CancelUserDeletion(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[id]
+	if !ok || row.DeletionScheduledAt == nil {
+		return db.ErrDeletionNotScheduled
+	}
+	row.DeletionScheduledAt = nil
+	return nil
+}
+
+// PurgeDeletedUsers deletes the accounts whose deletion grace period has passed
+func (r *Repository) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	due := selectRows(r.users, func(row *userRow) bool {
+		return row.DeletionScheduledAt != nil && !row.DeletionScheduledAt.After(now)
+	})
+	var purged int64
+	for _, row := range page(due, 100, 0) {
+		r.deleteUser(row.ID)
+		purged++
+	}
+	return purged, nil
+}
+
+// DeleteUser removes the user and everything they own. Personal chats are
+// deleted; chats and messages they shared with a workspace stay there without
+// an author. Organizations they were the only owner of pass to the next
+// admin, or member, by seniority, and organizations left empty are deleted.
+func (r *Repository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(id) {
+		return db.ErrUserNotFound
+	}
+	r.deleteUser(id)
+	return nil
+}
+
+func (r *Repository) deleteUser(id uuid.UUID) {
+	for _, row := range r.chats {
+		if row.UserID == id && row.WorkspaceID == nil {
+			r.deleteChat(row.ID)
+		}
+	}
+
+	for _, org := range r.orgs {
+		if r.orgRole(org.ID, id) != db.OrgRoleOwner || r.countOwners(org.ID) > 1 {
+			continue
+		}
+		heirs := selectRows(r.orgMembers, func(row *orgMemberRow) bool {
+			return row.OrganizationID == org.ID && row.UserID != id
+		})
+		sort.SliceStable(heirs, func(i, j int) bool {
+			if (heirs[i].Role == db.OrgRoleAdmin) != (heirs[j].Role == db.OrgRoleAdmin) {
+				return heirs[i].Role == db.OrgRoleAdmin
+			}
+			return heirs[i].CreatedAt.Before(heirs[j].CreatedAt)
+		})
+		if len(heirs) > 0 {
+			heirs[0].Role = db.OrgRoleOwner
+		}
+	}
+
+	// Lockout details name the username the attempts were made against
+	for _, row := range r.securityEvents {
+		if row.UserID != nil && *row.UserID == id {
+			delete(row.Detail, "key")
+		}
+	}
+	delete(r.throttles, "login:"+strings.ToLower(r.users[id].Username))
+
+	delete(r.users, id)
+	delete(r.metadata, id)
+	delete(r.preferences, id)
+	delete(r.instructions, id)
+	delete(r.totp, id)
+	for _, row := range r.chats {
+		if row.UserID == id {
+			row.UserID = uuid.Nil
+		}
+	}
+	for _, row := range r.messages {
+		if row.UserID == id {
+			row.UserID = uuid.Nil
+		}
+	}
+	for _, row := range r.jobs {
+		if row.UserID == id {
+			r.deleteJob(row.ID)
+		}
+	}
+	for _, row := range r.schedules {
+		if row.UserID == id {
+			r.deleteSchedule(row.ID)
+		}
+	}
+	for _, row := range r.sessions {
+		if row.UserID == id {
+			r.deleteSession(row.ID)
+		}
+	}
+	deleteRows(r.refreshTokens, func(row *refreshTokenRow) bool { return row.UserID == id })
+	deleteRows(r.emailTokens, func(row *emailTokenRow) bool { return row.UserID == id })
+	deleteRows(r.recoveryCodes, func(row *recoveryCodeRow) bool { return row.userID == id })
+	deleteRows(r.apiKeys, func(row *apiKeyRow) bool { return row.UserID == id })
+	deleteRows(r.identities, func(row *identityRow) bool { return row.UserID == id })
+	deleteRows(r.webauthnCredentials, func(row *webauthnCredentialRow) bool { return row.UserID == id })
+	deleteRows(r.webauthnChallenges, func(row *webauthnChallengeRow) bool { return row.UserID != nil && *row.UserID == id })
+	deleteRows(r.orgMembers, func(row *orgMemberRow) bool { return row.UserID == id })
+	deleteRows(r.dataExports, func(row *dataExportRow) bool { return row.UserID == id })
+	for _, row := range r.securityEvents {
+		if row.UserID != nil && *row.UserID == id {
+			row.UserID = nil
+		}
+		if row.ActorID != nil && *row.ActorID == id {
+			row.ActorID = nil
+		}
+	}
+	for _, row := range r.orgs {
+		if row.CreatedBy != nil && *row.CreatedBy == id {
+			row.CreatedBy = nil
+		}
+	}
+	for _, row := range r.workspacePatterns {
+		if row.CreatedBy != nil && *row.CreatedBy == id {
+			row.CreatedBy = nil
+		}
+	}
+
+	for _, org := range r.orgs {
+		if len(selectRows(r.orgMembers, func(row *orgMemberRow) bool { return row.OrganizationID == org.ID })) == 0 {
+			r.deleteOrganization(org.ID)
+		}
+	}
+}
+
+// exportFile is one file of GetUserExportFiles. Its rows marshal to the same
+// JSON objects as the Postgres export queries.
+func exportFile(name string, rows interface{}) (models.ExportFile, error) {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return models.ExportFile{}, fmt.Errorf("failed to export %s: %v", name, err)
+	}
+	return models.ExportFile{Name: name, Data: data}, nil
+}
+
+type exportProfile struct {
+	ID                  uuid.UUID  `json:"id"`
+	Username            string     `json:"username"`
+	Email               string     `json:"email"`
+	CreatedAt           time.Time  `json:"created_at"`
+	LastLogin           *time.Time `json:"last_login"`
+	IsActive            bool       `json:"is_active"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at"`
+	Role                string     `json:"role"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at"`
+}
+
+type exportMetadata struct {
+	PreferredLanguage string    `json:"preferred_language"`
+	Timezone          string    `json:"timezone"`
+	Interests         []string  `json:"interests"`
+	Profession        string    `json:"profession"`
+	EducationLevel    string    `json:"education_level"`
+	BirthYear         int       `json:"birth_year"`
+	Country           string    `json:"country"`
+	LastUpdated       time.Time `json:"last_updated"`
+}
+
+type exportPreferences struct {
+	DefaultAIModel       *uuid.UUID `json:"default_ai_model"`
+	Theme                string     `json:"theme"`
+	MessageDisplayCount  int        `json:"message_display_count"`
+	NotificationsEnabled bool       `json:"notifications_enabled"`
+}
+
+type exportInstructions struct {
+	Instructions   string    `json:"instructions"`
+	MetadataFields []string  `json:"metadata_fields"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type exportChat struct {
+	ID             uuid.UUID  `json:"id"`
+	Title          string     `json:"title"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUpdated    time.Time  `json:"last_updated"`
+	IsArchived     bool       `json:"is_archived"`
+	AIModelVersion string     `json:"ai_model_version"`
+	WorkspaceID    *uuid.UUID `json:"workspace_id"`
+	DeletedAt      *time.Time `json:"deleted_at"`
+}
+
+type exportMessage struct {
+	ID        uuid.UUID  `json:"id"`
+	ChatID    uuid.UUID  `json:"chat_id"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	IsEdited  bool       `json:"is_edited"`
+	Status    string     `json:"status"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+type exportUsage struct {
+	AIModelVersion string    `json:"ai_model_version"`
+	Role           string    `json:"role"`
+	Messages       int       `json:"messages"`
+	Characters     int       `json:"characters"`
+	FirstUsedAt    time.Time `json:"first_used_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+}
+
+type exportJob struct {
+	ID             uuid.UUID         `json:"id"`
+	Pattern        string            `json:"pattern"`
+	Variables      map[string]string `json:"variables"`
+	AIModelVersion string            `json:"ai_model_version"`
+	Status         string            `json:"status"`
+	CreatedAt      time.Time         `json:"created_at"`
+	FinishedAt     *time.Time        `json:"finished_at"`
+}
+
+type exportJobItem struct {
+	JobID    uuid.UUID `json:"job_id"`
+	Position int       `json:"position"`
+	Input    string    `json:"input"`
+	Output   string    `json:"output"`
+	Error    string    `json:"error"`
+	Status   string    `json:"status"`
+}
+
+type exportSchedule struct {
+	ID             uuid.UUID         `json:"id"`
+	Name           string            `json:"name"`
+	CronExpression string            `json:"cron_expression"`
+	Pattern        string            `json:"pattern"`
+	Prompt         string            `json:"prompt"`
+	Variables      map[string]string `json:"variables"`
+	AIModelVersion string            `json:"ai_model_version"`
+	ChatID         *uuid.UUID        `json:"chat_id"`
+	AppendToChat   bool              `json:"append_to_chat"`
+	IsActive       bool              `json:"is_active"`
+	NextRunAt      time.Time         `json:"next_run_at"`
+	LastRunAt      *time.Time        `json:"last_run_at"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+type exportScheduleRun struct {
+	ScheduleID uuid.UUID  `json:"schedule_id"`
+	ChatID     *uuid.UUID `json:"chat_id"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+type exportOrganization struct {
+	ID       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type exportWorkspacePattern struct {
+	WorkspaceID  uuid.UUID `json:"workspace_id"`
+	Name         string    `json:"name"`
+	SystemPrompt string    `json:"system_prompt"`
+	UserPrompt   string    `json:"user_prompt"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type exportSession struct {
+	ID         uuid.UUID  `json:"id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type exportAPIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type exportIdentity struct {
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email"`
+	Groups      []string  `json:"groups"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+type exportPasskey struct {
+	ID                uuid.UUID  `json:"id"`
+	Name              string     `json:"name"`
+	AttestationFormat string     `json:"attestation_format"`
+	Transports        []string   `json:"transports"`
+	BackupEligible    bool       `json:"backup_eligible"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at"`
+}
+
+type exportSecurityEvent struct {
+	ID        uuid.UUID         `json:"id"`
+	EventType string            `json:"event_type"`
+	IPAddress string            `json:"ip_address"`
+	Detail    map[string]string `json:"detail"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// byTime orders list by at, keeping insert order for equal times
+func byTime[R any](list []R, at func(R) time.Time) []R {
+	sort.SliceStable(list, func(i, j int) bool { return at(list[i]).Before(at(list[j])) })
+	return list
+}
+
+// GetUserExportFiles reads everything stored about the user, in the files and
+// with the fields of the Postgres export. Secrets are left out.
+func (r *Repository) GetUserExportFiles(ctx context.Context, userID uuid.UUID) ([]models.ExportFile, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	profile := []exportProfile{}
+	if row, ok := r.users[userID]; ok {
+		profile = append(profile, exportProfile{row.ID, row.Username, row.Email, row.CreatedAt, row.LastLogin, row.IsActive, row.EmailVerifiedAt, row.Role, row.DeletionScheduledAt})
+	}
+	metadata := []exportMetadata{}
+	if row, ok := r.metadata[userID]; ok {
+		metadata = append(metadata, exportMetadata{row.PreferredLanguage, row.Timezone, row.Interests, row.Profession, row.EducationLevel, row.BirthYear, row.Country, row.LastUpdated})
+	}
+	preferences := []exportPreferences{}
+	if row, ok := r.preferences[userID]; ok {
+		preferences = append(preferences, exportPreferences{row.DefaultAIModel, row.Theme, row.MessageDisplayCount, row.NotificationsEnabled})
+	}
+	instructions := []exportInstructions{}
+	if row, ok := r.instructions[userID]; ok {
+		instructions = append(instructions, exportInstructions{row.Instructions, row.MetadataFields, row.UpdatedAt})
+	}
+
+	chats := []exportChat{}
+	for _, row := range byTime(selectRows(r.chats, func(row *chatRow) bool { return row.UserID == userID }), func(row *chatRow) time.Time { return row.CreatedAt }) {
+		chats = append(chats, exportChat{row.ID, row.Title, row.CreatedAt, row.LastUpdated, row.IsArchived, row.AIModelVersion, row.WorkspaceID, row.DeletedAt})
+	}
+
+	list := selectRows(r.messages, func(row *messageRow) bool {
+		chat := r.chats[row.ChatID]
+		return row.UserID == userID || (chat.UserID == userID && chat.WorkspaceID == nil)
+	})
+	byTime(list, func(row *messageRow) time.Time { return row.CreatedAt })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].ChatID.String() < list[j].ChatID.String() })
+	messages := []exportMessage{}
+	for _, row := range list {
+		messages = append(messages, exportMessage{row.ID, row.ChatID, row.Role, row.Content, row.CreatedAt, row.IsEdited, row.Status, row.DeletedAt})
+	}
+
+	usage := []exportUsage{}
+	for _, row := range list {
+		if row.UserID != userID {
+			continue
+		}
+		version := r.chats[row.ChatID].AIModelVersion
+		i := 0
+		for i < len(usage) && (usage[i].AIModelVersion != version || usage[i].Role != row.Role) {
+			i++
+		}
+		if i == len(usage) {
+			usage = append(usage, exportUsage{AIModelVersion: version, Role: row.Role, FirstUsedAt: row.CreatedAt, LastUsedAt: row.CreatedAt})
+		}
+		usage[i].Messages++
+		usage[i].Characters += utf8.RuneCountInString(row.Content)
+		if row.CreatedAt.Before(usage[i].FirstUsedAt) {
+			usage[i].FirstUsedAt = row.CreatedAt
+		}
+		if row.CreatedAt.After(usage[i].LastUsedAt) {
+			usage[i].LastUsedAt = row.CreatedAt
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].AIModelVersion != usage[j].AIModelVersion {
+			return usage[i].AIModelVersion < usage[j].AIModelVersion
+		}
+		return usage[i].Role < usage[j].Role
+	})
+
+	jobs := []exportJob{}
+	jobItems := []exportJobItem{}
+	for _, row := range byTime(selectRows(r.jobs, func(row *jobRow) bool { return row.UserID == userID }), func(row *jobRow) time.Time { return row.CreatedAt }) {
+		jobs = append(jobs, exportJob{row.ID, row.Pattern, row.Variables, row.AIModelVersion, row.Status, row.CreatedAt, row.FinishedAt})
+		for _, item := range r.jobItemsOf(row.ID) {
+			jobItems = append(jobItems, exportJobItem{item.JobID, item.Position, item.Input, item.Output, item.Error, item.Status})
+		}
+	}
+	sort.SliceStable(jobItems, func(i, j int) bool { return jobItems[i].JobID.String() < jobItems[j].JobID.String() })
+
+	schedules := []exportSchedule{}
+	for _, row := range byTime(selectRows(r.schedules, func(row *scheduleRow) bool { return row.UserID == userID }), func(row *scheduleRow) time.Time { return row.CreatedAt }) {
+		schedules = append(schedules, exportSchedule{row.ID, row.Name, row.CronExpression, row.Pattern, row.Prompt, row.Variables, row.AIModelVersion, row.ChatID, row.AppendToChat, row.IsActive, row.NextRunAt, row.LastRunAt, row.CreatedAt})
+	}
+	scheduleRuns := []exportScheduleRun{}
+	runs := selectRows(r.scheduleRuns, func(row *scheduleRunRow) bool {
+		schedule, ok := r.schedules[row.ScheduleID]
+		return ok && schedule.UserID == userID
+	})
+	for _, row := range byTime(runs, func(row *scheduleRunRow) time.Time { return row.StartedAt }) {
+		scheduleRuns = append(scheduleRuns, exportScheduleRun{row.ScheduleID, row.ChatID, row.Status, row.Error, row.StartedAt, row.FinishedAt})
+	}
+
+	orgs := []exportOrganization{}
+	for _, row := range selectRows(r.orgMembers, func(row *orgMemberRow) bool { return row.UserID == userID }) {
+		org := r.orgs[row.OrganizationID]
+		orgs = append(orgs, exportOrganization{org.ID, org.Name, row.Role, row.CreatedAt})
+	}
+	sort.SliceStable(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+
+	patterns := []exportWorkspacePattern{}
+	for _, row := range selectRows(r.workspacePatterns, func(row *workspacePatternRow) bool { return row.CreatedBy != nil && *row.CreatedBy == userID }) {
+		patterns = append(patterns, exportWorkspacePattern{row.WorkspaceID, row.Name, row.System, row.User, row.CreatedAt, row.UpdatedAt})
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		if patterns[i].WorkspaceID != patterns[j].WorkspaceID {
+			return patterns[i].WorkspaceID.String() < patterns[j].WorkspaceID.String()
+		}
+		return patterns[i].Name < patterns[j].Name
+	})
+
+	sessions := []exportSession{}
+	for _, row := range byTime(selectRows(r.sessions, func(row *sessionRow) bool { return row.UserID == userID }), func(row *sessionRow) time.Time { return row.CreatedAt }) {
+		sessions = append(sessions, exportSession{row.ID, row.UserAgent, row.IPAddress, row.CreatedAt, row.LastUsedAt, row.RevokedAt})
+	}
+	apiKeys := []exportAPIKey{}
+	for _, row := range byTime(selectRows(r.apiKeys, func(row *apiKeyRow) bool { return row.UserID == userID }), func(row *apiKeyRow) time.Time { return row.CreatedAt }) {
+		apiKeys = append(apiKeys, exportAPIKey{row.ID, row.Name, row.Prefix, row.Scopes, row.CreatedAt, row.ExpiresAt, row.LastUsedAt, row.RevokedAt})
+	}
+	identities := []exportIdentity{}
+	for _, row := range byTime(selectRows(r.identities, func(row *identityRow) bool { return row.UserID == userID }), func(row *identityRow) time.Time { return row.CreatedAt }) {
+		identities = append(identities, exportIdentity{row.Provider, row.Subject, row.Email, row.Groups, row.CreatedAt, row.LastLoginAt})
+	}
+	passkeys := []exportPasskey{}
+	for _, row := range byTime(selectRows(r.webauthnCredentials, func(row *webauthnCredentialRow) bool { return row.UserID == userID }), func(row *webauthnCredentialRow) time.Time { return row.CreatedAt }) {
+		passkeys = append(passkeys, exportPasskey{row.ID, row.Name, row.AttestationFormat, row.Transports, row.BackupEligible, row.CreatedAt, row.LastUsedAt})
+	}
+	events := []exportSecurityEvent{}
+	for _, row := range byTime(selectRows(r.securityEvents, func(row *securityEventRow) bool { return row.UserID != nil && *row.UserID == userID }), func(row *securityEventRow) time.Time { return row.CreatedAt }) {
+		events = append(events, exportSecurityEvent{row.ID, row.EventType, row.IPAddress, row.Detail, row.CreatedAt})
+	}
+
+	exports := []struct {
+		name string
+		rows interface{}
+	}{
+		{"profile.json", profile},
+		{"metadata.json", metadata},
+		{"preferences.json", preferences},
+		{"custom_instructions.json", instructions},
+		{"chats.json", chats},
+		{"messages.json", messages},
+		{"usage.json", usage},
+		{"jobs.json", jobs},
+		{"job_items.json", jobItems},
+		{"schedules.json", schedules},
+		{"schedule_runs.json", scheduleRuns},
+		{"organizations.json", orgs},
+		{"workspace_patterns.json", patterns},
+		{"sessions.json", sessions},
+		{"api_keys.json", apiKeys},
+		{"identities.json", identities},
+		{"passkeys.json", passkeys},
+		{"security_events.json", events},
+	}
+	files := make([]models.ExportFile, 0, len(exports))
+	for _, export := range exports {
+		file, err := exportFile(export.name, export.rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+type dataExportRow struct {
+	inserted
+	models.DataExport
+	archive   []byte
+	startedAt *time.Time
+}
+
+// CreateDataExport queues an export unless the user already has one queued or running
+func (r *Repository) CreateDataExport(ctx context.Context, userID uuid.UUID) (*models.DataExport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, row := range r.dataExports {
+		if row.UserID == userID && (row.Status == db.ExportStatusQueued || row.Status == db.ExportStatusRunning) {
+			return nil, db.ErrExportInProgress
+		}
+	}
+	if !r.userExists(userID) {
+		return nil, fmt.Errorf("failed to create data export: %v", errForeignKey)
+	}
+	row := &dataExportRow{inserted: r.insert(), DataExport: models.DataExport{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Status:    db.ExportStatusQueued,
+		CreatedAt: time.Now(),
+	}}
+	r.dataExports[row.ID] = row
+	return &models.DataExport{ID: row.ID, UserID: row.UserID, Status: row.Status, CreatedAt: row.CreatedAt}, nil
+}
+
+func (r *Repository) GetDataExportsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.DataExport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.dataExports, func(row *dataExportRow) bool { return row.UserID == userID })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	exports := []*models.DataExport{}
+	for _, row := range list {
+		export := row.DataExport
+		exports = append(exports, &export)
+	}
+	return exports, nil
+}
+
+// GetDataExportArchive returns the zip of a finished export belonging to userID
+func (r *Repository) GetDataExportArchive(ctx context.Context, id uuid.UUID, userID uuid.UUID) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.dataExports[id]
+	if !ok || row.UserID != userID || row.Status != db.ExportStatusDone || row.ExpiresAt == nil || !row.ExpiresAt.After(time.Now()) {
+		return nil, db.ErrExportNotFound
+	}
+	return row.archive, nil
+}
+
+// ClaimDataExport marks the oldest queued export running and returns it, or
+// nil if there is none. Exports left running longer than staleAfter are claimed again.
+func (r *Repository) ClaimDataExport(ctx context.Context, staleAfter time.Duration) (*models.DataExport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stale := time.Now().Add(-staleAfter)
+	list := selectRows(r.dataExports, func(row *dataExportRow) bool {
+		return row.Status == db.ExportStatusQueued ||
+			(row.Status == db.ExportStatusRunning && row.startedAt != nil && row.startedAt.Before(stale))
+	})
+	if len(list) == 0 {
+		return nil, nil
+	}
+	row := byTime(list, func(row *dataExportRow) time.Time { return row.CreatedAt })[0]
+	row.Status = db.ExportStatusRunning
+	row.startedAt = timePtr(time.Now())
+	export := row.DataExport
+	return &export, nil
+}
+
+func (r *Repository) CompleteDataExport(ctx context.Context, id uuid.UUID, archive []byte, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.dataExports[id]; ok {
+		row.Status = db.ExportStatusDone
+		row.archive = archive
+		row.Size = int64(len(archive))
+		row.FinishedAt = timePtr(time.Now())
+		row.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+func (r *Repository) FailDataExport(ctx context.Context, id uuid.UUID, cause string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.dataExports[id]; ok {
+		row.Status = db.ExportStatusFailed
+		row.Error = cause
+		row.FinishedAt = timePtr(time.Now())
+		row.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+func (r *Repository) DeleteExpiredDataExports(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.dataExports, func(row *dataExportRow) bool {
+		return row.ExpiresAt != nil && row.ExpiresAt.Before(now)
+	}), nil
+}
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type apiKeyRow struct {
+	inserted
+	models.APIKey
+}
+
+func apiKey(row *apiKeyRow) *models.APIKey {
+	key := row.APIKey
+	key.Scopes = slices.Clone(row.Scopes)
+	return &key
+}
+
+func (r *Repository) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(key.UserID) {
+		return fmt.Errorf("failed to create api key: %v", errForeignKey)
+	}
+	if key.Scopes == nil {
+		return fmt.Errorf("failed to create api key: scopes is null")
+	}
+	for _, row := range r.apiKeys {
+		if row.KeyHash == key.KeyHash {
+			return fmt.Errorf("failed to create api key: %v", errUnique)
+		}
+	}
+	key.ID = uuid.New()
+	key.CreatedAt = time.Now()
+	r.apiKeys[key.ID] = &apiKeyRow{inserted: r.insert(), APIKey: models.APIKey{
+		ID:        key.ID,
+		UserID:    key.UserID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		KeyHash:   key.KeyHash,
+		Scopes:    slices.Clone(key.Scopes),
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}}
+	return nil
+}
+
+// GetActiveAPIKeyByHash finds a key that is neither revoked nor expired and whose owner is active
+func (r *Repository) GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, row := range r.apiKeys {
+		if row.KeyHash != keyHash || row.RevokedAt != nil || (row.ExpiresAt != nil && !row.ExpiresAt.After(now)) {
+			continue
+		}
+		if user, ok := r.users[row.UserID]; ok && user.IsActive {
+			return apiKey(row), nil
+		}
+	}
+	return nil, db.ErrAPIKeyInvalid
+}
+
+// GetAPIKeysByUserID lists a user's keys that have not been revoked, newest first
+func (r *Repository) GetAPIKeysByUserID(ctx context.Context, userID uuid.UUID) ([]*models.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.apiKeys, func(row *apiKeyRow) bool { return row.UserID == userID && row.RevokedAt == nil })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	keys := []*models.APIKey{}
+	for _, row := range list {
+		keys = append(keys, apiKey(row))
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys, returning false if they have no such key
+func (r *Repository) RevokeAPIKey(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.apiKeys[id]
+	if !ok || row.UserID != userID || row.RevokedAt != nil {
+		return false, nil
+	}
+	row.RevokedAt = timePtr(time.Now())
+	return true, nil
+}
+
+// TouchAPIKey records that a key was used. It writes at most once a minute per key.
+func (r *Repository) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if row, ok := r.apiKeys[id]; ok && (row.LastUsedAt == nil || row.LastUsedAt.Before(now.Add(-time.Minute))) {
+		row.LastUsedAt = &now
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type throttleRow struct {
+	inserted
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   *time.Time
+}
+
+type securityEventRow struct {
+	inserted
+	models.SecurityEvent
+}
+
+// IncrementAuthThrottle counts an attempt against key and returns the
+// number counted so far. Attempts older than window are forgotten.
+func (r *Repository) IncrementAuthThrottle(ctx context.Context, key string, window time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	row, ok := r.throttles[key]
+	if !ok {
+		row = &throttleRow{inserted: r.insert()}
+		r.throttles[key] = row
+	}
+	if row.lastFailureAt.Before(now.Add(-window)) {
+		row.failures = 1
+	} else {
+		row.failures++
+	}
+	row.lastFailureAt = now
+	return row.failures, nil
+}
+
+// LockAuthThrottle blocks attempts against key until the given time
+func (r *Repository) LockAuthThrottle(ctx context.Context, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.throttles[key]; ok {
+		row.lockedUntil = &until
+	}
+	return nil
+}
+
+// GetAuthLockedUntil returns the latest lock among keys that has not expired yet, or nil
+func (r *Repository) GetAuthLockedUntil(ctx context.Context, keys []string) (*time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var lockedUntil *time.Time
+	for _, key := range keys {
+		row, ok := r.throttles[key]
+		if !ok || row.lockedUntil == nil || !row.lockedUntil.After(now) {
+			continue
+		}
+		if lockedUntil == nil || row.lockedUntil.After(*lockedUntil) {
+			lockedUntil = timePtr(*row.lockedUntil)
+		}
+	}
+	return lockedUntil, nil
+}
+
+// ClearAuthThrottle forgets failures against key, after a successful login or an admin unlock.
+// It reports whether there was anything to forget.
+func (r *Repository) ClearAuthThrottle(ctx context.Context, key string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.throttles[key]
+	delete(r.throttles, key)
+	return ok, nil
+}
+
+// DeleteStaleAuthThrottles removes unlocked entries with no failure within window
+func (r *Repository) DeleteStaleAuthThrottles(ctx context.Context, window time.Duration) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-window)
+	return deleteRows(r.throttles, func(row *throttleRow) bool {
+		return row.lastFailureAt.Before(cutoff) && (row.lockedUntil == nil || row.lockedUntil.Before(now))
+	}), nil
+}
+
+func (r *Repository) CreateSecurityEvent(ctx context.Context, event *models.SecurityEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if event.Detail == nil {
+		event.Detail = map[string]string{}
+	}
+	if (event.UserID != nil && !r.userExists(*event.UserID)) || (event.ActorID != nil && !r.userExists(*event.ActorID)) {
+		return fmt.Errorf("failed to create security event: %v", errForeignKey)
+	}
+	event.ID = uuid.New()
+	event.CreatedAt = time.Now()
+	row := &securityEventRow{inserted: r.insert(), SecurityEvent: *event}
+	row.Detail = maps.Clone(event.Detail)
+	r.securityEvents[event.ID] = row
+	return nil
+}
+
+// GetSecurityEvents pages through events newest first, optionally only those about userID
+func (r *Repository) GetSecurityEvents(ctx context.Context, userID *uuid.UUID, limit int, offset int) ([]*models.SecurityEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.securityEvents, func(row *securityEventRow) bool {
+		return userID == nil || (row.UserID != nil && *row.UserID == *userID)
+	})
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		}
+		return list[i].order() > list[j].order()
+	})
+	events := []*models.SecurityEvent{}
+	for _, row := range page(list, limit, offset) {
+		event := row.SecurityEvent
+		event.Detail = maps.Clone(row.Detail)
+		events = append(events, &event)
+	}
+	return events, nil
+}
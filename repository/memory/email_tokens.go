@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type emailTokenRow struct {
+	inserted
+	models.EmailToken
+}
+
+// CreateEmailToken stores a new token, invalidating older unused tokens for the same purpose
+func (r *Repository) CreateEmailToken(ctx context.Context, token *models.EmailToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(token.UserID) {
+		return fmt.Errorf("failed to create email token: %v", errForeignKey)
+	}
+	for _, row := range r.emailTokens {
+		if row.TokenHash == token.TokenHash {
+			return fmt.Errorf("failed to create email token: %v", errUnique)
+		}
+	}
+	now := time.Now()
+	for _, row := range r.emailTokens {
+		if row.UserID == token.UserID && row.Purpose == token.Purpose && row.UsedAt == nil {
+			row.UsedAt = &now
+		}
+	}
+	token.ID = uuid.New()
+	token.CreatedAt = now
+	r.emailTokens[token.ID] = &emailTokenRow{inserted: r.insert(), EmailToken: models.EmailToken{
+		ID:        token.ID,
+		UserID:    token.UserID,
+		Purpose:   token.Purpose,
+		TokenHash: token.TokenHash,
+		CreatedAt: now,
+		ExpiresAt: token.ExpiresAt,
+	}}
+	return nil
+}
+
+// ConsumeEmailToken marks an unexpired, unused token as used and returns its user
+func (r *Repository) ConsumeEmailToken(ctx context.Context, tokenHash string, purpose string) (uuid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, row := range r.emailTokens {
+		if row.TokenHash == tokenHash && row.Purpose == purpose && row.UsedAt == nil && row.ExpiresAt.After(now) {
+			row.UsedAt = &now
+			return row.UserID, nil
+		}
+	}
+	return uuid.Nil, db.ErrEmailTokenInvalid
+}
+
+// DeleteExpiredEmailTokens removes tokens that can no longer be used
+func (r *Repository) DeleteExpiredEmailTokens(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.emailTokens, func(row *emailTokenRow) bool {
+		return row.ExpiresAt.Before(now) || row.UsedAt != nil
+	}), nil
+}
+
+func (r *Repository) MarkEmailVerified(ctx context.Context, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.users[userID]; ok && row.EmailVerifiedAt == nil {
+		row.EmailVerifiedAt = timePtr(time.Now())
+	}
+	return nil
+}
+
+func (r *Repository) IsEmailVerified(ctx context.Context, userID uuid.UUID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[userID]
+	if !ok {
+		return false, fmt.Errorf("failed to check email verification: %v", errNoRows)
+	}
+	return row.EmailVerifiedAt != nil, nil
+}
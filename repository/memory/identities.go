@@ -0,0 +1,128 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type oidcStateRow struct {
+	inserted
+	models.OIDCLoginState
+}
+
+type identityRow struct {
+	inserted
+	models.UserIdentity
+}
+
+func identity(row *identityRow) *models.UserIdentity {
+	identity := row.UserIdentity
+	identity.Groups = slices.Clone(row.Groups)
+	return &identity
+}
+
+func (r *Repository) CreateOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.oidcStates[state.StateHash]; ok {
+		return fmt.Errorf("failed to create oidc login state: %v", errUnique)
+	}
+	r.oidcStates[state.StateHash] = &oidcStateRow{inserted: r.insert(), OIDCLoginState: *state}
+	return nil
+}
+
+// ConsumeOIDCLoginState deletes and returns an unexpired state, so each login attempt completes once
+func (r *Repository) ConsumeOIDCLoginState(ctx context.Context, stateHash string, provider string) (*models.OIDCLoginState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.oidcStates[stateHash]
+	if !ok || row.Provider != provider || !row.ExpiresAt.After(time.Now()) {
+		return nil, db.ErrOIDCStateInvalid
+	}
+	delete(r.oidcStates, stateHash)
+	state := row.OIDCLoginState
+	return &state, nil
+}
+
+// DeleteExpiredOIDCLoginStates removes logins that were abandoned at the identity provider
+func (r *Repository) DeleteExpiredOIDCLoginStates(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.oidcStates, func(row *oidcStateRow) bool { return row.ExpiresAt.Before(now) }), nil
+}
+
+func (r *Repository) identityBySubject(provider string, subject string) *identityRow {
+	for _, row := range r.identities {
+		if row.Provider == provider && row.Subject == subject {
+			return row
+		}
+	}
+	return nil
+}
+
+func (r *Repository) GetUserIDByIdentity(ctx context.Context, provider string, subject string) (uuid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row := r.identityBySubject(provider, subject)
+	if row == nil {
+		return uuid.Nil, db.ErrIdentityNotFound
+	}
+	return row.UserID, nil
+}
+
+// UpsertIdentity links an identity to a user, or refreshes the email and
+// groups of an existing link after a login
+func (r *Repository) UpsertIdentity(ctx context.Context, identity *models.UserIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if identity.Groups == nil {
+		identity.Groups = []string{}
+	}
+	now := time.Now()
+	if row := r.identityBySubject(identity.Provider, identity.Subject); row != nil {
+		row.Email = identity.Email
+		row.Groups = slices.Clone(identity.Groups)
+		row.LastLoginAt = now
+		identity.ID = row.ID
+		identity.UserID = row.UserID
+		identity.CreatedAt = row.CreatedAt
+		identity.LastLoginAt = now
+		return nil
+	}
+
+	if !r.userExists(identity.UserID) {
+		return fmt.Errorf("failed to save identity: %v", errForeignKey)
+	}
+	identity.ID = uuid.New()
+	identity.CreatedAt = now
+	identity.LastLoginAt = now
+	row := &identityRow{inserted: r.insert(), UserIdentity: *identity}
+	row.Groups = slices.Clone(identity.Groups)
+	r.identities[identity.ID] = row
+	return nil
+}
+
+func (r *Repository) GetIdentitiesByUserID(ctx context.Context, userID uuid.UUID) ([]*models.UserIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := byTime(selectRows(r.identities, func(row *identityRow) bool { return row.UserID == userID }),
+		func(row *identityRow) time.Time { return row.CreatedAt })
+	identities := []*models.UserIdentity{}
+	for _, row := range list {
+		identities = append(identities, identity(row))
+	}
+	return identities, nil
+}
@@ -0,0 +1,229 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type jobRow struct {
+	inserted
+	models.Job
+}
+
+type jobItemRow struct {
+	inserted
+	models.JobItem
+	runAfter time.Time
+}
+
+// CreateJob inserts a job and one queued item per input
+func (r *Repository) CreateJob(ctx context.Context, job *models.Job, inputs []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(job.UserID) {
+		return fmt.Errorf("failed to create job: %v", errForeignKey)
+	}
+	now := time.Now()
+	job.ID = uuid.New()
+	job.Status = db.JobStatusQueued
+	job.CreatedAt = now
+	row := &jobRow{inserted: r.insert(), Job: *job}
+	row.Variables = maps.Clone(job.Variables)
+	r.jobs[job.ID] = row
+
+	for i, input := range inputs {
+		item := &jobItemRow{inserted: r.insert(), runAfter: now, JobItem: models.JobItem{
+			ID:        uuid.New(),
+			JobID:     job.ID,
+			Position:  i,
+			Input:     input,
+			Status:    db.JobStatusQueued,
+			UpdatedAt: now,
+		}}
+		r.jobItems[item.ID] = item
+	}
+	job.TotalItems = len(inputs)
+	return nil
+}
+
+// jobItemsOf returns the job's items in input order
+func (r *Repository) jobItemsOf(jobID uuid.UUID) []*jobItemRow {
+	items := selectRows(r.jobItems, func(row *jobItemRow) bool { return row.JobID == jobID })
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Position < items[j].Position })
+	return items
+}
+
+// job returns a copy of the job with its item counts
+func (r *Repository) job(row *jobRow) *models.Job {
+	job := row.Job
+	job.Variables = maps.Clone(row.Variables)
+	job.TotalItems, job.CompletedItems, job.FailedItems = 0, 0, 0
+	for _, item := range r.jobItemsOf(row.ID) {
+		job.TotalItems++
+		switch item.Status {
+		case db.JobStatusCompleted:
+			job.CompletedItems++
+		case db.JobStatusFailed:
+			job.FailedItems++
+		}
+	}
+	return &job
+}
+
+func (r *Repository) deleteJob(id uuid.UUID) {
+	delete(r.jobs, id)
+	deleteRows(r.jobItems, func(row *jobItemRow) bool { return row.JobID == id })
+}
+
+// GetJobByID retrieves a job along with its item counts
+func (r *Repository) GetJobByID(ctx context.Context, id uuid.UUID) (*models.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get job by ID: %v", errNoRows)
+	}
+	return r.job(row), nil
+}
+
+// GetJobsByUserID retrieves a user's jobs, newest first
+func (r *Repository) GetJobsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.jobs, func(row *jobRow) bool { return row.UserID == userID })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	var jobs []*models.Job
+	for _, row := range list {
+		jobs = append(jobs, r.job(row))
+	}
+	return jobs, nil
+}
+
+// GetJobItems retrieves a page of a job's items in input order
+func (r *Repository) GetJobItems(ctx context.Context, jobID uuid.UUID, offset, limit int) ([]*models.JobItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var items []*models.JobItem
+	for _, row := range page(r.jobItemsOf(jobID), limit, offset) {
+		item := row.JobItem
+		items = append(items, &item)
+	}
+	return items, nil
+}
+
+// ClaimJobItems marks up to limit runnable items as running and returns them
+func (r *Repository) ClaimJobItems(ctx context.Context, limit int) ([]*models.JobItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	runnable := selectRows(r.jobItems, func(row *jobItemRow) bool {
+		return row.Status == db.JobStatusQueued && !row.runAfter.After(now)
+	})
+
+	var items []*models.JobItem
+	for _, row := range page(runnable, limit, 0) {
+		row.Status = db.JobStatusRunning
+		row.Attempts++
+		row.UpdatedAt = now
+		items = append(items, &models.JobItem{
+			ID:        row.ID,
+			JobID:     row.JobID,
+			Position:  row.Position,
+			Input:     row.Input,
+			Status:    row.Status,
+			Attempts:  row.Attempts,
+			UpdatedAt: row.UpdatedAt,
+		})
+		if job, ok := r.jobs[row.JobID]; ok && job.Status == db.JobStatusQueued {
+			job.Status = db.JobStatusRunning
+		}
+	}
+	return items, nil
+}
+
+// CompleteJobItem stores the output of a finished item
+func (r *Repository) CompleteJobItem(ctx context.Context, item *models.JobItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.jobItems[item.ID]; ok {
+		row.Status = db.JobStatusCompleted
+		row.Output = item.Output
+		row.Error = ""
+		row.UpdatedAt = time.Now()
+	}
+	r.finishJobIfDone(item.JobID)
+	return nil
+}
+
+// FailJobItem records an error and requeues the item at retryAt, or fails it for good when retryAt is nil
+func (r *Repository) FailJobItem(ctx context.Context, item *models.JobItem, retryAt *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.jobItems[item.ID]; ok {
+		row.Status = db.JobStatusFailed
+		if retryAt != nil {
+			row.Status = db.JobStatusQueued
+			row.runAfter = *retryAt
+		}
+		row.Error = item.Error
+		row.UpdatedAt = time.Now()
+	}
+	r.finishJobIfDone(item.JobID)
+	return nil
+}
+
+// RequeueStaleJobItems puts back items left running by a worker that went
+// away, failing those that have used maxAttempts
+func (r *Repository) RequeueStaleJobItems(ctx context.Context, olderThan time.Duration, maxAttempts int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var requeued int64
+	for _, row := range r.jobItems {
+		if row.Status == db.JobStatusRunning && row.UpdatedAt.Before(now.Add(-olderThan)) {
+			row.Status = db.JobStatusQueued
+			if row.Attempts >= maxAttempts {
+				row.Status = db.JobStatusFailed
+			}
+			row.Error = db.StaleJobItemError
+			row.UpdatedAt = now
+			requeued++
+			r.finishJobIfDone(row.JobID)
+		}
+	}
+	return requeued, nil
+}
+
+// finishJobIfDone closes out a job once none of its items are left to run
+func (r *Repository) finishJobIfDone(jobID uuid.UUID) {
+	job, ok := r.jobs[jobID]
+	if !ok || job.FinishedAt != nil {
+		return
+	}
+	status := db.JobStatusCompleted
+	for _, item := range r.jobItemsOf(jobID) {
+		switch item.Status {
+		case db.JobStatusQueued, db.JobStatusRunning:
+			return
+		case db.JobStatusFailed:
+			status = db.JobStatusFailed
+		}
+	}
+	job.Status = status
+	job.FinishedAt = timePtr(time.Now())
+}
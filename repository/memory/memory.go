@@ -0,0 +1,973 @@
+// Package memory keeps every table in process memory. It behaves like
+// db.PostgresRepository, including its cascades and errors, so the whole HTTP
+// API can run in tests and demos without Postgres. Nothing is persisted.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+)
+
+// The constraint errors Postgres would raise where the repository does not map them to its own
+var (
+	errNoRows     = errors.New("no rows in result set")
+	errForeignKey = errors.New("violates foreign key constraint")
+	errUnique     = errors.New("violates unique constraint")
+	errCheck      = errors.New("violates check constraint")
+)
+
+// Repository implements repository.Repository. One mutex guards every table,
+// so each method is atomic like the statement or transaction it stands in for.
+type Repository struct {
+	mu sync.Mutex
+	// seq numbers inserts across all tables, standing in for the pk columns
+	seq int
+	// userPK is the users pk serial that GetUserByID looks up
+	userPK int
+
+	users               map[uuid.UUID]*userRow
+	metadata            map[uuid.UUID]*metadataRow
+	preferences         map[uuid.UUID]*preferencesRow
+	instructions        map[uuid.UUID]*instructionsRow
+	chatInstructions    map[uuid.UUID]*chatInstructionsRow
+	chats               map[uuid.UUID]*chatRow
+	messages            map[uuid.UUID]*messageRow
+	aiModels            map[uuid.UUID]*aiModelRow
+	jobs                map[uuid.UUID]*jobRow
+	jobItems            map[uuid.UUID]*jobItemRow
+	schedules           map[uuid.UUID]*scheduleRow
+	scheduleRuns        map[uuid.UUID]*scheduleRunRow
+	sessions            map[uuid.UUID]*sessionRow
+	refreshTokens       map[uuid.UUID]*refreshTokenRow
+	emailTokens         map[uuid.UUID]*emailTokenRow
+	totp                map[uuid.UUID]*totpRow
+	recoveryCodes       map[uuid.UUID]*recoveryCodeRow
+	usedMFAChallenges   map[string]*usedMFAChallengeRow
+	apiKeys             map[uuid.UUID]*apiKeyRow
+	identities          map[uuid.UUID]*identityRow
+	oidcStates          map[string]*oidcStateRow
+	webauthnChallenges  map[string]*webauthnChallengeRow
+	webauthnCredentials map[uuid.UUID]*webauthnCredentialRow
+	throttles           map[string]*throttleRow
+	securityEvents      map[uuid.UUID]*securityEventRow
+	signingKeys         map[string]*signingKeyRow
+	roleSettings        map[string]*roleSettingRow
+	orgs                map[uuid.UUID]*orgRow
+	orgMembers          map[orgMemberKey]*orgMemberRow
+	workspaces          map[uuid.UUID]*workspaceRow
+	workspacePatterns   map[workspacePatternKey]*workspacePatternRow
+	workspaceModels     map[workspaceModelKey]*workspaceModelRow
+	dataExports         map[uuid.UUID]*dataExportRow
+}
+
+var _ repository.Repository = (*Repository)(nil)
+
+// New returns an empty repository
+func New() *Repository {
+	r := &Repository{
+		users:               map[uuid.UUID]*userRow{},
+		metadata:            map[uuid.UUID]*metadataRow{},
+		preferences:         map[uuid.UUID]*preferencesRow{},
+		instructions:        map[uuid.UUID]*instructionsRow{},
+		chatInstructions:    map[uuid.UUID]*chatInstructionsRow{},
+		chats:               map[uuid.UUID]*chatRow{},
+		messages:            map[uuid.UUID]*messageRow{},
+		aiModels:            map[uuid.UUID]*aiModelRow{},
+		jobs:                map[uuid.UUID]*jobRow{},
+		jobItems:            map[uuid.UUID]*jobItemRow{},
+		schedules:           map[uuid.UUID]*scheduleRow{},
+		scheduleRuns:        map[uuid.UUID]*scheduleRunRow{},
+		sessions:            map[uuid.UUID]*sessionRow{},
+		refreshTokens:       map[uuid.UUID]*refreshTokenRow{},
+		emailTokens:         map[uuid.UUID]*emailTokenRow{},
+		totp:                map[uuid.UUID]*totpRow{},
+		recoveryCodes:       map[uuid.UUID]*recoveryCodeRow{},
+		usedMFAChallenges:   map[string]*usedMFAChallengeRow{},
+		apiKeys:             map[uuid.UUID]*apiKeyRow{},
+		identities:          map[uuid.UUID]*identityRow{},
+		oidcStates:          map[string]*oidcStateRow{},
+		webauthnChallenges:  map[string]*webauthnChallengeRow{},
+		webauthnCredentials: map[uuid.UUID]*webauthnCredentialRow{},
+		throttles:           map[string]*throttleRow{},
+		securityEvents:      map[uuid.UUID]*securityEventRow{},
+		signingKeys:         map[string]*signingKeyRow{},
+		roleSettings:        map[string]*roleSettingRow{},
+		orgs:                map[uuid.UUID]*orgRow{},
+		orgMembers:          map[orgMemberKey]*orgMemberRow{},
+		workspaces:          map[uuid.UUID]*workspaceRow{},
+		workspacePatterns:   map[workspacePatternKey]*workspacePatternRow{},
+		workspaceModels:     map[workspaceModelKey]*workspaceModelRow{},
+		dataExports:         map[uuid.UUID]*dataExportRow{},
+	}
+
+	// Seeded like the role_settings migration
+	now := time.Now()
+	r.roleSettings["user"] = &roleSettingRow{inserted: r.insert(), RoleSetting: models.RoleSetting{Role: "user", UpdatedAt: now}}
+	r.roleSettings["admin"] = &roleSettingRow{inserted: r.insert(), RoleSetting: models.RoleSetting{Role: "admin", MFARequired: true, UpdatedAt: now}}
+	return r
+}
+
+func (r *Repository) Close() {}
+
+// inserted is embedded in every row to remember when it was inserted
+type inserted struct {
+	seq int
+}
+
+func (i inserted) order() int {
+	return i.seq
+}
+
+type ordered interface {
+	order() int
+}
+
+func (r *Repository) insert() inserted {
+	r.seq++
+	return inserted{seq: r.seq}
+}
+
+// selectRows returns the rows of table that keep accepts, in insert order
+func selectRows[K comparable, R ordered](table map[K]R, keep func(R) bool) []R {
+	var list []R
+	for _, row := range table {
+		if keep(row) {
+			list = append(list, row)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].order() < list[j].order() })
+	return list
+}
+
+// deleteRows removes the rows of table that match and returns how many it removed
+func deleteRows[K comparable, R any](table map[K]R, match func(R) bool) int64 {
+	var deleted int64
+	for key, row := range table {
+		if match(row) {
+			delete(table, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// page applies OFFSET and LIMIT to list
+func page[T any](list []T, limit int, offset int) []T {
+	if offset >= len(list) {
+		return list[:0]
+	}
+	list = list[offset:]
+	if limit >= 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func uuidPtr(id uuid.UUID) *uuid.UUID {
+	return &id
+}
+
+type userRow struct {
+	inserted
+	pk int
+	models.User
+}
+
+func (r *Repository) userExists(id uuid.UUID) bool {
+	_, ok := r.users[id]
+	return ok
+}
+
+// uniqueUser reports whether username and email are free for the user with id
+func (r *Repository) uniqueUser(id uuid.UUID, username string, email string) bool {
+	for _, row := range r.users {
+		if row.ID != id && (row.Username == username || row.Email == email) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repository) CreateUser(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.uniqueUser(uuid.Nil, user.Username, user.Email) {
+		return fmt.Errorf("failed to create user: %v", errUnique)
+	}
+	r.userPK++
+	row := &userRow{inserted: r.insert(), pk: r.userPK, User: models.User{
+		ID:           uuid.New(),
+		Username:     user.Username,
+		Email:        user.Email,
+		PasswordHash: user.PasswordHash,
+		CreatedAt:    time.Now(),
+		IsActive:     true,
+		Role:         "user",
+	}}
+	r.users[row.ID] = row
+	user.ID = row.ID
+	return nil
+}
+
+func (r *Repository) GetUserByID(ctx context.Context, id int) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, row := range r.users {
+		if row.pk == id {
+			return &models.User{ID: row.ID, Username: row.Username, Email: row.Email, PasswordHash: row.PasswordHash}, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get user by ID: %v", errNoRows)
+}
+
+func (r *Repository) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, row := range r.users {
+		if row.Username == username {
+			user := row.User
+			return &user, nil
+		}
+	}
+	return nil, db.ErrUserNotFound
+}
+
+func (r *Repository) GetUserByUUID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user by ID: %v", errNoRows)
+	}
+	user := row.User
+	return &user, nil
+}
+
+func (r *Repository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, row := range r.users {
+		if strings.EqualFold(row.Email, email) {
+			user := row.User
+			return &user, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get user by email: %v", errNoRows)
+}
+
+func (r *Repository) UpdateUser(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[user.ID]
+	if !ok {
+		return nil
+	}
+	if !r.uniqueUser(user.ID, user.Username, user.Email) {
+		return fmt.Errorf("failed to update user: %v", errUnique)
+	}
+	row.Username = user.Username
+	row.Email = user.Email
+	row.PasswordHash = user.PasswordHash
+	return nil
+}
+
+func (r *Repository) UpdateUserPasswordHash(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.users[id]; ok {
+		row.PasswordHash = passwordHash
+	}
+	return nil
+}
+
+// UpdateUserProfile changes the username and email. A new email has to be verified again.
+func (r *Repository) UpdateUserProfile(ctx context.Context, id uuid.UUID, username string, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[id]
+	if !ok {
+		return db.ErrUserNotFound
+	}
+	if !r.uniqueUser(id, username, email) {
+		return db.ErrUserExists
+	}
+	if !strings.EqualFold(row.Email, email) {
+		row.EmailVerifiedAt = nil
+	}
+	row.Username = username
+	row.Email = email
+	return nil
+}
+
+// ListUsers pages through users, newest first. A non-empty search matches
+// the start of the username or email.
+func (r *Repository) ListUsers(ctx context.Context, search string, limit int, offset int) ([]*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	search = strings.ToLower(search)
+	list := selectRows(r.users, func(row *userRow) bool {
+		return strings.HasPrefix(strings.ToLower(row.Username), search) || strings.HasPrefix(strings.ToLower(row.Email), search)
+	})
+	slices.Reverse(list)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	users := []*models.User{}
+	for _, row := range page(list, limit, offset) {
+		user := row.User
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func (r *Repository) SetUserActive(ctx context.Context, id uuid.UUID, active bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.users[id]
+	if !ok {
+		return db.ErrUserNotFound
+	}
+	row.IsActive = active
+	return nil
+}
+
+func (r *Repository) SetUserRole(ctx context.Context, id uuid.UUID, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if role != "user" && role != "admin" {
+		return fmt.Errorf("failed to set user role: %v", errCheck)
+	}
+	row, ok := r.users[id]
+	if !ok {
+		return db.ErrUserNotFound
+	}
+	row.Role = role
+	return nil
+}
+
+type aiModelRow struct {
+	inserted
+	models.AIModel
+}
+
+func (r *Repository) uniqueAIModelName(id uuid.UUID, name string) bool {
+	for _, row := range r.aiModels {
+		if row.ID != id && row.Name == name {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repository) CreateAIModel(ctx context.Context, model *models.AIModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.uniqueAIModelName(uuid.Nil, model.Name) {
+		return db.ErrAIModelExists
+	}
+	model.ID = uuid.New()
+	r.aiModels[model.ID] = &aiModelRow{inserted: r.insert(), AIModel: *model}
+	return nil
+}
+
+func (r *Repository) GetAIModelByID(ctx context.Context, id uuid.UUID) (*models.AIModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.aiModels[id]
+	if !ok {
+		return nil, db.ErrAIModelNotFound
+	}
+	model := row.AIModel
+	return &model, nil
+}
+
+func (r *Repository) GetAllAIModels(ctx context.Context) ([]*models.AIModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var list []*models.AIModel
+	for _, row := range selectRows(r.aiModels, func(*aiModelRow) bool { return true }) {
+		model := row.AIModel
+		list = append(list, &model)
+	}
+	return list, nil
+}
+
+func (r *Repository) UpdateAIModel(ctx context.Context, model *models.AIModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.aiModels[model.ID]
+	if !ok {
+		return db.ErrAIModelNotFound
+	}
+	if !r.uniqueAIModelName(model.ID, model.Name) {
+		return db.ErrAIModelExists
+	}
+	row.AIModel = *model
+	return nil
+}
+
+func (r *Repository) DeleteAIModel(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.aiModels[id]; !ok {
+		return db.ErrAIModelNotFound
+	}
+	for _, row := range r.preferences {
+		if row.DefaultAIModel != nil && *row.DefaultAIModel == id {
+			return db.ErrAIModelInUse
+		}
+	}
+	delete(r.aiModels, id)
+	deleteRows(r.workspaceModels, func(row *workspaceModelRow) bool { return row.modelID == id })
+	return nil
+}
+
+type chatRow struct {
+	inserted
+	models.Chat
+}
+
+func (r *Repository) chatReferencesExist(chat *models.Chat) bool {
+	if !r.userExists(chat.UserID) {
+		return false
+	}
+	if chat.WorkspaceID != nil {
+		if _, ok := r.workspaces[*chat.WorkspaceID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repository) CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.createChat(chat)
+}
+
+func (r *Repository) createChat(chat *models.Chat) (*models.Chat, error) {
+	if !r.chatReferencesExist(chat) {
+		return nil, fmt.Errorf("failed to create chat: %v", errForeignKey)
+	}
+	chat.ID = uuid.New()
+	r.chats[chat.ID] = &chatRow{inserted: r.insert(), Chat: *chat}
+	return chat, nil
+}
+
+// GetChatByID returns the chat, or db.ErrChatNotFound if it is missing or in the trash
+func (r *Repository) GetChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.chats[id]
+	if !ok || row.DeletedAt != nil {
+		return nil, db.ErrChatNotFound
+	}
+	chat := row.Chat
+	return &chat, nil
+}
+
+func (r *Repository) UpdateChat(ctx context.Context, chat *models.Chat) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.chats[chat.ID]
+	if !ok {
+		return nil
+	}
+	if !r.chatReferencesExist(chat) {
+		return fmt.Errorf("failed to update chat: %v", errForeignKey)
+	}
+	created, deleted := row.CreatedAt, row.DeletedAt
+	row.Chat = *chat
+	row.CreatedAt, row.DeletedAt = created, deleted
+	return nil
+}
+
+// TouchChat moves the chat's last_updated forward to at, never back
+func (r *Repository) TouchChat(ctx context.Context, id uuid.UUID, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.touchChat(id, at)
+	return err
+}
+
+// touchChat returns the last_updated it replaced, or nil if it changed nothing
+func (r *Repository) touchChat(id uuid.UUID, at time.Time) (*time.Time, error) {
+	if err := r.writableChat(id); err != nil {
+		return nil, err
+	}
+	row := r.chats[id]
+	if !at.After(row.LastUpdated) {
+		return nil, nil
+	}
+	previous := row.LastUpdated
+	row.LastUpdated = at
+	return &previous, nil
+}
+
+// writableChat refuses writes to a chat that is missing or in the trash
+func (r *Repository) writableChat(id uuid.UUID) error {
+	row, ok := r.chats[id]
+	if !ok {
+		return db.ErrChatNotFound
+	}
+	if row.DeletedAt != nil {
+		return db.ErrChatTrashed
+	}
+	return nil
+}
+
+// DeleteChat moves the chat and its messages to the trash, stamping them
+// with the same deleted_at so RestoreChat brings back exactly those messages
+func (r *Repository) DeleteChat(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.chats[id]
+	if !ok {
+		return nil
+	}
+	if row.DeletedAt == nil {
+		row.DeletedAt = timePtr(time.Now())
+	}
+	for _, message := range r.messages {
+		if message.ChatID == id && message.DeletedAt == nil {
+			message.DeletedAt = row.DeletedAt
+		}
+	}
+	return nil
+}
+
+// GetTrashedChatByID returns the chat only if it is in the trash
+func (r *Repository) GetTrashedChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.chats[id]
+	if !ok || row.DeletedAt == nil {
+		return nil, db.ErrChatNotFound
+	}
+	chat := row.Chat
+	return &chat, nil
+}
+
+func byDeletedAt(list []*chatRow) {
+	sort.SliceStable(list, func(i, j int) bool { return list[i].DeletedAt.After(*list[j].DeletedAt) })
+}
+
+// GetTrashedChatsByUserID returns the user's trashed personal chats, most recently deleted first
+func (r *Repository) GetTrashedChatsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.chats, func(row *chatRow) bool {
+		return row.UserID == userID && row.WorkspaceID == nil && row.DeletedAt != nil
+	})
+	byDeletedAt(list)
+	return chatList(list), nil
+}
+
+// GetTrashedChatsByWorkspaceID returns the workspace's trashed chats, most recently deleted first
+func (r *Repository) GetTrashedChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.chats, func(row *chatRow) bool {
+		return row.WorkspaceID != nil && *row.WorkspaceID == workspaceID && row.DeletedAt != nil
+	})
+	byDeletedAt(list)
+	return chatList(list), nil
+}
+
+// RestoreChat takes the chat out of the trash with the messages that were trashed along with it
+func (r *Repository) RestoreChat(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.chats[id]
+	if !ok || row.DeletedAt == nil {
+		return db.ErrChatNotFound
+	}
+	for _, message := range r.messages {
+		if message.ChatID == id && message.DeletedAt != nil && message.DeletedAt.Equal(*row.DeletedAt) {
+			message.DeletedAt = nil
+		}
+	}
+	row.DeletedAt = nil
+	return nil
+}
+
+// PurgeTrash permanently deletes chats and messages that have been in the trash longer than olderThan
+func (r *Repository) PurgeTrash(ctx context.Context, olderThan time.Duration) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var purged int64
+	for id, row := range r.chats {
+		if row.DeletedAt != nil && row.DeletedAt.Before(cutoff) {
+			r.deleteChat(id)
+			purged++
+		}
+	}
+	purged += deleteRows(r.messages, func(row *messageRow) bool {
+		return row.DeletedAt != nil && row.DeletedAt.Before(cutoff)
+	})
+	return purged, nil
+}
+
+// deleteChat removes the chat and applies the foreign keys that reference it
+func (r *Repository) deleteChat(id uuid.UUID) {
+	delete(r.chats, id)
+	delete(r.chatInstructions, id)
+	deleteRows(r.messages, func(row *messageRow) bool { return row.ChatID == id })
+	for _, row := range r.users {
+		if row.LastChatID != nil && *row.LastChatID == id {
+			row.LastChatID = nil
+		}
+	}
+	for _, row := range r.schedules {
+		if row.ChatID != nil && *row.ChatID == id {
+			row.ChatID = nil
+		}
+	}
+	for _, row := range r.scheduleRuns {
+		if row.ChatID != nil && *row.ChatID == id {
+			row.ChatID = nil
+		}
+	}
+}
+
+func chatList(list []*chatRow) []*models.Chat {
+	var chats []*models.Chat
+	for _, row := range list {
+		chat := row.Chat
+		chats = append(chats, &chat)
+	}
+	return chats
+}
+
+func byLastUpdated(list []*chatRow) {
+	sort.SliceStable(list, func(i, j int) bool { return list[i].LastUpdated.After(list[j].LastUpdated) })
+}
+
+// GetChatsByUserID returns the user's personal chats; chats moved to a workspace are listed with it
+func (r *Repository) GetChatsByUserID(ctx context.Context, userID uuid.UUID, sortByLastUpdated bool) ([]*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.chats, func(row *chatRow) bool {
+		return row.UserID == userID && row.WorkspaceID == nil && row.DeletedAt == nil
+	})
+	if sortByLastUpdated {
+		byLastUpdated(list)
+	}
+	return chatList(list), nil
+}
+
+// GetChatsByWorkspaceID returns every chat shared with the workspace, most recently updated first
+func (r *Repository) GetChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.chats, func(row *chatRow) bool {
+		return row.WorkspaceID != nil && *row.WorkspaceID == workspaceID && row.DeletedAt == nil
+	})
+	byLastUpdated(list)
+	return chatList(list), nil
+}
+
+type messageRow struct {
+	inserted
+	models.Message
+}
+
+// CreateMessage inserts the message. Messages without a status are complete.
+func (r *Repository) CreateMessage(ctx context.Context, message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.createMessage(message)
+}
+
+func (r *Repository) createMessage(message *models.Message) error {
+	if message.Status == "" {
+		message.Status = db.MessageComplete
+	}
+	if !validMessageStatus(message.Status) {
+		return fmt.Errorf("failed to create message: %v", errCheck)
+	}
+	if err := r.writableChat(message.ChatID); err != nil {
+		return err
+	}
+	if !r.userExists(message.UserID) {
+		return fmt.Errorf("failed to create message: %v", errForeignKey)
+	}
+	message.ID = uuid.New()
+	r.messages[message.ID] = &messageRow{inserted: r.insert(), Message: *message}
+	return nil
+}
+
+func (r *Repository) GetMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.messages[id]
+	if !ok || row.DeletedAt != nil {
+		return nil, db.ErrMessageNotFound
+	}
+	message := row.Message
+	return &message, nil
+}
+
+func (r *Repository) UpdateMessage(ctx context.Context, message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.messages[message.ID]; ok {
+		row.Content = message.Content
+		row.IsEdited = message.IsEdited
+	}
+	return nil
+}
+
+func validMessageStatus(status string) bool {
+	return status == db.MessagePending || status == db.MessageComplete || status == db.MessageFailed
+}
+
+// FinishMessage saves the final content and status of a pending message
+func (r *Repository) FinishMessage(ctx context.Context, message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.finishMessage(message)
+	return err
+}
+
+// finishMessage returns the row as it was before, or nil if it changed nothing
+func (r *Repository) finishMessage(message *models.Message) (*models.Message, error) {
+	if !validMessageStatus(message.Status) {
+		return nil, fmt.Errorf("failed to finish message: %v", errCheck)
+	}
+	row, ok := r.messages[message.ID]
+	if !ok || row.Status != db.MessagePending {
+		return nil, nil
+	}
+	previous := row.Message
+	row.Content = message.Content
+	row.Status = message.Status
+	return &previous, nil
+}
+
+// FailStaleMessages marks messages still pending after olderThan as failed
+func (r *Repository) FailStaleMessages(ctx context.Context, olderThan time.Duration) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var failed int64
+	for _, row := range r.messages {
+		if row.Status == db.MessagePending && row.CreatedAt.Before(cutoff) {
+			row.Status = db.MessageFailed
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// DeleteMessage moves a message to the trash
+func (r *Repository) DeleteMessage(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.messages[id]; ok && row.DeletedAt == nil {
+		row.DeletedAt = timePtr(time.Now())
+	}
+	return nil
+}
+
+// trashedMessage returns a message trashed on its own from a chat that is not in the trash
+func (r *Repository) trashedMessage(id uuid.UUID) (*messageRow, bool) {
+	row, ok := r.messages[id]
+	if !ok || row.DeletedAt == nil || r.chats[row.ChatID].DeletedAt != nil {
+		return nil, false
+	}
+	return row, true
+}
+
+// GetTrashedMessageByID returns a message that was moved to the trash on its
+// own; messages trashed with their chat come back with RestoreChat
+func (r *Repository) GetTrashedMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.trashedMessage(id)
+	if !ok {
+		return nil, db.ErrMessageNotFound
+	}
+	message := row.Message
+	return &message, nil
+}
+
+// GetTrashedMessagesByChatID returns the messages moved to the trash from a
+// chat that is not itself in the trash, most recently deleted first
+func (r *Repository) GetTrashedMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.messages, func(row *messageRow) bool {
+		_, trashed := r.trashedMessage(row.ID)
+		return row.ChatID == chatID && trashed
+	})
+	sort.SliceStable(list, func(i, j int) bool { return list[i].DeletedAt.After(*list[j].DeletedAt) })
+	messages := []*models.Message{}
+	for _, row := range list {
+		message := row.Message
+		messages = append(messages, &message)
+	}
+	return messages, nil
+}
+
+// RestoreMessage takes a message out of the trash. It returns
+// db.ErrMessageNotFound unless the message was trashed on its own.
+func (r *Repository) RestoreMessage(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.trashedMessage(id)
+	if !ok {
+		return db.ErrMessageNotFound
+	}
+	row.DeletedAt = nil
+	return nil
+}
+
+// chatMessages returns the chat's messages that are not in the trash, oldest first
+func (r *Repository) chatMessages(chatID uuid.UUID) []*messageRow {
+	list := selectRows(r.messages, func(row *messageRow) bool { return row.ChatID == chatID && row.DeletedAt == nil })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (r *Repository) GetMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []*models.Message
+	for _, row := range r.chatMessages(chatID) {
+		message := row.Message
+		messages = append(messages, &message)
+	}
+	return messages, nil
+}
+
+// GetMessageContentsByChatID returns the chat's complete messages for sending to the model
+func (r *Repository) GetMessageContentsByChatID(ctx context.Context, chatID uuid.UUID) ([]models.MessageContent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []models.MessageContent
+	for _, row := range r.chatMessages(chatID) {
+		if row.Status != db.MessageComplete {
+			continue
+		}
+		messages = append(messages, models.MessageContent{Role: row.Role, Content: row.Content})
+	}
+	return messages, nil
+}
+
+// conversationTx applies a unit of work's writes as they are made, while
+// InTx holds the lock, and remembers how to undo them if the work fails
+type conversationTx struct {
+	r    *Repository
+	undo []func()
+}
+
+// InTx runs fn holding the lock and rolls back its writes if it returns an error
+func (r *Repository) InTx(ctx context.Context, fn func(tx repository.ConversationTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := &conversationTx{r: r}
+	if err := fn(tx); err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+func (tx *conversationTx) CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	created, err := tx.r.createChat(chat)
+	if err != nil {
+		return nil, err
+	}
+	id := created.ID
+	tx.undo = append(tx.undo, func() { delete(tx.r.chats, id) })
+	return created, nil
+}
+
+func (tx *conversationTx) TouchChat(ctx context.Context, id uuid.UUID, at time.Time) error {
+	previous, err := tx.r.touchChat(id, at)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		tx.undo = append(tx.undo, func() { tx.r.chats[id].LastUpdated = *previous })
+	}
+	return nil
+}
+
+func (tx *conversationTx) CreateMessage(ctx context.Context, message *models.Message) error {
+	if err := tx.r.createMessage(message); err != nil {
+		return err
+	}
+	id := message.ID
+	tx.undo = append(tx.undo, func() { delete(tx.r.messages, id) })
+	return nil
+}
+
+func (tx *conversationTx) FinishMessage(ctx context.Context, message *models.Message) error {
+	previous, err := tx.r.finishMessage(message)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		tx.undo = append(tx.undo, func() { tx.r.messages[previous.ID].Message = *previous })
+	}
+	return nil
+}
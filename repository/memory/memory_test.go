@@ -0,0 +1,15 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/repository/memory"
+	"github.com/FiveEightyEight/gippity-serv/repository/repositorytest"
+)
+
+func TestRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		return memory.New()
+	})
+}
@@ -0,0 +1,192 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type totpRow struct {
+	inserted
+	models.UserTOTP
+}
+
+type recoveryCodeRow struct {
+	inserted
+	userID   uuid.UUID
+	codeHash string
+	usedAt   *time.Time
+}
+
+type usedMFAChallengeRow struct {
+	inserted
+	expiresAt time.Time
+}
+
+// CreatePendingTOTP stores a new secret awaiting confirmation, replacing any
+// earlier unconfirmed one. An enabled secret is never overwritten.
+func (r *Repository) CreatePendingTOTP(ctx context.Context, userID uuid.UUID, secret string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(userID) {
+		return fmt.Errorf("failed to create totp secret: %v", errForeignKey)
+	}
+	row, ok := r.totp[userID]
+	if ok && row.EnabledAt != nil {
+		return db.ErrTOTPAlreadyEnabled
+	}
+	if !ok {
+		row = &totpRow{inserted: r.insert()}
+		r.totp[userID] = row
+	}
+	row.UserTOTP = models.UserTOTP{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+func (r *Repository) GetTOTP(ctx context.Context, userID uuid.UUID) (*models.UserTOTP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.totp[userID]
+	if !ok {
+		return nil, db.ErrTOTPNotEnrolled
+	}
+	totp := row.UserTOTP
+	return &totp, nil
+}
+
+// IsMFAEnabled reports whether login needs a second factor for the user
+func (r *Repository) IsMFAEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	methods, err := r.GetMFAMethods(ctx, userID)
+	return len(methods) > 0, err
+}
+
+// GetMFAMethods lists the second factors the user can log in with: "totp" and "webauthn"
+func (r *Repository) GetMFAMethods(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	methods := []string{}
+	if row, ok := r.totp[userID]; ok && row.EnabledAt != nil {
+		methods = append(methods, "totp")
+	}
+	for _, row := range r.webauthnCredentials {
+		if row.UserID == userID {
+			methods = append(methods, "webauthn")
+			break
+		}
+	}
+	return methods, nil
+}
+
+// UseTOTPStep records step as used. It returns false when that step or a later one was already used.
+func (r *Repository) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.totp[userID]
+	if !ok || row.LastUsedStep >= step {
+		return false, nil
+	}
+	row.LastUsedStep = step
+	return true, nil
+}
+
+// EnableTOTP confirms the pending secret and replaces the user's recovery codes
+func (r *Repository) EnableTOTP(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.totp[userID]
+	if !ok || row.EnabledAt != nil {
+		return db.ErrTOTPAlreadyEnabled
+	}
+	row.EnabledAt = timePtr(time.Now())
+	row.LastUsedStep = step
+	r.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+// DisableTOTP removes the secret and recovery codes
+func (r *Repository) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.totp, userID)
+	deleteRows(r.recoveryCodes, func(row *recoveryCodeRow) bool { return row.userID == userID })
+	return nil
+}
+
+func (r *Repository) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(userID) && len(codeHashes) > 0 {
+		return fmt.Errorf("failed to create recovery codes: %v", errForeignKey)
+	}
+	r.replaceRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+func (r *Repository) replaceRecoveryCodes(userID uuid.UUID, codeHashes []string) {
+	deleteRows(r.recoveryCodes, func(row *recoveryCodeRow) bool { return row.userID == userID })
+	for _, hash := range codeHashes {
+		row := &recoveryCodeRow{inserted: r.insert(), userID: userID, codeHash: hash}
+		r.recoveryCodes[uuid.New()] = row
+	}
+}
+
+// UseRecoveryCode marks an unused recovery code as used, returning false if there was none
+func (r *Repository) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	used := false
+	for _, row := range r.recoveryCodes {
+		if row.userID == userID && row.codeHash == codeHash && row.usedAt == nil {
+			row.usedAt = timePtr(time.Now())
+			used = true
+		}
+	}
+	return used, nil
+}
+
+func (r *Repository) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, row := range r.recoveryCodes {
+		if row.userID == userID && row.usedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// UseMFAChallenge records that the MFA challenge token jti completed a login.
+// It returns false when the token was already used, so a captured token cannot
+// be replayed for another login.
+func (r *Repository) UseMFAChallenge(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.usedMFAChallenges[jti]; ok {
+		return false, nil
+	}
+	r.usedMFAChallenges[jti] = &usedMFAChallengeRow{inserted: r.insert(), expiresAt: expiresAt}
+	return true, nil
+}
+
+func (r *Repository) DeleteExpiredMFAChallenges(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.usedMFAChallenges, func(row *usedMFAChallengeRow) bool { return row.expiresAt.Before(now) }), nil
+}
@@ -0,0 +1,462 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type orgRow struct {
+	inserted
+	models.Organization
+}
+
+type orgMemberKey struct {
+	orgID  uuid.UUID
+	userID uuid.UUID
+}
+
+type orgMemberRow struct {
+	inserted
+	models.OrganizationMember
+}
+
+type workspaceRow struct {
+	inserted
+	models.Workspace
+}
+
+type workspacePatternKey struct {
+	workspaceID uuid.UUID
+	name        string
+}
+
+type workspacePatternRow struct {
+	inserted
+	models.WorkspacePattern
+}
+
+type workspaceModelKey struct {
+	workspaceID uuid.UUID
+	modelID     uuid.UUID
+}
+
+type workspaceModelRow struct {
+	inserted
+	workspaceID uuid.UUID
+	modelID     uuid.UUID
+}
+
+// orgRole returns the user's role in the organization, or "" if they are not a member
+func (r *Repository) orgRole(orgID uuid.UUID, userID uuid.UUID) string {
+	if row, ok := r.orgMembers[orgMemberKey{orgID, userID}]; ok {
+		return row.Role
+	}
+	return ""
+}
+
+func (r *Repository) countOwners(orgID uuid.UUID) int {
+	owners := 0
+	for _, row := range r.orgMembers {
+		if row.OrganizationID == orgID && row.Role == db.OrgRoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+func (r *Repository) deleteOrganization(id uuid.UUID) {
+	delete(r.orgs, id)
+	deleteRows(r.orgMembers, func(row *orgMemberRow) bool { return row.OrganizationID == id })
+	for _, row := range r.workspaces {
+		if row.OrganizationID == id {
+			r.deleteWorkspace(row.ID)
+		}
+	}
+}
+
+func (r *Repository) deleteWorkspace(id uuid.UUID) {
+	delete(r.workspaces, id)
+	for _, row := range r.chats {
+		if row.WorkspaceID != nil && *row.WorkspaceID == id {
+			r.deleteChat(row.ID)
+		}
+	}
+	deleteRows(r.workspacePatterns, func(row *workspacePatternRow) bool { return row.WorkspaceID == id })
+	deleteRows(r.workspaceModels, func(row *workspaceModelRow) bool { return row.workspaceID == id })
+}
+
+// CreateOrganization creates the organization with ownerID as its first owner
+func (r *Repository) CreateOrganization(ctx context.Context, org *models.Organization, ownerID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(ownerID) {
+		return fmt.Errorf("failed to create organization: %v", errForeignKey)
+	}
+	org.ID = uuid.New()
+	org.CreatedAt = time.Now()
+	r.orgs[org.ID] = &orgRow{inserted: r.insert(), Organization: models.Organization{
+		ID:        org.ID,
+		Name:      org.Name,
+		CreatedBy: uuidPtr(ownerID),
+		CreatedAt: org.CreatedAt,
+	}}
+	r.orgMembers[orgMemberKey{org.ID, ownerID}] = &orgMemberRow{inserted: r.insert(), OrganizationMember: models.OrganizationMember{
+		OrganizationID: org.ID,
+		UserID:         ownerID,
+		Role:           db.OrgRoleOwner,
+		CreatedAt:      org.CreatedAt,
+	}}
+	org.CreatedBy = &ownerID
+	org.Role = db.OrgRoleOwner
+	return nil
+}
+
+// GetOrganizationsByUserID returns the organizations the user belongs to, with their role in each
+func (r *Repository) GetOrganizationsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Organization, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	orgs := []*models.Organization{}
+	for _, member := range selectRows(r.orgMembers, func(row *orgMemberRow) bool { return row.UserID == userID }) {
+		org := r.orgs[member.OrganizationID].Organization
+		org.Role = member.Role
+		orgs = append(orgs, &org)
+	}
+	sort.SliceStable(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return orgs, nil
+}
+
+// GetOrganizationRole returns the user's role in the organization, or "" if they are not a member
+func (r *Repository) GetOrganizationRole(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.orgRole(orgID, userID), nil
+}
+
+func (r *Repository) RenameOrganization(ctx context.Context, orgID uuid.UUID, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.orgs[orgID]
+	if !ok {
+		return db.ErrOrganizationNotFound
+	}
+	row.Name = name
+	return nil
+}
+
+// DeleteOrganization removes the organization with its workspaces and their chats
+func (r *Repository) DeleteOrganization(ctx context.Context, orgID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.orgs[orgID]; !ok {
+		return db.ErrOrganizationNotFound
+	}
+	r.deleteOrganization(orgID)
+	return nil
+}
+
+func (r *Repository) GetOrganizationMembers(ctx context.Context, orgID uuid.UUID) ([]*models.OrganizationMember, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members := []*models.OrganizationMember{}
+	for _, row := range selectRows(r.orgMembers, func(row *orgMemberRow) bool { return row.OrganizationID == orgID }) {
+		member := row.OrganizationMember
+		member.Username = r.users[row.UserID].Username
+		members = append(members, &member)
+	}
+	sort.SliceStable(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+	return members, nil
+}
+
+func (r *Repository) AddOrganizationMember(ctx context.Context, member *models.OrganizationMember) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := orgMemberKey{member.OrganizationID, member.UserID}
+	if _, ok := r.orgMembers[key]; ok {
+		return db.ErrMemberExists
+	}
+	if _, ok := r.orgs[member.OrganizationID]; !ok || !r.userExists(member.UserID) {
+		return db.ErrUserNotFound
+	}
+	if !db.ValidOrgRole(member.Role) {
+		return fmt.Errorf("failed to add organization member: %v", errCheck)
+	}
+	member.CreatedAt = time.Now()
+	r.orgMembers[key] = &orgMemberRow{inserted: r.insert(), OrganizationMember: models.OrganizationMember{
+		OrganizationID: member.OrganizationID,
+		UserID:         member.UserID,
+		Role:           member.Role,
+		CreatedAt:      member.CreatedAt,
+	}}
+	return nil
+}
+
+// memberChangeRefused returns why giving the member role would be refused, or nil.
+// Removing a member is checked with role "".
+func (r *Repository) memberChangeRefused(orgID uuid.UUID, userID uuid.UUID, role string) error {
+	current := r.orgRole(orgID, userID)
+	if current == "" {
+		return db.ErrMemberNotFound
+	}
+	if current == db.OrgRoleOwner && role != db.OrgRoleOwner && r.countOwners(orgID) <= 1 {
+		return db.ErrLastOwner
+	}
+	return nil
+}
+
+// SetOrganizationMemberRole changes a member's role, refusing to demote the last owner
+func (r *Repository) SetOrganizationMemberRole(ctx context.Context, orgID uuid.UUID, userID uuid.UUID, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.memberChangeRefused(orgID, userID, role); err != nil {
+		return err
+	}
+	if !db.ValidOrgRole(role) {
+		return fmt.Errorf("failed to set organization member role: %v", errCheck)
+	}
+	r.orgMembers[orgMemberKey{orgID, userID}].Role = role
+	return nil
+}
+
+// RemoveOrganizationMember takes the user out of the organization, refusing to remove the last owner.
+// Chats they shared with its workspaces stay with the workspaces.
+func (r *Repository) RemoveOrganizationMember(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.memberChangeRefused(orgID, userID, ""); err != nil {
+		return err
+	}
+	delete(r.orgMembers, orgMemberKey{orgID, userID})
+	return nil
+}
+
+func (r *Repository) workspaceNameTaken(orgID uuid.UUID, name string, except uuid.UUID) bool {
+	for _, row := range r.workspaces {
+		if row.OrganizationID == orgID && row.Name == name && row.ID != except {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repository) CreateWorkspace(ctx context.Context, workspace *models.Workspace) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.workspaceNameTaken(workspace.OrganizationID, workspace.Name, uuid.Nil) {
+		return db.ErrWorkspaceExists
+	}
+	if _, ok := r.orgs[workspace.OrganizationID]; !ok {
+		return db.ErrOrganizationNotFound
+	}
+	workspace.ID = uuid.New()
+	workspace.CreatedAt = time.Now()
+	r.workspaces[workspace.ID] = &workspaceRow{inserted: r.insert(), Workspace: *workspace}
+	return nil
+}
+
+func (r *Repository) GetWorkspaceByID(ctx context.Context, id uuid.UUID) (*models.Workspace, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.workspaces[id]
+	if !ok {
+		return nil, db.ErrWorkspaceNotFound
+	}
+	workspace := row.Workspace
+	return &workspace, nil
+}
+
+func (r *Repository) GetWorkspacesByOrganizationID(ctx context.Context, orgID uuid.UUID) ([]*models.Workspace, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	workspaces := []*models.Workspace{}
+	for _, row := range selectRows(r.workspaces, func(row *workspaceRow) bool { return row.OrganizationID == orgID }) {
+		workspace := row.Workspace
+		workspaces = append(workspaces, &workspace)
+	}
+	sort.SliceStable(workspaces, func(i, j int) bool { return workspaces[i].Name < workspaces[j].Name })
+	return workspaces, nil
+}
+
+func (r *Repository) RenameWorkspace(ctx context.Context, id uuid.UUID, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.workspaces[id]
+	if !ok {
+		return db.ErrWorkspaceNotFound
+	}
+	if r.workspaceNameTaken(row.OrganizationID, name, id) {
+		return db.ErrWorkspaceExists
+	}
+	row.Name = name
+	return nil
+}
+
+// DeleteWorkspace removes the workspace together with its chats and patterns
+func (r *Repository) DeleteWorkspace(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.workspaces[id]; !ok {
+		return db.ErrWorkspaceNotFound
+	}
+	r.deleteWorkspace(id)
+	return nil
+}
+
+// GetWorkspaceRole returns the user's role in the organization owning the
+// workspace, or "" if the workspace does not exist or they are not a member
+func (r *Repository) GetWorkspaceRole(ctx context.Context, workspaceID uuid.UUID, userID uuid.UUID) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.workspaces[workspaceID]
+	if !ok {
+		return "", nil
+	}
+	return r.orgRole(row.OrganizationID, userID), nil
+}
+
+// GetWorkspaceModels returns the workspace's model allowlist. An empty list allows every model.
+func (r *Repository) GetWorkspaceModels(ctx context.Context, workspaceID uuid.UUID) ([]*models.AIModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := []*models.AIModel{}
+	for _, row := range selectRows(r.workspaceModels, func(row *workspaceModelRow) bool { return row.workspaceID == workspaceID }) {
+		model := r.aiModels[row.modelID].AIModel
+		list = append(list, &model)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// SetWorkspaceModels replaces the workspace's model allowlist
+func (r *Repository) SetWorkspaceModels(ctx context.Context, workspaceID uuid.UUID, modelIDs []uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range modelIDs {
+		if _, ok := r.aiModels[id]; !ok {
+			return db.ErrAIModelNotFound
+		}
+		if _, ok := r.workspaces[workspaceID]; !ok {
+			return db.ErrAIModelNotFound
+		}
+	}
+	deleteRows(r.workspaceModels, func(row *workspaceModelRow) bool { return row.workspaceID == workspaceID })
+	for _, id := range modelIDs {
+		key := workspaceModelKey{workspaceID, id}
+		if _, ok := r.workspaceModels[key]; !ok {
+			r.workspaceModels[key] = &workspaceModelRow{inserted: r.insert(), workspaceID: workspaceID, modelID: id}
+		}
+	}
+	return nil
+}
+
+// IsModelAllowedInWorkspace reports whether chats in the workspace may use the
+// model version. An empty version means the default model, which an allowlist
+// does not name, so it is only allowed when there is no allowlist.
+func (r *Repository) IsModelAllowedInWorkspace(ctx context.Context, workspaceID uuid.UUID, version string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	allowlisted := false
+	for _, row := range r.workspaceModels {
+		if row.workspaceID != workspaceID {
+			continue
+		}
+		allowlisted = true
+		if model := r.aiModels[row.modelID]; model.Version == version && model.IsActive {
+			return true, nil
+		}
+	}
+	return !allowlisted, nil
+}
+
+func (r *Repository) GetWorkspacePatterns(ctx context.Context, workspaceID uuid.UUID) ([]*models.WorkspacePattern, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	patterns := []*models.WorkspacePattern{}
+	for _, row := range selectRows(r.workspacePatterns, func(row *workspacePatternRow) bool { return row.WorkspaceID == workspaceID }) {
+		pattern := row.WorkspacePattern
+		patterns = append(patterns, &pattern)
+	}
+	sort.SliceStable(patterns, func(i, j int) bool { return patterns[i].Name < patterns[j].Name })
+	return patterns, nil
+}
+
+func (r *Repository) GetWorkspacePattern(ctx context.Context, workspaceID uuid.UUID, name string) (*models.WorkspacePattern, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.workspacePatterns[workspacePatternKey{workspaceID, name}]
+	if !ok {
+		return nil, db.ErrPatternNotFound
+	}
+	pattern := row.WorkspacePattern
+	return &pattern, nil
+}
+
+// SaveWorkspacePattern creates or replaces a workspace pattern and reports whether it was created
+func (r *Repository) SaveWorkspacePattern(ctx context.Context, pattern *models.WorkspacePattern) (bool, error) {
+	if !db.ValidPatternName(pattern.Name) || pattern.System == "" {
+		return false, db.ErrInvalidPattern
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.workspaces[pattern.WorkspaceID]; !ok {
+		return false, db.ErrWorkspaceNotFound
+	}
+	now := time.Now()
+	key := workspacePatternKey{pattern.WorkspaceID, pattern.Name}
+	if row, ok := r.workspacePatterns[key]; ok {
+		row.System = pattern.System
+		row.User = pattern.User
+		row.UpdatedAt = now
+		pattern.CreatedBy = row.CreatedBy
+		pattern.CreatedAt = row.CreatedAt
+		pattern.UpdatedAt = now
+		return false, nil
+	}
+
+	if pattern.CreatedBy != nil && !r.userExists(*pattern.CreatedBy) {
+		return false, fmt.Errorf("failed to save workspace pattern: %v", errForeignKey)
+	}
+	pattern.CreatedAt = now
+	pattern.UpdatedAt = now
+	r.workspacePatterns[key] = &workspacePatternRow{inserted: r.insert(), WorkspacePattern: *pattern}
+	return true, nil
+}
+
+func (r *Repository) DeleteWorkspacePattern(ctx context.Context, workspaceID uuid.UUID, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := workspacePatternKey{workspaceID, name}
+	if _, ok := r.workspacePatterns[key]; !ok {
+		return db.ErrPatternNotFound
+	}
+	delete(r.workspacePatterns, key)
+	return nil
+}
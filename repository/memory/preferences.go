@@ -0,0 +1,202 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type preferencesRow struct {
+	inserted
+	models.UserPreferences
+}
+
+// GetUserPreferences returns the user's preferences, or the defaults if they never saved any
+func (r *Repository) GetUserPreferences(ctx context.Context, userID uuid.UUID) (*models.UserPreferences, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.preferences[userID]
+	if !ok {
+		return &models.UserPreferences{UserID: userID, Theme: "light", MessageDisplayCount: 50, NotificationsEnabled: true}, nil
+	}
+	preferences := row.UserPreferences
+	return &preferences, nil
+}
+
+func (r *Repository) SaveUserPreferences(ctx context.Context, preferences *models.UserPreferences) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if preferences.DefaultAIModel != nil {
+		if _, ok := r.aiModels[*preferences.DefaultAIModel]; !ok {
+			return db.ErrAIModelNotFound
+		}
+	}
+	if !r.userExists(preferences.UserID) {
+		return fmt.Errorf("failed to save user preferences: %v", errForeignKey)
+	}
+	row, ok := r.preferences[preferences.UserID]
+	if !ok {
+		row = &preferencesRow{inserted: r.insert()}
+		r.preferences[preferences.UserID] = row
+	}
+	row.UserPreferences = *preferences
+	return nil
+}
+
+// GetDefaultAIModelVersion returns the version of the user's default model, or
+// "" when they have none or it has been deactivated
+func (r *Repository) GetDefaultAIModelVersion(ctx context.Context, userID uuid.UUID) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.preferences[userID]
+	if !ok || row.DefaultAIModel == nil {
+		return "", nil
+	}
+	model, ok := r.aiModels[*row.DefaultAIModel]
+	if !ok || !model.IsActive {
+		return "", nil
+	}
+	return model.Version, nil
+}
+
+type metadataRow struct {
+	inserted
+	models.UserMetadata
+}
+
+// GetUserMetadata returns the user's metadata, empty if they never saved any
+func (r *Repository) GetUserMetadata(ctx context.Context, userID uuid.UUID) (*models.UserMetadata, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.metadata[userID]
+	if !ok {
+		return &models.UserMetadata{UserID: userID, Interests: []string{}}, nil
+	}
+	metadata := row.UserMetadata
+	metadata.Interests = slices.Clone(row.Interests)
+	if metadata.Interests == nil {
+		metadata.Interests = []string{}
+	}
+	return &metadata, nil
+}
+
+func (r *Repository) SaveUserMetadata(ctx context.Context, metadata *models.UserMetadata) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(metadata.UserID) {
+		return fmt.Errorf("failed to save user metadata: %v", errForeignKey)
+	}
+	row, ok := r.metadata[metadata.UserID]
+	if !ok {
+		row = &metadataRow{inserted: r.insert()}
+		r.metadata[metadata.UserID] = row
+	}
+	metadata.LastUpdated = time.Now()
+	row.UserMetadata = *metadata
+	row.Interests = slices.Clone(metadata.Interests)
+	return nil
+}
+
+// GetUserTimezone returns the timezone from the user's metadata, or "" when none is set
+func (r *Repository) GetUserTimezone(ctx context.Context, userID uuid.UUID) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.timezone(userID), nil
+}
+
+func (r *Repository) timezone(userID uuid.UUID) string {
+	if row, ok := r.metadata[userID]; ok {
+		return row.Timezone
+	}
+	return ""
+}
+
+type instructionsRow struct {
+	inserted
+	models.CustomInstructions
+}
+
+// GetCustomInstructions returns the user's custom instructions, empty if they never saved any
+func (r *Repository) GetCustomInstructions(ctx context.Context, userID uuid.UUID) (*models.CustomInstructions, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.instructions[userID]
+	if !ok {
+		return &models.CustomInstructions{UserID: userID, MetadataFields: []string{}}, nil
+	}
+	instructions := row.CustomInstructions
+	instructions.MetadataFields = slices.Clone(row.MetadataFields)
+	return &instructions, nil
+}
+
+func (r *Repository) SaveCustomInstructions(ctx context.Context, instructions *models.CustomInstructions) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(instructions.UserID) {
+		return fmt.Errorf("failed to save custom instructions: %v", errForeignKey)
+	}
+	if instructions.MetadataFields == nil {
+		return fmt.Errorf("failed to save custom instructions: metadata_fields is null")
+	}
+	row, ok := r.instructions[instructions.UserID]
+	if !ok {
+		row = &instructionsRow{inserted: r.insert()}
+		r.instructions[instructions.UserID] = row
+	}
+	instructions.UpdatedAt = time.Now()
+	row.CustomInstructions = *instructions
+	row.MetadataFields = slices.Clone(instructions.MetadataFields)
+	return nil
+}
+
+type chatInstructionsRow struct {
+	inserted
+	models.ChatInstructions
+}
+
+// GetChatInstructions returns the chat's settings, the defaults if none were saved
+func (r *Repository) GetChatInstructions(ctx context.Context, chatID uuid.UUID) (*models.ChatInstructions, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.chatInstructions[chatID]
+	if !ok {
+		return &models.ChatInstructions{ChatID: chatID}, nil
+	}
+	instructions := row.ChatInstructions
+	return &instructions, nil
+}
+
+func (r *Repository) SaveChatInstructions(ctx context.Context, instructions *models.ChatInstructions) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.chats[instructions.ChatID]; !ok {
+		return fmt.Errorf("failed to save chat instructions: %v", errForeignKey)
+	}
+	row, ok := r.chatInstructions[instructions.ChatID]
+	if !ok {
+		row = &chatInstructionsRow{inserted: r.insert()}
+		r.chatInstructions[instructions.ChatID] = row
+	}
+	instructions.UpdatedAt = time.Now()
+	row.ChatInstructions = *instructions
+	if instructions.Instructions != nil {
+		text := *instructions.Instructions
+		row.Instructions = &text
+	}
+	return nil
+}
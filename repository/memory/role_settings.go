@@ -0,0 +1,56 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+)
+
+type roleSettingRow struct {
+	inserted
+	models.RoleSetting
+}
+
+func (r *Repository) GetRoleSettings(ctx context.Context) ([]*models.RoleSetting, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	settings := []*models.RoleSetting{}
+	for _, row := range r.roleSettings {
+		setting := row.RoleSetting
+		settings = append(settings, &setting)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Role < settings[j].Role })
+	return settings, nil
+}
+
+// RoleRequiresMFA reports whether users with role must have a second factor.
+// Roles without settings do not.
+func (r *Repository) RoleRequiresMFA(ctx context.Context, role string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.roleSettings[role]
+	return ok && row.MFARequired, nil
+}
+
+func (r *Repository) SetRoleMFARequired(ctx context.Context, role string, required bool) (*models.RoleSetting, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if role != "user" && role != "admin" {
+		return nil, fmt.Errorf("failed to set role setting: %v", errCheck)
+	}
+	row, ok := r.roleSettings[role]
+	if !ok {
+		row = &roleSettingRow{inserted: r.insert(), RoleSetting: models.RoleSetting{Role: role}}
+		r.roleSettings[role] = row
+	}
+	row.MFARequired = required
+	row.UpdatedAt = time.Now()
+	setting := row.RoleSetting
+	return &setting, nil
+}
@@ -0,0 +1,233 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type scheduleRow struct {
+	inserted
+	models.Schedule
+}
+
+type scheduleRunRow struct {
+	inserted
+	models.ScheduleRun
+}
+
+func (r *Repository) scheduleReferencesExist(schedule *models.Schedule) bool {
+	if schedule.ChatID != nil {
+		if _, ok := r.chats[*schedule.ChatID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// schedule returns a copy of the schedule with its owner's timezone
+func (r *Repository) schedule(row *scheduleRow) *models.Schedule {
+	schedule := row.Schedule
+	schedule.Variables = maps.Clone(row.Variables)
+	schedule.Timezone = r.timezone(row.UserID)
+	return &schedule
+}
+
+func (r *Repository) deleteSchedule(id uuid.UUID) {
+	delete(r.schedules, id)
+	deleteRows(r.scheduleRuns, func(row *scheduleRunRow) bool { return row.ScheduleID == id })
+}
+
+func (r *Repository) CreateSchedule(ctx context.Context, schedule *models.Schedule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.userExists(schedule.UserID) || !r.scheduleReferencesExist(schedule) {
+		return fmt.Errorf("failed to create schedule: %v", errForeignKey)
+	}
+	schedule.ID = uuid.New()
+	schedule.CreatedAt = time.Now()
+	row := &scheduleRow{inserted: r.insert(), Schedule: *schedule}
+	row.Variables = maps.Clone(schedule.Variables)
+	row.LastRunAt = nil
+	row.Timezone = ""
+	r.schedules[schedule.ID] = row
+	return nil
+}
+
+func (r *Repository) GetScheduleByID(ctx context.Context, id uuid.UUID) (*models.Schedule, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.schedules[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get schedule by ID: %v", errNoRows)
+	}
+	return r.schedule(row), nil
+}
+
+func (r *Repository) GetSchedulesByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Schedule, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.schedules, func(row *scheduleRow) bool { return row.UserID == userID })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	var schedules []*models.Schedule
+	for _, row := range list {
+		schedules = append(schedules, r.schedule(row))
+	}
+	return schedules, nil
+}
+
+func (r *Repository) UpdateSchedule(ctx context.Context, schedule *models.Schedule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.schedules[schedule.ID]
+	if !ok {
+		return nil
+	}
+	if !r.scheduleReferencesExist(schedule) {
+		return fmt.Errorf("failed to update schedule: %v", errForeignKey)
+	}
+	row.Name = schedule.Name
+	row.CronExpression = schedule.CronExpression
+	row.Pattern = schedule.Pattern
+	row.Prompt = schedule.Prompt
+	row.Variables = maps.Clone(schedule.Variables)
+	row.AIModelVersion = schedule.AIModelVersion
+	row.ChatID = schedule.ChatID
+	row.AppendToChat = schedule.AppendToChat
+	row.IsActive = schedule.IsActive
+	row.NextRunAt = schedule.NextRunAt
+	return nil
+}
+
+func (r *Repository) DeleteSchedule(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deleteSchedule(id)
+	return nil
+}
+
+// SetScheduleChat pins the chat that later runs of the schedule append to
+func (r *Repository) SetScheduleChat(ctx context.Context, id uuid.UUID, chatID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.schedules[id]
+	if !ok {
+		return nil
+	}
+	if _, ok := r.chats[chatID]; !ok {
+		return fmt.Errorf("failed to set schedule chat: %v", errForeignKey)
+	}
+	row.ChatID = &chatID
+	return nil
+}
+
+// DeactivateSchedule stops a schedule from running until its owner turns it back on
+func (r *Repository) DeactivateSchedule(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.schedules[id]; ok {
+		row.IsActive = false
+	}
+	return nil
+}
+
+// GetDueScheduleIDs lists active schedules whose next run is at or before now
+func (r *Repository) GetDueScheduleIDs(ctx context.Context, now time.Time) ([]uuid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.schedules, func(row *scheduleRow) bool { return row.IsActive && !row.NextRunAt.After(now) })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].NextRunAt.Before(list[j].NextRunAt) })
+	var ids []uuid.UUID
+	for _, row := range list {
+		ids = append(ids, row.ID)
+	}
+	return ids, nil
+}
+
+// ClaimScheduleRun advances next_run_at using next if the schedule is still
+// due. Holding the lock throughout means a run is claimed once.
+func (r *Repository) ClaimScheduleRun(ctx context.Context, id uuid.UUID, now time.Time, next func(*models.Schedule) (time.Time, error)) (*models.Schedule, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.schedules[id]
+	if !ok || !row.IsActive || row.NextRunAt.After(now) {
+		return nil, false, nil
+	}
+	schedule := r.schedule(row)
+	nextRunAt, err := next(schedule)
+	if err != nil {
+		return nil, false, err
+	}
+	row.NextRunAt = nextRunAt
+	row.LastRunAt = &now
+	schedule.LastRunAt = &now
+	schedule.NextRunAt = nextRunAt
+	return schedule, true, nil
+}
+
+func (r *Repository) CreateScheduleRun(ctx context.Context, run *models.ScheduleRun) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.schedules[run.ScheduleID]; !ok {
+		return fmt.Errorf("failed to create schedule run: %v", errForeignKey)
+	}
+	run.ID = uuid.New()
+	run.StartedAt = time.Now()
+	r.scheduleRuns[run.ID] = &scheduleRunRow{inserted: r.insert(), ScheduleRun: models.ScheduleRun{
+		ID:         run.ID,
+		ScheduleID: run.ScheduleID,
+		Status:     run.Status,
+		StartedAt:  run.StartedAt,
+	}}
+	return nil
+}
+
+func (r *Repository) FinishScheduleRun(ctx context.Context, run *models.ScheduleRun) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.scheduleRuns[run.ID]
+	if !ok {
+		return nil
+	}
+	if run.ChatID != nil {
+		if _, ok := r.chats[*run.ChatID]; !ok {
+			return fmt.Errorf("failed to finish schedule run: %v", errForeignKey)
+		}
+	}
+	row.Status = run.Status
+	row.ChatID = run.ChatID
+	row.Error = run.Error
+	row.FinishedAt = timePtr(time.Now())
+	return nil
+}
+
+// GetScheduleRuns lists every run of a schedule, newest first
+func (r *Repository) GetScheduleRuns(ctx context.Context, scheduleID uuid.UUID) ([]*models.ScheduleRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.scheduleRuns, func(row *scheduleRunRow) bool { return row.ScheduleID == scheduleID })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	var runs []*models.ScheduleRun
+	for _, row := range list {
+		run := row.ScheduleRun
+		runs = append(runs, &run)
+	}
+	return runs, nil
+}
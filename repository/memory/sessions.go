@@ -0,0 +1,249 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type sessionRow struct {
+	inserted
+	models.Session
+}
+
+type refreshTokenRow struct {
+	inserted
+	models.RefreshToken
+}
+
+// CreateSession records a new login and stamps the user's last_login
+func (r *Repository) CreateSession(ctx context.Context, session *models.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[session.UserID]
+	if !ok {
+		return fmt.Errorf("failed to create session: %v", errForeignKey)
+	}
+	now := time.Now()
+	session.ID = uuid.New()
+	session.CreatedAt = now
+	session.LastUsedAt = now
+	r.sessions[session.ID] = &sessionRow{inserted: r.insert(), Session: models.Session{
+		ID:         session.ID,
+		UserID:     session.UserID,
+		UserAgent:  session.UserAgent,
+		IPAddress:  session.IPAddress,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}}
+	user.LastLogin = &now
+	return nil
+}
+
+func (r *Repository) GetSessionByID(ctx context.Context, id uuid.UUID) (*models.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get session by ID: %v", errNoRows)
+	}
+	session := row.Session
+	return &session, nil
+}
+
+// GetActiveSessionsByUserID lists a user's sessions that have not been revoked, most recently used first
+func (r *Repository) GetActiveSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := selectRows(r.sessions, func(row *sessionRow) bool { return row.UserID == userID && row.RevokedAt == nil })
+	sort.SliceStable(list, func(i, j int) bool { return list[i].LastUsedAt.After(list[j].LastUsedAt) })
+	var sessions []*models.Session
+	for _, row := range list {
+		session := row.Session
+		sessions = append(sessions, &session)
+	}
+	return sessions, nil
+}
+
+// TouchSession updates when the session was last used
+func (r *Repository) TouchSession(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if row, ok := r.sessions[id]; ok {
+		row.LastUsedAt = time.Now()
+	}
+	return nil
+}
+
+// RevokeSession ends a login along with its refresh tokens
+func (r *Repository) RevokeSession(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revokeFamily(id, time.Now())
+	return nil
+}
+
+// revokeFamily revokes the session and the refresh tokens issued for it
+func (r *Repository) revokeFamily(sessionID uuid.UUID, now time.Time) {
+	if row, ok := r.sessions[sessionID]; ok && row.RevokedAt == nil {
+		row.RevokedAt = &now
+	}
+	for _, row := range r.refreshTokens {
+		if row.FamilyID == sessionID && row.RevokedAt == nil {
+			row.RevokedAt = &now
+		}
+	}
+}
+
+// RevokeUserSessions ends every login of a user and returns the revoked session IDs
+func (r *Repository) RevokeUserSessions(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var ids []uuid.UUID
+	for _, row := range selectRows(r.sessions, func(row *sessionRow) bool { return row.UserID == userID && row.RevokedAt == nil }) {
+		row.RevokedAt = &now
+		ids = append(ids, row.ID)
+	}
+	for _, row := range r.refreshTokens {
+		if row.UserID == userID && row.RevokedAt == nil {
+			row.RevokedAt = &now
+		}
+	}
+	return ids, nil
+}
+
+func (r *Repository) deleteSession(id uuid.UUID) {
+	delete(r.sessions, id)
+	deleteRows(r.refreshTokens, func(row *refreshTokenRow) bool { return row.FamilyID == id })
+}
+
+// DeleteStaleSessions removes sessions that were revoked or idle for longer than olderThan
+func (r *Repository) DeleteStaleSessions(ctx context.Context, olderThan time.Duration) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	var deleted int64
+	for _, row := range r.sessions {
+		last := row.LastUsedAt
+		if row.RevokedAt != nil {
+			last = *row.RevokedAt
+		}
+		if last.Before(cutoff) {
+			r.deleteSession(row.ID)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r *Repository) uniqueRefreshTokenHash(tokenHash string) bool {
+	for _, row := range r.refreshTokens {
+		if row.TokenHash == tokenHash {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Repository) createRefreshToken(token *models.RefreshToken) error {
+	if _, ok := r.sessions[token.FamilyID]; !ok || !r.userExists(token.UserID) {
+		return errForeignKey
+	}
+	if !r.uniqueRefreshTokenHash(token.TokenHash) {
+		return errUnique
+	}
+	token.ID = uuid.New()
+	token.CreatedAt = time.Now()
+	r.refreshTokens[token.ID] = &refreshTokenRow{inserted: r.insert(), RefreshToken: models.RefreshToken{
+		ID:        token.ID,
+		FamilyID:  token.FamilyID,
+		UserID:    token.UserID,
+		TokenHash: token.TokenHash,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}}
+	return nil
+}
+
+func (r *Repository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.createRefreshToken(token); err != nil {
+		return fmt.Errorf("failed to create refresh token: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) refreshTokenByHash(tokenHash string) *refreshTokenRow {
+	for _, row := range r.refreshTokens {
+		if row.TokenHash == tokenHash {
+			return row
+		}
+	}
+	return nil
+}
+
+// RotateRefreshToken marks the token with oldHash as used and stores next in the
+// same family. Presenting a token that was already used revokes the family and its session.
+func (r *Repository) RotateRefreshToken(ctx context.Context, oldHash string, next *models.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.refreshTokenByHash(oldHash)
+	if current == nil {
+		return db.ErrRefreshTokenInvalid
+	}
+	now := time.Now()
+	if current.RevokedAt != nil || current.ExpiresAt.Before(now) ||
+		current.FamilyID != next.FamilyID || current.UserID != next.UserID {
+		return db.ErrRefreshTokenInvalid
+	}
+
+	if current.UsedAt != nil {
+		r.revokeFamily(current.FamilyID, now)
+		return db.ErrRefreshTokenReused
+	}
+
+	if err := r.createRefreshToken(next); err != nil {
+		return fmt.Errorf("failed to create rotated refresh token: %v", err)
+	}
+	current.UsedAt = &now
+	return nil
+}
+
+// GetRefreshTokenByHash retrieves a live refresh token record
+func (r *Repository) GetRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row := r.refreshTokenByHash(tokenHash)
+	if row == nil || row.RevokedAt != nil || !row.ExpiresAt.After(time.Now()) {
+		return nil, db.ErrRefreshTokenInvalid
+	}
+	token := row.RefreshToken
+	return &token, nil
+}
+
+// DeleteExpiredRefreshTokens removes records that can no longer be presented.
+// Used tokens are kept until they expire so reuse can still be detected.
+func (r *Repository) DeleteExpiredRefreshTokens(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.refreshTokens, func(row *refreshTokenRow) bool { return row.ExpiresAt.Before(now) }), nil
+}
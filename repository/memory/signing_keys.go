@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+)
+
+type signingKeyRow struct {
+	inserted
+	models.SigningKey
+}
+
+// GetSigningKeys returns the JWT signing keys that have not expired, oldest first
+func (r *Repository) GetSigningKeys(ctx context.Context) ([]*models.SigningKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	list := byTime(selectRows(r.signingKeys, func(row *signingKeyRow) bool { return row.ExpiresAt.After(now) }),
+		func(row *signingKeyRow) time.Time { return row.CreatedAt })
+	keys := []*models.SigningKey{}
+	for _, row := range list {
+		key := row.SigningKey
+		key.PrivateKey = slices.Clone(row.PrivateKey)
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+func (r *Repository) CreateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.signingKeys[key.ID]; ok {
+		return fmt.Errorf("failed to create signing key: %v", errUnique)
+	}
+	row := &signingKeyRow{inserted: r.insert(), SigningKey: *key}
+	row.PrivateKey = slices.Clone(key.PrivateKey)
+	r.signingKeys[key.ID] = row
+	return nil
+}
+
+func (r *Repository) DeleteExpiredSigningKeys(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.signingKeys, func(row *signingKeyRow) bool { return row.ExpiresAt.Before(now) }), nil
+}
@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+type webauthnChallengeRow struct {
+	inserted
+	models.WebAuthnChallenge
+}
+
+type webauthnCredentialRow struct {
+	inserted
+	models.WebAuthnCredential
+}
+
+func webauthnCredential(row *webauthnCredentialRow) *models.WebAuthnCredential {
+	credential := row.WebAuthnCredential
+	credential.CredentialID = slices.Clone(row.CredentialID)
+	credential.PublicKey = slices.Clone(row.PublicKey)
+	credential.AAGUID = slices.Clone(row.AAGUID)
+	credential.Transports = slices.Clone(row.Transports)
+	return &credential
+}
+
+func (r *Repository) CreateWebAuthnChallenge(ctx context.Context, challenge *models.WebAuthnChallenge) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if challenge.UserID != nil && !r.userExists(*challenge.UserID) {
+		return fmt.Errorf("failed to create webauthn challenge: %v", errForeignKey)
+	}
+	if _, ok := r.webauthnChallenges[challenge.Challenge]; ok {
+		return fmt.Errorf("failed to create webauthn challenge: %v", errUnique)
+	}
+	r.webauthnChallenges[challenge.Challenge] = &webauthnChallengeRow{inserted: r.insert(), WebAuthnChallenge: *challenge}
+	return nil
+}
+
+// ConsumeWebAuthnChallenge deletes and returns an unexpired challenge, so each ceremony completes once
+func (r *Repository) ConsumeWebAuthnChallenge(ctx context.Context, challenge string, purpose string) (*models.WebAuthnChallenge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.webauthnChallenges[challenge]
+	if !ok || row.Purpose != purpose || !row.ExpiresAt.After(time.Now()) {
+		return nil, db.ErrWebAuthnChallengeInvalid
+	}
+	delete(r.webauthnChallenges, challenge)
+	result := row.WebAuthnChallenge
+	return &result, nil
+}
+
+func (r *Repository) DeleteExpiredWebAuthnChallenges(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return deleteRows(r.webauthnChallenges, func(row *webauthnChallengeRow) bool { return row.ExpiresAt.Before(now) }), nil
+}
+
+func (r *Repository) credentialByCredentialID(credentialID []byte) *webauthnCredentialRow {
+	for _, row := range r.webauthnCredentials {
+		if bytes.Equal(row.CredentialID, credentialID) {
+			return row
+		}
+	}
+	return nil
+}
+
+func (r *Repository) CreateWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if credential.Transports == nil {
+		credential.Transports = []string{}
+	}
+	if !r.userExists(credential.UserID) {
+		return fmt.Errorf("failed to create webauthn credential: %v", errForeignKey)
+	}
+	if r.credentialByCredentialID(credential.CredentialID) != nil {
+		return fmt.Errorf("failed to create webauthn credential: %v", errUnique)
+	}
+	credential.ID = uuid.New()
+	credential.CreatedAt = time.Now()
+	credential.LastUsedAt = nil
+	row := &webauthnCredentialRow{inserted: r.insert(), WebAuthnCredential: *credential}
+	row.WebAuthnCredential = *webauthnCredential(row)
+	r.webauthnCredentials[credential.ID] = row
+	return nil
+}
+
+func (r *Repository) GetWebAuthnCredentialByCredentialID(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row := r.credentialByCredentialID(credentialID)
+	if row == nil {
+		return nil, db.ErrWebAuthnCredentialNotFound
+	}
+	return webauthnCredential(row), nil
+}
+
+func (r *Repository) GetWebAuthnCredentialsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := byTime(selectRows(r.webauthnCredentials, func(row *webauthnCredentialRow) bool { return row.UserID == userID }),
+		func(row *webauthnCredentialRow) time.Time { return row.CreatedAt })
+	credentials := []*models.WebAuthnCredential{}
+	for _, row := range list {
+		credentials = append(credentials, webauthnCredential(row))
+	}
+	return credentials, nil
+}
+
+// UseWebAuthnCredential stores the new signature counter. It returns false if
+// another request already stored the same or a higher count, which means the
+// assertion was replayed or the credential cloned.
+func (r *Repository) UseWebAuthnCredential(ctx context.Context, id uuid.UUID, signCount uint32) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.webauthnCredentials[id]
+	if !ok || (signCount != 0 && row.SignCount >= signCount) {
+		return false, nil
+	}
+	row.SignCount = signCount
+	row.LastUsedAt = timePtr(time.Now())
+	return true, nil
+}
+
+func (r *Repository) DeleteWebAuthnCredential(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	row, ok := r.webauthnCredentials[id]
+	if !ok || row.UserID != userID {
+		return false, nil
+	}
+	delete(r.webauthnCredentials, id)
+	return true, nil
+}
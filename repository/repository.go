@@ -2,65 +2,296 @@ package repository
 
 import (
 	"context"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/FiveEightyEight/gippity-serv/models"
 )
 
+// Repository is everything the handlers, jobs and auth packages need from storage.
+// db.PostgresRepository, sqlite.Repository and memory.Repository implement it.
+type Repository interface {
+	UserRepository
+	UserMetadataRepository
+	UserPreferencesRepository
+	InstructionsRepository
+	ChatRepository
+	MessageRepository
+	AIModelRepository
+	JobRepository
+	ScheduleRepository
+	SessionRepository
+	EmailTokenRepository
+	MFARepository
+	APIKeyRepository
+	IdentityRepository
+	WebAuthnRepository
+	SecurityRepository
+	SigningKeyRepository
+	RoleSettingRepository
+	OrganizationRepository
+	DataExportRepository
+	UnitOfWork
+
+	Close()
+}
+
 // UserRepository defines the interface for user-related database operations
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *models.User) error
 	GetUserByID(ctx context.Context, id int) (*models.User, error)
 	GetUserByUsername(ctx context.Context, username string) (*models.User, error)
+	GetUserByUUID(ctx context.Context, id uuid.UUID) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
 	UpdateUser(ctx context.Context, user *models.User) error
-	DeleteUser(ctx context.Context, id int) error
+	UpdateUserPasswordHash(ctx context.Context, id uuid.UUID, passwordHash string) error
+	UpdateUserProfile(ctx context.Context, id uuid.UUID, username string, email string) error
+	ListUsers(ctx context.Context, search string, limit int, offset int) ([]*models.User, error)
+	SetUserActive(ctx context.Context, id uuid.UUID, active bool) error
+	SetUserRole(ctx context.Context, id uuid.UUID, role string) error
+	DeleteUser(ctx context.Context, id uuid.UUID) error
+	ScheduleUserDeletion(ctx context.Context, id uuid.UUID, at time.Time) error
+	CancelUserDeletion(ctx context.Context, id uuid.UUID) error
+	PurgeDeletedUsers(ctx context.Context) (int64, error)
 }
 
 // UserMetadataRepository defines the interface for user metadata-related database operations
 type UserMetadataRepository interface {
-	CreateUserMetadata(ctx context.Context, metadata *models.UserMetadata) error
-	GetUserMetadataByUserID(ctx context.Context, userID int) (*models.UserMetadata, error)
-	UpdateUserMetadata(ctx context.Context, metadata *models.UserMetadata) error
-	DeleteUserMetadata(ctx context.Context, userID int) error
+	GetUserMetadata(ctx context.Context, userID uuid.UUID) (*models.UserMetadata, error)
+	SaveUserMetadata(ctx context.Context, metadata *models.UserMetadata) error
+	GetUserTimezone(ctx context.Context, userID uuid.UUID) (string, error)
+}
+
+// UserPreferencesRepository defines the interface for user preferences-related database operations
+type UserPreferencesRepository interface {
+	GetUserPreferences(ctx context.Context, userID uuid.UUID) (*models.UserPreferences, error)
+	SaveUserPreferences(ctx context.Context, preferences *models.UserPreferences) error
+	GetDefaultAIModelVersion(ctx context.Context, userID uuid.UUID) (string, error)
+}
+
+// InstructionsRepository defines the interface for custom instruction-related database operations
+type InstructionsRepository interface {
+	GetCustomInstructions(ctx context.Context, userID uuid.UUID) (*models.CustomInstructions, error)
+	SaveCustomInstructions(ctx context.Context, instructions *models.CustomInstructions) error
+	GetChatInstructions(ctx context.Context, chatID uuid.UUID) (*models.ChatInstructions, error)
+	SaveChatInstructions(ctx context.Context, instructions *models.ChatInstructions) error
 }
 
 // ChatRepository defines the interface for chat-related database operations
 type ChatRepository interface {
-	CreateChat(ctx context.Context, chat *models.Chat) error
-	GetChatByID(ctx context.Context, id int) (*models.Chat, error)
-	GetChatsByUserID(ctx context.Context, userID int) ([]*models.Chat, error)
+	CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error)
+	GetChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error)
+	GetChatsByUserID(ctx context.Context, userID uuid.UUID, sortByLastUpdated bool) ([]*models.Chat, error)
+	GetChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error)
 	UpdateChat(ctx context.Context, chat *models.Chat) error
-	DeleteChat(ctx context.Context, id int) error
+	TouchChat(ctx context.Context, id uuid.UUID, at time.Time) error
+	DeleteChat(ctx context.Context, id uuid.UUID) error
+	GetTrashedChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error)
+	GetTrashedChatsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Chat, error)
+	GetTrashedChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error)
+	RestoreChat(ctx context.Context, id uuid.UUID) error
+	PurgeTrash(ctx context.Context, olderThan time.Duration) (int64, error)
 }
 
 // MessageRepository defines the interface for message-related database operations
 type MessageRepository interface {
 	CreateMessage(ctx context.Context, message *models.Message) error
-	GetMessageByID(ctx context.Context, id int) (*models.Message, error)
-	GetMessagesByChatID(ctx context.Context, chatID int) ([]*models.Message, error)
+	GetMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error)
+	GetMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error)
+	GetMessageContentsByChatID(ctx context.Context, chatID uuid.UUID) ([]models.MessageContent, error)
 	UpdateMessage(ctx context.Context, message *models.Message) error
-	DeleteMessage(ctx context.Context, id int) error
+	FinishMessage(ctx context.Context, message *models.Message) error
+	FailStaleMessages(ctx context.Context, olderThan time.Duration) (int64, error)
+	DeleteMessage(ctx context.Context, id uuid.UUID) error
+	GetTrashedMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error)
+	GetTrashedMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error)
+	RestoreMessage(ctx context.Context, id uuid.UUID) error
+}
+
+// ConversationTx is what a unit of work can do to chats and messages
+type ConversationTx interface {
+	CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error)
+	TouchChat(ctx context.Context, id uuid.UUID, at time.Time) error
+	CreateMessage(ctx context.Context, message *models.Message) error
+	FinishMessage(ctx context.Context, message *models.Message) error
+}
+
+// UnitOfWork groups writes that must commit together
+type UnitOfWork interface {
+	// InTx runs fn in a transaction that commits if fn returns nil and rolls
+	// back otherwise. fn should only use tx and do no slow work, since the
+	// transaction holds a connection, and in SQLite and memory the write lock.
+	InTx(ctx context.Context, fn func(tx ConversationTx) error) error
 }
 
 // AIModelRepository defines the interface for AI model-related database operations
 type AIModelRepository interface {
 	CreateAIModel(ctx context.Context, model *models.AIModel) error
-	GetAIModelByID(ctx context.Context, id int) (*models.AIModel, error)
-	GetAllActiveAIModels(ctx context.Context) ([]*models.AIModel, error)
+	GetAIModelByID(ctx context.Context, id uuid.UUID) (*models.AIModel, error)
+	GetAllAIModels(ctx context.Context) ([]*models.AIModel, error)
 	UpdateAIModel(ctx context.Context, model *models.AIModel) error
-	DeleteAIModel(ctx context.Context, id int) error
+	DeleteAIModel(ctx context.Context, id uuid.UUID) error
 }
 
-// ChatAIModelRepository defines the interface for chat-AI model association-related database operations
-type ChatAIModelRepository interface {
-	AssociateChatWithAIModel(ctx context.Context, chatID, aiModelID int) error
-	GetAIModelsByChatID(ctx context.Context, chatID int) ([]*models.AIModel, error)
-	RemoveChatAIModelAssociation(ctx context.Context, chatID, aiModelID int) error
+// JobRepository defines the interface for batch job-related database operations
+type JobRepository interface {
+	CreateJob(ctx context.Context, job *models.Job, inputs []string) error
+	GetJobByID(ctx context.Context, id uuid.UUID) (*models.Job, error)
+	GetJobsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Job, error)
+	GetJobItems(ctx context.Context, jobID uuid.UUID, offset, limit int) ([]*models.JobItem, error)
+	ClaimJobItems(ctx context.Context, limit int) ([]*models.JobItem, error)
+	CompleteJobItem(ctx context.Context, item *models.JobItem) error
+	FailJobItem(ctx context.Context, item *models.JobItem, retryAt *time.Time) error
+	RequeueStaleJobItems(ctx context.Context, olderThan time.Duration, maxAttempts int) (int64, error)
 }
 
-// UserPreferencesRepository defines the interface for user preferences-related database operations
-type UserPreferencesRepository interface {
-	CreateUserPreferences(ctx context.Context, preferences *models.UserPreferences) error
-	GetUserPreferencesByUserID(ctx context.Context, userID int) (*models.UserPreferences, error)
-	UpdateUserPreferences(ctx context.Context, preferences *models.UserPreferences) error
-	DeleteUserPreferences(ctx context.Context, userID int) error
+// ScheduleRepository defines the interface for schedule-related database operations
+type ScheduleRepository interface {
+	CreateSchedule(ctx context.Context, schedule *models.Schedule) error
+	GetScheduleByID(ctx context.Context, id uuid.UUID) (*models.Schedule, error)
+	GetSchedulesByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Schedule, error)
+	UpdateSchedule(ctx context.Context, schedule *models.Schedule) error
+	DeleteSchedule(ctx context.Context, id uuid.UUID) error
+	SetScheduleChat(ctx context.Context, id uuid.UUID, chatID uuid.UUID) error
+	DeactivateSchedule(ctx context.Context, id uuid.UUID) error
+	GetDueScheduleIDs(ctx context.Context, now time.Time) ([]uuid.UUID, error)
+	ClaimScheduleRun(ctx context.Context, id uuid.UUID, now time.Time, next func(*models.Schedule) (time.Time, error)) (*models.Schedule, bool, error)
+	CreateScheduleRun(ctx context.Context, run *models.ScheduleRun) error
+	FinishScheduleRun(ctx context.Context, run *models.ScheduleRun) error
+	GetScheduleRuns(ctx context.Context, scheduleID uuid.UUID) ([]*models.ScheduleRun, error)
+}
+
+// SessionRepository defines the interface for session and refresh token-related database operations
+type SessionRepository interface {
+	CreateSession(ctx context.Context, session *models.Session) error
+	GetSessionByID(ctx context.Context, id uuid.UUID) (*models.Session, error)
+	GetActiveSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Session, error)
+	TouchSession(ctx context.Context, id uuid.UUID) error
+	RevokeSession(ctx context.Context, id uuid.UUID) error
+	RevokeUserSessions(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+	DeleteStaleSessions(ctx context.Context, olderThan time.Duration) (int64, error)
+	CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, oldHash string, next *models.RefreshToken) error
+	GetRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error)
+	DeleteExpiredRefreshTokens(ctx context.Context) (int64, error)
+}
+
+// EmailTokenRepository defines the interface for email verification-related database operations
+type EmailTokenRepository interface {
+	CreateEmailToken(ctx context.Context, token *models.EmailToken) error
+	ConsumeEmailToken(ctx context.Context, tokenHash string, purpose string) (uuid.UUID, error)
+	DeleteExpiredEmailTokens(ctx context.Context) (int64, error)
+	MarkEmailVerified(ctx context.Context, userID uuid.UUID) error
+	IsEmailVerified(ctx context.Context, userID uuid.UUID) (bool, error)
+}
+
+// MFARepository defines the interface for second factor-related database operations
+type MFARepository interface {
+	CreatePendingTOTP(ctx context.Context, userID uuid.UUID, secret string) error
+	GetTOTP(ctx context.Context, userID uuid.UUID) (*models.UserTOTP, error)
+	IsMFAEnabled(ctx context.Context, userID uuid.UUID) (bool, error)
+	GetMFAMethods(ctx context.Context, userID uuid.UUID) ([]string, error)
+	UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	EnableTOTP(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, userID uuid.UUID) error
+	ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error)
+	UseMFAChallenge(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+	DeleteExpiredMFAChallenges(ctx context.Context) (int64, error)
+}
+
+// APIKeyRepository defines the interface for api key-related database operations
+type APIKeyRepository interface {
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error)
+	GetAPIKeysByUserID(ctx context.Context, userID uuid.UUID) ([]*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error)
+	TouchAPIKey(ctx context.Context, id uuid.UUID) error
+}
+
+// IdentityRepository defines the interface for single sign-on-related database operations
+type IdentityRepository interface {
+	CreateOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error
+	ConsumeOIDCLoginState(ctx context.Context, stateHash string, provider string) (*models.OIDCLoginState, error)
+	DeleteExpiredOIDCLoginStates(ctx context.Context) (int64, error)
+	GetUserIDByIdentity(ctx context.Context, provider string, subject string) (uuid.UUID, error)
+	UpsertIdentity(ctx context.Context, identity *models.UserIdentity) error
+	GetIdentitiesByUserID(ctx context.Context, userID uuid.UUID) ([]*models.UserIdentity, error)
+}
+
+// WebAuthnRepository defines the interface for passkey-related database operations
+type WebAuthnRepository interface {
+	CreateWebAuthnChallenge(ctx context.Context, challenge *models.WebAuthnChallenge) error
+	ConsumeWebAuthnChallenge(ctx context.Context, challenge string, purpose string) (*models.WebAuthnChallenge, error)
+	DeleteExpiredWebAuthnChallenges(ctx context.Context) (int64, error)
+	CreateWebAuthnCredential(ctx context.Context, credential *models.WebAuthnCredential) error
+	GetWebAuthnCredentialByCredentialID(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error)
+	GetWebAuthnCredentialsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.WebAuthnCredential, error)
+	UseWebAuthnCredential(ctx context.Context, id uuid.UUID, signCount uint32) (bool, error)
+	DeleteWebAuthnCredential(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error)
+}
+
+// SecurityRepository defines the interface for login throttling and security event-related database operations
+type SecurityRepository interface {
+	IncrementAuthThrottle(ctx context.Context, key string, window time.Duration) (int, error)
+	LockAuthThrottle(ctx context.Context, key string, until time.Time) error
+	GetAuthLockedUntil(ctx context.Context, keys []string) (*time.Time, error)
+	ClearAuthThrottle(ctx context.Context, key string) (bool, error)
+	DeleteStaleAuthThrottles(ctx context.Context, window time.Duration) (int64, error)
+	CreateSecurityEvent(ctx context.Context, event *models.SecurityEvent) error
+	GetSecurityEvents(ctx context.Context, userID *uuid.UUID, limit int, offset int) ([]*models.SecurityEvent, error)
+}
+
+// SigningKeyRepository defines the interface for JWT signing key-related database operations
+type SigningKeyRepository interface {
+	GetSigningKeys(ctx context.Context) ([]*models.SigningKey, error)
+	CreateSigningKey(ctx context.Context, key *models.SigningKey) error
+	DeleteExpiredSigningKeys(ctx context.Context) (int64, error)
+}
+
+// RoleSettingRepository defines the interface for per-role policy-related database operations
+type RoleSettingRepository interface {
+	GetRoleSettings(ctx context.Context) ([]*models.RoleSetting, error)
+	RoleRequiresMFA(ctx context.Context, role string) (bool, error)
+	SetRoleMFARequired(ctx context.Context, role string, required bool) (*models.RoleSetting, error)
+}
+
+// OrganizationRepository defines the interface for organization and workspace-related database operations
+type OrganizationRepository interface {
+	CreateOrganization(ctx context.Context, org *models.Organization, ownerID uuid.UUID) error
+	GetOrganizationsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Organization, error)
+	GetOrganizationRole(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) (string, error)
+	RenameOrganization(ctx context.Context, orgID uuid.UUID, name string) error
+	DeleteOrganization(ctx context.Context, orgID uuid.UUID) error
+	GetOrganizationMembers(ctx context.Context, orgID uuid.UUID) ([]*models.OrganizationMember, error)
+	AddOrganizationMember(ctx context.Context, member *models.OrganizationMember) error
+	SetOrganizationMemberRole(ctx context.Context, orgID uuid.UUID, userID uuid.UUID, role string) error
+	RemoveOrganizationMember(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) error
+	CreateWorkspace(ctx context.Context, workspace *models.Workspace) error
+	GetWorkspaceByID(ctx context.Context, id uuid.UUID) (*models.Workspace, error)
+	GetWorkspacesByOrganizationID(ctx context.Context, orgID uuid.UUID) ([]*models.Workspace, error)
+	RenameWorkspace(ctx context.Context, id uuid.UUID, name string) error
+	DeleteWorkspace(ctx context.Context, id uuid.UUID) error
+	GetWorkspaceRole(ctx context.Context, workspaceID uuid.UUID, userID uuid.UUID) (string, error)
+	GetWorkspaceModels(ctx context.Context, workspaceID uuid.UUID) ([]*models.AIModel, error)
+	SetWorkspaceModels(ctx context.Context, workspaceID uuid.UUID, modelIDs []uuid.UUID) error
+	IsModelAllowedInWorkspace(ctx context.Context, workspaceID uuid.UUID, version string) (bool, error)
+	GetWorkspacePatterns(ctx context.Context, workspaceID uuid.UUID) ([]*models.WorkspacePattern, error)
+	GetWorkspacePattern(ctx context.Context, workspaceID uuid.UUID, name string) (*models.WorkspacePattern, error)
+	SaveWorkspacePattern(ctx context.Context, pattern *models.WorkspacePattern) (bool, error)
+	DeleteWorkspacePattern(ctx context.Context, workspaceID uuid.UUID, name string) error
+}
+
+// DataExportRepository defines the interface for data export-related database operations
+type DataExportRepository interface {
+	GetUserExportFiles(ctx context.Context, userID uuid.UUID) ([]models.ExportFile, error)
+	CreateDataExport(ctx context.Context, userID uuid.UUID) (*models.DataExport, error)
+	GetDataExportsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.DataExport, error)
+	GetDataExportArchive(ctx context.Context, id uuid.UUID, userID uuid.UUID) ([]byte, error)
+	ClaimDataExport(ctx context.Context, staleAfter time.Duration) (*models.DataExport, error)
+	CompleteDataExport(ctx context.Context, id uuid.UUID, archive []byte, expiresAt time.Time) error
+	FailDataExport(ctx context.Context, id uuid.UUID, cause string, expiresAt time.Time) error
+	DeleteExpiredDataExports(ctx context.Context) (int64, error)
 }
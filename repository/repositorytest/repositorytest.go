@@ -0,0 +1,715 @@
+// Package repositorytest checks that an implementation of
+// repository.Repository behaves the way the handlers expect, so memory,
+// SQLite and Postgres can be held to the same contract.
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/google/uuid"
+)
+
+// Run runs the contract against the repository returned by newRepo. The
+// repository may hold rows from earlier runs, so every test creates its own
+// users and leaves shared settings as it found them.
+func Run(t *testing.T, newRepo func(t *testing.T) repository.Repository) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo repository.Repository)
+	}{
+		{"Users", testUsers},
+		{"ChatTrash", testChatTrash},
+		{"MessageTrash", testMessageTrash},
+		{"InTx", testInTx},
+		{"InTxRollsBackEveryWrite", testInTxRollsBackEveryWrite},
+		{"MessageStatus", testMessageStatus},
+		{"RefreshTokens", testRefreshTokens},
+		{"MFAChallenges", testMFAChallenges},
+		{"RecoveryCodes", testRecoveryCodes},
+		{"APIKeys", testAPIKeys},
+		{"EmailTokens", testEmailTokens},
+		{"RoleSettings", testRoleSettings},
+		{"Preferences", testPreferences},
+		{"Instructions", testInstructions},
+		{"AccountDeletion", testAccountDeletion},
+		{"DataExports", testDataExports},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepo(t))
+		})
+	}
+}
+
+// createUser inserts a user whose name and email no earlier run has taken
+func createUser(t *testing.T, repo repository.Repository) *models.User {
+	t.Helper()
+	name := "user-" + uuid.NewString()[:8]
+	user := &models.User{Username: name, Email: name + "@example.com", PasswordHash: "hash"}
+	if err := repo.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+func createChat(t *testing.T, repo repository.Repository, user *models.User) *models.Chat {
+	t.Helper()
+	now := time.Now()
+	chat, err := repo.CreateChat(context.Background(), &models.Chat{UserID: user.ID, Title: "chat", CreatedAt: now, LastUpdated: now})
+	if err != nil {
+		t.Fatalf("failed to create chat: %v", err)
+	}
+	return chat
+}
+
+func createMessage(t *testing.T, repo repository.Repository, chat *models.Chat, content string) *models.Message {
+	t.Helper()
+	message := &models.Message{ChatID: chat.ID, UserID: chat.UserID, Role: "user", Content: content, CreatedAt: time.Now()}
+	if err := repo.CreateMessage(context.Background(), message); err != nil {
+		t.Fatalf("failed to create message: %v", err)
+	}
+	return message
+}
+
+func testUsers(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+
+	byUsername, err := repo.GetUserByUsername(ctx, user.Username)
+	if err != nil || byUsername.ID != user.ID {
+		t.Fatalf("GetUserByUsername = %v, %v; want user %s", byUsername, err, user.ID)
+	}
+	byID, err := repo.GetUserByUUID(ctx, user.ID)
+	if err != nil || byID.Email != user.Email || !byID.IsActive || byID.Role != "user" {
+		t.Fatalf("GetUserByUUID = %+v, %v", byID, err)
+	}
+	if _, err := repo.GetUserByUsername(ctx, "missing-"+uuid.NewString()); !errors.Is(err, db.ErrUserNotFound) {
+		t.Fatalf("GetUserByUsername of a missing user returned %v, want ErrUserNotFound", err)
+	}
+	if err := repo.CreateUser(ctx, &models.User{Username: user.Username, Email: "other-" + user.Email, PasswordHash: "hash"}); err == nil {
+		t.Fatal("CreateUser accepted a taken username")
+	}
+
+	if err := repo.SetUserActive(ctx, user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetUserRole(ctx, user.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	byID, err = repo.GetUserByUUID(ctx, user.ID)
+	if err != nil || byID.IsActive || byID.Role != "admin" {
+		t.Fatalf("after deactivating and promoting, GetUserByUUID = %+v, %v", byID, err)
+	}
+	if err := repo.SetUserRole(ctx, uuid.New(), "admin"); !errors.Is(err, db.ErrUserNotFound) {
+		t.Fatalf("SetUserRole of a missing user returned %v, want ErrUserNotFound", err)
+	}
+}
+
+func testChatTrash(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	chat := createChat(t, repo, user)
+	createMessage(t, repo, chat, "hello")
+
+	if err := repo.DeleteChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetChatByID(ctx, chat.ID); !errors.Is(err, db.ErrChatNotFound) {
+		t.Fatalf("GetChatByID of a trashed chat returned %v, want ErrChatNotFound", err)
+	}
+	chats, err := repo.GetChatsByUserID(ctx, user.ID, false)
+	if err != nil || len(chats) != 0 {
+		t.Fatalf("GetChatsByUserID = %d chats, %v; want none", len(chats), err)
+	}
+	trashed, err := repo.GetTrashedChatsByUserID(ctx, user.ID)
+	if err != nil || len(trashed) != 1 || trashed[0].ID != chat.ID {
+		t.Fatalf("GetTrashedChatsByUserID = %d chats, %v; want the deleted one", len(trashed), err)
+	}
+
+	// A trashed chat takes no new messages and is not touched
+	message := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "user", Content: "late", CreatedAt: time.Now()}
+	if err := repo.CreateMessage(ctx, message); !errors.Is(err, db.ErrChatTrashed) {
+		t.Fatalf("CreateMessage in a trashed chat returned %v, want ErrChatTrashed", err)
+	}
+	if err := repo.TouchChat(ctx, chat.ID, time.Now()); !errors.Is(err, db.ErrChatTrashed) {
+		t.Fatalf("TouchChat of a trashed chat returned %v, want ErrChatTrashed", err)
+	}
+	if err := repo.TouchChat(ctx, uuid.New(), time.Now()); !errors.Is(err, db.ErrChatNotFound) {
+		t.Fatalf("TouchChat of a missing chat returned %v, want ErrChatNotFound", err)
+	}
+
+	if err := repo.RestoreChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RestoreChat(ctx, chat.ID); !errors.Is(err, db.ErrChatNotFound) {
+		t.Fatalf("restoring a live chat returned %v, want ErrChatNotFound", err)
+	}
+	messages, err := repo.GetMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("restored chat has %d messages (%v), want 1", len(messages), err)
+	}
+}
+
+func testMessageTrash(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	chat := createChat(t, repo, user)
+	first := createMessage(t, repo, chat, "first")
+	second := createMessage(t, repo, chat, "second")
+
+	if _, err := repo.GetTrashedMessageByID(ctx, first.ID); !errors.Is(err, db.ErrMessageNotFound) {
+		t.Fatalf("GetTrashedMessageByID of a live message returned %v, want ErrMessageNotFound", err)
+	}
+	if err := repo.DeleteMessage(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetMessageByID(ctx, first.ID); !errors.Is(err, db.ErrMessageNotFound) {
+		t.Fatalf("GetMessageByID of a trashed message returned %v, want ErrMessageNotFound", err)
+	}
+	messages, err := repo.GetMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(messages) != 1 || messages[0].ID != second.ID {
+		t.Fatalf("GetMessagesByChatID = %d messages, %v; want only the second", len(messages), err)
+	}
+	trashed, err := repo.GetTrashedMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(trashed) != 1 || trashed[0].ID != first.ID || trashed[0].DeletedAt == nil {
+		t.Fatalf("GetTrashedMessagesByChatID = %d messages, %v; want the first with deleted_at", len(trashed), err)
+	}
+
+	if err := repo.RestoreMessage(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RestoreMessage(ctx, first.ID); !errors.Is(err, db.ErrMessageNotFound) {
+		t.Fatalf("restoring a live message returned %v, want ErrMessageNotFound", err)
+	}
+
+	// Messages of a trashed chat can only come back with the chat
+	if err := repo.DeleteMessage(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteChat(ctx, chat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RestoreMessage(ctx, first.ID); !errors.Is(err, db.ErrMessageNotFound) {
+		t.Fatalf("restoring a message of a trashed chat returned %v, want ErrMessageNotFound", err)
+	}
+	trashed, err = repo.GetTrashedMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(trashed) != 0 {
+		t.Fatalf("GetTrashedMessagesByChatID of a trashed chat = %d messages, %v; want none", len(trashed), err)
+	}
+}
+
+func testInTx(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	chat := createChat(t, repo, user)
+
+	rollback := errors.New("roll back")
+	err := repo.InTx(ctx, func(tx repository.ConversationTx) error {
+		message := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "user", Content: "discarded", CreatedAt: time.Now()}
+		if err := tx.CreateMessage(ctx, message); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("InTx returned %v, want the error of fn", err)
+	}
+	messages, err := repo.GetMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("rolled back unit of work left %d messages (%v)", len(messages), err)
+	}
+
+	err = repo.InTx(ctx, func(tx repository.ConversationTx) error {
+		message := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "user", Content: "kept", CreatedAt: time.Now()}
+		if err := tx.CreateMessage(ctx, message); err != nil {
+			return err
+		}
+		return tx.TouchChat(ctx, chat.ID, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err = repo.GetMessagesByChatID(ctx, chat.ID)
+	if err != nil || len(messages) != 1 || messages[0].Content != "kept" {
+		t.Fatalf("committed unit of work left %d messages (%v), want 1", len(messages), err)
+	}
+}
+
+func testInTxRollsBackEveryWrite(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	chat := createChat(t, repo, user)
+	reply := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "assistant", Status: db.MessagePending, CreatedAt: time.Now()}
+	if err := repo.CreateMessage(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := errors.New("roll back")
+	err := repo.InTx(ctx, func(tx repository.ConversationTx) error {
+		now := time.Now()
+		created, err := tx.CreateChat(ctx, &models.Chat{UserID: user.ID, Title: "discarded", CreatedAt: now, LastUpdated: now})
+		if err != nil {
+			return err
+		}
+		if err := tx.CreateMessage(ctx, &models.Message{ChatID: created.ID, UserID: user.ID, Role: "user", Content: "discarded", CreatedAt: now}); err != nil {
+			return err
+		}
+		if err := tx.FinishMessage(ctx, &models.Message{ID: reply.ID, Content: "discarded", Status: db.MessageComplete}); err != nil {
+			return err
+		}
+		if err := tx.TouchChat(ctx, chat.ID, now.Add(time.Hour)); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("InTx returned %v, want the error of fn", err)
+	}
+
+	chats, err := repo.GetChatsByUserID(ctx, user.ID, false)
+	if err != nil || len(chats) != 1 || chats[0].ID != chat.ID {
+		t.Fatalf("after a rollback GetChatsByUserID = %d chats, %v; want only the first", len(chats), err)
+	}
+	if !chats[0].LastUpdated.Before(time.Now()) {
+		t.Fatalf("a rolled back TouchChat left last_updated at %v", chats[0].LastUpdated)
+	}
+	message, err := repo.GetMessageByID(ctx, reply.ID)
+	if err != nil || message.Status != db.MessagePending || message.Content != "" {
+		t.Fatalf("a rolled back FinishMessage left %+v, %v", message, err)
+	}
+}
+
+func testMessageStatus(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	chat := createChat(t, repo, user)
+	question := createMessage(t, repo, chat, "question")
+	if question.Status != db.MessageComplete {
+		t.Fatalf("a message created without a status is %q, want complete", question.Status)
+	}
+	if err := repo.CreateMessage(ctx, &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "user", Status: "lost", CreatedAt: time.Now()}); err == nil {
+		t.Fatal("CreateMessage accepted an unknown status")
+	}
+
+	reply := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "assistant", Status: db.MessagePending, CreatedAt: time.Now()}
+	if err := repo.CreateMessage(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+	// Only complete messages are sent back to the model
+	contents, err := repo.GetMessageContentsByChatID(ctx, chat.ID)
+	if err != nil || len(contents) != 1 || contents[0].Content != "question" {
+		t.Fatalf("GetMessageContentsByChatID with a pending reply = %v, %v; want the question", contents, err)
+	}
+
+	reply.Content = "answer"
+	reply.Status = db.MessageComplete
+	if err := repo.FinishMessage(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = repo.GetMessageContentsByChatID(ctx, chat.ID)
+	if err != nil || len(contents) != 2 || contents[1].Content != "answer" {
+		t.Fatalf("GetMessageContentsByChatID = %v, %v; want the question and answer", contents, err)
+	}
+	// A finished message stays as it was finished
+	if err := repo.FinishMessage(ctx, &models.Message{ID: reply.ID, Content: "late", Status: db.MessageFailed}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := repo.GetMessageByID(ctx, reply.ID); err != nil || message.Content != "answer" || message.Status != db.MessageComplete {
+		t.Fatalf("finishing a message twice left %+v, %v", message, err)
+	}
+
+	stale := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "assistant", Status: db.MessagePending, CreatedAt: time.Now().Add(-time.Hour)}
+	fresh := &models.Message{ChatID: chat.ID, UserID: user.ID, Role: "assistant", Status: db.MessagePending, CreatedAt: time.Now()}
+	for _, message := range []*models.Message{stale, fresh} {
+		if err := repo.CreateMessage(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failed, err := repo.FailStaleMessages(ctx, 30*time.Minute); err != nil || failed < 1 {
+		t.Fatalf("FailStaleMessages = %d, %v; want at least 1", failed, err)
+	}
+	if message, err := repo.GetMessageByID(ctx, stale.ID); err != nil || message.Status != db.MessageFailed {
+		t.Fatalf("a stale pending reply is %+v, %v; want failed", message, err)
+	}
+	if message, err := repo.GetMessageByID(ctx, fresh.ID); err != nil || message.Status != db.MessagePending {
+		t.Fatalf("a fresh pending reply is %+v, %v; want pending", message, err)
+	}
+}
+
+func testRefreshTokens(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	session := &models.Session{UserID: user.ID, UserAgent: "test", IPAddress: "127.0.0.1"}
+	if err := repo.CreateSession(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	first := &models.RefreshToken{FamilyID: session.ID, UserID: user.ID, TokenHash: "first-" + session.ID.String(), ExpiresAt: expires}
+	if err := repo.CreateRefreshToken(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	second := &models.RefreshToken{FamilyID: session.ID, UserID: user.ID, TokenHash: "second-" + session.ID.String(), ExpiresAt: expires}
+	if err := repo.RotateRefreshToken(ctx, first.TokenHash, second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Presenting a rotated token again revokes the whole login
+	third := &models.RefreshToken{FamilyID: session.ID, UserID: user.ID, TokenHash: "third-" + session.ID.String(), ExpiresAt: expires}
+	if err := repo.RotateRefreshToken(ctx, first.TokenHash, third); !errors.Is(err, db.ErrRefreshTokenReused) {
+		t.Fatalf("rotating a used token returned %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := repo.GetRefreshTokenByHash(ctx, second.TokenHash); !errors.Is(err, db.ErrRefreshTokenInvalid) {
+		t.Fatalf("token of a revoked family returned %v, want ErrRefreshTokenInvalid", err)
+	}
+	got, err := repo.GetSessionByID(ctx, session.ID)
+	if err != nil || got.RevokedAt == nil {
+		t.Fatalf("session after reuse = %+v, %v; want revoked", got, err)
+	}
+}
+
+func testMFAChallenges(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	jti := uuid.NewString()
+	expires := time.Now().Add(5 * time.Minute)
+	for i, want := range []bool{true, false} {
+		used, err := repo.UseMFAChallenge(ctx, jti, expires)
+		if err != nil || used != want {
+			t.Fatalf("UseMFAChallenge call %d = %v, %v; want %v", i+1, used, err, want)
+		}
+	}
+}
+
+func testRecoveryCodes(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	if err := repo.CreatePendingTOTP(ctx, user.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := repo.IsMFAEnabled(ctx, user.ID); err != nil || enabled {
+		t.Fatalf("IsMFAEnabled with pending totp = %v, %v; want false", enabled, err)
+	}
+	if err := repo.EnableTOTP(ctx, user.ID, 10, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.EnableTOTP(ctx, user.ID, 11, nil); !errors.Is(err, db.ErrTOTPAlreadyEnabled) {
+		t.Fatalf("enabling totp twice returned %v, want ErrTOTPAlreadyEnabled", err)
+	}
+	if used, err := repo.UseTOTPStep(ctx, user.ID, 10); err != nil || used {
+		t.Fatalf("UseTOTPStep of the enrollment step = %v, %v; want false", used, err)
+	}
+	if used, err := repo.UseTOTPStep(ctx, user.ID, 11); err != nil || !used {
+		t.Fatalf("UseTOTPStep of a later step = %v, %v; want true", used, err)
+	}
+
+	for i, want := range []bool{true, false} {
+		used, err := repo.UseRecoveryCode(ctx, user.ID, "a")
+		if err != nil || used != want {
+			t.Fatalf("UseRecoveryCode call %d = %v, %v; want %v", i+1, used, err, want)
+		}
+	}
+	if count, err := repo.CountRecoveryCodes(ctx, user.ID); err != nil || count != 1 {
+		t.Fatalf("CountRecoveryCodes = %d, %v; want 1", count, err)
+	}
+}
+
+func testAPIKeys(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	key := &models.APIKey{UserID: user.ID, Name: "ci", Prefix: "gpt_test", KeyHash: "hash-" + user.ID.String(), Scopes: []string{"chat:write"}}
+	if err := repo.CreateAPIKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetActiveAPIKeyByHash(ctx, key.KeyHash)
+	if err != nil || got.ID != key.ID || len(got.Scopes) != 1 || got.Scopes[0] != "chat:write" {
+		t.Fatalf("GetActiveAPIKeyByHash = %+v, %v", got, err)
+	}
+
+	if revoked, err := repo.RevokeAPIKey(ctx, key.ID, uuid.New()); err != nil || revoked {
+		t.Fatalf("revoking another user's key = %v, %v; want false", revoked, err)
+	}
+	if revoked, err := repo.RevokeAPIKey(ctx, key.ID, user.ID); err != nil || !revoked {
+		t.Fatalf("RevokeAPIKey = %v, %v; want true", revoked, err)
+	}
+	if _, err := repo.GetActiveAPIKeyByHash(ctx, key.KeyHash); !errors.Is(err, db.ErrAPIKeyInvalid) {
+		t.Fatalf("GetActiveAPIKeyByHash of a revoked key returned %v, want ErrAPIKeyInvalid", err)
+	}
+}
+
+func testEmailTokens(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	token := &models.EmailToken{UserID: user.ID, Purpose: db.EmailTokenVerify, TokenHash: "hash-" + user.ID.String(), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := repo.CreateEmailToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.ConsumeEmailToken(ctx, token.TokenHash, db.EmailTokenReset); !errors.Is(err, db.ErrEmailTokenInvalid) {
+		t.Fatalf("consuming a token for another purpose returned %v, want ErrEmailTokenInvalid", err)
+	}
+	userID, err := repo.ConsumeEmailToken(ctx, token.TokenHash, db.EmailTokenVerify)
+	if err != nil || userID != user.ID {
+		t.Fatalf("ConsumeEmailToken = %s, %v; want %s", userID, err, user.ID)
+	}
+	if _, err := repo.ConsumeEmailToken(ctx, token.TokenHash, db.EmailTokenVerify); !errors.Is(err, db.ErrEmailTokenInvalid) {
+		t.Fatalf("consuming a token twice returned %v, want ErrEmailTokenInvalid", err)
+	}
+}
+
+func testRoleSettings(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	settings, err := repo.GetRoleSettings(ctx)
+	if err != nil || len(settings) != 2 || settings[0].Role != "admin" || settings[1].Role != "user" {
+		t.Fatalf("GetRoleSettings = %v, %v; want admin and user", settings, err)
+	}
+	original := settings[1].MFARequired
+	t.Cleanup(func() {
+		if _, err := repo.SetRoleMFARequired(ctx, "user", original); err != nil {
+			t.Errorf("failed to restore the user role setting: %v", err)
+		}
+	})
+
+	setting, err := repo.SetRoleMFARequired(ctx, "user", !original)
+	if err != nil || setting.MFARequired == original {
+		t.Fatalf("SetRoleMFARequired = %+v, %v", setting, err)
+	}
+	if required, err := repo.RoleRequiresMFA(ctx, "user"); err != nil || required == original {
+		t.Fatalf("RoleRequiresMFA = %v, %v; want %v", required, err, !original)
+	}
+}
+
+func testPreferences(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	preferences, err := repo.GetUserPreferences(ctx, user.ID)
+	if err != nil || preferences.Theme != "light" || preferences.MessageDisplayCount != 50 || !preferences.NotificationsEnabled || preferences.DefaultAIModel != nil {
+		t.Fatalf("GetUserPreferences before saving = %+v, %v; want the defaults", preferences, err)
+	}
+
+	model := &models.AIModel{Name: "model-" + user.Username, Version: "v-" + user.Username, IsActive: true}
+	if err := repo.CreateAIModel(ctx, model); err != nil {
+		t.Fatal(err)
+	}
+	missing := uuid.New()
+	preferences.DefaultAIModel = &missing
+	if err := repo.SaveUserPreferences(ctx, preferences); !errors.Is(err, db.ErrAIModelNotFound) {
+		t.Fatalf("SaveUserPreferences with a missing model returned %v, want ErrAIModelNotFound", err)
+	}
+	preferences.DefaultAIModel = &model.ID
+	preferences.Theme = "dark"
+	if err := repo.SaveUserPreferences(ctx, preferences); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := repo.GetUserPreferences(ctx, user.ID)
+	if err != nil || saved.Theme != "dark" || saved.DefaultAIModel == nil || *saved.DefaultAIModel != model.ID {
+		t.Fatalf("GetUserPreferences = %+v, %v", saved, err)
+	}
+	if version, err := repo.GetDefaultAIModelVersion(ctx, user.ID); err != nil || version != model.Version {
+		t.Fatalf("GetDefaultAIModelVersion = %q, %v; want %q", version, err, model.Version)
+	}
+	model.IsActive = false
+	if err := repo.UpdateAIModel(ctx, model); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := repo.GetDefaultAIModelVersion(ctx, user.ID); err != nil || version != "" {
+		t.Fatalf("GetDefaultAIModelVersion of a deactivated model = %q, %v; want none", version, err)
+	}
+
+	metadata, err := repo.GetUserMetadata(ctx, user.ID)
+	if err != nil || metadata.Interests == nil || metadata.Timezone != "" {
+		t.Fatalf("GetUserMetadata before saving = %+v, %v", metadata, err)
+	}
+	if timezone, err := repo.GetUserTimezone(ctx, user.ID); err != nil || timezone != "" {
+		t.Fatalf("GetUserTimezone before saving = %q, %v", timezone, err)
+	}
+	metadata.Timezone = "Asia/Tokyo"
+	metadata.Interests = []string{"chess", "go"}
+	if err := repo.SaveUserMetadata(ctx, metadata); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repo.GetUserMetadata(ctx, user.ID)
+	if err != nil || len(stored.Interests) != 2 || stored.Interests[1] != "go" || stored.LastUpdated.IsZero() {
+		t.Fatalf("GetUserMetadata = %+v, %v", stored, err)
+	}
+	if timezone, err := repo.GetUserTimezone(ctx, user.ID); err != nil || timezone != "Asia/Tokyo" {
+		t.Fatalf("GetUserTimezone = %q, %v; want Asia/Tokyo", timezone, err)
+	}
+}
+
+func testInstructions(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	instructions, err := repo.GetCustomInstructions(ctx, user.ID)
+	if err != nil || instructions.Instructions != "" || instructions.MetadataFields == nil {
+		t.Fatalf("GetCustomInstructions before saving = %+v, %v", instructions, err)
+	}
+	instructions.Instructions = "Be brief."
+	instructions.MetadataFields = []string{"profession", "interests"}
+	if err := repo.SaveCustomInstructions(ctx, instructions); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := repo.GetCustomInstructions(ctx, user.ID)
+	if err != nil || saved.Instructions != "Be brief." || len(saved.MetadataFields) != 2 || saved.MetadataFields[1] != "interests" {
+		t.Fatalf("GetCustomInstructions = %+v, %v", saved, err)
+	}
+
+	chat := createChat(t, repo, user)
+	chatInstructions, err := repo.GetChatInstructions(ctx, chat.ID)
+	if err != nil || chatInstructions.Instructions != nil || chatInstructions.PersonalizationDisabled {
+		t.Fatalf("GetChatInstructions before saving = %+v, %v", chatInstructions, err)
+	}
+	override := "Answer in haiku."
+	if err := repo.SaveChatInstructions(ctx, &models.ChatInstructions{ChatID: chat.ID, Instructions: &override, PersonalizationDisabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	chatInstructions, err = repo.GetChatInstructions(ctx, chat.ID)
+	if err != nil || chatInstructions.Instructions == nil || *chatInstructions.Instructions != override || !chatInstructions.PersonalizationDisabled {
+		t.Fatalf("GetChatInstructions = %+v, %v", chatInstructions, err)
+	}
+	if err := repo.SaveChatInstructions(ctx, &models.ChatInstructions{ChatID: chat.ID}); err != nil {
+		t.Fatal(err)
+	}
+	chatInstructions, err = repo.GetChatInstructions(ctx, chat.ID)
+	if err != nil || chatInstructions.Instructions != nil || chatInstructions.PersonalizationDisabled {
+		t.Fatalf("GetChatInstructions after clearing = %+v, %v", chatInstructions, err)
+	}
+}
+
+func testAccountDeletion(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := createUser(t, repo)
+	if err := repo.ScheduleUserDeletion(ctx, user.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ScheduleUserDeletion(ctx, user.ID, time.Now().Add(time.Hour)); !errors.Is(err, db.ErrDeletionScheduled) {
+		t.Fatalf("scheduling a deletion twice returned %v, want ErrDeletionScheduled", err)
+	}
+	if err := repo.CancelUserDeletion(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CancelUserDeletion(ctx, user.ID); !errors.Is(err, db.ErrDeletionNotScheduled) {
+		t.Fatalf("cancelling a deletion twice returned %v, want ErrDeletionNotScheduled", err)
+	}
+
+	// The only owner of an organization hands it to an admin before anyone else
+	member, admin := createUser(t, repo), createUser(t, repo)
+	org := &models.Organization{Name: "org-" + user.Username}
+	if err := repo.CreateOrganization(ctx, org, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*models.OrganizationMember{
+		{OrganizationID: org.ID, UserID: member.ID, Role: db.OrgRoleMember},
+		{OrganizationID: org.ID, UserID: admin.ID, Role: db.OrgRoleAdmin},
+	} {
+		if err := repo.AddOrganizationMember(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workspace := &models.Workspace{OrganizationID: org.ID, Name: "team"}
+	if err := repo.CreateWorkspace(ctx, workspace); err != nil {
+		t.Fatal(err)
+	}
+	personal := createChat(t, repo, user)
+	now := time.Now()
+	shared, err := repo.CreateChat(ctx, &models.Chat{UserID: user.ID, Title: "shared", CreatedAt: now, LastUpdated: now, WorkspaceID: &workspace.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.ScheduleUserDeletion(ctx, user.ID, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := repo.PurgeDeletedUsers(ctx); err != nil || purged < 1 {
+		t.Fatalf("PurgeDeletedUsers = %d, %v; want at least 1", purged, err)
+	}
+	if _, err := repo.GetUserByUsername(ctx, user.Username); !errors.Is(err, db.ErrUserNotFound) {
+		t.Fatalf("GetUserByUsername of a purged user returned %v, want ErrUserNotFound", err)
+	}
+	if _, err := repo.GetChatByID(ctx, personal.ID); !errors.Is(err, db.ErrChatNotFound) {
+		t.Fatalf("GetChatByID of a purged user's chat returned %v, want ErrChatNotFound", err)
+	}
+	if chat, err := repo.GetChatByID(ctx, shared.ID); err != nil || chat.UserID != uuid.Nil {
+		t.Fatalf("GetChatByID of a workspace chat = %+v, %v; want it kept without an author", chat, err)
+	}
+	if role, err := repo.GetOrganizationRole(ctx, org.ID, admin.ID); err != nil || role != db.OrgRoleOwner {
+		t.Fatalf("the admin's role is %q, %v; want owner", role, err)
+	}
+	if role, err := repo.GetOrganizationRole(ctx, org.ID, member.ID); err != nil || role != db.OrgRoleMember {
+		t.Fatalf("the member's role is %q, %v; want member", role, err)
+	}
+
+	if err := repo.DeleteUser(ctx, user.ID); !errors.Is(err, db.ErrUserNotFound) {
+		t.Fatalf("DeleteUser of a missing user returned %v, want ErrUserNotFound", err)
+	}
+	if err := repo.DeleteUser(ctx, member.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUserByUsername(ctx, member.Username); !errors.Is(err, db.ErrUserNotFound) {
+		t.Fatalf("GetUserByUsername of a deleted user returned %v, want ErrUserNotFound", err)
+	}
+}
+
+func testDataExports(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user, other := createUser(t, repo), createUser(t, repo)
+	export, err := repo.CreateDataExport(ctx, user.ID)
+	if err != nil || export.Status != db.ExportStatusQueued {
+		t.Fatalf("CreateDataExport = %+v, %v", export, err)
+	}
+	if _, err := repo.CreateDataExport(ctx, user.ID); !errors.Is(err, db.ErrExportInProgress) {
+		t.Fatalf("a second export returned %v, want ErrExportInProgress", err)
+	}
+	if _, err := repo.GetDataExportArchive(ctx, export.ID, user.ID); !errors.Is(err, db.ErrExportNotFound) {
+		t.Fatalf("GetDataExportArchive of a queued export returned %v, want ErrExportNotFound", err)
+	}
+
+	// Earlier runs may have left queued exports ahead of this one
+	for {
+		claimed, err := repo.ClaimDataExport(ctx, time.Hour)
+		if err != nil || claimed == nil {
+			t.Fatalf("ClaimDataExport = %v, %v; want the queued export", claimed, err)
+		}
+		if claimed.ID == export.ID {
+			break
+		}
+	}
+	if claimed, err := repo.ClaimDataExport(ctx, time.Hour); err != nil || (claimed != nil && claimed.ID == export.ID) {
+		t.Fatalf("ClaimDataExport = %v, %v; want a running export left alone", claimed, err)
+	}
+
+	archive := []byte("archive")
+	if err := repo.CompleteDataExport(ctx, export.ID, archive, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetDataExportArchive(ctx, export.ID, other.ID); !errors.Is(err, db.ErrExportNotFound) {
+		t.Fatalf("GetDataExportArchive for another user returned %v, want ErrExportNotFound", err)
+	}
+	if got, err := repo.GetDataExportArchive(ctx, export.ID, user.ID); err != nil || string(got) != string(archive) {
+		t.Fatalf("GetDataExportArchive = %q, %v", got, err)
+	}
+	exports, err := repo.GetDataExportsByUserID(ctx, user.ID)
+	if err != nil || len(exports) != 1 || exports[0].Status != db.ExportStatusDone || exports[0].Size != int64(len(archive)) {
+		t.Fatalf("GetDataExportsByUserID = %+v, %v", exports, err)
+	}
+	// A finished export makes room for the next one
+	if _, err := repo.CreateDataExport(ctx, user.ID); err != nil {
+		t.Fatalf("an export after a finished one returned %v", err)
+	}
+
+	files, err := repo.GetUserExportFiles(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	for _, file := range files {
+		names[file.Name] = string(file.Data)
+	}
+	if profile, ok := names["profile.json"]; !ok || !strings.Contains(profile, user.Username) {
+		t.Fatalf("GetUserExportFiles = %v; want a profile.json naming the user", names)
+	}
+}
@@ -0,0 +1,110 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row row) (*models.APIKey, error) {
+	key := &models.APIKey{}
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		asJSON(&key.Scopes),
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt)
+	return key, err
+}
+
+func (r *Repository) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	query := `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+              VALUES ($1, $2, $3, $4, $5, $6)
+              RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.KeyHash,
+		asJSON(key.Scopes),
+		nullTS(key.ExpiresAt)).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create api key: %v", err)
+	}
+	return nil
+}
+
+// GetActiveAPIKeyByHash finds a key that is neither revoked nor expired and whose owner is active
+func (r *Repository) GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+              FROM api_keys
+              WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ` + now + `)
+                AND user_id IN (SELECT id FROM users WHERE is_active IS NOT FALSE)`
+	key, err := scanAPIKey(r.db.QueryRowContext(ctx, query, keyHash))
+	if err == sql.ErrNoRows {
+		return nil, db.ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %v", err)
+	}
+	return key, nil
+}
+
+// GetAPIKeysByUserID lists a user's keys that have not been revoked, newest first
+func (r *Repository) GetAPIKeysByUserID(ctx context.Context, userID uuid.UUID) ([]*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + `
+              FROM api_keys
+              WHERE user_id = $1 AND revoked_at IS NULL
+              ORDER BY created_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []*models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over api keys: %v", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys, returning false if they have no such key
+func (r *Repository) RevokeAPIKey(ctx context.Context, id uuid.UUID, userID uuid.UUID) (bool, error) {
+	query := `UPDATE api_keys SET revoked_at = ` + now + ` WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+	tag, err := r.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke api key: %v", err)
+	}
+	return affected(tag) > 0, nil
+}
+
+// TouchAPIKey records that a key was used. It writes at most once a minute per key.
+func (r *Repository) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE api_keys SET last_used_at = ` + now + `
+              WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < strftime('%Y-%m-%d %H:%M:%f000000', 'now', '-1 minute'))`
+	_, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to touch api key: %v", err)
+	}
+	return nil
+}
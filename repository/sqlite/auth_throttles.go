@@ -0,0 +1,116 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+// IncrementAuthThrottle counts an attempt against key and returns the
+// number counted so far. Attempts older than window are forgotten.
+func (r *Repository) IncrementAuthThrottle(ctx context.Context, key string, window time.Duration) (int, error) {
+	query := `INSERT INTO auth_throttles (key, failures, last_failure_at) VALUES ($1, 1, ` + now + `)
+              ON CONFLICT (key) DO UPDATE SET
+                  failures = CASE WHEN auth_throttles.last_failure_at < $2 THEN 1 ELSE auth_throttles.failures + 1 END,
+                  last_failure_at = ` + now + `
+              RETURNING failures`
+	var failures int
+	err := r.db.QueryRowContext(ctx, query, key, ts(time.Now().Add(-window))).Scan(&failures)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment auth throttle: %v", err)
+	}
+	return failures, nil
+}
+
+// LockAuthThrottle blocks attempts against key until the given time
+func (r *Repository) LockAuthThrottle(ctx context.Context, key string, until time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE auth_throttles SET locked_until = $2 WHERE key = $1`, key, ts(until))
+	if err != nil {
+		return fmt.Errorf("failed to lock auth throttle: %v", err)
+	}
+	return nil
+}
+
+// GetAuthLockedUntil returns the latest lock among keys that has not expired yet, or nil
+func (r *Repository) GetAuthLockedUntil(ctx context.Context, keys []string) (*time.Time, error) {
+	query := `SELECT locked_until FROM auth_throttles
+              WHERE key IN (SELECT value FROM json_each($1)) AND locked_until > ` + now + `
+              ORDER BY locked_until DESC
+              LIMIT 1`
+	var lockedUntil *time.Time
+	err := r.db.QueryRowContext(ctx, query, asJSON(keys)).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get auth lock: %v", err)
+	}
+	return lockedUntil, nil
+}
+
+// ClearAuthThrottle forgets failures against key, after a successful login or an admin unlock.
+// It reports whether there was anything to forget.
+func (r *Repository) ClearAuthThrottle(ctx context.Context, key string) (bool, error) {
+	tag, err := r.db.ExecContext(ctx, `DELETE FROM auth_throttles WHERE key = $1`, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to clear auth throttle: %v", err)
+	}
+	return affected(tag) > 0, nil
+}
+
+// DeleteStaleAuthThrottles removes unlocked entries with no failure within window
+func (r *Repository) DeleteStaleAuthThrottles(ctx context.Context, window time.Duration) (int64, error) {
+	query := `DELETE FROM auth_throttles
+              WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < ` + now + `)`
+	tag, err := r.db.ExecContext(ctx, query, ts(time.Now().Add(-window)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale auth throttles: %v", err)
+	}
+	return affected(tag), nil
+}
+
+func (r *Repository) CreateSecurityEvent(ctx context.Context, event *models.SecurityEvent) error {
+	if event.Detail == nil {
+		event.Detail = map[string]string{}
+	}
+	query := `INSERT INTO security_events (user_id, actor_id, event_type, ip_address, detail)
+              VALUES ($1, $2, $3, $4, $5)
+              RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, event.UserID, event.ActorID, event.EventType, event.IPAddress, asJSON(event.Detail)).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create security event: %v", err)
+	}
+	return nil
+}
+
+// GetSecurityEvents pages through events newest first, optionally only those about userID
+func (r *Repository) GetSecurityEvents(ctx context.Context, userID *uuid.UUID, limit int, offset int) ([]*models.SecurityEvent, error) {
+	query := `SELECT id, user_id, actor_id, event_type, COALESCE(ip_address, ''), detail, created_at
+              FROM security_events
+              WHERE $1 IS NULL OR user_id = $1
+              ORDER BY created_at DESC, pk DESC
+              LIMIT $2 OFFSET $3`
+	rows, err := r.db.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get security events: %v", err)
+	}
+	defer rows.Close()
+
+	events := []*models.SecurityEvent{}
+	for rows.Next() {
+		event := &models.SecurityEvent{}
+		if err := rows.Scan(&event.ID, &event.UserID, &event.ActorID, &event.EventType, &event.IPAddress, asJSON(&event.Detail), &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan security event: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over security events: %v", err)
+	}
+	return events, nil
+}
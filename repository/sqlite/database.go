@@ -0,0 +1,741 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+const userColumns = `id, username, email, password_hash, created_at, last_login, COALESCE(is_active, TRUE), email_verified_at, role, deletion_scheduled_at`
+
+func scanUser(row row) (*models.User, error) {
+	user := &models.User{}
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash,
+		&user.CreatedAt,
+		&user.LastLogin,
+		&user.IsActive,
+		&user.EmailVerifiedAt,
+		&user.Role,
+		&user.DeletionScheduledAt)
+	return user, err
+}
+
+func (r *Repository) CreateUser(ctx context.Context, user *models.User) error {
+	query := `INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id`
+	err := r.db.QueryRowContext(ctx, query, user.Username, user.Email, user.PasswordHash).Scan(&user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) GetUserByID(ctx context.Context, id int) (*models.User, error) {
+	query := `SELECT id, username, email, password_hash FROM users WHERE pk = $1`
+	user := &models.User{}
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by ID: %v", err)
+	}
+	return user, nil
+}
+
+func (r *Repository) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
+	user, err := scanUser(r.db.QueryRowContext(ctx, query, username))
+	if err == sql.ErrNoRows {
+		return nil, db.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by username: %v", err)
+	}
+	return user, nil
+}
+
+func (r *Repository) GetUserByUUID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	user, err := scanUser(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by ID: %v", err)
+	}
+	return user, nil
+}
+
+func (r *Repository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE LOWER(email) = LOWER($1)`
+	user, err := scanUser(r.db.QueryRowContext(ctx, query, email))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by email: %v", err)
+	}
+	return user, nil
+}
+
+func (r *Repository) UpdateUser(ctx context.Context, user *models.User) error {
+	query := `UPDATE users SET username = $1, email = $2, password_hash = $3 WHERE id = $4`
+	_, err := r.db.ExecContext(ctx, query, user.Username, user.Email, user.PasswordHash, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+	return nil
+}
+
+// UpdateUserPasswordHash replaces only the password hash, e.g. when upgrading it after login
+func (r *Repository) UpdateUserPasswordHash(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1 WHERE id = $2`
+	_, err := r.db.ExecContext(ctx, query, passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %v", err)
+	}
+	return nil
+}
+
+// ListUsers pages through users, newest first. A non-empty search matches
+// the start of the username or email.
+func (r *Repository) ListUsers(ctx context.Context, search string, limit int, offset int) ([]*models.User, error) {
+	query := `SELECT ` + userColumns + `
+              FROM users
+              WHERE $1 = '' OR username LIKE $1 || '%' ESCAPE '\' OR email LIKE $1 || '%' ESCAPE '\'
+              ORDER BY created_at DESC, pk DESC
+              LIMIT $2 OFFSET $3`
+	rows, err := r.db.QueryContext(ctx, query, escapeLike(search), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over users: %v", err)
+	}
+	return users, nil
+}
+
+func (r *Repository) SetUserActive(ctx context.Context, id uuid.UUID, active bool) error {
+	tag, err := r.db.ExecContext(ctx, `UPDATE users SET is_active = $2 WHERE id = $1`, id, active)
+	if err != nil {
+		return fmt.Errorf("failed to set user active: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *Repository) SetUserRole(ctx context.Context, id uuid.UUID, role string) error {
+	tag, err := r.db.ExecContext(ctx, `UPDATE users SET role = $2 WHERE id = $1`, id, role)
+	if err != nil {
+		return fmt.Errorf("failed to set user role: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrUserNotFound
+	}
+	return nil
+}
+
+// escapeLike makes s match literally in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (r *Repository) CreateAIModel(ctx context.Context, model *models.AIModel) error {
+	query := `INSERT INTO ai_models (name, version, description, is_active) VALUES ($1, $2, $3, $4) RETURNING id`
+	err := r.db.QueryRowContext(ctx, query, model.Name, model.Version, model.Description, model.IsActive).Scan(&model.ID)
+	if isSQLiteError(err, uniqueViolation) {
+		return db.ErrAIModelExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create AI model: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) GetAIModelByID(ctx context.Context, id uuid.UUID) (*models.AIModel, error) {
+	query := `SELECT id, name, version, description, is_active FROM ai_models WHERE id = $1`
+	model := &models.AIModel{}
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&model.ID, &model.Name, &model.Version, &model.Description, &model.IsActive)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrAIModelNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AI model by ID: %v", err)
+	}
+	return model, nil
+}
+
+func (r *Repository) GetAllAIModels(ctx context.Context) ([]*models.AIModel, error) {
+	query := `SELECT id, name, version, description, is_active FROM ai_models`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all AI models: %v", err)
+	}
+	defer rows.Close()
+
+	var list []*models.AIModel
+	for rows.Next() {
+		model := &models.AIModel{}
+		if err := rows.Scan(&model.ID, &model.Name, &model.Version, &model.Description, &model.IsActive); err != nil {
+			return nil, fmt.Errorf("failed to scan AI model: %v", err)
+		}
+		list = append(list, model)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over AI models: %v", err)
+	}
+
+	return list, nil
+}
+
+func (r *Repository) UpdateAIModel(ctx context.Context, model *models.AIModel) error {
+	query := `UPDATE ai_models SET name = $1, version = $2, description = $3, is_active = $4 WHERE id = $5`
+	tag, err := r.db.ExecContext(ctx, query, model.Name, model.Version, model.Description, model.IsActive, model.ID)
+	if isSQLiteError(err, uniqueViolation) {
+		return db.ErrAIModelExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update AI model: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrAIModelNotFound
+	}
+	return nil
+}
+
+func (r *Repository) DeleteAIModel(ctx context.Context, id uuid.UUID) error {
+	query := `DELETE FROM ai_models WHERE id = $1`
+	tag, err := r.db.ExecContext(ctx, query, id)
+	if isSQLiteError(err, foreignKeyViolation) {
+		return db.ErrAIModelInUse
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete AI model: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrAIModelNotFound
+	}
+	return nil
+}
+
+func (r *Repository) CreateChat(ctx context.Context, chat *models.Chat) (*models.Chat, error) {
+	query := `INSERT INTO chats (user_id, title, created_at, last_updated, is_archived, ai_model_version, workspace_id) 
+              VALUES ($1, $2, $3, $4, $5, $6, $7) 
+              RETURNING id`
+	err := r.db.QueryRowContext(ctx, query,
+		chat.UserID,
+		chat.Title,
+		ts(chat.CreatedAt),
+		ts(chat.LastUpdated),
+		chat.IsArchived,
+		chat.AIModelVersion,
+		chat.WorkspaceID).Scan(&chat.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chat: %v", err)
+	}
+	return chat, nil
+}
+
+const chatColumns = `id, user_id, title, created_at, last_updated, is_archived, ai_model_version, workspace_id, deleted_at`
+
+func scanChat(row row) (*models.Chat, error) {
+	chat := &models.Chat{}
+	err := row.Scan(
+		&chat.ID,
+		&chat.UserID,
+		&chat.Title,
+		&chat.CreatedAt,
+		&chat.LastUpdated,
+		&chat.IsArchived,
+		&chat.AIModelVersion,
+		&chat.WorkspaceID,
+		&chat.DeletedAt)
+	return chat, err
+}
+
+// GetChatByID returns the chat unless it is in the trash
+func (r *Repository) GetChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE id = $1 AND deleted_at IS NULL`
+	chat, err := scanChat(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, db.ErrChatNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat by ID: %v", err)
+	}
+	return chat, nil
+}
+
+func (r *Repository) UpdateChat(ctx context.Context, chat *models.Chat) error {
+	query := `UPDATE chats 
+              SET user_id = $1, title = $2, last_updated = $3, is_archived = $4, ai_model_version = $5, workspace_id = $6
+              WHERE id = $7`
+	_, err := r.db.ExecContext(ctx, query,
+		chat.UserID,
+		chat.Title,
+		ts(chat.LastUpdated),
+		chat.IsArchived,
+		chat.AIModelVersion,
+		chat.WorkspaceID,
+		chat.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update chat: %v", err)
+	}
+	return nil
+}
+
+// TouchChat moves the chat's last_updated forward to at. It never moves it
+// back, so replies finishing out of order leave the latest time.
+// TouchChat moves last_updated forward to at. Trashed chats are refused with db.ErrChatTrashed.
+func (r *Repository) TouchChat(ctx context.Context, id uuid.UUID, at time.Time) error {
+	query := `UPDATE chats SET last_updated = MAX(COALESCE(last_updated, $2), $2) WHERE id = $1 AND deleted_at IS NULL`
+	tag, err := r.db.ExecContext(ctx, query, id, ts(at))
+	if err != nil {
+		return fmt.Errorf("failed to touch chat: %v", err)
+	}
+	if affected(tag) == 0 {
+		return r.unwritableChat(ctx, id)
+	}
+	return nil
+}
+
+// unwritableChat explains why a write to a chat matched no row
+func (r *Repository) unwritableChat(ctx context.Context, id uuid.UUID) error {
+	var trashed bool
+	err := r.db.QueryRowContext(ctx, `SELECT deleted_at IS NOT NULL FROM chats WHERE id = $1`, id).Scan(&trashed)
+	if err == sql.ErrNoRows {
+		return db.ErrChatNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get chat: %v", err)
+	}
+	if trashed {
+		return db.ErrChatTrashed
+	}
+	return db.ErrChatNotFound
+}
+
+// DeleteChat moves the chat and its messages to the trash, stamping them
+// with the same deleted_at so RestoreChat brings back exactly those messages
+func (r *Repository) DeleteChat(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE chats SET deleted_at = `+now+` WHERE id = $1 AND deleted_at IS NULL`, id); err != nil {
+		return fmt.Errorf("failed to delete chat: %v", err)
+	}
+	query := `UPDATE messages SET deleted_at = (SELECT deleted_at FROM chats WHERE id = $1)
+              WHERE chat_id = $1 AND deleted_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to delete chat messages: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// GetTrashedChatByID returns the chat only if it is in the trash
+func (r *Repository) GetTrashedChatByID(ctx context.Context, id uuid.UUID) (*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE id = $1 AND deleted_at IS NOT NULL`
+	chat, err := scanChat(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, db.ErrChatNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed chat by ID: %v", err)
+	}
+	return chat, nil
+}
+
+// GetTrashedChatsByUserID returns the user's trashed personal chats, most recently deleted first
+func (r *Repository) GetTrashedChatsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE user_id = $1 AND workspace_id IS NULL AND deleted_at IS NOT NULL
+              ORDER BY deleted_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed chats by user ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
+
+// GetTrashedChatsByWorkspaceID returns the workspace's trashed chats, most recently deleted first
+func (r *Repository) GetTrashedChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE workspace_id = $1 AND deleted_at IS NOT NULL
+              ORDER BY deleted_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed chats by workspace ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
+
+// RestoreChat takes the chat out of the trash with the messages that were
+// trashed along with it. Messages deleted on their own before stay trashed.
+func (r *Repository) RestoreChat(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE messages SET deleted_at = NULL
+              WHERE chat_id = $1 AND deleted_at = (SELECT deleted_at FROM chats WHERE id = $1)`
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to restore chat messages: %v", err)
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE chats SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore chat: %v", err)
+	}
+	if affected(result) == 0 {
+		return db.ErrChatNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes chats and messages that have been in the
+// trash longer than olderThan, and returns how many it deleted
+func (r *Repository) PurgeTrash(ctx context.Context, olderThan time.Duration) (int64, error) {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	cutoff := ts(time.Now().Add(-olderThan))
+	chats, err := tx.ExecContext(ctx, `DELETE FROM chats WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trashed chats: %v", err)
+	}
+	messages, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trashed messages: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return affected(chats) + affected(messages), nil
+}
+
+// GetChatsByUserID returns the user's personal chats; chats moved to a workspace are listed with it
+func (r *Repository) GetChatsByUserID(ctx context.Context, userID uuid.UUID, sortByLastUpdated bool) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE user_id = $1 AND workspace_id IS NULL AND deleted_at IS NULL`
+
+	if sortByLastUpdated {
+		query += ` ORDER BY last_updated DESC`
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats by user ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
+
+// GetChatsByWorkspaceID returns every chat shared with the workspace, most recently updated first
+func (r *Repository) GetChatsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]*models.Chat, error) {
+	query := `SELECT ` + chatColumns + `
+              FROM chats 
+              WHERE workspace_id = $1 AND deleted_at IS NULL
+              ORDER BY last_updated DESC`
+	rows, err := r.db.QueryContext(ctx, query, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats by workspace ID: %v", err)
+	}
+	defer rows.Close()
+	return scanChats(rows)
+}
+
+func scanChats(rows *sql.Rows) ([]*models.Chat, error) {
+	var chats []*models.Chat
+	for rows.Next() {
+		chat, err := scanChat(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan chat: %v", err)
+		}
+		chats = append(chats, chat)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over chats: %v", err)
+	}
+
+	return chats, nil
+}
+
+// CreateMessage inserts a new message into the database. Messages without a status are complete.
+func (r *Repository) CreateMessage(ctx context.Context, message *models.Message) error {
+	if message.Status == "" {
+		message.Status = db.MessageComplete
+	}
+	query := `INSERT INTO messages (chat_id, user_id, role, content, created_at, is_edited, status)
+              SELECT id, $2, $3, $4, $5, $6, $7
+              FROM chats WHERE id = $1 AND deleted_at IS NULL
+              RETURNING id`
+	err := r.db.QueryRowContext(ctx, query,
+		message.ChatID,
+		message.UserID,
+		message.Role,
+		message.Content,
+		ts(message.CreatedAt),
+		message.IsEdited,
+		message.Status).Scan(&message.ID)
+	if err == sql.ErrNoRows {
+		return r.unwritableChat(ctx, message.ChatID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create message: %v", err)
+	}
+	return nil
+}
+
+// GetMessageByID retrieves a message by its ID
+func (r *Repository) GetMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error) {
+	query := `SELECT id, chat_id, user_id, role, content, created_at, is_edited, status
+              FROM messages
+              WHERE id = $1 AND deleted_at IS NULL`
+	message := &models.Message{}
+	err := r.db.QueryRowContext(ctx, query, id).Scan(
+		&message.ID,
+		&message.ChatID,
+		&message.UserID,
+		&message.Role,
+		&message.Content,
+		&message.CreatedAt,
+		&message.IsEdited,
+		&message.Status)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message by ID: %v", err)
+	}
+	return message, nil
+}
+
+// UpdateMessage updates an existing message in the database
+func (r *Repository) UpdateMessage(ctx context.Context, message *models.Message) error {
+	query := `UPDATE messages
+              SET content = $1, is_edited = $2
+              WHERE id = $3`
+	_, err := r.db.ExecContext(ctx, query,
+		message.Content,
+		message.IsEdited,
+		message.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %v", err)
+	}
+	return nil
+}
+
+// FinishMessage saves the final content and status of a pending message.
+// Messages that are no longer pending are left as they are.
+func (r *Repository) FinishMessage(ctx context.Context, message *models.Message) error {
+	query := `UPDATE messages
+              SET content = $1, status = $2
+              WHERE id = $3 AND status = 'pending'`
+	_, err := r.db.ExecContext(ctx, query, message.Content, message.Status, message.ID)
+	if err != nil {
+		return fmt.Errorf("failed to finish message: %v", err)
+	}
+	return nil
+}
+
+// FailStaleMessages marks messages still pending after olderThan as failed,
+// such as replies whose server stopped while they streamed
+func (r *Repository) FailStaleMessages(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `UPDATE messages SET status = 'failed' WHERE status = 'pending' AND created_at < $1`
+	result, err := r.db.ExecContext(ctx, query, ts(time.Now().Add(-olderThan)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fail stale messages: %v", err)
+	}
+	return affected(result), nil
+}
+
+// DeleteMessage moves a message to the trash
+func (r *Repository) DeleteMessage(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE messages SET deleted_at = ` + now + ` WHERE id = $1 AND deleted_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %v", err)
+	}
+	return nil
+}
+
+// GetTrashedMessageByID returns a message that was moved to the trash on its
+// own; messages trashed with their chat come back with RestoreChat
+func (r *Repository) GetTrashedMessageByID(ctx context.Context, id uuid.UUID) (*models.Message, error) {
+	query := `SELECT m.id, m.chat_id, m.user_id, m.role, m.content, m.created_at, m.is_edited, m.status, m.deleted_at
+              FROM messages m JOIN chats c ON c.id = m.chat_id
+              WHERE m.id = $1 AND m.deleted_at IS NOT NULL AND c.deleted_at IS NULL`
+	message := &models.Message{}
+	err := r.db.QueryRowContext(ctx, query, id).Scan(
+		&message.ID,
+		&message.ChatID,
+		&message.UserID,
+		&message.Role,
+		&message.Content,
+		&message.CreatedAt,
+		&message.IsEdited,
+		&message.Status,
+		&message.DeletedAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed message by ID: %v", err)
+	}
+	return message, nil
+}
+
+// GetTrashedMessagesByChatID returns the messages moved to the trash from a
+// chat that is not itself in the trash, most recently deleted first
+func (r *Repository) GetTrashedMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error) {
+	query := `SELECT m.id, m.chat_id, m.user_id, m.role, m.content, m.created_at, m.is_edited, m.status, m.deleted_at
+              FROM messages m JOIN chats c ON c.id = m.chat_id
+              WHERE m.chat_id = $1 AND m.deleted_at IS NOT NULL AND c.deleted_at IS NULL
+              ORDER BY m.deleted_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed messages by chat ID: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.Message{}
+	for rows.Next() {
+		message := &models.Message{}
+		if err := rows.Scan(
+			&message.ID,
+			&message.ChatID,
+			&message.UserID,
+			&message.Role,
+			&message.Content,
+			&message.CreatedAt,
+			&message.IsEdited,
+			&message.Status,
+			&message.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over messages: %v", err)
+	}
+	return messages, nil
+}
+
+// RestoreMessage takes a message out of the trash. It returns
+// db.ErrMessageNotFound unless the message was trashed on its own.
+func (r *Repository) RestoreMessage(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE messages SET deleted_at = NULL
+              WHERE id = $1 AND deleted_at IS NOT NULL
+              AND chat_id IN (SELECT id FROM chats WHERE deleted_at IS NULL)`
+	tag, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore message: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrMessageNotFound
+	}
+	return nil
+}
+
+// GetMessagesByChatID retrieves all messages for a given chat_id
+func (r *Repository) GetMessagesByChatID(ctx context.Context, chatID uuid.UUID) ([]*models.Message, error) {
+	query := `SELECT id, chat_id, user_id, role, content, created_at, is_edited, status
+              FROM messages
+              WHERE chat_id = $1 AND deleted_at IS NULL
+              ORDER BY created_at ASC`
+	rows, err := r.db.QueryContext(ctx, query, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages by chat ID: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []*models.Message
+	for rows.Next() {
+		message := &models.Message{}
+		if err := rows.Scan(
+			&message.ID,
+			&message.ChatID,
+			&message.UserID,
+			&message.Role,
+			&message.Content,
+			&message.CreatedAt,
+			&message.IsEdited,
+			&message.Status); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over messages: %v", err)
+	}
+
+	return messages, nil
+}
+
+// GetMessageContentsByChatID returns the chat's complete messages for sending to the model
+func (r *Repository) GetMessageContentsByChatID(ctx context.Context, chatID uuid.UUID) ([]models.MessageContent, error) {
+	query := `SELECT role, content
+              FROM messages
+              WHERE chat_id = $1 AND status = 'complete' AND deleted_at IS NULL
+              ORDER BY created_at ASC`
+	rows, err := r.db.QueryContext(ctx, query, chatID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message contents by chat ID: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []models.MessageContent
+	for rows.Next() {
+		var msg models.MessageContent
+		if err := rows.Scan(&msg.Role, &msg.Content); err != nil {
+			return nil, fmt.Errorf("failed to scan message content: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over message contents: %v", err)
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,85 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+// CreateEmailToken stores a new token, invalidating older unused tokens for the same purpose
+func (r *Repository) CreateEmailToken(ctx context.Context, token *models.EmailToken) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin email token transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE email_tokens SET used_at = `+now+` WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`, token.UserID, token.Purpose)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate old email tokens: %v", err)
+	}
+
+	query := `INSERT INTO email_tokens (user_id, purpose, token_hash, expires_at)
+              VALUES ($1, $2, $3, $4)
+              RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, token.UserID, token.Purpose, token.TokenHash, ts(token.ExpiresAt)).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create email token: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit email token: %v", err)
+	}
+	return nil
+}
+
+// ConsumeEmailToken marks an unexpired, unused token as used and returns its user.
+// Doing both in one statement means a token can only ever be consumed once.
+func (r *Repository) ConsumeEmailToken(ctx context.Context, tokenHash string, purpose string) (uuid.UUID, error) {
+	query := `UPDATE email_tokens
+              SET used_at = ` + now + `
+              WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > ` + now + `
+              RETURNING user_id`
+	var userID uuid.UUID
+	err := r.db.QueryRowContext(ctx, query, tokenHash, purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, db.ErrEmailTokenInvalid
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to consume email token: %v", err)
+	}
+	return userID, nil
+}
+
+// DeleteExpiredEmailTokens removes tokens that can no longer be used
+func (r *Repository) DeleteExpiredEmailTokens(ctx context.Context) (int64, error) {
+	query := `DELETE FROM email_tokens WHERE expires_at < ` + now + ` OR used_at IS NOT NULL`
+	tag, err := r.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired email tokens: %v", err)
+	}
+	return affected(tag), nil
+}
+
+func (r *Repository) MarkEmailVerified(ctx context.Context, userID uuid.UUID) error {
+	query := `UPDATE users SET email_verified_at = ` + now + ` WHERE id = $1 AND email_verified_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark email verified: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) IsEmailVerified(ctx context.Context, userID uuid.UUID) (bool, error) {
+	query := `SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1`
+	var verified bool
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&verified)
+	if err != nil {
+		return false, fmt.Errorf("failed to check email verification: %v", err)
+	}
+	return verified, nil
+}
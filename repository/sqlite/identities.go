@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+func (r *Repository) CreateOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error {
+	query := `INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at)
+              VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.db.ExecContext(ctx, query, state.StateHash, state.Provider, state.Nonce, state.CodeVerifier, ts(state.ExpiresAt))
+	if err != nil {
+		return fmt.Errorf("failed to create oidc login state: %v", err)
+	}
+	return nil
+}
+
+// ConsumeOIDCLoginState deletes and returns an unexpired state, so each login attempt completes once
+func (r *Repository) ConsumeOIDCLoginState(ctx context.Context, stateHash string, provider string) (*models.OIDCLoginState, error) {
+	query := `DELETE FROM oidc_login_states
+              WHERE state_hash = $1 AND provider = $2 AND expires_at > ` + now + `
+              RETURNING state_hash, provider, nonce, code_verifier, expires_at`
+	state := &models.OIDCLoginState{}
+	err := r.db.QueryRowContext(ctx, query, stateHash, provider).Scan(
+		&state.StateHash,
+		&state.Provider,
+		&state.Nonce,
+		&state.CodeVerifier,
+		&state.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrOIDCStateInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume oidc login state: %v", err)
+	}
+	return state, nil
+}
+
+// DeleteExpiredOIDCLoginStates removes logins that were abandoned at the identity provider
+func (r *Repository) DeleteExpiredOIDCLoginStates(ctx context.Context) (int64, error) {
+	tag, err := r.db.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < `+now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired oidc login states: %v", err)
+	}
+	return affected(tag), nil
+}
+
+func (r *Repository) GetUserIDByIdentity(ctx context.Context, provider string, subject string) (uuid.UUID, error) {
+	query := `SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`
+	var userID uuid.UUID
+	err := r.db.QueryRowContext(ctx, query, provider, subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, db.ErrIdentityNotFound
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to get identity: %v", err)
+	}
+	return userID, nil
+}
+
+// UpsertIdentity links an identity to a user, or refreshes the email and
+// groups of an existing link after a login
+func (r *Repository) UpsertIdentity(ctx context.Context, identity *models.UserIdentity) error {
+	if identity.Groups == nil {
+		identity.Groups = []string{}
+	}
+	query := `INSERT INTO user_identities (user_id, provider, subject, email, groups)
+              VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (provider, subject) DO UPDATE
+              SET email = EXCLUDED.email, groups = EXCLUDED.groups, last_login_at = ` + now + `
+              RETURNING id, user_id, created_at, last_login_at`
+	err := r.db.QueryRowContext(ctx, query,
+		identity.UserID,
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+		asJSON(identity.Groups)).Scan(&identity.ID, &identity.UserID, &identity.CreatedAt, &identity.LastLoginAt)
+	if err != nil {
+		return fmt.Errorf("failed to save identity: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) GetIdentitiesByUserID(ctx context.Context, userID uuid.UUID) ([]*models.UserIdentity, error) {
+	query := `SELECT id, user_id, provider, subject, COALESCE(email, ''), groups, created_at, last_login_at
+              FROM user_identities
+              WHERE user_id = $1
+              ORDER BY created_at`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identities by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	identities := []*models.UserIdentity{}
+	for rows.Next() {
+		identity := &models.UserIdentity{}
+		if err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Subject,
+			&identity.Email,
+			asJSON(&identity.Groups),
+			&identity.CreatedAt,
+			&identity.LastLoginAt); err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over identities: %v", err)
+	}
+	return identities, nil
+}
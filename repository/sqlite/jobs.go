@@ -0,0 +1,286 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+const jobColumns = `j.id, j.user_id, j.pattern, j.variables, j.ai_model_version, j.status, j.created_at, j.finished_at,
+              (SELECT COUNT(*) FROM job_items i WHERE i.job_id = j.id),
+              (SELECT COUNT(*) FROM job_items i WHERE i.job_id = j.id AND i.status = 'completed'),
+              (SELECT COUNT(*) FROM job_items i WHERE i.job_id = j.id AND i.status = 'failed')`
+
+func scanJob(row row) (*models.Job, error) {
+	job := &models.Job{}
+	var aiModelVersion *string
+	err := row.Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Pattern,
+		asJSON(&job.Variables),
+		&aiModelVersion,
+		&job.Status,
+		&job.CreatedAt,
+		&job.FinishedAt,
+		&job.TotalItems,
+		&job.CompletedItems,
+		&job.FailedItems)
+	if aiModelVersion != nil {
+		job.AIModelVersion = *aiModelVersion
+	}
+	return job, err
+}
+
+// CreateJob inserts a job and one queued item per input in a single transaction
+func (r *Repository) CreateJob(ctx context.Context, job *models.Job, inputs []string) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin job transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO jobs (user_id, pattern, variables, ai_model_version, status)
+              VALUES ($1, $2, $3, $4, $5)
+              RETURNING id, created_at`
+	job.Status = db.JobStatusQueued
+	err = tx.QueryRowContext(ctx, query,
+		job.UserID,
+		job.Pattern,
+		asJSON(job.Variables),
+		job.AIModelVersion,
+		job.Status).Scan(&job.ID, &job.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+
+	for i, input := range inputs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO job_items (job_id, position, input) VALUES ($1, $2, $3)`, job.ID, i, input)
+		if err != nil {
+			return fmt.Errorf("failed to create job items: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit job: %v", err)
+	}
+	job.TotalItems = len(inputs)
+	return nil
+}
+
+// GetJobByID retrieves a job along with its item counts
+func (r *Repository) GetJobByID(ctx context.Context, id uuid.UUID) (*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+              FROM jobs j
+              WHERE j.id = $1`
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job by ID: %v", err)
+	}
+	return job, nil
+}
+
+// GetJobsByUserID retrieves a user's jobs, newest first
+func (r *Repository) GetJobsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Job, error) {
+	query := `SELECT ` + jobColumns + `
+              FROM jobs j
+              WHERE j.user_id = $1
+              ORDER BY j.created_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jobs by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over jobs: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// GetJobItems retrieves a page of a job's items in input order
+func (r *Repository) GetJobItems(ctx context.Context, jobID uuid.UUID, offset, limit int) ([]*models.JobItem, error) {
+	query := `SELECT id, job_id, position, input, COALESCE(output, ''), COALESCE(error, ''), status, attempts, updated_at
+              FROM job_items
+              WHERE job_id = $1
+              ORDER BY position ASC
+              LIMIT $3 OFFSET $2`
+	rows, err := r.db.QueryContext(ctx, query, jobID, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []*models.JobItem
+	for rows.Next() {
+		item := &models.JobItem{}
+		if err := rows.Scan(
+			&item.ID,
+			&item.JobID,
+			&item.Position,
+			&item.Input,
+			&item.Output,
+			&item.Error,
+			&item.Status,
+			&item.Attempts,
+			&item.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan job item: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over job items: %v", err)
+	}
+
+	return items, nil
+}
+
+// ClaimJobItems marks up to limit runnable items as running and returns them.
+// SQLite runs one write at a time, so several workers can poll the same table
+// without handing out an item twice.
+func (r *Repository) ClaimJobItems(ctx context.Context, limit int) ([]*models.JobItem, error) {
+	query := `UPDATE job_items
+              SET status = 'running', attempts = attempts + 1, updated_at = ` + now + `
+              WHERE id IN (
+                  SELECT id FROM job_items
+                  WHERE status = 'queued' AND run_after <= ` + now + `
+                  ORDER BY pk
+                  LIMIT $1)
+              RETURNING id, job_id, position, input, status, attempts, updated_at`
+	rows, err := r.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim job items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []*models.JobItem
+	for rows.Next() {
+		item := &models.JobItem{}
+		if err := rows.Scan(
+			&item.ID,
+			&item.JobID,
+			&item.Position,
+			&item.Input,
+			&item.Status,
+			&item.Attempts,
+			&item.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan claimed job item: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over claimed job items: %v", err)
+	}
+
+	if len(items) > 0 {
+		query = `UPDATE jobs SET status = 'running'
+                 WHERE status = 'queued' AND id IN (SELECT job_id FROM job_items WHERE status = 'running')`
+		if _, err := r.db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to mark jobs running: %v", err)
+		}
+	}
+
+	return items, nil
+}
+
+// CompleteJobItem stores the output of a finished item
+func (r *Repository) CompleteJobItem(ctx context.Context, item *models.JobItem) error {
+	query := `UPDATE job_items
+              SET status = 'completed', output = $1, error = NULL, updated_at = ` + now + `
+              WHERE id = $2`
+	_, err := r.db.ExecContext(ctx, query, item.Output, item.ID)
+	if err != nil {
+		return fmt.Errorf("failed to complete job item: %v", err)
+	}
+	return r.finishJobIfDone(ctx, item.JobID)
+}
+
+// FailJobItem records an error and requeues the item at retryAt, or fails it for good when retryAt is nil
+func (r *Repository) FailJobItem(ctx context.Context, item *models.JobItem, retryAt *time.Time) error {
+	status := db.JobStatusFailed
+	if retryAt != nil {
+		status = db.JobStatusQueued
+	}
+	query := `UPDATE job_items
+              SET status = $1, error = $2, run_after = COALESCE($3, run_after), updated_at = ` + now + `
+              WHERE id = $4`
+	_, err := r.db.ExecContext(ctx, query, status, item.Error, nullTS(retryAt), item.ID)
+	if err != nil {
+		return fmt.Errorf("failed to fail job item: %v", err)
+	}
+	return r.finishJobIfDone(ctx, item.JobID)
+}
+
+// RequeueStaleJobItems puts back items left running by a worker that went
+// away, failing those that have used maxAttempts
+func (r *Repository) RequeueStaleJobItems(ctx context.Context, olderThan time.Duration, maxAttempts int) (int64, error) {
+	query := `UPDATE job_items
+              SET status = CASE WHEN attempts >= $2 THEN 'failed' ELSE 'queued' END,
+                  error = $3, updated_at = ` + now + `
+              WHERE status = 'running' AND updated_at < $1
+              RETURNING job_id, status`
+	rows, err := r.db.QueryContext(ctx, query, ts(time.Now().Add(-olderThan)), maxAttempts, db.StaleJobItemError)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stale job items: %v", err)
+	}
+	defer rows.Close()
+
+	var requeued int64
+	failedJobs := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var jobID uuid.UUID
+		var status string
+		if err := rows.Scan(&jobID, &status); err != nil {
+			return 0, fmt.Errorf("failed to scan stale job item: %v", err)
+		}
+		requeued++
+		if status == db.JobStatusFailed {
+			failedJobs[jobID] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating over stale job items: %v", err)
+	}
+	rows.Close()
+
+	for jobID := range failedJobs {
+		if err := r.finishJobIfDone(ctx, jobID); err != nil {
+			return requeued, err
+		}
+	}
+	return requeued, nil
+}
+
+// finishJobIfDone closes out a job once none of its items are left to run
+func (r *Repository) finishJobIfDone(ctx context.Context, jobID uuid.UUID) error {
+	query := `UPDATE jobs
+              SET status = CASE
+                      WHEN EXISTS (SELECT 1 FROM job_items WHERE job_id = $1 AND status = 'failed') THEN 'failed'
+                      ELSE 'completed'
+                  END,
+                  finished_at = ` + now + `
+              WHERE id = $1
+                AND finished_at IS NULL
+                AND NOT EXISTS (SELECT 1 FROM job_items WHERE job_id = $1 AND status IN ('queued', 'running'))`
+	_, err := r.db.ExecContext(ctx, query, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to finish job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrator applies the migrations embedded in repository/sqlite/migrations
+type Migrator struct {
+	db         *sql.DB
+	migrations []db.Migration
+}
+
+// Migrator reads the embedded migrations. Every version needs both an up and a down file.
+func (r *Repository) Migrator() (*Migrator, error) {
+	migrations, err := db.LoadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: r.pool, migrations: migrations}, nil
+}
+
+// Latest is the highest embedded version
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the last steps applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		applied, err := appliedVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; !ok {
+				continue
+			}
+			if err := revert(ctx, tx, m.migrations[i]); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// To applies or reverts migrations until version is the last one applied
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("no migration has version %d", version)
+	}
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		applied, err := appliedVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err := revert(ctx, tx, migration); err != nil {
+					return err
+				}
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := apply(ctx, tx, migration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status lists every embedded migration with when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]db.MigrationStatus, error) {
+	var statuses []db.MigrationStatus
+	err := m.inTx(ctx, func(tx *sql.Tx) error {
+		applied, err := appliedVersions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := db.MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+func (m *Migrator) known(version int64) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// inTx runs fn in one write transaction, after making sure schema_migrations
+// exists. SQLite has no advisory locks, so instances starting together wait
+// on the write lock instead, and a failed migration leaves the schema as the
+// run found it.
+func (m *Migrator) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+                  version INTEGER PRIMARY KEY,
+                  name TEXT NOT NULL,
+                  applied_at TIMESTAMP NOT NULL DEFAULT (` + now + `)
+              )`
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migrations: %v", err)
+	}
+	return nil
+}
+
+func appliedVersions(ctx context.Context, tx *sql.Tx) (map[int64]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating applied migrations: %v", err)
+	}
+	return applied, nil
+}
+
+// apply runs the up migration and records it
+func apply(ctx context.Context, tx *sql.Tx, migration db.Migration) error {
+	_, err := tx.ExecContext(ctx, migration.Up)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+// revert runs the down migration and removes its record
+func revert(ctx context.Context, tx *sql.Tx, migration db.Migration) error {
+	_, err := tx.ExecContext(ctx, migration.Down)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revert migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
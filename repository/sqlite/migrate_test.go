@@ -0,0 +1,175 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+)
+
+// testMigrations create two tables, and the third fails after creating one
+var testMigrations = []db.Migration{
+	{Version: 1, Name: "users", Up: `CREATE TABLE users (id INTEGER)`, Down: `DROP TABLE users`},
+	{Version: 2, Name: "widgets", Up: `CREATE TABLE widgets (id INTEGER)`, Down: `DROP TABLE widgets`},
+	{Version: 3, Name: "broken", Up: `CREATE TABLE gadgets (id INTEGER); SELECT * FROM missing_table`, Down: `DROP TABLE gadgets`},
+}
+
+// newTestRepo opens an empty database file of its own
+func newTestRepo(t *testing.T) *Repository {
+	t.Helper()
+	repo, err := Open(filepath.Join(t.TempDir(), "gippity.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(repo.Close)
+	return repo
+}
+
+func tableExists(t *testing.T, repo *Repository, table string) bool {
+	t.Helper()
+	var count int
+	if err := repo.pool.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+// expectApplied fails unless schema_migrations records exactly versions
+func expectApplied(t *testing.T, m *Migrator, versions ...int64) {
+	t.Helper()
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []int64
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			applied = append(applied, status.Version)
+		}
+	}
+	if len(applied) != len(versions) {
+		t.Fatalf("applied versions = %v, want %v", applied, versions)
+	}
+	for i := range versions {
+		if applied[i] != versions[i] {
+			t.Fatalf("applied versions = %v, want %v", applied, versions)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	repo := newTestRepo(t)
+	m, err := repo.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range m.migrations {
+		if migration.Version != int64(i+1) {
+			t.Fatalf("migration %d_%s follows version %d; versions must not skip", migration.Version, migration.Name, i)
+		}
+	}
+
+	// Every down file undoes its up file
+	ctx := context.Background()
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !tableExists(t, repo, "users") || !tableExists(t, repo, "chats") {
+		t.Fatal("Up did not create the schema")
+	}
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m)
+	var left []string
+	rows, err := repo.pool.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name <> 'schema_migrations'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, name)
+	}
+	if len(left) != 0 {
+		t.Fatalf("migrating to 0 left %v behind", left)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("migrating up again failed: %v", err)
+	}
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	repo := newTestRepo(t)
+	m := &Migrator{db: repo.pool, migrations: testMigrations[:2]}
+	ctx := context.Background()
+	expectApplied(t, m)
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1, 2)
+	if !tableExists(t, repo, "users") || !tableExists(t, repo, "widgets") {
+		t.Fatal("Up did not create the tables")
+	}
+	// Applying again has nothing to do
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Down reverts the newest first
+	if err := m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1)
+	if !tableExists(t, repo, "users") || tableExists(t, repo, "widgets") {
+		t.Fatal("Down 1 did not revert only the last migration")
+	}
+
+	if err := m.To(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1, 2)
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m)
+	if tableExists(t, repo, "users") || tableExists(t, repo, "widgets") {
+		t.Fatal("migrating to 0 left tables behind")
+	}
+	if err := m.To(ctx, 7); err == nil {
+		t.Fatal("To accepted a version with no migration")
+	}
+}
+
+func TestMigratorRollsBackFailedRun(t *testing.T) {
+	repo := newTestRepo(t)
+	m := &Migrator{db: repo.pool, migrations: testMigrations}
+	ctx := context.Background()
+	err := m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "3_broken") {
+		t.Fatalf("Up returned %v, want the broken migration's error", err)
+	}
+	// The whole run is one transaction, so nothing before the failure stays applied
+	expectApplied(t, m)
+	for _, table := range []string{"users", "widgets", "gadgets"} {
+		if tableExists(t, repo, table) {
+			t.Fatalf("the failed run left %s behind", table)
+		}
+	}
+
+	// Runs that stop short of the broken migration still work
+	if err := m.To(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied(t, m, 1, 2)
+	status, err := m.Status(ctx)
+	if err != nil || len(status) != 3 || status[2].Name != "broken" || status[2].AppliedAt != nil {
+		t.Fatalf("Status = %+v, %v", status, err)
+	}
+}
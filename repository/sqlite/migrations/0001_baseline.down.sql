@@ -0,0 +1,32 @@
+DROP TABLE IF EXISTS chat_instructions;
+DROP TABLE IF EXISTS custom_instructions;
+DROP TABLE IF EXISTS data_exports;
+DROP TABLE IF EXISTS workspace_models;
+DROP TABLE IF EXISTS workspace_patterns;
+DROP TABLE IF EXISTS workspaces;
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
+DROP TABLE IF EXISTS jwt_signing_keys;
+DROP TABLE IF EXISTS security_events;
+DROP TABLE IF EXISTS auth_throttles;
+DROP TABLE IF EXISTS webauthn_challenges;
+DROP TABLE IF EXISTS webauthn_credentials;
+DROP TABLE IF EXISTS oidc_login_states;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS email_tokens;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS schedule_runs;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS job_items;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS user_preferences;
+DROP TABLE IF EXISTS chat_ai_models;
+DROP TABLE IF EXISTS ai_models;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS chats;
+DROP TABLE IF EXISTS user_metadata;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,421 @@
+-- The Postgres schema as of 0016_custom_instructions translated to SQLite. UUIDs are random version 4
+-- text, timestamps are UTC text that sorts in time order, and arrays and JSONB
+-- are JSON text.
+
+-- Users table
+CREATE TABLE users (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    username VARCHAR(50) UNIQUE NOT NULL,
+    email VARCHAR(255) UNIQUE NOT NULL,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    last_login TIMESTAMP,
+    is_active BOOLEAN DEFAULT TRUE,
+    email_verified_at TIMESTAMP,
+    role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin')),
+    -- Set when the user asks to delete their account; the account is purged once it passes
+    deletion_scheduled_at TIMESTAMP
+);
+
+CREATE INDEX idx_users_id ON users(id);
+CREATE INDEX idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
+
+-- User metadata table
+CREATE TABLE user_metadata (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    preferred_language VARCHAR(10),
+    timezone VARCHAR(50),
+    interests JSON,
+    profession VARCHAR(100),
+    education_level VARCHAR(50),
+    birth_year INTEGER,
+    country VARCHAR(50),
+    last_updated TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+-- Chats table
+CREATE TABLE chats (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    -- Personal chats are deleted with their user; shared ones are kept without one
+    user_id TEXT REFERENCES users(id) ON DELETE SET NULL,
+    title VARCHAR(255),
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    last_updated TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    is_archived BOOLEAN DEFAULT FALSE,
+    ai_model_version VARCHAR(20)
+);
+
+CREATE INDEX idx_chats_id ON chats(id);
+
+-- Messages table
+CREATE TABLE messages (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    chat_id TEXT REFERENCES chats(id) ON DELETE CASCADE,
+    user_id TEXT REFERENCES users(id) ON DELETE SET NULL,
+    role VARCHAR(20) NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    is_edited BOOLEAN DEFAULT FALSE
+);
+
+CREATE INDEX idx_messages_id ON messages(id);
+
+-- AI Models table
+CREATE TABLE ai_models (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    name VARCHAR(50) UNIQUE NOT NULL,
+    version VARCHAR(20) NOT NULL,
+    description TEXT,
+    is_active BOOLEAN DEFAULT TRUE
+);
+
+CREATE INDEX idx_ai_models_id ON ai_models(id);
+
+-- Chat-AI Model association table
+CREATE TABLE chat_ai_models (
+    chat_id TEXT REFERENCES chats(id) ON DELETE CASCADE,
+    ai_model_id TEXT REFERENCES ai_models(id),
+    PRIMARY KEY (chat_id, ai_model_id)
+);
+
+-- User preferences table
+CREATE TABLE user_preferences (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    default_ai_model TEXT REFERENCES ai_models(id),
+    theme VARCHAR(20) DEFAULT 'light',
+    message_display_count INTEGER DEFAULT 50,
+    notifications_enabled BOOLEAN DEFAULT TRUE
+);
+
+-- Add foreign key constraint for chats in users table
+ALTER TABLE users ADD COLUMN last_chat_id TEXT REFERENCES chats(id) ON DELETE SET NULL;
+-- Batch jobs table
+CREATE TABLE jobs (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    pattern VARCHAR(100) NOT NULL,
+    variables JSON,
+    ai_model_version VARCHAR(20),
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    finished_at TIMESTAMP
+);
+
+CREATE INDEX idx_jobs_user_id ON jobs(user_id);
+
+-- Batch job items table, one row per input, claimed by workers in a write transaction
+CREATE TABLE job_items (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    job_id TEXT REFERENCES jobs(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    input TEXT NOT NULL,
+    output TEXT,
+    error TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    run_after TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+CREATE INDEX idx_job_items_job_id ON job_items(job_id, position);
+CREATE INDEX idx_job_items_queue ON job_items(status, run_after);
+
+-- Scheduled recurring prompts, evaluated in the owner's timezone
+CREATE TABLE schedules (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    cron_expression VARCHAR(100) NOT NULL,
+    pattern VARCHAR(100),
+    prompt TEXT NOT NULL,
+    variables JSON,
+    ai_model_version VARCHAR(20),
+    chat_id TEXT REFERENCES chats(id) ON DELETE SET NULL,
+    append_to_chat BOOLEAN DEFAULT FALSE,
+    is_active BOOLEAN DEFAULT TRUE,
+    next_run_at TIMESTAMP NOT NULL,
+    last_run_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+CREATE INDEX idx_schedules_user_id ON schedules(user_id);
+CREATE INDEX idx_schedules_next_run_at ON schedules(next_run_at) WHERE is_active;
+
+-- One row per scheduled run
+CREATE TABLE schedule_runs (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    schedule_id TEXT REFERENCES schedules(id) ON DELETE CASCADE,
+    chat_id TEXT REFERENCES chats(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    started_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    finished_at TIMESTAMP
+);
+
+CREATE INDEX idx_schedule_runs_schedule_id ON schedule_runs(schedule_id, started_at);
+
+-- Sessions table, one row per login
+CREATE TABLE sessions (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT,
+    ip_address VARCHAR(45),
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    last_used_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+
+-- Refresh tokens, stored hashed; the family is the session they were issued for
+CREATE TABLE refresh_tokens (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    family_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);
+
+-- Single-use tokens sent by email for verification, password reset and magic-link login
+CREATE TABLE email_tokens (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_email_tokens_user_id ON email_tokens(user_id, purpose);
+
+-- TOTP second factor; enabled_at stays NULL until the user confirms a first code
+CREATE TABLE user_totp (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    enabled_at TIMESTAMP,
+    last_used_step INTEGER NOT NULL DEFAULT 0
+);
+
+-- Single-use recovery codes, stored hashed
+CREATE TABLE mfa_recovery_codes (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id);
+
+-- Personal API keys, stored hashed; prefix is kept so users can tell keys apart
+CREATE TABLE api_keys (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash VARCHAR(64) UNIQUE NOT NULL,
+    scopes JSON NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
+
+-- Accounts at external OpenID Connect providers linked to a user
+CREATE TABLE user_identities (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    groups JSON NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    last_login_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+
+-- State, nonce and PKCE verifier of logins waiting on the identity provider
+CREATE TABLE oidc_login_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Passkeys; public_key is the COSE key from the authenticator
+CREATE TABLE webauthn_credentials (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BLOB UNIQUE NOT NULL,
+    public_key BLOB NOT NULL,
+    sign_count INTEGER NOT NULL DEFAULT 0,
+    aaguid BLOB,
+    attestation_format VARCHAR(32) NOT NULL,
+    transports JSON NOT NULL DEFAULT '[]',
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- Challenges of WebAuthn ceremonies in progress; each can be answered once
+CREATE TABLE webauthn_challenges (
+    challenge VARCHAR(64) PRIMARY KEY,
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Failed attempts per throttle key, e.g. login:<username> or ip:<address>
+CREATE TABLE auth_throttles (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    locked_until TIMESTAMP
+);
+
+-- Audit trail of lockouts and other security relevant changes
+CREATE TABLE security_events (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE SET NULL,
+    actor_id TEXT REFERENCES users(id) ON DELETE SET NULL,
+    event_type VARCHAR(50) NOT NULL,
+    ip_address VARCHAR(45),
+    detail JSON NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+CREATE INDEX idx_security_events_user_id ON security_events(user_id, created_at DESC);
+CREATE INDEX idx_security_events_created_at ON security_events(created_at DESC);
+
+-- Keys that sign JWTs. A key is published in the JWKS from creation, signs
+-- from activates_at until a newer key activates, and verifies until expires_at.
+CREATE TABLE jwt_signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL,
+    private_key BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    activates_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Organizations group users; every member can use the organization's workspaces
+CREATE TABLE organizations (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    name VARCHAR(100) NOT NULL,
+    created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+-- Owners manage everything, admins manage members and workspaces, members use them
+CREATE TABLE organization_members (
+    organization_id TEXT REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX idx_organization_members_user_id ON organization_members(user_id);
+
+-- Team workspaces hold shared chats, patterns and a model allowlist
+CREATE TABLE workspaces (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    organization_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    UNIQUE (organization_id, name)
+);
+
+-- Chats without a workspace are personal to their user
+ALTER TABLE chats ADD COLUMN workspace_id TEXT REFERENCES workspaces(id) ON DELETE CASCADE;
+CREATE INDEX idx_chats_workspace_id ON chats(workspace_id, last_updated DESC);
+
+CREATE TABLE workspace_patterns (
+    workspace_id TEXT REFERENCES workspaces(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    system_prompt TEXT NOT NULL,
+    user_prompt TEXT NOT NULL DEFAULT '',
+    created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    PRIMARY KEY (workspace_id, name)
+);
+
+-- Models a workspace may use; a workspace without rows may use every active model
+CREATE TABLE workspace_models (
+    workspace_id TEXT REFERENCES workspaces(id) ON DELETE CASCADE,
+    ai_model_id TEXT REFERENCES ai_models(id) ON DELETE CASCADE,
+    PRIMARY KEY (workspace_id, ai_model_id)
+);
+
+-- Requested exports of everything stored about a user; archive is the zip once built
+CREATE TABLE data_exports (
+    pk INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL DEFAULT (lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))),
+    user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    error TEXT,
+    archive BLOB,
+    size INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX idx_data_exports_user_id ON data_exports(user_id, created_at DESC);
+CREATE INDEX idx_data_exports_queue ON data_exports(status, created_at);
+
+-- How the assistant should respond to a user, and which user_metadata fields
+-- they agreed to share with it
+CREATE TABLE custom_instructions (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    instructions TEXT NOT NULL DEFAULT '',
+    metadata_fields JSON NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+-- Per chat settings; instructions replace the user's own when set
+CREATE TABLE chat_instructions (
+    chat_id TEXT PRIMARY KEY REFERENCES chats(id) ON DELETE CASCADE,
+    instructions TEXT,
+    personalization_disabled BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
@@ -0,0 +1,6 @@
+-- Assistant replies are saved as pending before they stream and marked
+-- complete or failed when the stream ends. Existing messages are complete.
+ALTER TABLE messages ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'complete'
+    CHECK (status IN ('pending', 'complete', 'failed'));
+
+CREATE INDEX idx_messages_pending ON messages(created_at) WHERE status = 'pending';
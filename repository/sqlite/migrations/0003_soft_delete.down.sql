@@ -0,0 +1,5 @@
+-- Anything still in the trash is restored
+DROP INDEX IF EXISTS idx_messages_deleted_at;
+DROP INDEX IF EXISTS idx_chats_deleted_at;
+ALTER TABLE messages DROP COLUMN deleted_at;
+ALTER TABLE chats DROP COLUMN deleted_at;
@@ -0,0 +1,7 @@
+-- MFA challenge tokens that completed a login, by jti, so each one works once.
+-- Rows are swept once the token has expired anyway.
+CREATE TABLE used_mfa_challenges (
+    jti VARCHAR(64) PRIMARY KEY,
+    used_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now')),
+    expires_at TIMESTAMP NOT NULL
+);
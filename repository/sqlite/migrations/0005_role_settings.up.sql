@@ -0,0 +1,9 @@
+-- Policy per role, managed by admins. Users whose role requires MFA can only
+-- enroll a second factor until they have one; admin starts out required.
+CREATE TABLE role_settings (
+    role VARCHAR(20) PRIMARY KEY CHECK (role IN ('user', 'admin')),
+    mfa_required BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f000000', 'now'))
+);
+
+INSERT INTO role_settings (role, mfa_required) VALUES ('user', FALSE), ('admin', TRUE);
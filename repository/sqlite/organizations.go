@@ -0,0 +1,444 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+// CreateOrganization creates the organization with ownerID as its first owner
+func (r *Repository) CreateOrganization(ctx context.Context, org *models.Organization, ownerID uuid.UUID) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin organization transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO organizations (name, created_by) VALUES ($1, $2) RETURNING id, created_at`
+	if err := tx.QueryRowContext(ctx, query, org.Name, ownerID).Scan(&org.ID, &org.CreatedAt); err != nil {
+		return fmt.Errorf("failed to create organization: %v", err)
+	}
+	query = `INSERT INTO organization_members (organization_id, user_id, role) VALUES ($1, $2, $3)`
+	if _, err := tx.ExecContext(ctx, query, org.ID, ownerID, db.OrgRoleOwner); err != nil {
+		return fmt.Errorf("failed to add organization owner: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit organization: %v", err)
+	}
+	org.CreatedBy = &ownerID
+	org.Role = db.OrgRoleOwner
+	return nil
+}
+
+// GetOrganizationsByUserID returns the organizations the user belongs to, with their role in each
+func (r *Repository) GetOrganizationsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Organization, error) {
+	query := `SELECT o.id, o.name, o.created_by, o.created_at, m.role
+              FROM organizations o
+              JOIN organization_members m ON m.organization_id = o.id
+              WHERE m.user_id = $1
+              ORDER BY o.name`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organizations: %v", err)
+	}
+	defer rows.Close()
+
+	orgs := []*models.Organization{}
+	for rows.Next() {
+		org := &models.Organization{}
+		if err := rows.Scan(&org.ID, &org.Name, &org.CreatedBy, &org.CreatedAt, &org.Role); err != nil {
+			return nil, fmt.Errorf("failed to scan organization: %v", err)
+		}
+		orgs = append(orgs, org)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over organizations: %v", err)
+	}
+	return orgs, nil
+}
+
+// GetOrganizationRole returns the user's role in the organization, or "" if they are not a member
+func (r *Repository) GetOrganizationRole(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) (string, error) {
+	query := `SELECT role FROM organization_members WHERE organization_id = $1 AND user_id = $2`
+	var role string
+	err := r.db.QueryRowContext(ctx, query, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get organization role: %v", err)
+	}
+	return role, nil
+}
+
+func (r *Repository) RenameOrganization(ctx context.Context, orgID uuid.UUID, name string) error {
+	tag, err := r.db.ExecContext(ctx, `UPDATE organizations SET name = $2 WHERE id = $1`, orgID, name)
+	if err != nil {
+		return fmt.Errorf("failed to rename organization: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrOrganizationNotFound
+	}
+	return nil
+}
+
+// DeleteOrganization removes the organization with its workspaces and their chats
+func (r *Repository) DeleteOrganization(ctx context.Context, orgID uuid.UUID) error {
+	tag, err := r.db.ExecContext(ctx, `DELETE FROM organizations WHERE id = $1`, orgID)
+	if err != nil {
+		return fmt.Errorf("failed to delete organization: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrOrganizationNotFound
+	}
+	return nil
+}
+
+func (r *Repository) GetOrganizationMembers(ctx context.Context, orgID uuid.UUID) ([]*models.OrganizationMember, error) {
+	query := `SELECT m.organization_id, m.user_id, u.username, m.role, m.created_at
+              FROM organization_members m
+              JOIN users u ON u.id = m.user_id
+              WHERE m.organization_id = $1
+              ORDER BY u.username`
+	rows, err := r.db.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization members: %v", err)
+	}
+	defer rows.Close()
+
+	members := []*models.OrganizationMember{}
+	for rows.Next() {
+		member := &models.OrganizationMember{}
+		if err := rows.Scan(&member.OrganizationID, &member.UserID, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan organization member: %v", err)
+		}
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over organization members: %v", err)
+	}
+	return members, nil
+}
+
+func (r *Repository) AddOrganizationMember(ctx context.Context, member *models.OrganizationMember) error {
+	query := `INSERT INTO organization_members (organization_id, user_id, role) VALUES ($1, $2, $3) RETURNING created_at`
+	err := r.db.QueryRowContext(ctx, query, member.OrganizationID, member.UserID, member.Role).Scan(&member.CreatedAt)
+	if isSQLiteError(err, uniqueViolation) {
+		return db.ErrMemberExists
+	}
+	if isSQLiteError(err, foreignKeyViolation) {
+		return db.ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add organization member: %v", err)
+	}
+	return nil
+}
+
+// SetOrganizationMemberRole changes a member's role, refusing to demote the last owner
+func (r *Repository) SetOrganizationMemberRole(ctx context.Context, orgID uuid.UUID, userID uuid.UUID, role string) error {
+	query := `UPDATE organization_members SET role = $3
+              WHERE organization_id = $1 AND user_id = $2
+                AND ($3 = 'owner' OR role <> 'owner'
+                     OR (SELECT COUNT(*) FROM organization_members WHERE organization_id = $1 AND role = 'owner') > 1)`
+	tag, err := r.db.ExecContext(ctx, query, orgID, userID, role)
+	if err != nil {
+		return fmt.Errorf("failed to set organization member role: %v", err)
+	}
+	if affected(tag) == 0 {
+		return r.memberChangeRefused(ctx, orgID, userID)
+	}
+	return nil
+}
+
+// RemoveOrganizationMember takes the user out of the organization, refusing to remove the last owner.
+// Chats they shared with its workspaces stay with the workspaces.
+func (r *Repository) RemoveOrganizationMember(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) error {
+	query := `DELETE FROM organization_members
+              WHERE organization_id = $1 AND user_id = $2
+                AND (role <> 'owner'
+                     OR (SELECT COUNT(*) FROM organization_members WHERE organization_id = $1 AND role = 'owner') > 1)`
+	tag, err := r.db.ExecContext(ctx, query, orgID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove organization member: %v", err)
+	}
+	if affected(tag) == 0 {
+		return r.memberChangeRefused(ctx, orgID, userID)
+	}
+	return nil
+}
+
+// memberChangeRefused works out why a member update touched no rows
+func (r *Repository) memberChangeRefused(ctx context.Context, orgID uuid.UUID, userID uuid.UUID) error {
+	role, err := r.GetOrganizationRole(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return db.ErrMemberNotFound
+	}
+	return db.ErrLastOwner
+}
+
+func (r *Repository) CreateWorkspace(ctx context.Context, workspace *models.Workspace) error {
+	query := `INSERT INTO workspaces (organization_id, name) VALUES ($1, $2) RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, workspace.OrganizationID, workspace.Name).Scan(&workspace.ID, &workspace.CreatedAt)
+	if isSQLiteError(err, uniqueViolation) {
+		return db.ErrWorkspaceExists
+	}
+	if isSQLiteError(err, foreignKeyViolation) {
+		return db.ErrOrganizationNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create workspace: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) GetWorkspaceByID(ctx context.Context, id uuid.UUID) (*models.Workspace, error) {
+	query := `SELECT id, organization_id, name, created_at FROM workspaces WHERE id = $1`
+	workspace := &models.Workspace{}
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&workspace.ID, &workspace.OrganizationID, &workspace.Name, &workspace.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace by ID: %v", err)
+	}
+	return workspace, nil
+}
+
+func (r *Repository) GetWorkspacesByOrganizationID(ctx context.Context, orgID uuid.UUID) ([]*models.Workspace, error) {
+	query := `SELECT id, organization_id, name, created_at FROM workspaces WHERE organization_id = $1 ORDER BY name`
+	rows, err := r.db.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %v", err)
+	}
+	defer rows.Close()
+
+	workspaces := []*models.Workspace{}
+	for rows.Next() {
+		workspace := &models.Workspace{}
+		if err := rows.Scan(&workspace.ID, &workspace.OrganizationID, &workspace.Name, &workspace.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace: %v", err)
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over workspaces: %v", err)
+	}
+	return workspaces, nil
+}
+
+func (r *Repository) RenameWorkspace(ctx context.Context, id uuid.UUID, name string) error {
+	tag, err := r.db.ExecContext(ctx, `UPDATE workspaces SET name = $2 WHERE id = $1`, id, name)
+	if isSQLiteError(err, uniqueViolation) {
+		return db.ErrWorkspaceExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rename workspace: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrWorkspaceNotFound
+	}
+	return nil
+}
+
+// DeleteWorkspace removes the workspace together with its chats and patterns
+func (r *Repository) DeleteWorkspace(ctx context.Context, id uuid.UUID) error {
+	tag, err := r.db.ExecContext(ctx, `DELETE FROM workspaces WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete workspace: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrWorkspaceNotFound
+	}
+	return nil
+}
+
+// GetWorkspaceRole returns the user's role in the organization owning the
+// workspace, or "" if the workspace does not exist or they are not a member
+func (r *Repository) GetWorkspaceRole(ctx context.Context, workspaceID uuid.UUID, userID uuid.UUID) (string, error) {
+	query := `SELECT m.role
+              FROM workspaces w
+              JOIN organization_members m ON m.organization_id = w.organization_id
+              WHERE w.id = $1 AND m.user_id = $2`
+	var role string
+	err := r.db.QueryRowContext(ctx, query, workspaceID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get workspace role: %v", err)
+	}
+	return role, nil
+}
+
+// GetWorkspaceModels returns the workspace's model allowlist. An empty list allows every model.
+func (r *Repository) GetWorkspaceModels(ctx context.Context, workspaceID uuid.UUID) ([]*models.AIModel, error) {
+	query := `SELECT m.id, m.name, m.version, m.description, m.is_active
+              FROM workspace_models wm
+              JOIN ai_models m ON m.id = wm.ai_model_id
+              WHERE wm.workspace_id = $1
+              ORDER BY m.name`
+	rows, err := r.db.QueryContext(ctx, query, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace models: %v", err)
+	}
+	defer rows.Close()
+
+	list := []*models.AIModel{}
+	for rows.Next() {
+		model := &models.AIModel{}
+		if err := rows.Scan(&model.ID, &model.Name, &model.Version, &model.Description, &model.IsActive); err != nil {
+			return nil, fmt.Errorf("failed to scan AI model: %v", err)
+		}
+		list = append(list, model)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over workspace models: %v", err)
+	}
+	return list, nil
+}
+
+// SetWorkspaceModels replaces the workspace's model allowlist
+func (r *Repository) SetWorkspaceModels(ctx context.Context, workspaceID uuid.UUID, modelIDs []uuid.UUID) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin workspace models transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspace_models WHERE workspace_id = $1`, workspaceID); err != nil {
+		return fmt.Errorf("failed to clear workspace models: %v", err)
+	}
+	query := `INSERT INTO workspace_models (workspace_id, ai_model_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	for _, modelID := range modelIDs {
+		_, err = tx.ExecContext(ctx, query, workspaceID, modelID)
+		if isSQLiteError(err, foreignKeyViolation) {
+			return db.ErrAIModelNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set workspace models: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit workspace models: %v", err)
+	}
+	return nil
+}
+
+// IsModelAllowedInWorkspace reports whether chats in the workspace may use the
+// model version. An empty version means the default model, which an allowlist
+// does not name, so it is only allowed when there is no allowlist.
+func (r *Repository) IsModelAllowedInWorkspace(ctx context.Context, workspaceID uuid.UUID, version string) (bool, error) {
+	query := `SELECT NOT EXISTS (SELECT 1 FROM workspace_models WHERE workspace_id = $1)
+                  OR EXISTS (SELECT 1 FROM workspace_models wm
+                             JOIN ai_models m ON m.id = wm.ai_model_id
+                             WHERE wm.workspace_id = $1 AND m.version = $2 AND m.is_active)`
+	var allowed bool
+	if err := r.db.QueryRowContext(ctx, query, workspaceID, version).Scan(&allowed); err != nil {
+		return false, fmt.Errorf("failed to check workspace model: %v", err)
+	}
+	return allowed, nil
+}
+
+func (r *Repository) GetWorkspacePatterns(ctx context.Context, workspaceID uuid.UUID) ([]*models.WorkspacePattern, error) {
+	query := `SELECT workspace_id, name, system_prompt, user_prompt, created_by, created_at, updated_at
+              FROM workspace_patterns
+              WHERE workspace_id = $1
+              ORDER BY name`
+	rows, err := r.db.QueryContext(ctx, query, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace patterns: %v", err)
+	}
+	defer rows.Close()
+
+	patterns := []*models.WorkspacePattern{}
+	for rows.Next() {
+		pattern := &models.WorkspacePattern{}
+		if err := rows.Scan(&pattern.WorkspaceID, &pattern.Name, &pattern.System, &pattern.User, &pattern.CreatedBy, &pattern.CreatedAt, &pattern.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace pattern: %v", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over workspace patterns: %v", err)
+	}
+	return patterns, nil
+}
+
+func (r *Repository) GetWorkspacePattern(ctx context.Context, workspaceID uuid.UUID, name string) (*models.WorkspacePattern, error) {
+	query := `SELECT workspace_id, name, system_prompt, user_prompt, created_by, created_at, updated_at
+              FROM workspace_patterns
+              WHERE workspace_id = $1 AND name = $2`
+	pattern := &models.WorkspacePattern{}
+	err := r.db.QueryRowContext(ctx, query, workspaceID, name).Scan(&pattern.WorkspaceID, &pattern.Name, &pattern.System, &pattern.User, &pattern.CreatedBy, &pattern.CreatedAt, &pattern.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrPatternNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace pattern: %v", err)
+	}
+	return pattern, nil
+}
+
+// SaveWorkspacePattern creates or replaces a workspace pattern and reports whether it was created
+func (r *Repository) SaveWorkspacePattern(ctx context.Context, pattern *models.WorkspacePattern) (bool, error) {
+	if !db.ValidPatternName(pattern.Name) || pattern.System == "" {
+		return false, db.ErrInvalidPattern
+	}
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin workspace pattern transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM workspace_patterns WHERE workspace_id = $1 AND name = $2)`
+	if err := tx.QueryRowContext(ctx, query, pattern.WorkspaceID, pattern.Name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to get workspace pattern: %v", err)
+	}
+	query = `INSERT INTO workspace_patterns (workspace_id, name, system_prompt, user_prompt, created_by)
+             VALUES ($1, $2, $3, $4, $5)
+             ON CONFLICT (workspace_id, name) DO UPDATE SET
+                 system_prompt = EXCLUDED.system_prompt,
+                 user_prompt = EXCLUDED.user_prompt,
+                 updated_at = ` + now + `
+             RETURNING created_by, created_at, updated_at`
+	err = tx.QueryRowContext(ctx, query, pattern.WorkspaceID, pattern.Name, pattern.System, pattern.User, pattern.CreatedBy).
+		Scan(&pattern.CreatedBy, &pattern.CreatedAt, &pattern.UpdatedAt)
+	if isSQLiteError(err, foreignKeyViolation) {
+		return false, db.ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to save workspace pattern: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit workspace pattern: %v", err)
+	}
+	return !exists, nil
+}
+
+func (r *Repository) DeleteWorkspacePattern(ctx context.Context, workspaceID uuid.UUID, name string) error {
+	tag, err := r.db.ExecContext(ctx, `DELETE FROM workspace_patterns WHERE workspace_id = $1 AND name = $2`, workspaceID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete workspace pattern: %v", err)
+	}
+	if affected(tag) == 0 {
+		return db.ErrPatternNotFound
+	}
+	return nil
+}
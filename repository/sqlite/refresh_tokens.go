@@ -0,0 +1,125 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/db"
+	"github.com/FiveEightyEight/gippity-serv/models"
+)
+
+func (r *Repository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at)
+              VALUES ($1, $2, $3, $4)
+              RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query,
+		token.FamilyID,
+		token.UserID,
+		token.TokenHash,
+		ts(token.ExpiresAt)).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %v", err)
+	}
+	return nil
+}
+
+// RotateRefreshToken marks the token with oldHash as used and stores next in the
+// same family. Presenting a token that was already used revokes the family and its session.
+func (r *Repository) RotateRefreshToken(ctx context.Context, oldHash string, next *models.RefreshToken) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin refresh transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	current := &models.RefreshToken{}
+	query := `SELECT id, family_id, user_id, expires_at, used_at, revoked_at
+              FROM refresh_tokens
+              WHERE token_hash = $1`
+	err = tx.QueryRowContext(ctx, query, oldHash).Scan(
+		&current.ID,
+		&current.FamilyID,
+		&current.UserID,
+		&current.ExpiresAt,
+		&current.UsedAt,
+		&current.RevokedAt)
+	if err == sql.ErrNoRows {
+		return db.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get refresh token: %v", err)
+	}
+
+	if current.RevokedAt != nil || current.ExpiresAt.Before(time.Now()) ||
+		current.FamilyID != next.FamilyID || current.UserID != next.UserID {
+		return db.ErrRefreshTokenInvalid
+	}
+
+	if current.UsedAt != nil {
+		_, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = `+now+` WHERE family_id = $1 AND revoked_at IS NULL`, current.FamilyID)
+		if err != nil {
+			return fmt.Errorf("failed to revoke refresh token family: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = `+now+` WHERE id = $1 AND revoked_at IS NULL`, current.FamilyID)
+		if err != nil {
+			return fmt.Errorf("failed to revoke session: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit refresh token revocation: %v", err)
+		}
+		return db.ErrRefreshTokenReused
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = `+now+` WHERE id = $1`, current.ID); err != nil {
+		return fmt.Errorf("failed to mark refresh token used: %v", err)
+	}
+
+	query = `INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at)
+             VALUES ($1, $2, $3, $4)
+             RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, next.FamilyID, next.UserID, next.TokenHash, ts(next.ExpiresAt)).Scan(&next.ID, &next.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create rotated refresh token: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit refresh token rotation: %v", err)
+	}
+	return nil
+}
+
+// GetRefreshTokenByHash retrieves a live refresh token record
+func (r *Repository) GetRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	query := `SELECT id, family_id, user_id, created_at, expires_at, used_at, revoked_at
+              FROM refresh_tokens
+              WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > ` + now
+	token := &models.RefreshToken{TokenHash: tokenHash}
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&token.ID,
+		&token.FamilyID,
+		&token.UserID,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %v", err)
+	}
+	return token, nil
+}
+
+// DeleteExpiredRefreshTokens removes records that can no longer be presented.
+// Used tokens are kept until they expire so reuse can still be detected.
+func (r *Repository) DeleteExpiredRefreshTokens(ctx context.Context) (int64, error) {
+	query := `DELETE FROM refresh_tokens WHERE expires_at < ` + now
+	tag, err := r.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired refresh tokens: %v", err)
+	}
+	return affected(tag), nil
+}
@@ -0,0 +1,58 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+)
+
+func (r *Repository) GetRoleSettings(ctx context.Context) ([]*models.RoleSetting, error) {
+	query := `SELECT role, mfa_required, updated_at FROM role_settings ORDER BY role`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role settings: %v", err)
+	}
+	defer rows.Close()
+
+	settings := []*models.RoleSetting{}
+	for rows.Next() {
+		setting := &models.RoleSetting{}
+		if err := rows.Scan(&setting.Role, &setting.MFARequired, &setting.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan role setting: %v", err)
+		}
+		settings = append(settings, setting)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over role settings: %v", err)
+	}
+	return settings, nil
+}
+
+// RoleRequiresMFA reports whether users with role must have a second factor.
+// Roles without settings do not.
+func (r *Repository) RoleRequiresMFA(ctx context.Context, role string) (bool, error) {
+	var required bool
+	err := r.db.QueryRowContext(ctx, `SELECT mfa_required FROM role_settings WHERE role = $1`, role).Scan(&required)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get role setting: %v", err)
+	}
+	return required, nil
+}
+
+func (r *Repository) SetRoleMFARequired(ctx context.Context, role string, required bool) (*models.RoleSetting, error) {
+	query := `INSERT INTO role_settings (role, mfa_required) VALUES ($1, $2)
+              ON CONFLICT (role) DO UPDATE SET mfa_required = EXCLUDED.mfa_required, updated_at = ` + now + `
+              RETURNING role, mfa_required, updated_at`
+	setting := &models.RoleSetting{}
+	err := r.db.QueryRowContext(ctx, query, role, required).Scan(&setting.Role, &setting.MFARequired, &setting.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set role setting: %v", err)
+	}
+	return setting, nil
+}
@@ -0,0 +1,170 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+	"github.com/google/uuid"
+)
+
+// CreateSession records a new login and stamps the user's last_login
+func (r *Repository) CreateSession(ctx context.Context, session *models.Session) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin session transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO sessions (user_id, user_agent, ip_address)
+              VALUES ($1, $2, $3)
+              RETURNING id, created_at, last_used_at`
+	err = tx.QueryRowContext(ctx, query,
+		session.UserID,
+		session.UserAgent,
+		session.IPAddress).Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET last_login = $1 WHERE id = $2`, ts(session.CreatedAt), session.UserID); err != nil {
+		return fmt.Errorf("failed to update last login: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit session: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) GetSessionByID(ctx context.Context, id uuid.UUID) (*models.Session, error) {
+	query := `SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, revoked_at
+              FROM sessions
+              WHERE id = $1`
+	session := &models.Session{}
+	err := r.db.QueryRowContext(ctx, query, id).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.UserAgent,
+		&session.IPAddress,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.RevokedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session by ID: %v", err)
+	}
+	return session, nil
+}
+
+// GetActiveSessionsByUserID lists a user's sessions that have not been revoked, most recently used first
+func (r *Repository) GetActiveSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.Session, error) {
+	query := `SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, revoked_at
+              FROM sessions
+              WHERE user_id = $1 AND revoked_at IS NULL
+              ORDER BY last_used_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions by user ID: %v", err)
+	}
+	defer rows.Close()
+
+	var sessions []*models.Session
+	for rows.Next() {
+		session := &models.Session{}
+		if err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IPAddress,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %v", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over sessions: %v", err)
+	}
+
+	return sessions, nil
+}
+
+// TouchSession updates when the session was last used
+func (r *Repository) TouchSession(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE sessions SET last_used_at = ` + now + ` WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to touch session: %v", err)
+	}
+	return nil
+}
+
+// RevokeSession ends a login along with its refresh tokens
+func (r *Repository) RevokeSession(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin session transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = `+now+` WHERE id = $1 AND revoked_at IS NULL`, id); err != nil {
+		return fmt.Errorf("failed to revoke session: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = `+now+` WHERE family_id = $1 AND revoked_at IS NULL`, id); err != nil {
+		return fmt.Errorf("failed to revoke session refresh tokens: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit session revocation: %v", err)
+	}
+	return nil
+}
+
+// RevokeUserSessions ends every login of a user and returns the revoked session IDs
+func (r *Repository) RevokeUserSessions(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin session transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `UPDATE sessions SET revoked_at = `+now+` WHERE user_id = $1 AND revoked_at IS NULL RETURNING id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke user sessions: %v", err)
+	}
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan session ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over revoked sessions: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = `+now+` WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return nil, fmt.Errorf("failed to revoke user refresh tokens: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit session revocation: %v", err)
+	}
+	return ids, nil
+}
+
+// DeleteStaleSessions removes sessions that were revoked or idle for longer than olderThan
+func (r *Repository) DeleteStaleSessions(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `DELETE FROM sessions WHERE COALESCE(revoked_at, last_used_at) < $1`
+	tag, err := r.db.ExecContext(ctx, query, ts(time.Now().Add(-olderThan)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale sessions: %v", err)
+	}
+	return affected(tag), nil
+}
@@ -0,0 +1,53 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/FiveEightyEight/gippity-serv/models"
+)
+
+// GetSigningKeys returns the JWT signing keys that have not expired, oldest first
+func (r *Repository) GetSigningKeys(ctx context.Context) ([]*models.SigningKey, error) {
+	query := `SELECT kid, algorithm, private_key, created_at, activates_at, expires_at
+              FROM jwt_signing_keys
+              WHERE expires_at > ` + now + `
+              ORDER BY created_at`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signing keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []*models.SigningKey{}
+	for rows.Next() {
+		key := &models.SigningKey{}
+		if err := rows.Scan(&key.ID, &key.Algorithm, &key.PrivateKey, &key.CreatedAt, &key.ActivatesAt, &key.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over signing keys: %v", err)
+	}
+	return keys, nil
+}
+
+func (r *Repository) CreateSigningKey(ctx context.Context, key *models.SigningKey) error {
+	query := `INSERT INTO jwt_signing_keys (kid, algorithm, private_key, created_at, activates_at, expires_at)
+              VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.db.ExecContext(ctx, query, key.ID, key.Algorithm, key.PrivateKey, ts(key.CreatedAt), ts(key.ActivatesAt), ts(key.ExpiresAt))
+	if err != nil {
+		return fmt.Errorf("failed to create signing key: %v", err)
+	}
+	return nil
+}
+
+func (r *Repository) DeleteExpiredSigningKeys(ctx context.Context) (int64, error) {
+	tag, err := r.db.ExecContext(ctx, `DELETE FROM jwt_signing_keys WHERE expires_at < `+now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired signing keys: %v", err)
+	}
+	return affected(tag), nil
+}
@@ -0,0 +1,180 @@
+// Package sqlite stores everything in a single SQLite file through the pure-Go
+// modernc.org/sqlite driver, so gippity-serv runs on a laptop without Postgres
+// or cgo. It behaves like db.PostgresRepository, including its UUIDs,
+// timestamps, cascades and errors, with its own migrations in sqlite/migrations.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/joho/godotenv"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Scheme is the DATABASE_URL prefix that selects this repository, as in sqlite://gippity.db
+const Scheme = "sqlite://"
+
+// dbtx is what queries run on: the database, or the transaction of a unit of work
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Repository implements repository.Repository on a SQLite database
+type Repository struct {
+	db   dbtx
+	pool *sql.DB
+}
+
+var _ repository.Repository = (*Repository)(nil)
+
+func NewDatabaseConnection() (*Repository, error) {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file")
+	}
+	return Open(strings.TrimPrefix(os.Getenv("DATABASE_URL"), Scheme))
+}
+
+// Open opens or creates the database file at path. Every connection enforces
+// foreign keys, waits on a busy database instead of failing, and starts its
+// transactions with the write lock so concurrent writers queue up.
+func Open(path string) (*Repository, error) {
+	if path == "" {
+		return nil, fmt.Errorf("failed to connect to database: no file in %s url", Scheme)
+	}
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	return &Repository{db: db, pool: db}, nil
+}
+
+func (r *Repository) Close() {
+	r.pool.Close()
+}
+
+// InTx runs fn on a copy of the repository whose queries all go through one
+// transaction. The transaction takes the write lock when it begins.
+func (r *Repository) InTx(ctx context.Context, fn func(tx repository.ConversationTx) error) error {
+	tx, err := r.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&Repository{db: tx, pool: r.pool}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// timeFormat is how timestamps are stored: UTC with a fixed width, so
+// comparing them as text compares them as times. The driver reads it back
+// as a time.Time in columns declared TIMESTAMP.
+const timeFormat = "2006-01-02 15:04:05.000000000"
+
+// now is the current time in timeFormat, for use in queries where Postgres has NOW()
+const now = `strftime('%Y-%m-%d %H:%M:%f000000', 'now')`
+
+// ts formats t for a TIMESTAMP column
+func ts(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+// nullTS formats t for a nullable TIMESTAMP column
+func nullTS(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return ts(*t)
+}
+
+// parseTS reads a timestamp that lost its declared type in an expression such as MAX
+func parseTS(s string) (time.Time, error) {
+	return time.ParseInLocation(timeFormat, s, time.UTC)
+}
+
+// jsonColumn stores v as JSON text where Postgres has arrays and JSONB, and
+// scans it back into v, which must then be a pointer. A nil slice or map is NULL.
+type jsonColumn struct {
+	v interface{}
+}
+
+func asJSON(v interface{}) jsonColumn {
+	return jsonColumn{v: v}
+}
+
+func (c jsonColumn) Value() (driver.Value, error) {
+	data, err := json.Marshal(c.v)
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == "null" {
+		return nil, nil
+	}
+	return string(data), nil
+}
+
+func (c jsonColumn) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), c.v)
+	case []byte:
+		return json.Unmarshal(src, c.v)
+	default:
+		return fmt.Errorf("cannot scan %T as json", src)
+	}
+}
+
+// row is a single result row, from QueryRow or a Rows being iterated
+type row interface {
+	Scan(dest ...interface{}) error
+}
+
+// affected is how many rows a statement changed
+func affected(result sql.Result) int64 {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// SQLite extended result codes the repository maps to its own errors
+const (
+	foreignKeyViolation = sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
+	uniqueViolation     = sqlite3.SQLITE_CONSTRAINT_UNIQUE
+)
+
+// isSQLiteError reports whether err has the result code. A duplicate primary
+// key counts as a unique violation, as it does in Postgres.
+func isSQLiteError(err error, code int) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == code || (code == uniqueViolation && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
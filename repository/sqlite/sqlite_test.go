@@ -0,0 +1,35 @@
+package sqlite_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/FiveEightyEight/gippity-serv/repository"
+	"github.com/FiveEightyEight/gippity-serv/repository/repositorytest"
+	"github.com/FiveEightyEight/gippity-serv/repository/sqlite"
+)
+
+func TestRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		repo, err := sqlite.Open(filepath.Join(t.TempDir(), "gippity.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(repo.Close)
+		m, err := repo.Migrator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
+
+func TestOpenNeedsAPath(t *testing.T) {
+	if _, err := sqlite.Open(""); err == nil {
+		t.Fatal("Open accepted a url without a file")
+	}
+}
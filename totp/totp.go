@@ -0,0 +1,104 @@
+// Package totp implements RFC 6238 time-based one-time passwords with the
+// defaults authenticator apps expect: HMAC-SHA1, 6 digits and a 30 second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is how many steps either side of now a code is still accepted,
+	// to allow for clock drift and slow typing
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// modulus keeps the last Digits decimal digits of a truncated HMAC
+var modulus = func() uint32 {
+	m := uint32(1)
+	for i := 0; i < Digits; i++ {
+		m *= 10
+	}
+	return m
+}()
+
+// GenerateSecret returns a random 160 bit secret, base32 encoded
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate totp secret: %v", err)
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// ProvisioningURI is the otpauth:// URI authenticator apps read from a QR code
+func ProvisioningURI(issuer string, account string, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period.Seconds())))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step is the time step t falls in
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code returns the code for secret at step
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %v", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%modulus), nil
+}
+
+// Validate checks code against the steps around t and returns the step it
+// matched. Steps at or before lastStep are refused so a code cannot be replayed.
+func Validate(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
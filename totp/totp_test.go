@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of RFC 6238 Appendix B, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// Appendix B lists 8 digit codes; a 6 digit code is their last 6 digits
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-Digits:]; code != want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, code, want)
+		}
+	}
+}
+
+func TestCodeRejectsInvalidSecret(t *testing.T) {
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Fatal("Code accepted a secret that is not base32")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	for offset := int64(-Skew - 1); offset <= Skew+1; offset++ {
+		code, err := Code(rfcSecret, current+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(rfcSecret, code, now, 0)
+		want := offset >= -Skew && offset <= Skew
+		if ok != want {
+			t.Errorf("code %d steps from now accepted = %v, want %v", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code %d steps from now matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+}
+
+func TestValidateRefusesUsedSteps(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := Code(rfcSecret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, ok := Validate(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("a fresh code was refused")
+	}
+	if _, ok := Validate(rfcSecret, code, now, step); ok {
+		t.Fatal("a code was accepted again after its step was used")
+	}
+
+	// Once a later step is used, an earlier code in the window is refused too
+	earlier, err := Code(rfcSecret, Step(now)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(rfcSecret, earlier, now, step); ok {
+		t.Fatal("a code from before the last used step was accepted")
+	}
+}
+
+func TestValidateNormalizesInput(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{" " + code + " ", code[:3] + " " + code[3:]} {
+		if _, ok := Validate(rfcSecret, input, now, 0); !ok {
+			t.Errorf("Validate(%q) refused a valid code", input)
+		}
+	}
+	for _, input := range []string{"", code[:Digits-1], code + "0", "abcdef"} {
+		if _, ok := Validate(rfcSecret, input, now, 0); ok {
+			t.Errorf("Validate(%q) accepted an invalid code", input)
+		}
+	}
+}
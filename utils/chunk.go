@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// charsPerToken is the usual rule of thumb for English text with OpenAI tokenizers
+const charsPerToken = 4
+
+// EstimateTokens approximates how many tokens text will use
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// ChunkText splits text into chunks of at most maxTokens, preferring line and
+// word boundaries. Each chunk after the first starts with up to overlapTokens
+// from the end of the previous one so context is not lost at the seams.
+// A maxTokens of zero or less leaves text whole, so callers check their budget.
+func ChunkText(text string, maxTokens, overlapTokens int) []string {
+	if maxTokens <= 0 || EstimateTokens(text) <= maxTokens {
+		return []string{text}
+	}
+	if overlapTokens > maxTokens/2 {
+		overlapTokens = maxTokens / 2
+	}
+
+	var chunks []string
+	var current []string
+	currentTokens := 0
+	for _, segment := range splitSegments(text, maxTokens) {
+		segmentTokens := EstimateTokens(segment)
+		if currentTokens+segmentTokens > maxTokens && len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, ""))
+			current = overlapTail(current, overlapTokens, maxTokens-segmentTokens)
+			currentTokens = 0
+			for _, kept := range current {
+				currentTokens += EstimateTokens(kept)
+			}
+		}
+		current = append(current, segment)
+		currentTokens += segmentTokens
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, ""))
+	}
+	return chunks
+}
+
+// overlapTail returns the trailing segments that fit in both the overlap and the room left
+func overlapTail(segments []string, overlapTokens, room int) []string {
+	limit := min(overlapTokens, room)
+	total := 0
+	start := len(segments)
+	for start > 0 {
+		tokens := EstimateTokens(segments[start-1])
+		if total+tokens > limit {
+			break
+		}
+		total += tokens
+		start--
+	}
+	return append([]string(nil), segments[start:]...)
+}
+
+// splitSegments breaks text into lines, then words, then runes until every piece fits
+func splitSegments(text string, maxTokens int) []string {
+	var segments []string
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		if EstimateTokens(line) <= maxTokens {
+			segments = append(segments, line)
+			continue
+		}
+		for _, word := range strings.SplitAfter(line, " ") {
+			if EstimateTokens(word) <= maxTokens {
+				segments = append(segments, word)
+				continue
+			}
+			runes := []rune(word)
+			step := maxTokens * charsPerToken
+			for i := 0; i < len(runes); i += step {
+				segments = append(segments, string(runes[i:min(i+step, len(runes))]))
+			}
+		}
+	}
+	return segments
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// numberedLines returns n distinct lines of words, so overlaps can only match where they were copied
+func numberedLines(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "line%03d alpha%03d beta%03d gamma%03d\n", i, i, i, i)
+	}
+	return b.String()
+}
+
+// overlapOf returns the longest end of prev that next starts with
+func overlapOf(prev, next string) string {
+	for i := 0; i < len(prev); i++ {
+		if strings.HasPrefix(next, prev[i:]) {
+			return prev[i:]
+		}
+	}
+	return ""
+}
+
+// checkChunks fails unless every chunk fits and chunks made without overlap add back up to text
+func checkChunks(t *testing.T, text string, chunks []string, maxTokens int) {
+	t.Helper()
+	for i, chunk := range chunks {
+		if tokens := EstimateTokens(chunk); tokens > maxTokens {
+			t.Fatalf("chunk %d has %d tokens, more than %d", i, tokens, maxTokens)
+		}
+		if !utf8.ValidString(chunk) {
+			t.Fatalf("chunk %d splits a character: %q", i, chunk)
+		}
+	}
+	if rebuilt := strings.Join(chunks, ""); rebuilt != text {
+		t.Fatalf("chunks do not add back up to the text:\n%q\nwant\n%q", rebuilt, text)
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"ääää", 1},
+	} {
+		if got := EstimateTokens(tt.text); got != tt.want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestChunkTextLeavesTextThatFitsWhole(t *testing.T) {
+	text := numberedLines(10)
+	for _, maxTokens := range []int{EstimateTokens(text), 1000} {
+		if chunks := ChunkText(text, maxTokens, 10); len(chunks) != 1 || chunks[0] != text {
+			t.Errorf("ChunkText with %d tokens split text that fits into %d chunks", maxTokens, len(chunks))
+		}
+	}
+}
+
+func TestChunkTextWithoutBudget(t *testing.T) {
+	// inputBudget goes to zero or below when the pattern alone fills the context window
+	text := numberedLines(50)
+	for _, maxTokens := range []int{0, -1, -5000} {
+		if chunks := ChunkText(text, maxTokens, 10); len(chunks) != 1 || chunks[0] != text {
+			t.Errorf("ChunkText with %d tokens returned %d chunks, want the text whole", maxTokens, len(chunks))
+		}
+	}
+}
+
+func TestChunkTextBreaksAtLines(t *testing.T) {
+	text := numberedLines(100)
+	chunks := ChunkText(text, 50, 0)
+	if len(chunks) < 2 {
+		t.Fatalf("ChunkText returned %d chunks, want several", len(chunks))
+	}
+	checkChunks(t, text, chunks, 50)
+	for i, chunk := range chunks {
+		if !strings.HasSuffix(chunk, "\n") {
+			t.Fatalf("chunk %d ends mid line: %q", i, chunk[max(0, len(chunk)-20):])
+		}
+	}
+}
+
+func TestChunkTextOverlap(t *testing.T) {
+	text := numberedLines(100)
+	for _, tt := range []struct {
+		name          string
+		overlapTokens int
+		maxOverlap    int
+	}{
+		{"overlap of a line", 10, 10},
+		{"overlap capped at half the chunk", 40, 25},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := ChunkText(text, 50, tt.overlapTokens)
+			if len(chunks) < 2 {
+				t.Fatalf("ChunkText returned %d chunks, want several", len(chunks))
+			}
+			rebuilt := chunks[0]
+			for i := 1; i < len(chunks); i++ {
+				if tokens := EstimateTokens(chunks[i]); tokens > 50 {
+					t.Fatalf("chunk %d has %d tokens, more than 50", i, tokens)
+				}
+				// Overlaps are whole lines from the end of the previous chunk
+				overlap := overlapOf(chunks[i-1], chunks[i])
+				if overlap == "" || !strings.HasPrefix(overlap, "line") {
+					t.Fatalf("chunk %d does not start with a line of chunk %d: %q", i, i-1, overlap)
+				}
+				if tokens := EstimateTokens(overlap); tokens > tt.maxOverlap {
+					t.Fatalf("chunk %d repeats %d tokens, more than %d", i, tokens, tt.maxOverlap)
+				}
+				rebuilt += chunks[i][len(overlap):]
+			}
+			if rebuilt != text {
+				t.Fatal("chunks without their overlaps do not add back up to the text")
+			}
+		})
+	}
+}
+
+func TestChunkTextSplitsLongLinesAndWords(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		text string
+	}{
+		{"long line", strings.Repeat("word ", 200)},
+		{"long word", strings.Repeat("x", 1000)},
+		{"multibyte word", strings.Repeat("日本語", 300)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := ChunkText(tt.text, 20, 0)
+			if len(chunks) < 2 {
+				t.Fatalf("ChunkText returned %d chunks, want several", len(chunks))
+			}
+			checkChunks(t, tt.text, chunks, 20)
+		})
+	}
+}
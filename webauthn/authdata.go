@@ -0,0 +1,74 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttestedData   = 0x40
+	flagExtensions     = 0x80
+)
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (a *authenticatorData) UserPresent() bool  { return a.Flags&flagUserPresent != 0 }
+func (a *authenticatorData) UserVerified() bool { return a.Flags&flagUserVerified != 0 }
+
+// parseAuthenticatorData reads the structure in WebAuthn section 6.1
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	a := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if a.Flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		a.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength > 1023 || len(rest) < idLength {
+			return nil, errors.New("invalid credential id length")
+		}
+		a.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		a.PublicKey = rest[:n]
+		rest = rest[n:]
+	}
+
+	if a.Flags&flagExtensions != 0 {
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes in authenticator data")
+	}
+	return a, nil
+}
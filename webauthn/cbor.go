@@ -0,0 +1,179 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxCBORDepth bounds nesting so a hostile attestation cannot exhaust the stack
+const maxCBORDepth = 16
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborDecoder reads the subset of CBOR (RFC 8949) that WebAuthn uses.
+// Integers decode to int64, byte strings to []byte, text to string, arrays to
+// []interface{} and maps to map[interface{}]interface{}.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeCBOR decodes one item and returns how many bytes it used
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.decode(0)
+	return v, d.pos, err
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, errors.New("cbor: nested too deeply")
+	}
+	if d.pos >= len(d.data) {
+		return nil, errCBORTruncated
+	}
+	initial := d.data[d.pos]
+	d.pos++
+	major, info := initial>>5, initial&0x1f
+
+	if major == 7 {
+		return d.simple(info)
+	}
+	arg, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case 6:
+		// Tags carry no meaning for WebAuthn; return the tagged item
+		return d.decode(depth + 1)
+	}
+	return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// argument reads the length or value that follows the initial byte.
+// Indefinite lengths are not allowed in WebAuthn's canonical CBOR.
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.bytes(1)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(b[0]), nil
+	case info == 25:
+		b, err := d.bytes(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.bytes(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.bytes(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+}
+
+func (d *cborDecoder) simple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		_, err := d.bytes(2)
+		return nil, err
+	case 26:
+		b, err := d.bytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 27:
+		b, err := d.bytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
+
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
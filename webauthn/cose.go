@@ -0,0 +1,149 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// COSE algorithm identifiers we accept, in order of preference
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgES384 int64 = -35
+	AlgES512 int64 = -36
+	AlgRS256 int64 = -257
+)
+
+var supportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgES384, AlgES512, AlgRS256}
+
+const (
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+)
+
+// PublicKey is a credential public key decoded from its COSE form
+type PublicKey struct {
+	Algorithm int64
+	Key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key as stored with a credential
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	v, n, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(cose) {
+		return nil, errors.New("cose: trailing data after key")
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("cose: key is not a map")
+	}
+	return publicKeyFromMap(m)
+}
+
+func publicKeyFromMap(m map[interface{}]interface{}) (*PublicKey, error) {
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+
+	switch kty {
+	case coseKeyTypeEC2:
+		y, _ := m[int64(-3)].([]byte)
+		var curve ecdh.Curve
+		var ellipticCurve elliptic.Curve
+		var size int
+		switch {
+		case crv == 1 && alg == AlgES256:
+			curve, ellipticCurve, size = ecdh.P256(), elliptic.P256(), 32
+		case crv == 2 && alg == AlgES384:
+			curve, ellipticCurve, size = ecdh.P384(), elliptic.P384(), 48
+		case crv == 3 && alg == AlgES512:
+			curve, ellipticCurve, size = ecdh.P521(), elliptic.P521(), 66
+		default:
+			return nil, fmt.Errorf("cose: unsupported curve %d for algorithm %d", crv, alg)
+		}
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("cose: invalid ec coordinates")
+		}
+		// ecdh rejects points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := curve.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("cose: invalid ec point: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: ellipticCurve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return &PublicKey{Algorithm: alg, Key: key}, nil
+	case coseKeyTypeRSA:
+		if alg != AlgRS256 {
+			return nil, fmt.Errorf("cose: unsupported rsa algorithm %d", alg)
+		}
+		nBytes, _ := m[int64(-1)].([]byte)
+		eBytes, _ := m[int64(-2)].([]byte)
+		if len(nBytes) < 256 || len(eBytes) == 0 || len(eBytes) > 4 {
+			return nil, errors.New("cose: invalid rsa key")
+		}
+		e := new(big.Int).SetBytes(eBytes)
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(e.Int64())}
+		return &PublicKey{Algorithm: alg, Key: key}, nil
+	case coseKeyTypeOKP:
+		if alg != AlgEdDSA || crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("cose: unsupported okp key")
+		}
+		return &PublicKey{Algorithm: alg, Key: ed25519.PublicKey(x)}, nil
+	}
+	return nil, fmt.Errorf("cose: unsupported key type %d", kty)
+}
+
+// Verify checks sig over data with the key's algorithm
+func (k *PublicKey) Verify(data []byte, sig []byte) error {
+	return verifySignature(k.Algorithm, k.Key, data, sig)
+}
+
+func verifySignature(alg int64, key crypto.PublicKey, data []byte, sig []byte) error {
+	var h hash.Hash
+	switch alg {
+	case AlgES256, AlgRS256:
+		h = sha256.New()
+	case AlgES384:
+		h = sha512.New384()
+	case AlgES512:
+		h = sha512.New()
+	case AlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, data, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", alg)
+	}
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %d does not match key type %T", alg, key)
+}
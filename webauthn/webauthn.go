@@ -0,0 +1,446 @@
+// Package webauthn runs the server side of WebAuthn registration and
+// authentication ceremonies for passkeys. It supports the "none" and "packed"
+// attestation formats and ES256, ES384, ES512, EdDSA and RS256 credentials.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrChallengeMismatch = errors.New("webauthn: challenge does not match")
+	// ErrSignCountRegressed means the authenticator's counter went backwards,
+	// which happens when a credential has been cloned
+	ErrSignCountRegressed = errors.New("webauthn: signature counter did not increase")
+)
+
+// Config is the relying party: this server as WebAuthn sees it
+type Config struct {
+	RPID   string
+	RPName string
+	// Origins are the pages allowed to run ceremonies, e.g. https://app.example.com
+	Origins []string
+	// Attestation is the conveyance preference sent to browsers: none, indirect or direct
+	Attestation string
+	Timeout     time.Duration
+}
+
+// ConfigFromEnv reads WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME, WEBAUTHN_ORIGINS and
+// WEBAUTHN_ATTESTATION, defaulting the ID and origin to APP_URL
+func ConfigFromEnv() (*Config, error) {
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:4321"
+	}
+	parsed, err := url.Parse(appURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APP_URL: %v", err)
+	}
+
+	config := &Config{
+		RPID:        parsed.Hostname(),
+		RPName:      "gippity-serv",
+		Origins:     []string{strings.TrimRight(appURL, "/")},
+		Attestation: "none",
+		Timeout:     5 * time.Minute,
+	}
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		config.RPID = rpID
+	}
+	if rpName := os.Getenv("WEBAUTHN_RP_NAME"); rpName != "" {
+		config.RPName = rpName
+	}
+	if origins := os.Getenv("WEBAUTHN_ORIGINS"); origins != "" {
+		config.Origins = nil
+		for _, origin := range strings.Split(origins, ",") {
+			config.Origins = append(config.Origins, strings.TrimRight(strings.TrimSpace(origin), "/"))
+		}
+	}
+	if attestation := os.Getenv("WEBAUTHN_ATTESTATION"); attestation != "" {
+		switch attestation {
+		case "none", "indirect", "direct":
+			config.Attestation = attestation
+		default:
+			return nil, fmt.Errorf("WEBAUTHN_ATTESTATION must be none, indirect or direct, got %s", attestation)
+		}
+	}
+	return config, nil
+}
+
+// CredentialDescriptor names a credential in allow and exclude lists
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+func NewCredentialDescriptor(id []byte, transports []string) CredentialDescriptor {
+	return CredentialDescriptor{Type: "public-key", ID: base64.RawURLEncoding.EncodeToString(id), Transports: transports}
+}
+
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+// CreationOptions is PublicKeyCredentialCreationOptions in its JSON form, as
+// accepted by PublicKeyCredential.parseCreationOptionsFromJSON
+type CreationOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RP               map[string]string      `json:"rp"`
+	User             UserEntity             `json:"user"`
+	PubKeyCredParams []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout          int64                  `json:"timeout"`
+	Attestation      string                 `json:"attestation"`
+	Exclude          []CredentialDescriptor `json:"excludeCredentials"`
+	Selection        map[string]string      `json:"authenticatorSelection"`
+}
+
+// RequestOptions is PublicKeyCredentialRequestOptions in its JSON form
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	Allow            []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// NewChallenge returns a random challenge, base64url encoded as it appears in client data
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (c *Config) CreationOptions(challenge string, userID []byte, name string, displayName string, exclude []CredentialDescriptor) *CreationOptions {
+	params := make([]credentialParameter, len(supportedAlgorithms))
+	for i, alg := range supportedAlgorithms {
+		params[i] = credentialParameter{Type: "public-key", Alg: alg}
+	}
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return &CreationOptions{
+		Challenge:        challenge,
+		RP:               map[string]string{"id": c.RPID, "name": c.RPName},
+		User:             UserEntity{ID: base64.RawURLEncoding.EncodeToString(userID), Name: name, DisplayName: displayName},
+		PubKeyCredParams: params,
+		Timeout:          c.Timeout.Milliseconds(),
+		Attestation:      c.Attestation,
+		Exclude:          exclude,
+		Selection: map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	}
+}
+
+func (c *Config) RequestOptions(challenge string, allow []CredentialDescriptor) *RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             c.RPID,
+		Timeout:          c.Timeout.Milliseconds(),
+		Allow:            allow,
+		UserVerification: "preferred",
+	}
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// RegistrationResponse is the JSON form of the credential from navigator.credentials.create
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON form of the credential from navigator.credentials.get
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Challenge returns the challenge the browser signed, to look up the ceremony
+func (r *RegistrationResponse) Challenge() (string, error) {
+	cd, _, err := parseClientData(r.Response.ClientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return cd.Challenge, nil
+}
+
+func (r *AssertionResponse) Challenge() (string, error) {
+	cd, _, err := parseClientData(r.Response.ClientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return cd.Challenge, nil
+}
+
+// CredentialID is the raw credential ID the assertion claims to be from
+func (r *AssertionResponse) CredentialID() ([]byte, error) {
+	return decodeBase64(r.RawID)
+}
+
+// UserHandle is the user ID a discoverable credential was registered with, or nil if it sent none
+func (r *AssertionResponse) UserHandle() ([]byte, error) {
+	if r.Response.UserHandle == "" {
+		return nil, nil
+	}
+	return decodeBase64(r.Response.UserHandle)
+}
+
+// Credential is what to store after a successful registration
+type Credential struct {
+	ID                []byte
+	PublicKey         []byte
+	SignCount         uint32
+	AAGUID            []byte
+	AttestationFormat string
+	Transports        []string
+	UserVerified      bool
+	BackupEligible    bool
+}
+
+// AssertionResult is what changed after a successful authentication
+type AssertionResult struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// VerifyRegistration checks a registration ceremony against the challenge issued for it
+func (c *Config) VerifyRegistration(resp *RegistrationResponse, challenge string) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: credential type must be public-key")
+	}
+	_, clientDataJSON, err := c.verifyClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	rawAttestation, err := decodeBase64(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid attestation object encoding: %v", err)
+	}
+	decoded, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid attestation object: %v", err)
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: attestation object is not a map")
+	}
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+
+	authData, err := c.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.Flags&flagAttestedData == 0 {
+		return nil, errors.New("webauthn: registration has no attested credential data")
+	}
+	rawID, err := decodeBase64(resp.RawID)
+	if err != nil || !bytes.Equal(rawID, authData.CredentialID) {
+		return nil, errors.New("webauthn: credential id does not match authenticator data")
+	}
+	publicKey, err := ParsePublicKey(authData.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return nil, errors.New("webauthn: none attestation must have an empty statement")
+		}
+	case "packed":
+		if err := verifyPackedAttestation(statement, signed, publicKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("webauthn: unsupported attestation format %q", format)
+	}
+
+	return &Credential{
+		ID:                authData.CredentialID,
+		PublicKey:         authData.PublicKey,
+		SignCount:         authData.SignCount,
+		AAGUID:            authData.AAGUID,
+		AttestationFormat: format,
+		Transports:        resp.Response.Transports,
+		UserVerified:      authData.UserVerified(),
+		BackupEligible:    authData.Flags&flagBackupEligible != 0,
+	}, nil
+}
+
+// verifyPackedAttestation checks a "packed" statement, either self attestation
+// by the credential key or a signature by the x5c certificate. The certificate
+// chain is not checked against a trust store.
+func verifyPackedAttestation(statement map[interface{}]interface{}, signed []byte, credentialKey *PublicKey) error {
+	alg, _ := statement["alg"].(int64)
+	sig, _ := statement["sig"].([]byte)
+	if len(sig) == 0 {
+		return errors.New("webauthn: packed attestation has no signature")
+	}
+
+	chain, _ := statement["x5c"].([]interface{})
+	if len(chain) == 0 {
+		if alg != credentialKey.Algorithm {
+			return errors.New("webauthn: self attestation algorithm does not match credential")
+		}
+		if err := credentialKey.Verify(signed, sig); err != nil {
+			return fmt.Errorf("webauthn: packed self attestation: %v", err)
+		}
+		return nil
+	}
+
+	der, _ := chain[0].([]byte)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("webauthn: invalid attestation certificate: %v", err)
+	}
+	if err := verifySignature(alg, cert.PublicKey, signed, sig); err != nil {
+		return fmt.Errorf("webauthn: packed attestation: %v", err)
+	}
+	return nil
+}
+
+// VerifyAssertion checks an authentication ceremony against the challenge
+// issued for it and the stored credential
+func (c *Config) VerifyAssertion(resp *AssertionResponse, challenge string, publicKeyCOSE []byte, storedSignCount uint32) (*AssertionResult, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: credential type must be public-key")
+	}
+	_, clientDataJSON, err := c.verifyClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	rawAuthData, err := decodeBase64(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid authenticator data encoding: %v", err)
+	}
+	authData, err := c.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := decodeBase64(resp.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid signature encoding: %v", err)
+	}
+	publicKey, err := ParsePublicKey(publicKeyCOSE)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := publicKey.Verify(signed, sig); err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+
+	// Authenticators that do not count always send zero
+	if (authData.SignCount != 0 || storedSignCount != 0) && authData.SignCount <= storedSignCount {
+		return nil, ErrSignCountRegressed
+	}
+	return &AssertionResult{SignCount: authData.SignCount, UserVerified: authData.UserVerified()}, nil
+}
+
+func (c *Config) verifyClientData(encoded string, ceremony string, challenge string) (*clientData, []byte, error) {
+	cd, raw, err := parseClientData(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cd.Type != ceremony {
+		return nil, nil, fmt.Errorf("webauthn: client data type is %q, want %q", cd.Type, ceremony)
+	}
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return nil, nil, ErrChallengeMismatch
+	}
+	if cd.CrossOrigin {
+		return nil, nil, errors.New("webauthn: cross-origin ceremonies are not allowed")
+	}
+	for _, origin := range c.Origins {
+		if cd.Origin == origin {
+			return cd, raw, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("webauthn: origin %q is not allowed", cd.Origin)
+}
+
+func (c *Config) verifyAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	authData, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return nil, errors.New("webauthn: credential is for a different relying party")
+	}
+	if !authData.UserPresent() {
+		return nil, errors.New("webauthn: user was not present")
+	}
+	return authData, nil
+}
+
+func parseClientData(encoded string) (*clientData, []byte, error) {
+	raw, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("webauthn: invalid client data encoding: %v", err)
+	}
+	cd := &clientData{}
+	if err := json.Unmarshal(raw, cd); err != nil {
+		return nil, nil, fmt.Errorf("webauthn: invalid client data: %v", err)
+	}
+	return cd, raw, nil
+}
+
+// decodeBase64 accepts base64url with or without padding, which is what
+// browsers and client libraries variously send
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,496 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRPID   = "app.example.com"
+	testOrigin = "https://app.example.com"
+)
+
+func testConfig() *Config {
+	return &Config{
+		RPID:        testRPID,
+		RPName:      "test",
+		Origins:     []string{testOrigin},
+		Attestation: "none",
+		Timeout:     time.Minute,
+	}
+}
+
+// cborPair is one map entry; maps are written in the order given so tests
+// control the exact bytes the authenticator produces
+type cborPair struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// encodeCBOR writes the subset of CBOR the software authenticator needs
+func encodeCBOR(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeCBOR(&buf, v)
+	return buf.Bytes()
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	default:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		if v >= 0 {
+			writeCBORHead(buf, 0, uint64(v))
+		} else {
+			writeCBORHead(buf, 1, uint64(-1-v))
+		}
+	case int64:
+		writeCBOR(buf, int(v))
+	case []byte:
+		writeCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			writeCBOR(buf, item)
+		}
+	case []cborPair:
+		writeCBORHead(buf, 5, uint64(len(v)))
+		for _, pair := range v {
+			writeCBOR(buf, pair.Key)
+			writeCBOR(buf, pair.Value)
+		}
+	default:
+		panic("encodeCBOR: unsupported type")
+	}
+}
+
+// authenticator is an in-process ES256 authenticator that answers ceremonies
+// the way a browser and security key would
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	rpID         string
+	origin       string
+	flags        byte
+	signCount    uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{
+		key:          key,
+		credentialID: id,
+		rpID:         testRPID,
+		origin:       testOrigin,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *authenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR([]cborPair{
+		{1, coseKeyTypeEC2},
+		{3, AlgES256},
+		{-1, 1},
+		{-2, x},
+		{-3, y},
+	})
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	var buf bytes.Buffer
+	buf.Write(rpIDHash[:])
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedData
+	}
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, a.signCount)
+	if attested {
+		buf.Write(make([]byte, 16))
+		binary.Write(&buf, binary.BigEndian, uint16(len(a.credentialID)))
+		buf.Write(a.credentialID)
+		buf.Write(a.coseKey())
+	}
+	return buf.Bytes()
+}
+
+func (a *authenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+func (a *authenticator) sign(authData []byte, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// register answers navigator.credentials.create with the given attestation format
+func (a *authenticator) register(challenge string, format string) *RegistrationResponse {
+	authData := a.authData(true)
+	clientDataJSON := a.clientData("webauthn.create", challenge)
+	statement := []cborPair{}
+	if format == "packed" {
+		statement = []cborPair{
+			{"alg", AlgES256},
+			{"sig", a.sign(authData, clientDataJSON)},
+		}
+	}
+	attestation := encodeCBOR([]cborPair{
+		{"fmt", format},
+		{"attStmt", statement},
+		{"authData", authData},
+	})
+	return a.registrationResponse(clientDataJSON, attestation)
+}
+
+func (a *authenticator) registrationResponse(clientDataJSON []byte, attestation []byte) *RegistrationResponse {
+	resp := &RegistrationResponse{ID: encode(a.credentialID), RawID: encode(a.credentialID), Type: "public-key"}
+	resp.Response.ClientDataJSON = encode(clientDataJSON)
+	resp.Response.AttestationObject = encode(attestation)
+	resp.Response.Transports = []string{"internal"}
+	return resp
+}
+
+// assert answers navigator.credentials.get, counting the signature first
+func (a *authenticator) assert(challenge string) *AssertionResponse {
+	a.signCount++
+	authData := a.authData(false)
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	resp := &AssertionResponse{ID: encode(a.credentialID), RawID: encode(a.credentialID), Type: "public-key"}
+	resp.Response.ClientDataJSON = encode(clientDataJSON)
+	resp.Response.AuthenticatorData = encode(authData)
+	resp.Response.Signature = encode(a.sign(authData, clientDataJSON))
+	return resp
+}
+
+func mustChallenge(t *testing.T) string {
+	t.Helper()
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for _, format := range []string{"none", "packed"} {
+		t.Run(format, func(t *testing.T) {
+			config := testConfig()
+			auth := newAuthenticator(t)
+
+			challenge := mustChallenge(t)
+			credential, err := config.VerifyRegistration(auth.register(challenge, format), challenge)
+			if err != nil {
+				t.Fatalf("VerifyRegistration: %v", err)
+			}
+			if !bytes.Equal(credential.ID, auth.credentialID) {
+				t.Errorf("credential id = %x, want %x", credential.ID, auth.credentialID)
+			}
+			if credential.AttestationFormat != format || !credential.UserVerified {
+				t.Errorf("credential = %+v", credential)
+			}
+
+			for i := 0; i < 2; i++ {
+				challenge := mustChallenge(t)
+				result, err := config.VerifyAssertion(auth.assert(challenge), challenge, credential.PublicKey, credential.SignCount)
+				if err != nil {
+					t.Fatalf("VerifyAssertion: %v", err)
+				}
+				if result.SignCount != auth.signCount || !result.UserVerified {
+					t.Errorf("result = %+v, want sign count %d and user verified", result, auth.signCount)
+				}
+				credential.SignCount = result.SignCount
+			}
+		})
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator)
+		want   string
+	}{
+		{"wrong origin", func(a *authenticator) { a.origin = "https://evil.example.com" }, "is not allowed"},
+		{"rpIdHash mismatch", func(a *authenticator) { a.rpID = "evil.example.com" }, "different relying party"},
+		{"user not present", func(a *authenticator) { a.flags &^= flagUserPresent }, "not present"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAuthenticator(t)
+			tt.modify(auth)
+			challenge := mustChallenge(t)
+			_, err := testConfig().VerifyRegistration(auth.register(challenge, "none"), challenge)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("VerifyRegistration error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("challenge mismatch", func(t *testing.T) {
+		auth := newAuthenticator(t)
+		_, err := testConfig().VerifyRegistration(auth.register(mustChallenge(t), "none"), mustChallenge(t))
+		if !errors.Is(err, ErrChallengeMismatch) {
+			t.Fatalf("VerifyRegistration error = %v, want ErrChallengeMismatch", err)
+		}
+	})
+
+	t.Run("packed signature by another key", func(t *testing.T) {
+		auth := newAuthenticator(t)
+		other := newAuthenticator(t)
+		challenge := mustChallenge(t)
+		attested := auth.authData(true)
+		clientDataJSON := auth.clientData("webauthn.create", challenge)
+		attestation := encodeCBOR([]cborPair{
+			{"fmt", "packed"},
+			{"attStmt", []cborPair{{"alg", AlgES256}, {"sig", other.sign(attested, clientDataJSON)}}},
+			{"authData", attested},
+		})
+		resp := auth.registrationResponse(clientDataJSON, attestation)
+		if _, err := testConfig().VerifyRegistration(resp, challenge); err == nil {
+			t.Fatal("VerifyRegistration accepted a packed attestation signed by another key")
+		}
+	})
+}
+
+func TestAssertionRejected(t *testing.T) {
+	config := testConfig()
+	auth := newAuthenticator(t)
+	challenge := mustChallenge(t)
+	credential, err := config.VerifyRegistration(auth.register(challenge, "none"), challenge)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+
+	t.Run("wrong origin", func(t *testing.T) {
+		a := *auth
+		a.origin = "https://app.example.com.evil.test"
+		challenge := mustChallenge(t)
+		_, err := config.VerifyAssertion(a.assert(challenge), challenge, credential.PublicKey, 0)
+		if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+			t.Fatalf("VerifyAssertion error = %v", err)
+		}
+	})
+
+	t.Run("rpIdHash mismatch", func(t *testing.T) {
+		a := *auth
+		a.rpID = "example.com"
+		challenge := mustChallenge(t)
+		_, err := config.VerifyAssertion(a.assert(challenge), challenge, credential.PublicKey, 0)
+		if err == nil || !strings.Contains(err.Error(), "different relying party") {
+			t.Fatalf("VerifyAssertion error = %v", err)
+		}
+	})
+
+	t.Run("user not present", func(t *testing.T) {
+		a := *auth
+		a.flags = flagUserVerified
+		challenge := mustChallenge(t)
+		_, err := config.VerifyAssertion(a.assert(challenge), challenge, credential.PublicKey, 0)
+		if err == nil || !strings.Contains(err.Error(), "not present") {
+			t.Fatalf("VerifyAssertion error = %v", err)
+		}
+	})
+
+	t.Run("user not verified is reported", func(t *testing.T) {
+		// Passwordless login refuses these; as a second factor presence is enough
+		a := *auth
+		a.flags = flagUserPresent
+		challenge := mustChallenge(t)
+		result, err := config.VerifyAssertion(a.assert(challenge), challenge, credential.PublicKey, 0)
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if result.UserVerified {
+			t.Fatal("UserVerified = true without the UV flag")
+		}
+	})
+
+	t.Run("sign count regression", func(t *testing.T) {
+		a := *auth
+		a.signCount = 10
+		challenge := mustChallenge(t)
+		_, err := config.VerifyAssertion(a.assert(challenge), challenge, credential.PublicKey, 11)
+		if !errors.Is(err, ErrSignCountRegressed) {
+			t.Fatalf("VerifyAssertion error = %v, want ErrSignCountRegressed", err)
+		}
+		challenge = mustChallenge(t)
+		_, err = config.VerifyAssertion(a.assert(challenge), challenge, credential.PublicKey, 12)
+		if !errors.Is(err, ErrSignCountRegressed) {
+			t.Fatalf("VerifyAssertion with an equal count error = %v, want ErrSignCountRegressed", err)
+		}
+	})
+
+	t.Run("tampered authenticator data", func(t *testing.T) {
+		a := *auth
+		challenge := mustChallenge(t)
+		resp := a.assert(challenge)
+		raw, _ := decodeBase64(resp.Response.AuthenticatorData)
+		raw[36]++
+		resp.Response.AuthenticatorData = encode(raw)
+		if _, err := config.VerifyAssertion(resp, challenge, credential.PublicKey, 0); err == nil {
+			t.Fatal("VerifyAssertion accepted a signature over different authenticator data")
+		}
+	})
+
+	t.Run("wrong ceremony type", func(t *testing.T) {
+		a := *auth
+		challenge := mustChallenge(t)
+		resp := a.assert(challenge)
+		resp.Response.ClientDataJSON = encode(a.clientData("webauthn.create", challenge))
+		if _, err := config.VerifyAssertion(resp, challenge, credential.PublicKey, 0); err == nil {
+			t.Fatal("VerifyAssertion accepted registration client data")
+		}
+	})
+}
+
+func TestMalformedAttestation(t *testing.T) {
+	auth := newAuthenticator(t)
+	challenge := mustChallenge(t)
+	valid := auth.register(challenge, "none")
+	rawAttestation, _ := decodeBase64(valid.Response.AttestationObject)
+	clientDataJSON, _ := decodeBase64(valid.Response.ClientDataJSON)
+
+	attested := auth.authData(true)
+	keyStart := len(attested) - len(auth.coseKey())
+
+	tests := map[string][]byte{
+		"empty":                 {},
+		"truncated":             rawAttestation[:len(rawAttestation)/2],
+		"not a map":             encodeCBOR([]interface{}{"fmt", "none"}),
+		"indefinite length map": {0xbf, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0xff},
+		"byte string overruns":  {0xa1, 0x63, 'f', 'm', 't', 0x5a, 0xff, 0xff, 0xff, 0xff},
+		"array length overruns": {0xa1, 0x63, 'f', 'm', 't', 0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"nested too deeply":     append(bytes.Repeat([]byte{0x81}, maxCBORDepth+2), 0x00),
+		"authData truncated in key": encodeCBOR([]cborPair{
+			{"fmt", "none"},
+			{"attStmt", []cborPair{}},
+			{"authData", attested[:keyStart+10]},
+		}),
+		"authData trailing bytes": encodeCBOR([]cborPair{
+			{"fmt", "none"},
+			{"attStmt", []cborPair{}},
+			{"authData", append(append([]byte{}, attested...), 0x00)},
+		}),
+		"authData credential id overruns": encodeCBOR([]cborPair{
+			{"fmt", "none"},
+			{"attStmt", []cborPair{}},
+			{"authData", append(append([]byte{}, attested[:53]...), 0xff, 0xff)},
+		}),
+		"unsupported format": encodeCBOR([]cborPair{
+			{"fmt", "fido-u2f"},
+			{"attStmt", []cborPair{}},
+			{"authData", attested},
+		}),
+	}
+	for name, attestation := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := auth.registrationResponse(clientDataJSON, attestation)
+			if _, err := testConfig().VerifyRegistration(resp, challenge); err == nil {
+				t.Fatal("VerifyRegistration accepted a malformed attestation object")
+			}
+		})
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	v, n, err := decodeCBOR([]byte{0xa2, 0x01, 0x02, 0x20, 0x43, 'a', 'b', 'c', 0xff})
+	if err != nil {
+		t.Fatalf("decodeCBOR: %v", err)
+	}
+	if n != 8 {
+		t.Errorf("used %d bytes, want 8", n)
+	}
+	m, _ := v.(map[interface{}]interface{})
+	if m[int64(1)] != int64(2) || !bytes.Equal(m[int64(-1)].([]byte), []byte("abc")) {
+		t.Errorf("decoded %#v", v)
+	}
+
+	for name, data := range map[string][]byte{
+		"truncated argument":  {0x19, 0x01},
+		"truncated text":      {0x65, 'a', 'b'},
+		"float key":           {0xa1, 0xf9, 0x00, 0x00, 0x01},
+		"reserved info":       {0x1c},
+		"unsupported simple":  {0xf8, 0x20},
+		"negative overflow":   {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"map missing a value": {0xa1, 0x01},
+	} {
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("%s: decodeCBOR accepted %x", name, data)
+		}
+	}
+}
+
+func TestParsePublicKeyRejectsMalformedKeys(t *testing.T) {
+	auth := newAuthenticator(t)
+	valid := auth.coseKey()
+	if _, err := ParsePublicKey(valid); err != nil {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+
+	offCurve := make([]byte, 32)
+	offCurve[31] = 1
+	for name, key := range map[string][]byte{
+		"truncated":     valid[:len(valid)-5],
+		"trailing data": append(append([]byte{}, valid...), 0x00),
+		"not a map":     encodeCBOR([]interface{}{1, 2}),
+		"point off the curve": encodeCBOR([]cborPair{
+			{1, coseKeyTypeEC2}, {3, AlgES256}, {-1, 1}, {-2, offCurve}, {-3, offCurve},
+		}),
+		"unsupported algorithm": encodeCBOR([]cborPair{
+			{1, coseKeyTypeEC2}, {3, -260}, {-1, 1}, {-2, offCurve}, {-3, offCurve},
+		}),
+	} {
+		if _, err := ParsePublicKey(key); err == nil {
+			t.Errorf("%s: ParsePublicKey accepted %x", name, key)
+		}
+	}
+}